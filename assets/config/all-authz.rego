@@ -3,9 +3,41 @@ package example.authz
 # See https://www.openpolicyagent.org/docs/latest/policy-reference/ to learn more about rego
 
 default allow := false
+default ingest := false
+default read := false
+default admin := false
+default forward := false
 
 allow = response {
 	response := {
 		"tenants": ["default"]
 	}
 }
+
+# ingestion endpoints, called by application servers
+ingest = response {
+	response := {
+		"tenants": ["default"]
+	}
+}
+
+# decoders, stored events and the latest event of a device
+read = response {
+	response := {
+		"tenants": ["default"]
+	}
+}
+
+# replaying stored events
+admin = response {
+	response := {
+		"tenants": ["default"]
+	}
+}
+
+# messages forwarded from mqtt, with the tenant and device of their topic
+forward = response {
+	response := {
+		"tenants": ["default"]
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/builtin"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/pkg/lwm2m"
+	"github.com/diwise/senml"
+)
+
+const defaultDevEUI string = "cli"
+
+type decodeResult struct {
+	SensorType string              `json:"sensorType"`
+	Decoder    string              `json:"decoder"`
+	DevEUI     string              `json:"devEUI"`
+	Payload    types.SensorPayload `json:"payload"`
+	Packs      []senml.Pack        `json:"packs"`
+}
+
+// storedEvent matches a row exported from the sensor_events_v2 table. The event column may be
+// exported either as a JSON object or as a string containing JSON.
+type storedEvent struct {
+	SensorID string          `json:"sensor_id"`
+	DeviceID string          `json:"device_id"`
+	Event    json.RawMessage `json:"event"`
+}
+
+type decodeOptions struct {
+	sensorType string
+	devEUI     string
+	output     string
+}
+
+func runDecode(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	sensorType := fs.String("type", "", "sensor type (decoder) to use, defaults to the sensorType of the event")
+	hexData := fs.String("hex", "", "hex encoded payload")
+	base64Data := fs.String("base64", "", "base64 encoded payload")
+	eventFile := fs.String("event", "", "file containing a stored sensor event, or - for stdin")
+	batch := fs.Bool("batch", false, "read sensor events as JSON lines from stdin")
+	fPort := fs.Int("fport", 0, "fPort of the payload")
+	ts := fs.String("ts", "", "timestamp of the payload (RFC3339), defaults to now")
+	devEUI := fs.String("deveui", defaultDevEUI, "DevEUI to use as device id in the output")
+	output := fs.String("output", "senml", "output format, senml or json")
+	logLevel := fs.String("loglevel", "warn", "log level for decoder output written to stderr")
+
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: iot-agent-cli decode -type <sensor type> (-hex <payload> | -base64 <payload> | -event <file> | -batch) [flags]")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if *output != "senml" && *output != "json" {
+		fmt.Fprintf(stderr, "unsupported output format %q\n", *output)
+		return errUsage
+	}
+
+	ctx = withLogger(ctx, stderr, *logLevel)
+	registry := decoders.NewRegistry()
+
+	opts := decodeOptions{
+		sensorType: *sensorType,
+		devEUI:     *devEUI,
+		output:     *output,
+	}
+
+	if *batch {
+		return decodeBatch(ctx, registry, opts, stdin, stdout, stderr)
+	}
+
+	var evt types.Event
+	var err error
+
+	switch {
+	case *eventFile != "":
+		var b []byte
+		if *eventFile == "-" {
+			b, err = io.ReadAll(stdin)
+		} else {
+			b, err = os.ReadFile(*eventFile)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read event: %w", err)
+		}
+
+		evt, opts.devEUI, err = parseEvent(b, opts.devEUI)
+		if err != nil {
+			return err
+		}
+	case *hexData != "" || *base64Data != "":
+		evt, err = newEvent(*hexData, *base64Data, *fPort, *ts, opts)
+		if err != nil {
+			return err
+		}
+	default:
+		fs.Usage()
+		return errUsage
+	}
+
+	result, err := decode(ctx, registry, opts.sensorType, opts.devEUI, evt)
+	if err != nil {
+		return err
+	}
+
+	return writeResult(stdout, result, opts.output, "  ")
+}
+
+func decodeBatch(ctx context.Context, registry decoders.Registry, opts decodeOptions, stdin io.Reader, stdout, stderr io.Writer) error {
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+
+	line, failed := 0, 0
+
+	for scanner.Scan() {
+		line++
+
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		evt, deviceID, err := parseEvent(b, opts.devEUI)
+		if err == nil {
+			var result decodeResult
+			result, err = decode(ctx, registry, opts.sensorType, deviceID, evt)
+			if err == nil {
+				err = writeResult(stdout, result, opts.output, "")
+			}
+		}
+
+		if err != nil {
+			failed++
+			fmt.Fprintf(stderr, "line %d: %s\n", line, err.Error())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d events could not be decoded", failed, line)
+	}
+
+	return nil
+}
+
+func decode(ctx context.Context, registry decoders.Registry, sensorType, deviceID string, evt types.Event) (decodeResult, error) {
+	if sensorType == "" {
+		sensorType = evt.SensorType
+	}
+
+	if sensorType == "" {
+		return decodeResult{}, errors.New("no sensor type given and the event does not contain one")
+	}
+
+	if evt.Payload == nil {
+		return decodeResult{}, types.ErrPayloadContainsNoData
+	}
+
+	decoder, converter, ok := registry.Get(ctx, sensorType)
+	if !ok {
+		return decodeResult{}, fmt.Errorf("%w: %s", types.ErrDecoderOrConverterNotFound, sensorType)
+	}
+
+	payload, err := decoder(ctx, evt)
+	if err != nil {
+		return decodeResult{}, err
+	}
+
+	objects, err := converter(ctx, deviceID, payload, evt.Timestamp)
+	if err != nil {
+		return decodeResult{}, err
+	}
+
+	version, _ := registry.Resolve(sensorType)
+
+	return decodeResult{
+		SensorType: sensorType,
+		Decoder:    version,
+		DevEUI:     evt.DevEUI,
+		Payload:    payload,
+		Packs:      lwm2m.ToPacks(objects),
+	}, nil
+}
+
+func newEvent(hexData, base64Data string, fPort int, ts string, opts decodeOptions) (types.Event, error) {
+	var data []byte
+	var err error
+
+	if hexData != "" {
+		data, err = hex.DecodeString(strings.TrimSpace(hexData))
+	} else {
+		data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(base64Data))
+	}
+
+	if err != nil {
+		return types.Event{}, fmt.Errorf("failed to decode payload: %w", err)
+	}
+
+	timestamp := time.Now().UTC()
+	if ts != "" {
+		timestamp, err = time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return types.Event{}, fmt.Errorf("invalid timestamp: %w", err)
+		}
+	}
+
+	return types.Event{
+		DevEUI:     opts.devEUI,
+		SensorType: opts.sensorType,
+		Payload: &types.Payload{
+			FPort: fPort,
+			Data:  data,
+		},
+		Timestamp: timestamp.UTC(),
+	}, nil
+}
+
+// parseEvent accepts either a serialized types.Event or a row from sensor_events_v2 and returns
+// the event along with the device id to use when converting.
+func parseEvent(b []byte, defaultDeviceID string) (types.Event, string, error) {
+	var evt types.Event
+	var row storedEvent
+
+	if err := json.Unmarshal(b, &row); err != nil {
+		return evt, "", fmt.Errorf("failed to parse event: %w", err)
+	}
+
+	raw := []byte(row.Event)
+
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return evt, "", fmt.Errorf("failed to parse event column: %w", err)
+		}
+		raw = []byte(s)
+	}
+
+	if len(raw) == 0 || string(raw) == "null" {
+		raw = b
+	}
+
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return evt, "", fmt.Errorf("failed to parse event: %w", err)
+	}
+
+	deviceID := defaultDeviceID
+	if row.DeviceID != "" {
+		deviceID = row.DeviceID
+	} else if evt.DevEUI != "" && defaultDeviceID == defaultDevEUI {
+		deviceID = evt.DevEUI
+	}
+
+	return evt, deviceID, nil
+}
+
+func writeResult(w io.Writer, result decodeResult, output, indent string) error {
+	var v any = result
+	if output == "senml" {
+		v = result.Packs
+	}
+
+	var b []byte
+	var err error
+
+	if indent != "" {
+		b, err = json.MarshalIndent(v, "", indent)
+	} else {
+		b, err = json.Marshal(v)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/diwise/senml"
+	"github.com/matryer/is"
+)
+
+func TestDecodeHexPayload(t *testing.T) {
+	is := is.New(t)
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), []string{"decode", "-type", "elsys", "-hex", "0100e6", "-fport", "5", "-deveui", "abc"}, nil, &stdout, &stderr)
+	is.NoErr(err)
+
+	var packs []senml.Pack
+	is.NoErr(json.Unmarshal(stdout.Bytes(), &packs))
+	is.Equal(len(packs), 1)
+	is.Equal(packs[0][0].BaseName, "abc/3303/")
+	is.Equal(*packs[0][1].Value, 23.0)
+}
+
+func TestDecodeStoredEventAsJSON(t *testing.T) {
+	is := is.New(t)
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), []string{"decode", "-event", "-", "-output", "json"}, strings.NewReader(storedRow), &stdout, &stderr)
+	is.NoErr(err)
+
+	var result struct {
+		SensorType string          `json:"sensorType"`
+		Decoder    string          `json:"decoder"`
+		DevEUI     string          `json:"devEUI"`
+		Payload    json.RawMessage `json:"payload"`
+		Packs      []senml.Pack    `json:"packs"`
+	}
+	is.NoErr(json.Unmarshal(stdout.Bytes(), &result))
+	is.Equal(result.SensorType, "elsys")
+	is.Equal(result.Decoder, "elsys@1")
+	is.Equal(result.DevEUI, "a81758fffe05e6fb")
+	is.Equal(result.Packs[0][0].BaseName, "internal-id/3303/")
+}
+
+func TestDecodeBatch(t *testing.T) {
+	is := is.New(t)
+
+	input := storedRow + "\n" + `{"devEUI":"a81758fffe05e6fb","payload":{"fPort":5,"data":"AQDm"},"timestamp":"2024-08-05T11:23:45Z"}` + "\n" + "not json\n"
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), []string{"decode", "-type", "elsys", "-batch"}, strings.NewReader(input), &stdout, &stderr)
+	is.True(err != nil) // the last line is not valid json
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	is.Equal(len(lines), 2)
+	is.True(strings.Contains(stderr.String(), "line 3:"))
+}
+
+func TestDecodeRequiresSensorType(t *testing.T) {
+	is := is.New(t)
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), []string{"decode", "-hex", "0100e6"}, nil, &stdout, &stderr)
+	is.True(err != nil)
+	is.Equal(stdout.Len(), 0)
+}
+
+const storedRow string = `{"sensor_id":"a81758fffe05e6fb","device_id":"internal-id","event":{"devEUI":"a81758fffe05e6fb","sensorType":"elsys","payload":{"fPort":5,"data":"AQDm"},"timestamp":"2024-08-05T11:23:45Z"},"error":null}`
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+var commands = []command{
+	{name: "decode", usage: "decode a payload or stored sensor event using a registered decoder", run: runDecode},
+	{name: "replay", usage: "decode stored sensor events again and optionally republish them", run: runReplay},
+}
+
+var errUsage = errors.New("usage")
+
+func main() {
+	ctx := context.Background()
+
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		if !errors.Is(err, errUsage) {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		printUsage(stderr)
+		return errUsage
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(ctx, args[1:], stdin, stdout, stderr)
+		}
+	}
+
+	fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+	printUsage(stderr)
+
+	return errUsage
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: iot-agent-cli <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// withLogger makes sure that decoder log output ends up on stderr so that it does not mix with
+// the decoded output on stdout.
+func withLogger(ctx context.Context, stderr io.Writer, level string) context.Context {
+	var lvl slog.Level
+
+	switch strings.ToLower(level) {
+	case "debug":
+		lvl = slog.LevelDebug
+	case "info":
+		lvl = slog.LevelInfo
+	case "error":
+		lvl = slog.LevelError
+	default:
+		lvl = slog.LevelWarn
+	}
+
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: lvl}))
+	return logging.NewContextWithLogger(ctx, logger)
+}
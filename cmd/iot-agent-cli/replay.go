@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api"
+)
+
+func runReplay(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	url := fs.String("url", "http://localhost:8080", "base url of the iot-agent")
+	token := fs.String("token", os.Getenv("IOT_AGENT_TOKEN"), "bearer token, defaults to IOT_AGENT_TOKEN")
+	sensorID := fs.String("sensor", "", "sensor id (DevEUI) of the events to replay")
+	deviceID := fs.String("device", "", "device id of the events to replay")
+	sensorType := fs.String("type", "", "sensor type (decoder) of the events to replay")
+	errorText := fs.String("error", "", "replay events with an error containing this text")
+	from := fs.String("from", "", "replay events stored from this time (RFC3339)")
+	to := fs.String("to", "", "replay events stored before this time (RFC3339)")
+	limit := fs.Int("limit", 0, "maximum number of events to replay")
+	republish := fs.Bool("republish", false, "send the measurements to iot-core, default is a dry run")
+	output := fs.String("output", "summary", "output format, summary or json")
+
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: iot-agent-cli replay (-sensor <id> | -device <id> | -type <sensor type> | -error <text> | -from <time>) [flags]")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if *output != "summary" && *output != "json" {
+		fmt.Fprintf(stderr, "unsupported output format %q\n", *output)
+		return errUsage
+	}
+
+	dryRun := !*republish
+
+	req := api.ReplayRequest{
+		SensorID:   *sensorID,
+		DeviceID:   *deviceID,
+		SensorType: *sensorType,
+		Error:      *errorText,
+		Limit:      *limit,
+		DryRun:     &dryRun,
+	}
+
+	var err error
+
+	if req.From, err = parseTime(*from); err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+
+	if req.To, err = parseTime(*to); err != nil {
+		return fmt.Errorf("invalid to: %w", err)
+	}
+
+	if req.SensorID == "" && req.DeviceID == "" && req.SensorType == "" && req.Error == "" && req.From == nil {
+		fs.Usage()
+		return errUsage
+	}
+
+	report, body, err := replay(ctx, strings.TrimSuffix(*url, "/"), *token, req)
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		_, err = fmt.Fprintln(stdout, string(body))
+		return err
+	}
+
+	return writeReplaySummary(stdout, report)
+}
+
+func replay(ctx context.Context, url, token string, req api.ReplayRequest) (application.ReplayReport, []byte, error) {
+	var report application.ReplayReport
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return report, nil, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/api/v0/admin/replay", bytes.NewReader(b))
+	if err != nil {
+		return report, nil, err
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return report, nil, fmt.Errorf("replay request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return report, nil, fmt.Errorf("failed to read replay response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return report, nil, fmt.Errorf("replay request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	err = json.Unmarshal(body, &report)
+	if err != nil {
+		return report, nil, fmt.Errorf("failed to parse replay response: %w", err)
+	}
+
+	return report, body, nil
+}
+
+func writeReplaySummary(w io.Writer, report application.ReplayReport) error {
+	for _, r := range report.Results {
+		switch {
+		case r.NewError != "":
+			fmt.Fprintf(w, "%s %s %s error: %s\n", r.Time.Format(time.RFC3339), r.SensorID, r.ID, r.NewError)
+		case r.PublishError != "":
+			fmt.Fprintf(w, "%s %s %s publish error: %s\n", r.Time.Format(time.RFC3339), r.SensorID, r.ID, r.PublishError)
+		case r.Changed:
+			fmt.Fprintf(w, "%s %s %s changed +%d -%d %s => %s\n", r.Time.Format(time.RFC3339), r.SensorID, r.ID, len(r.Added), len(r.Removed), r.Decoder, r.NewDecoder)
+		}
+	}
+
+	mode := "dry run"
+	if !report.DryRun {
+		mode = "republished"
+	}
+
+	_, err := fmt.Fprintf(w, "%s: %d events, %d changed, %d failed, %d published\n", mode, report.Events, report.Changed, report.Failed, report.Published)
+	return err
+}
+
+func parseTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api"
+	"github.com/matryer/is"
+)
+
+func TestReplaySendsDryRunRequest(t *testing.T) {
+	is := is.New(t)
+
+	var req api.ReplayRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.Equal(r.URL.Path, "/api/v0/admin/replay")
+		is.Equal(r.Header.Get("Authorization"), "Bearer secret")
+
+		b, _ := io.ReadAll(r.Body)
+		is.NoErr(json.Unmarshal(b, &req))
+
+		report := application.ReplayReport{
+			DryRun:  true,
+			Events:  2,
+			Changed: 1,
+			Results: []application.ReplayResult{
+				{ID: "1", SensorID: "a81758fffe05e6fb", Time: time.Date(2024, 8, 5, 11, 23, 45, 0, time.UTC), Changed: true, Added: []json.RawMessage{json.RawMessage(`{}`)}, Decoder: "elsys@1", NewDecoder: "elsys@2"},
+				{ID: "2", SensorID: "a81758fffe05e6fb"},
+			},
+		}
+		b, _ = json.Marshal(report)
+		w.Write(b)
+	}))
+	defer server.Close()
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), []string{"replay", "-url", server.URL, "-token", "secret", "-sensor", "a81758fffe05e6fb", "-from", "2024-08-05T00:00:00Z"}, nil, &stdout, &stderr)
+	is.NoErr(err)
+
+	is.Equal(req.SensorID, "a81758fffe05e6fb")
+	is.True(*req.DryRun)
+	is.Equal(*req.From, time.Date(2024, 8, 5, 0, 0, 0, 0, time.UTC))
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	is.Equal(len(lines), 2)
+	is.Equal(lines[0], "2024-08-05T11:23:45Z a81758fffe05e6fb 1 changed +1 -0 elsys@1 => elsys@2")
+	is.Equal(lines[1], "dry run: 2 events, 1 changed, 0 failed, 0 published")
+}
+
+func TestReplayRequiresAFilter(t *testing.T) {
+	is := is.New(t)
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), []string{"replay", "-republish"}, nil, &stdout, &stderr)
+	is.Equal(err, errUsage)
+}
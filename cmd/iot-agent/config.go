@@ -5,6 +5,7 @@ import (
 
 	"github.com/diwise/iot-agent/internal/pkg/application"
 	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/mqtt"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/sinks"
 	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/storage"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/servicerunner"
@@ -19,6 +20,8 @@ const (
 	controlPort
 
 	policiesFile
+	policiesReloadInterval
+	ingestAuthRequired
 
 	dbHost
 	dbUser
@@ -29,12 +32,53 @@ const (
 
 	createUnknownDeviceEnabled
 	createUnknownDeviceTenant
+	createUnknownDeviceTenantFromTopic
 	deviceprofileFile
 
+	forwardingMode
 	forwardingEndpoint
+	forwardingToken
+	forwardingWorkers
+	forwardingMaxAttempts
+	forwardingMinBackoff
+	forwardingMaxBackoff
+	forwardingQueueDir
+	forwardingQueueMaxBytes
+	forwardingQueueSegmentBytes
+	forwardingQueueReplay
 	appServerFacade
 	devMgmtUrl
 
+	deduplicationWindow
+	frameCounterTracking
+	dropReplayedFrames
+
+	deviceCacheEnabled
+	deviceCacheTTL
+	deviceCacheMaxStale
+	deviceCacheSize
+	deviceCacheInvalidation
+
+	outboxEnabled
+	outboxMaxAttempts
+
+	sinksFile
+	mqttPublishTopic
+	mqttPublishBroker
+	mqttPublishQoS
+	mqttPublishRetained
+
+	kafkaBrokers
+	kafkaTopics
+	kafkaGroupID
+	kafkaFormat
+	kafkaFacade
+	kafkaMessageType
+	kafkaDeadLetterTopic
+	kafkaMaxAttempts
+	kafkaMinBackoff
+	kafkaMaxBackoff
+
 	oauth2ClientId
 	oauth2ClientSecret
 	oauth2TokenUrl
@@ -51,7 +95,8 @@ type appConfig struct {
 	//	storage    storage.Storage
 	//	facade     facades.EventFunc
 
-	mqttCfg      *mqtt.Config
+	mqttCfgs     []mqtt.Config
+	sinkCfgs     []sinks.Config
 	messengerCfg *messaging.Config
 	storageCfg   *storage.Config
 	dpCfg        map[string]application.DeviceProfileConfig
@@ -207,7 +207,16 @@ func (d *devmodeStorage) Ping(ctx context.Context) error {
 func newDevmodeStorage(_ context.Context) (storage.Storage, error) {
 	return &devmodeStorage{
 		storage.StorageMock{
-			SaveFunc: func(ctx context.Context, se apptypes.Event, device devicemgmtclient.Device, payload apptypes.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
+			SaveFunc: func(ctx context.Context, se apptypes.Event, device devicemgmtclient.Device, decoder string, payload apptypes.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
+				return nil
+			},
+			QueryEventsFunc: func(ctx context.Context, q apptypes.EventQuery) ([]apptypes.StoredEvent, error) {
+				return []apptypes.StoredEvent{}, nil
+			},
+			GetFrameCounterFunc: func(ctx context.Context, sensorID string) (apptypes.FrameCounter, error) {
+				return apptypes.FrameCounter{}, storage.ErrNotFound
+			},
+			SaveFrameCounterFunc: func(ctx context.Context, sensorID string, fc apptypes.FrameCounter) error {
 				return nil
 			},
 		},
@@ -9,15 +9,24 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/diwise/iot-agent/internal/pkg/application"
 	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/kafka"
 	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/mqtt"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/outbox"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/sinks"
 	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/storage"
 	"github.com/diwise/iot-agent/internal/pkg/presentation/api"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api/auth"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api/webhook"
 	dmclient "github.com/diwise/iot-device-mgmt/pkg/client"
+	dmtypes "github.com/diwise/iot-device-mgmt/pkg/types"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/buildinfo"
 	"github.com/diwise/service-chassis/pkg/infrastructure/env"
@@ -36,7 +45,9 @@ func defaultFlags() flagMap {
 		servicePort:   "8080",
 		controlPort:   "8000",
 
-		policiesFile: "/opt/diwise/config/authz.rego",
+		policiesFile:           "/opt/diwise/config/authz.rego",
+		policiesReloadInterval: "30s",
+		ingestAuthRequired:     "false",
 
 		dbHost:     "",
 		dbUser:     "",
@@ -45,12 +56,53 @@ func defaultFlags() flagMap {
 		dbName:     "diwise",
 		dbSSLMode:  "disable",
 
-		createUnknownDeviceEnabled: "false",
-		createUnknownDeviceTenant:  "default",
-		deviceprofileFile:          "/opt/diwise/config/deviceprofiles.yaml",
-
-		forwardingEndpoint: "http://127.0.0.1/api/v0/messages",
-		appServerFacade:    "servanet",
+		createUnknownDeviceEnabled:         "false",
+		createUnknownDeviceTenant:          "default",
+		createUnknownDeviceTenantFromTopic: "false",
+		deviceprofileFile:                  "/opt/diwise/config/deviceprofiles.yaml",
+
+		forwardingMode:              "http",
+		forwardingEndpoint:          defaultForwardingEndpoint,
+		forwardingToken:             "",
+		forwardingWorkers:           "4",
+		forwardingMaxAttempts:       "5",
+		forwardingMinBackoff:        "500ms",
+		forwardingMaxBackoff:        "30s",
+		forwardingQueueDir:          "",
+		forwardingQueueMaxBytes:     "268435456",
+		forwardingQueueSegmentBytes: "16777216",
+		forwardingQueueReplay:       "true",
+		appServerFacade:             "servanet",
+
+		deduplicationWindow:  "5m",
+		frameCounterTracking: "true",
+		dropReplayedFrames:   "false",
+
+		deviceCacheEnabled:      "true",
+		deviceCacheTTL:          "5m",
+		deviceCacheMaxStale:     "24h",
+		deviceCacheSize:         "10000",
+		deviceCacheInvalidation: "true",
+
+		outboxEnabled:     "true",
+		outboxMaxAttempts: "10",
+
+		sinksFile:           "",
+		mqttPublishTopic:    "",
+		mqttPublishBroker:   "",
+		mqttPublishQoS:      "0",
+		mqttPublishRetained: "false",
+
+		kafkaBrokers:         "",
+		kafkaTopics:          "",
+		kafkaGroupID:         "iot-agent",
+		kafkaFormat:          "raw",
+		kafkaFacade:          "",
+		kafkaMessageType:     "up",
+		kafkaDeadLetterTopic: "",
+		kafkaMaxAttempts:     "5",
+		kafkaMinBackoff:      "500ms",
+		kafkaMaxBackoff:      "30s",
 
 		logLevel: "debug",
 
@@ -73,16 +125,29 @@ func main() {
 	dpCfg, err := parseExternalConfigFile(ctx, f)
 	exitIf(err, logger, "failed to parse device profile configuration")
 
-	mqttConfig, err := mqtt.NewConfigFromEnvironment("")
+	mqttConfigs, err := mqtt.NewConfigsFromEnvironment()
 	exitIf(err, logger, "mqtt configuration error")
 
+	for _, c := range mqttConfigs {
+		if c.Facade() != "" && !slices.Contains(facades.Names(), c.Facade()) {
+			exitIf(fmt.Errorf("unknown facade %q", c.Facade()), logger, "mqtt configuration error", "broker", c.Name())
+		}
+	}
+
+	err = resolveForwarding(ctx, flags, mqttConfigs)
+	exitIf(err, logger, "mqtt forwarding configuration error")
+
+	sinkConfigs, err := newSinkConfigs(flags)
+	exitIf(err, logger, "sinks configuration error")
+
 	messengerConfig := messaging.LoadConfiguration(ctx, serviceName, logger)
 	storageConfig := storage.LoadConfiguration(ctx)
 
 	ctx, cancel := context.WithCancel(ctx)
 
 	appCfg := appConfig{
-		mqttCfg:      &mqttConfig,
+		mqttCfgs:     mqttConfigs,
+		sinkCfgs:     sinkConfigs,
 		messengerCfg: &messengerConfig,
 		storageCfg:   &storageConfig,
 		dpCfg:        dpCfg,
@@ -102,9 +167,14 @@ func initialize(ctx context.Context, flags flagMap, cfg *appConfig) (servicerunn
 
 	var dmClient dmclient.DeviceManagementClient
 	var messenger messaging.MsgContext
-	var mqttClient mqtt.Client
+	mqttClients := make([]mqtt.Client, len(cfg.mqttCfgs))
 	var store storage.Storage
 	var facade facades.EventFunc
+	var app application.App
+	var deviceCache *application.DeviceCache
+	var msgOutbox *outbox.Outbox
+	var outputs *sinks.Sinks
+	var kafkaConsumer *kafka.Consumer
 
 	probes := map[string]k8shandlers.ServiceProber{
 		"rabbitmq": func(ctx context.Context) (string, error) {
@@ -139,17 +209,30 @@ func initialize(ctx context.Context, flags flagMap, cfg *appConfig) (servicerunn
 
 			return "ok", nil
 		},
-		"mqtt": func(context.Context) (string, error) {
-			if mqttClient == nil {
+	}
+
+	// each broker connection reports its own readiness
+	for idx, c := range cfg.mqttCfgs {
+		if !c.Enabled() {
+			continue
+		}
+
+		name := "mqtt"
+		if len(cfg.mqttCfgs) > 1 {
+			name = "mqtt-" + c.Name()
+		}
+
+		probes[name] = func(context.Context) (string, error) {
+			if mqttClients[idx] == nil {
 				return "", errors.New("mqtt not initialized")
 			}
 
-			if !mqttClient.Ready() {
+			if !mqttClients[idx].Ready() {
 				return "", errors.New("mqtt not connected")
 			}
 
 			return "ok", nil
-		},
+		}
 	}
 
 	_, runner := servicerunner.New(ctx, *cfg,
@@ -160,16 +243,75 @@ func initialize(ctx context.Context, flags flagMap, cfg *appConfig) (servicerunn
 			muxinit(func(ctx context.Context, identifier string, port string, appCfg *appConfig, handler *http.ServeMux) error {
 				logger.Debug("initializing public webserver")
 
-				app := application.New(
+				dedupWindow, err := time.ParseDuration(flags[deduplicationWindow])
+				if err != nil {
+					return fmt.Errorf("invalid deduplication window: %w", err)
+				}
+
+				options := []application.Option{
+					application.WithDeduplication(dedupWindow),
+				}
+
+				if flags[frameCounterTracking] == "true" {
+					options = append(options, application.WithFrameCounterTracking(flags[dropReplayedFrames] == "true"))
+				}
+
+				if flags[createUnknownDeviceTenantFromTopic] == "true" {
+					options = append(options, application.WithTenantHints())
+				}
+
+				if flags[deviceCacheEnabled] == "true" {
+					cacheCfg, err := newDeviceCacheConfig(flags)
+					if err != nil {
+						return err
+					}
+
+					deviceCache = application.NewDeviceCache(dmClient, cacheCfg)
+					options = append(options, application.WithDeviceCache(deviceCache))
+				}
+
+				var msgCtx messaging.MsgContext = messenger
+				if msgOutbox != nil {
+					msgCtx = msgOutbox
+				}
+
+				outputs, err = sinks.New(ctx, appCfg.sinkCfgs, sinks.Dependencies{
+					IoTCore: application.NewIoTCoreSink(msgCtx),
+					Brokers: appCfg.mqttCfgs,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to create sinks: %w", err)
+				}
+
+				for _, s := range outputs.All() {
+					options = append(options, application.WithSinks(s))
+				}
+
+				app = application.New(
 					dmClient,
-					messenger,
+					msgCtx,
 					store,
 					flags[createUnknownDeviceEnabled] == "true",
 					flags[createUnknownDeviceTenant],
 					appCfg.dpCfg,
+					options...,
 				)
 
-				api.RegisterHandlers(ctx, handler, app, facade)
+				policies, err := newPolicies(ctx, flags[policiesFile], flags[policiesReloadInterval])
+				if err != nil {
+					return fmt.Errorf("failed to load authorization policies: %w", err)
+				}
+
+				if flags[ingestAuthRequired] != "true" {
+					policies.AllowAnonymous(auth.IngestRule)
+				}
+
+				webhooks, err := webhook.NewVerifiersFromEnvironment(facades.Names()...)
+				if err != nil {
+					return err
+				}
+
+				api.RegisterHandlers(ctx, handler, policies, webhooks, app, facade)
 
 				return nil
 			}),
@@ -184,9 +326,30 @@ func initialize(ctx context.Context, flags flagMap, cfg *appConfig) (servicerunn
 				return fmt.Errorf("failed to create storage: %w", err)
 			}
 
-			mqttClient, err = mqtt.NewClient(ctx, *ac.mqttCfg, flags[forwardingEndpoint])
+			facade = facades.New(flags[appServerFacade])
+
+			deadLetters, err := newDeadLetterStore(store, ac.devmode)
 			if err != nil {
-				return fmt.Errorf("failed to create mqtt client: %w", err)
+				return err
+			}
+
+			for idx, c := range ac.mqttCfgs {
+				fwd, err := newForwarding(flags, c.Facade(), func() application.App { return app }, facade, deadLetters)
+				if err != nil {
+					return err
+				}
+
+				mqttClients[idx], err = mqtt.NewClient(ctx, c, fwd)
+				if err != nil {
+					return fmt.Errorf("failed to create mqtt client for broker %s: %w", c.Name(), err)
+				}
+			}
+
+			if flags[kafkaBrokers] != "" {
+				kafkaConsumer, err = newKafkaConsumer(ctx, flags, func() application.App { return app }, facade)
+				if err != nil {
+					return fmt.Errorf("failed to create kafka consumer: %w", err)
+				}
 			}
 
 			messenger, err = messaging.Initialize(ctx, *ac.messengerCfg)
@@ -199,21 +362,65 @@ func initialize(ctx context.Context, flags flagMap, cfg *appConfig) (servicerunn
 				return fmt.Errorf("failed to create device management client: %w", err)
 			}
 
-			facade = facades.New(flags[appServerFacade])
+			if flags[outboxEnabled] == "true" {
+				msgOutbox, err = newOutbox(ctx, messenger, store, flags[outboxMaxAttempts], ac.devmode)
+				if err != nil {
+					return fmt.Errorf("failed to create outbox: %w", err)
+				}
+			}
 
 			return nil
 		}),
 		onstarting(func(ctx context.Context, appCfg *appConfig) (err error) {
 			logger.Debug("starting servicerunner")
 			messenger.Start()
-			mqttClient.Start()
+
+			if deviceCache != nil && flags[deviceCacheInvalidation] == "true" {
+				err = messenger.RegisterTopicMessageHandler(dmtypes.DeviceUpdated{}.TopicName(), application.NewDeviceUpdatedHandler(deviceCache))
+				if err != nil {
+					return fmt.Errorf("failed to register device cache invalidation: %w", err)
+				}
+			}
+
+			if msgOutbox != nil {
+				msgOutbox.Start()
+			}
+
+			for _, c := range mqttClients {
+				c.Start()
+			}
+
+			if kafkaConsumer != nil {
+				kafkaConsumer.Start()
+			}
+
+			if outputs != nil {
+				if err := outputs.Start(); err != nil {
+					return err
+				}
+			}
 
 			return nil
 		}),
 		onshutdown(func(ctx context.Context, appCfg *appConfig) error {
 			logger.Debug("shutting down servicerunner")
 
-			mqttClient.Stop()
+			for _, c := range mqttClients {
+				c.Stop()
+			}
+
+			if kafkaConsumer != nil {
+				kafkaConsumer.Stop()
+			}
+
+			if outputs != nil {
+				outputs.Stop()
+			}
+
+			if msgOutbox != nil {
+				msgOutbox.Stop()
+			}
+
 			messenger.Close()
 			dmClient.Close(ctx)
 			store.Close()
@@ -226,6 +433,196 @@ func initialize(ctx context.Context, flags flagMap, cfg *appConfig) (servicerunn
 	return runner, nil
 }
 
+const (
+	defaultForwardingEndpoint string = "http://127.0.0.1/api/v0/messages/mqtt"
+	legacyForwardingEndpoint  string = "http://127.0.0.1/api/v0/messages"
+)
+
+// resolveForwarding requires a token when messages from an enabled broker are posted to the
+// forwarding endpoint, since the endpoint rejects requests without a bearer token and the
+// messages would otherwise only end up as dead letters. Until INGEST_AUTH_REQUIRED is enabled,
+// messages are instead posted without a token to the ingestion endpoint that was used before
+// tokens were required, where the hints of the messages are not used.
+func resolveForwarding(ctx context.Context, flags flagMap, cfgs []mqtt.Config) error {
+	if flags[forwardingMode] != "http" || flags[forwardingToken] != "" {
+		return nil
+	}
+
+	for _, c := range cfgs {
+		if !c.Enabled() {
+			continue
+		}
+
+		if flags[ingestAuthRequired] == "true" {
+			return fmt.Errorf("MSG_FWD_TOKEN is required when messages from broker %s are forwarded to %s", c.Name(), flags[forwardingEndpoint])
+		}
+
+		if flags[forwardingEndpoint] == defaultForwardingEndpoint {
+			flags[forwardingEndpoint] = legacyForwardingEndpoint
+		}
+
+		logging.GetFromContext(ctx).Warn("MSG_FWD_TOKEN is not set, mqtt messages are forwarded without a token. Set MSG_FWD_TOKEN before enabling INGEST_AUTH_REQUIRED", "endpoint", flags[forwardingEndpoint])
+
+		return nil
+	}
+
+	return nil
+}
+
+// newForwarding configures how messages from a broker are forwarded. In direct mode they are
+// handled in-process by the application, which is only created after the mqtt clients.
+func newForwarding(flags flagMap, brokerFacade string, app func() application.App, defaultFacade facades.EventFunc, deadLetters mqtt.DeadLetterStore) (mqtt.Forwarding, error) {
+	var fwd mqtt.Forwarding
+
+	switch flags[forwardingMode] {
+	case "http":
+		fwd = mqtt.Forwarding{Endpoint: flags[forwardingEndpoint], Token: flags[forwardingToken]}
+	case "direct":
+		facade := defaultFacade
+		if brokerFacade != "" {
+			facade = facades.New(brokerFacade)
+		}
+
+		fwd = mqtt.Forwarding{
+			Handler: func(ctx context.Context, im types.IncomingMessage) error {
+				return application.HandleIncomingMessage(ctx, app(), facade, im)
+			},
+		}
+	default:
+		return mqtt.Forwarding{}, fmt.Errorf("unsupported forwarding mode %q, expected http or direct", flags[forwardingMode])
+	}
+
+	var err error
+
+	fwd.Workers, err = strconv.Atoi(flags[forwardingWorkers])
+	if err != nil || fwd.Workers < 1 {
+		return mqtt.Forwarding{}, fmt.Errorf("invalid forwarding workers %q", flags[forwardingWorkers])
+	}
+
+	fwd.Retry.MaxAttempts, err = strconv.Atoi(flags[forwardingMaxAttempts])
+	if err != nil || fwd.Retry.MaxAttempts < 1 {
+		return mqtt.Forwarding{}, fmt.Errorf("invalid forwarding max attempts %q", flags[forwardingMaxAttempts])
+	}
+
+	fwd.Retry.MinBackoff, err = time.ParseDuration(flags[forwardingMinBackoff])
+	if err != nil {
+		return mqtt.Forwarding{}, fmt.Errorf("invalid forwarding min backoff: %w", err)
+	}
+
+	fwd.Retry.MaxBackoff, err = time.ParseDuration(flags[forwardingMaxBackoff])
+	if err != nil {
+		return mqtt.Forwarding{}, fmt.Errorf("invalid forwarding max backoff: %w", err)
+	}
+
+	fwd.DeadLetters = deadLetters
+
+	fwd.Queue = mqtt.QueueConfig{
+		Dir:    flags[forwardingQueueDir],
+		Replay: flags[forwardingQueueReplay] == "true",
+	}
+
+	fwd.Queue.MaxBytes, err = strconv.ParseInt(flags[forwardingQueueMaxBytes], 10, 64)
+	if err != nil {
+		return mqtt.Forwarding{}, fmt.Errorf("invalid forwarding queue max bytes: %w", err)
+	}
+
+	fwd.Queue.SegmentBytes, err = strconv.ParseInt(flags[forwardingQueueSegmentBytes], 10, 64)
+	if err != nil {
+		return mqtt.Forwarding{}, fmt.Errorf("invalid forwarding queue segment bytes: %w", err)
+	}
+
+	return fwd, nil
+}
+
+// newKafkaConsumer configures the consumption of kafka topics. Messages are handled in-process,
+// by the application that is only created after the consumer.
+func newKafkaConsumer(ctx context.Context, flags flagMap, app func() application.App, defaultFacade facades.EventFunc) (*kafka.Consumer, error) {
+	facade := defaultFacade
+	if flags[kafkaFacade] != "" {
+		if !slices.Contains(facades.Names(), flags[kafkaFacade]) {
+			return nil, fmt.Errorf("unknown facade %q", flags[kafkaFacade])
+		}
+		facade = facades.New(flags[kafkaFacade])
+	}
+
+	cfg := kafka.ConsumerConfig{
+		Brokers:         splitList(flags[kafkaBrokers]),
+		Topics:          splitList(flags[kafkaTopics]),
+		GroupID:         flags[kafkaGroupID],
+		Format:          strings.ToLower(flags[kafkaFormat]),
+		MessageType:     flags[kafkaMessageType],
+		DeadLetterTopic: flags[kafkaDeadLetterTopic],
+	}
+
+	var err error
+
+	cfg.MaxAttempts, err = strconv.Atoi(flags[kafkaMaxAttempts])
+	if err != nil {
+		return nil, fmt.Errorf("invalid kafka max attempts %q", flags[kafkaMaxAttempts])
+	}
+
+	cfg.MinBackoff, err = time.ParseDuration(flags[kafkaMinBackoff])
+	if err != nil {
+		return nil, fmt.Errorf("invalid kafka min backoff: %w", err)
+	}
+
+	cfg.MaxBackoff, err = time.ParseDuration(flags[kafkaMaxBackoff])
+	if err != nil {
+		return nil, fmt.Errorf("invalid kafka max backoff: %w", err)
+	}
+
+	return kafka.NewConsumer(ctx, cfg, func(ctx context.Context, im types.IncomingMessage) error {
+		return application.HandleIncomingMessage(ctx, app(), facade, im)
+	})
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func newDeadLetterStore(store storage.Storage, devmode bool) (mqtt.DeadLetterStore, error) {
+	if devmode {
+		return mqtt.NewMemoryDeadLetterStore(), nil
+	}
+
+	deadLetters, ok := store.(mqtt.DeadLetterStore)
+	if !ok {
+		return nil, errors.New("storage does not support mqtt dead letters")
+	}
+
+	return deadLetters, nil
+}
+
+func newPolicies(ctx context.Context, path, reloadInterval string) (*auth.Policies, error) {
+	interval, err := time.ParseDuration(reloadInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policies reload interval: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policies, err := auth.NewPolicies(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go policies.Watch(ctx, path, interval)
+	}
+
+	return policies, nil
+}
+
 func newStorage(ctx context.Context, cfg storage.Config, devmode bool) (storage.Storage, error) {
 	if devmode {
 		logging.GetFromContext(ctx).Warn("devmode is enabled, using in-memory storage")
@@ -244,6 +641,81 @@ func newDeviceMgmtClient(ctx context.Context, url, tokenUrl, clientId, clientSec
 	return dmclient.New(ctx, url, tokenUrl, true, clientId, clientSecret)
 }
 
+// newSinkConfigs returns the sinks that measurements are delivered to, read from SINKS_FILE if
+// it is set. Otherwise measurements are sent to iot-core and, if MQTT_PUBLISH_TOPIC is set,
+// published to mqtt.
+func newSinkConfigs(flags flagMap) ([]sinks.Config, error) {
+	if flags[sinksFile] != "" {
+		f, err := os.Open(flags[sinksFile])
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sinks file: %w", err)
+		}
+		defer f.Close()
+
+		return sinks.NewConfigsFromFile(f)
+	}
+
+	cfgs := []sinks.Config{{Name: "iot-core", Type: "iotcore"}}
+
+	if flags[mqttPublishTopic] != "" {
+		qos, err := strconv.Atoi(flags[mqttPublishQoS])
+		if err != nil || qos < 0 || qos > 2 {
+			return nil, fmt.Errorf("invalid publish qos %q", flags[mqttPublishQoS])
+		}
+
+		cfgs = append(cfgs, sinks.Config{
+			Name:     "mqtt",
+			Type:     "mqtt",
+			Broker:   flags[mqttPublishBroker],
+			Topic:    flags[mqttPublishTopic],
+			QoS:      byte(qos),
+			Retained: flags[mqttPublishRetained] == "true",
+		})
+	}
+
+	return cfgs, nil
+}
+
+func newOutbox(ctx context.Context, messenger messaging.MsgContext, store storage.Storage, maxAttempts string, devmode bool) (*outbox.Outbox, error) {
+	cfg := outbox.DefaultConfig()
+
+	n, err := strconv.Atoi(maxAttempts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbox max attempts: %w", err)
+	}
+	cfg.MaxAttempts = n
+
+	if devmode {
+		return outbox.New(ctx, messenger, outbox.NewMemoryStore(), cfg), nil
+	}
+
+	outboxStore, ok := store.(outbox.Store)
+	if !ok {
+		return nil, errors.New("storage does not support an outbox")
+	}
+
+	return outbox.New(ctx, messenger, outboxStore, cfg), nil
+}
+
+func newDeviceCacheConfig(flags flagMap) (application.DeviceCacheConfig, error) {
+	ttl, err := time.ParseDuration(flags[deviceCacheTTL])
+	if err != nil {
+		return application.DeviceCacheConfig{}, fmt.Errorf("invalid device cache ttl: %w", err)
+	}
+
+	maxStale, err := time.ParseDuration(flags[deviceCacheMaxStale])
+	if err != nil {
+		return application.DeviceCacheConfig{}, fmt.Errorf("invalid device cache max stale: %w", err)
+	}
+
+	size, err := strconv.Atoi(flags[deviceCacheSize])
+	if err != nil {
+		return application.DeviceCacheConfig{}, fmt.Errorf("invalid device cache size: %w", err)
+	}
+
+	return application.DeviceCacheConfig{TTL: ttl, MaxStale: maxStale, Size: size}, nil
+}
+
 func parseExternalConfig(ctx context.Context, flags flagMap) (context.Context, flagMap) {
 	// Allow environment variables to override certain defaults
 	envOrDef := env.GetVariableOrDefault
@@ -253,6 +725,8 @@ func parseExternalConfig(ctx context.Context, flags flagMap) (context.Context, f
 	flags[logLevel] = envOrDef(ctx, "LOG_LEVEL", flags[logLevel])
 
 	flags[policiesFile] = envOrDef(ctx, "POLICIES_FILE", flags[policiesFile])
+	flags[policiesReloadInterval] = envOrDef(ctx, "POLICIES_RELOAD_INTERVAL", flags[policiesReloadInterval])
+	flags[ingestAuthRequired] = envOrDef(ctx, "INGEST_AUTH_REQUIRED", flags[ingestAuthRequired])
 
 	flags[dbHost] = envOrDef(ctx, "POSTGRES_HOST", flags[dbHost])
 	flags[dbPort] = envOrDef(ctx, "POSTGRES_PORT", flags[dbPort])
@@ -263,9 +737,46 @@ func parseExternalConfig(ctx context.Context, flags flagMap) (context.Context, f
 
 	flags[createUnknownDeviceEnabled] = envOrDef(ctx, "CREATE_UNKNOWN_DEVICE_ENABLED", flags[createUnknownDeviceEnabled])
 	flags[createUnknownDeviceTenant] = envOrDef(ctx, "CREATE_UNKNOWN_DEVICE_TENANT", flags[createUnknownDeviceTenant])
+	flags[createUnknownDeviceTenantFromTopic] = envOrDef(ctx, "CREATE_UNKNOWN_DEVICE_TENANT_FROM_TOPIC", flags[createUnknownDeviceTenantFromTopic])
+	flags[forwardingMode] = envOrDef(ctx, "MSG_FWD_MODE", flags[forwardingMode])
 	flags[forwardingEndpoint] = envOrDef(ctx, "MSG_FWD_ENDPOINT", flags[forwardingEndpoint])
+	flags[forwardingToken] = envOrDef(ctx, "MSG_FWD_TOKEN", flags[forwardingToken])
+	flags[forwardingWorkers] = envOrDef(ctx, "MSG_FWD_WORKERS", flags[forwardingWorkers])
+	flags[forwardingMaxAttempts] = envOrDef(ctx, "MSG_FWD_MAX_ATTEMPTS", flags[forwardingMaxAttempts])
+	flags[forwardingMinBackoff] = envOrDef(ctx, "MSG_FWD_MIN_BACKOFF", flags[forwardingMinBackoff])
+	flags[forwardingMaxBackoff] = envOrDef(ctx, "MSG_FWD_MAX_BACKOFF", flags[forwardingMaxBackoff])
+	flags[forwardingQueueDir] = envOrDef(ctx, "MSG_FWD_QUEUE_DIR", flags[forwardingQueueDir])
+	flags[forwardingQueueMaxBytes] = envOrDef(ctx, "MSG_FWD_QUEUE_MAX_BYTES", flags[forwardingQueueMaxBytes])
+	flags[forwardingQueueSegmentBytes] = envOrDef(ctx, "MSG_FWD_QUEUE_SEGMENT_BYTES", flags[forwardingQueueSegmentBytes])
+	flags[forwardingQueueReplay] = envOrDef(ctx, "MSG_FWD_QUEUE_REPLAY", flags[forwardingQueueReplay])
 	flags[appServerFacade] = envOrDef(ctx, "APPSERVER_FACADE", flags[appServerFacade])
 	flags[devMgmtUrl] = envOrDef(ctx, "DEV_MGMT_URL", flags[devMgmtUrl])
+	flags[deduplicationWindow] = envOrDef(ctx, "DEDUPLICATION_WINDOW", flags[deduplicationWindow])
+	flags[frameCounterTracking] = envOrDef(ctx, "FCNT_TRACKING_ENABLED", flags[frameCounterTracking])
+	flags[dropReplayedFrames] = envOrDef(ctx, "FCNT_DROP_REPLAYS", flags[dropReplayedFrames])
+	flags[deviceCacheEnabled] = envOrDef(ctx, "DEVICE_CACHE_ENABLED", flags[deviceCacheEnabled])
+	flags[deviceCacheTTL] = envOrDef(ctx, "DEVICE_CACHE_TTL", flags[deviceCacheTTL])
+	flags[deviceCacheMaxStale] = envOrDef(ctx, "DEVICE_CACHE_MAX_STALE", flags[deviceCacheMaxStale])
+	flags[deviceCacheSize] = envOrDef(ctx, "DEVICE_CACHE_SIZE", flags[deviceCacheSize])
+	flags[deviceCacheInvalidation] = envOrDef(ctx, "DEVICE_CACHE_INVALIDATION_ENABLED", flags[deviceCacheInvalidation])
+	flags[outboxEnabled] = envOrDef(ctx, "OUTBOX_ENABLED", flags[outboxEnabled])
+	flags[outboxMaxAttempts] = envOrDef(ctx, "OUTBOX_MAX_ATTEMPTS", flags[outboxMaxAttempts])
+	flags[sinksFile] = envOrDef(ctx, "SINKS_FILE", flags[sinksFile])
+	flags[mqttPublishTopic] = envOrDef(ctx, "MQTT_PUBLISH_TOPIC", flags[mqttPublishTopic])
+	flags[mqttPublishBroker] = envOrDef(ctx, "MQTT_PUBLISH_BROKER", flags[mqttPublishBroker])
+	flags[mqttPublishQoS] = envOrDef(ctx, "MQTT_PUBLISH_QOS", flags[mqttPublishQoS])
+	flags[mqttPublishRetained] = envOrDef(ctx, "MQTT_PUBLISH_RETAINED", flags[mqttPublishRetained])
+
+	flags[kafkaBrokers] = envOrDef(ctx, "KAFKA_BROKERS", flags[kafkaBrokers])
+	flags[kafkaTopics] = envOrDef(ctx, "KAFKA_TOPICS", flags[kafkaTopics])
+	flags[kafkaGroupID] = envOrDef(ctx, "KAFKA_GROUP_ID", flags[kafkaGroupID])
+	flags[kafkaFormat] = envOrDef(ctx, "KAFKA_FORMAT", flags[kafkaFormat])
+	flags[kafkaFacade] = envOrDef(ctx, "KAFKA_FACADE", flags[kafkaFacade])
+	flags[kafkaMessageType] = envOrDef(ctx, "KAFKA_MESSAGE_TYPE", flags[kafkaMessageType])
+	flags[kafkaDeadLetterTopic] = envOrDef(ctx, "KAFKA_DEAD_LETTER_TOPIC", flags[kafkaDeadLetterTopic])
+	flags[kafkaMaxAttempts] = envOrDef(ctx, "KAFKA_MAX_ATTEMPTS", flags[kafkaMaxAttempts])
+	flags[kafkaMinBackoff] = envOrDef(ctx, "KAFKA_MIN_BACKOFF", flags[kafkaMinBackoff])
+	flags[kafkaMaxBackoff] = envOrDef(ctx, "KAFKA_MAX_BACKOFF", flags[kafkaMaxBackoff])
 
 	flags[oauth2TokenUrl] = envOrDef(ctx, "OAUTH2_TOKEN_URL", flags[oauth2TokenUrl])
 	flags[oauth2ClientId] = envOrDef(ctx, "OAUTH2_CLIENT_ID", flags[oauth2ClientId])
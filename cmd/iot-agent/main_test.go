@@ -6,6 +6,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/mqtt"
 	"github.com/matryer/is"
 )
 
@@ -27,6 +28,47 @@ func TestParseExternalConfigFile(t *testing.T) {
 	is.Equal(elsys.Tags.Mappings["mount"], "position")
 }
 
+func TestForwardingOverHTTPRequiresToken(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("MQTT_HOST", "broker")
+	t.Setenv("MQTT_TOPIC_0", "application/#")
+	cfg, err := mqtt.NewConfigFromEnvironment("")
+	is.NoErr(err)
+
+	ctx := context.Background()
+
+	flags := defaultFlags()
+	flags[ingestAuthRequired] = "true"
+	is.True(resolveForwarding(ctx, flags, []mqtt.Config{cfg}) != nil)
+
+	flags[forwardingToken] = "integration"
+	is.NoErr(resolveForwarding(ctx, flags, []mqtt.Config{cfg}))
+	is.Equal(flags[forwardingEndpoint], defaultForwardingEndpoint)
+
+	flags[forwardingToken] = ""
+	flags[forwardingMode] = "direct"
+	is.NoErr(resolveForwarding(ctx, flags, []mqtt.Config{cfg}))
+}
+
+func TestForwardingWithoutTokenUsesLegacyEndpointUntilAuthIsRequired(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("MQTT_HOST", "broker")
+	t.Setenv("MQTT_TOPIC_0", "application/#")
+	cfg, err := mqtt.NewConfigFromEnvironment("")
+	is.NoErr(err)
+
+	flags := defaultFlags()
+	is.NoErr(resolveForwarding(context.Background(), flags, []mqtt.Config{cfg}))
+	is.Equal(flags[forwardingEndpoint], legacyForwardingEndpoint)
+
+	flags = defaultFlags()
+	flags[forwardingEndpoint] = "http://iot-agent:8080/api/v0/messages"
+	is.NoErr(resolveForwarding(context.Background(), flags, []mqtt.Config{cfg}))
+	is.Equal(flags[forwardingEndpoint], "http://iot-agent:8080/api/v0/messages")
+}
+
 const testDeviceProfileYAML = `
 Elsys_Codec:
   profile_name: elsys
@@ -5,6 +5,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 )
@@ -27,6 +28,12 @@ func (a AirQualityPayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("airquality", Decoder, Converter,
+		decoders.WithURNs(lwm2m.Temperature{}.ObjectURN(), lwm2m.Humidity{}.ObjectURN(), lwm2m.AirQuality{}.ObjectURN()),
+	)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 
 	if e.Payload.FPort != 2 {
@@ -6,6 +6,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 )
@@ -31,6 +32,12 @@ func (a AxsensorPayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("axsensor", Decoder, Converter,
+		decoders.WithURNs(lwm2m.Device{}.ObjectURN(), lwm2m.Distance{}.ObjectURN(), lwm2m.FillingLevel{}.ObjectURN(), lwm2m.Humidity{}.ObjectURN(), lwm2m.Pressure{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN()),
+	)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 
 	if e.Payload.FPort != 2 {
@@ -0,0 +1,19 @@
+// Package builtin registers all decoders that are part of the iot-agent. Import it for its
+// side effects before calling decoders.NewRegistry.
+package builtin
+
+import (
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/airquality"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/axsensor"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/elsys"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/enviot"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/milesight"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/niab"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/qalcosonic"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/senlabt"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/sensative"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/sensefarm"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/talkpool"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/vegapuls"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/x2climate"
+)
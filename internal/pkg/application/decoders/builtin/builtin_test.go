@@ -0,0 +1,32 @@
+package builtin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
+	"github.com/matryer/is"
+)
+
+func TestBuiltinSensorTypesAreRegistered(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	r := decoders.NewRegistry()
+
+	for _, sensorType := range []string{
+		"airquality", "axsensor", "enviot", "niab-fls",
+		"qalcosonic", "qalcosonic/w1t", "qalcosonic/w1h", "qalcosonic/w1e",
+		"vegapuls_air_41", "elt_2_hp", "elsys", "elsys/elt/sht3x", "elsys_codec",
+		"milesight", "milesight_am100", "senlabt", "tem_lab_14ns",
+		"sensefarm", "cube02", "sensative", "strips_lora_ms_h", "presence",
+		"talkpool/oy1210", "x2climate",
+	} {
+		_, _, ok := r.Get(ctx, sensorType)
+		is.True(ok) // builtin sensor type is not registered
+	}
+
+	for _, info := range r.List() {
+		is.True(len(info.URNs) > 0) // every sensor type should declare the objects it can emit
+	}
+}
@@ -2,14 +2,21 @@ package decoders
 
 import (
 	"context"
+	"errors"
 	"io"
 
 	"log/slog"
 	"testing"
+	"time"
 
 	"github.com/diwise/iot-agent/internal/pkg/application/decoders/defaultdecoder"
 	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/matryer/is"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 )
 
 func TestDefaultDecoder(t *testing.T) {
@@ -25,6 +32,191 @@ func TestDefaultDecoder(t *testing.T) {
 	is.Equal(objects[0].ID(), "devID")
 }
 
+func TestRegisterValidatesRegistrations(t *testing.T) {
+	is, _ := testSetup(t)
+
+	r := newRegistrations()
+	is.NoErr(r.register("sensor", testDecoder("v1"), testConverter, WithAliases("alias"), WithDeprecated("old")))
+
+	is.True(r.register("missing-converter", testDecoder("v1"), nil) != nil)
+	is.True(r.register("missing-decoder", nil, testConverter) != nil)
+	is.True(r.register("sensor", testDecoder("v1"), testConverter) != nil)                                 // same name and version
+	is.True(r.register("other", testDecoder("v1"), testConverter, WithAliases("old")) != nil)              // alias taken by another sensor type
+	is.True(r.register("alias", testDecoder("v1"), testConverter) != nil)                                  // name taken by an alias
+	is.True(r.register("other", testDecoder("v1"), testConverter, WithAliases("sensor")) != nil)           // alias taken by a sensor type
+	is.True(r.register("sensor@2", testDecoder("v1"), testConverter) != nil)                               // version must be given as an option
+	is.True(r.register("sensor", testDecoder("v0"), testConverter, WithVersion(0)) != nil)                 // invalid version
+	is.NoErr(r.register("sensor", testDecoder("v2"), testConverter, WithVersion(2), WithAliases("alias"))) // same alias for the same sensor type
+}
+
+func TestRegistryAliasesAndDeprecatedNames(t *testing.T) {
+	is, _ := testSetup(t)
+	ctx := context.Background()
+
+	r := newRegistrations()
+	is.NoErr(r.register("sensor", testDecoder("sensor"), testConverter, WithAliases("alias"), WithDeprecated("old"), WithURNs("urn:oma:lwm2m:ext:3303")))
+
+	reg := newRegistry(r)
+
+	for _, name := range []string{"sensor", "Alias", "old"} {
+		d, c, ok := reg.Get(ctx, name)
+		is.True(ok)
+		is.True(c != nil)
+		_, err := d(ctx, types.Event{})
+		is.Equal(err.Error(), "sensor")
+
+		v, ok := reg.Resolve(name)
+		is.True(ok)
+		is.Equal(v, "sensor@1")
+	}
+
+	_, _, ok := reg.Get(ctx, "unknown")
+	is.True(!ok)
+
+	info := reg.List()
+	is.Equal(len(info), 1)
+	is.Equal(info[0].SensorType, "sensor")
+	is.Equal(info[0].Aliases, []string{"alias"})
+	is.Equal(info[0].Deprecated, []string{"old"})
+	is.Equal(info[0].URNs, []string{"urn:oma:lwm2m:ext:3303"})
+}
+
+func TestRegistryPinnedVersions(t *testing.T) {
+	is, _ := testSetup(t)
+	ctx := context.Background()
+
+	r := newRegistrations()
+	is.NoErr(r.register("qalcosonic/w1e", testDecoder("previous version"), testConverter))
+	is.NoErr(r.register("qalcosonic/w1e", testDecoder("current version"), testConverter, WithVersion(2)))
+	is.NoErr(r.register("elsys", testDecoder("elsys"), testConverter))
+
+	reg := newRegistry(r)
+
+	v, ok := reg.Resolve("Qalcosonic/W1E")
+	is.True(ok)
+	is.Equal(v, "qalcosonic/w1e@2")
+
+	v, ok = reg.Resolve("qalcosonic/w1e@1")
+	is.True(ok)
+	is.Equal(v, "qalcosonic/w1e@1")
+
+	v, _ = reg.Resolve("qalcosonic/w1e@2")
+	is.Equal(v, "qalcosonic/w1e@2")
+
+	v, _ = reg.Resolve("elsys")
+	is.Equal(v, "elsys@1")
+
+	d, _, ok := reg.Get(ctx, "qalcosonic/w1e@1")
+	is.True(ok)
+	_, err := d(ctx, types.Event{})
+	is.Equal(err.Error(), "previous version")
+
+	d, _, _ = reg.Get(ctx, "qalcosonic/w1e")
+	_, err = d(ctx, types.Event{})
+	is.Equal(err.Error(), "current version")
+
+	_, _, ok = reg.Get(ctx, "qalcosonic/w1e@3")
+	is.True(!ok) // a pinned version that does not exist must not fall back to the current one
+
+	_, _, ok = reg.Get(ctx, "qalcosonic/w1e@latest")
+	is.True(!ok)
+
+	for _, info := range reg.List() {
+		if info.SensorType == "qalcosonic/w1e" {
+			is.Equal(info.Version, 2)
+			is.Equal(info.Versions, []int{1})
+		}
+	}
+}
+
+func TestRegistryPinsRegisteredVersions(t *testing.T) {
+	is, _ := testSetup(t)
+
+	r := newRegistrations()
+	is.NoErr(r.register("qalcosonic/w1e", testDecoder("previous version"), testConverter))
+	is.NoErr(r.register("qalcosonic/w1e", testDecoder("current version"), testConverter, WithVersion(2)))
+
+	reg := newRegistry(r)
+
+	v, ok := reg.Pin("qalcosonic/w1e", "1")
+	is.True(ok)
+	is.Equal(v, "qalcosonic/w1e@1")
+
+	v, ok = reg.Pin("qalcosonic/w1e@2", " 1 ")
+	is.True(ok)
+	is.Equal(v, "qalcosonic/w1e@1") // the version of the device replaces the version of the profile
+
+	for _, version := range []string{"3", "0", "one", ""} {
+		v, ok = reg.Pin("qalcosonic/w1e@2", version)
+		is.True(!ok)
+		is.Equal(v, "qalcosonic/w1e@2")
+	}
+
+	_, ok = reg.Pin("unknown", "1")
+	is.True(!ok)
+}
+
+func TestRegistryInstrumentsUseSensorTypeAttribute(t *testing.T) {
+	is, _ := testSetup(t)
+	ctx := context.Background()
+
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	r := newRegistrations()
+	is.NoErr(r.register("sensor", testDecoder("failed"), testConverter, WithDeprecated("old")))
+	is.NoErr(r.register("other", func(ctx context.Context, e types.Event) (types.SensorPayload, error) { return nil, nil }, testConverter))
+
+	reg := newRegistry(r)
+
+	for _, name := range []string{"sensor", "old", "other", "other"} {
+		d, c, _ := reg.Get(ctx, name)
+		p, _ := d(ctx, types.Event{})
+		c(ctx, "device", p, time.Now())
+	}
+
+	var rm metricdata.ResourceMetrics
+	is.NoErr(reader.Collect(ctx, &rm))
+
+	sums := map[string]map[string]int64{}
+	histograms := map[string]map[string]uint64{}
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				sums[m.Name] = map[string]int64{}
+				for _, dp := range data.DataPoints {
+					v, _ := dp.Attributes.Value("sensor_type")
+					sums[m.Name][v.AsString()] = dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				histograms[m.Name] = map[string]uint64{}
+				for _, dp := range data.DataPoints {
+					v, _ := dp.Attributes.Value("sensor_type")
+					histograms[m.Name][v.AsString()] = dp.Count
+				}
+			}
+		}
+	}
+
+	is.Equal(sums["diwise.decoding.errors.total"], map[string]int64{"sensor": 2})
+	is.Equal(sums["diwise.decoding.total"], map[string]int64{"other": 2})
+	is.Equal(sums["diwise.decoding.deprecated.total"], map[string]int64{"old": 1})
+	is.Equal(histograms["diwise.decoding.duration"], map[string]uint64{"sensor": 2, "other": 2})
+	is.Equal(histograms["diwise.converting.duration"], map[string]uint64{"sensor": 2, "other": 2})
+}
+
+func testDecoder(msg string) DecoderFunc {
+	return func(ctx context.Context, e types.Event) (types.SensorPayload, error) {
+		return nil, errors.New(msg)
+	}
+}
+
+func testConverter(ctx context.Context, deviceID string, payload types.SensorPayload, ts time.Time) ([]lwm2m.Lwm2mObject, error) {
+	return nil, nil
+}
+
 func testSetup(t *testing.T) (*is.I, *slog.Logger) {
 	is := is.New(t)
 	return is, slog.New(slog.NewTextHandler(io.Discard, nil))
@@ -8,6 +8,7 @@ import (
 	"slices"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
@@ -58,6 +59,19 @@ func (a ElsysPayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	urns := decoders.WithURNs(
+		lwm2m.Device{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN(), lwm2m.Humidity{}.ObjectURN(), lwm2m.Illuminance{}.ObjectURN(),
+		lwm2m.AirQuality{}.ObjectURN(), lwm2m.Presence{}.ObjectURN(), lwm2m.Loudness{}.ObjectURN(), lwm2m.DigitalInput{}.ObjectURN(),
+	)
+
+	decoders.Register("elsys", Decoder, Converter, urns,
+		decoders.WithAliases("elt_2_hp"),
+		decoders.WithDeprecated("elsys_codec"),
+	)
+	decoders.Register("elsys/elt/sht3x", Decoder, ConverterEltSht3x, urns)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	var p ElsysPayload
 	var err error
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
@@ -33,6 +34,13 @@ func (a MilesightPayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("milesight", Decoder, Converter,
+		decoders.WithDeprecated("milesight_am100"),
+		decoders.WithURNs(lwm2m.Device{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN(), lwm2m.Humidity{}.ObjectURN(), lwm2m.AirQuality{}.ObjectURN(), lwm2m.Distance{}.ObjectURN(), lwm2m.DigitalInput{}.ObjectURN()),
+	)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	return decode(e.Payload.Data)
 }
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
@@ -25,6 +26,12 @@ func (a NiabPayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("niab-fls", Decoder, Converter,
+		decoders.WithURNs(lwm2m.Device{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN(), lwm2m.Distance{}.ObjectURN()),
+	)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	return decode(e.Payload.Object)
 }
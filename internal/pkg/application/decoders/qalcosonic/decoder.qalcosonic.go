@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
@@ -71,6 +72,15 @@ type Value struct {
 	Timestamp time.Time
 }
 
+func init() {
+	urns := decoders.WithURNs(lwm2m.WaterMeter{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN())
+
+	decoders.Register("qalcosonic", Decoder, Converter, urns)
+	decoders.Register("qalcosonic/w1t", DecoderW1t, Converter, urns)
+	decoders.Register("qalcosonic/w1h", DecoderW1h, Converter, urns)
+	decoders.Register("qalcosonic/w1e", DecoderW1e, Converter, urns)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	var err error
 
@@ -3,27 +3,20 @@ package decoders
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/airquality"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/axsensor"
 	"github.com/diwise/iot-agent/internal/pkg/application/decoders/defaultdecoder"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/elsys"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/enviot"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/milesight"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/niab"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/qalcosonic"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/senlabt"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/sensative"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/sensefarm"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/talkpool"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/vegapuls"
-	"github.com/diwise/iot-agent/internal/pkg/application/decoders/x2climate"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
@@ -32,142 +25,402 @@ type ConverterFunc func(ctx context.Context, deviceID string, payload types.Sens
 
 type Registry interface {
 	Get(ctx context.Context, sensorType string) (DecoderFunc, ConverterFunc, bool)
+	Resolve(sensorType string) (string, bool)
+	Pin(sensorType, version string) (string, bool)
+	List() []Info
 }
 
-type registryImpl struct {
-	decoders   map[string]DecoderFunc
-	converters map[string]ConverterFunc
+// A sensor type may be pinned to a specific decoder version by appending @<version>
+// to its name, e.g. qalcosonic/w1e@1. Without a version the current one is used.
+const versionSeparator string = "@"
+
+// VersionMetadataKey is the key of the device metadata that pins a single device to a decoder
+// version, e.g. 1, regardless of the version of the sensor type of its profile.
+const VersionMetadataKey string = "decoder-version"
+
+// Info describes a registered sensor type, the alternative names it can be
+// referred to by and the LwM2M objects its converter is able to emit.
+type Info struct {
+	SensorType string   `json:"sensorType"`
+	Version    int      `json:"version"`
+	Versions   []int    `json:"versions,omitempty"`
+	Aliases    []string `json:"aliases,omitempty"`
+	Deprecated []string `json:"deprecated,omitempty"`
+	URNs       []string `json:"urns"`
 }
 
-func NewRegistry() Registry {
-	decoders := map[string]DecoderFunc{
-		"airquality": airquality.Decoder,
-		"axsensor":   axsensor.Decoder,
-		"enviot":     enviot.Decoder,
-		"niab-fls":   niab.Decoder,
+type registration struct {
+	name       string
+	version    int
+	decoder    DecoderFunc
+	converter  ConverterFunc
+	aliases    []string
+	deprecated []string
+	urns       []string
+}
 
-		"qalcosonic":     qalcosonic.Decoder,
-		"qalcosonic/w1t": qalcosonic.DecoderW1t,
-		"qalcosonic/w1h": qalcosonic.DecoderW1h,
-		"qalcosonic/w1e": qalcosonic.DecoderW1e,
+type RegistrationOption func(*registration)
 
-		"vegapuls_air_41": vegapuls.Decoder,
+// WithAliases adds alternative names that the sensor type can be referred to by.
+func WithAliases(aliases ...string) RegistrationOption {
+	return func(r *registration) {
+		r.aliases = append(r.aliases, aliases...)
+	}
+}
 
-		"elt_2_hp":        elsys.Decoder,
-		"elsys":           elsys.Decoder,
-		"elsys/elt/sht3x": elsys.Decoder,
-		"elsys_codec":     elsys.Decoder, // deprecated, use elsys
+// WithDeprecated adds alternative names that are still supported but should be replaced by
+// the name of the sensor type. Every use of a deprecated name is logged and counted.
+func WithDeprecated(names ...string) RegistrationOption {
+	return func(r *registration) {
+		r.deprecated = append(r.deprecated, names...)
+	}
+}
 
-		"milesight":       milesight.Decoder,
-		"milesight_am100": milesight.Decoder, // deprecated, use milesight
+// WithURNs declares the LwM2M objects that the converter is able to emit.
+func WithURNs(urns ...string) RegistrationOption {
+	return func(r *registration) {
+		r.urns = append(r.urns, urns...)
+	}
+}
 
-		"senlabt":      senlabt.Decoder,
-		"tem_lab_14ns": senlabt.Decoder, // deprecated, use senlabt
+// WithVersion registers the decoder as a specific version of the sensor type. The highest
+// registered version of a sensor type is the current one. Defaults to version 1.
+func WithVersion(version int) RegistrationOption {
+	return func(r *registration) {
+		r.version = version
+	}
+}
 
-		"sensefarm": sensefarm.Decoder,
-		"cube02":    sensefarm.Decoder, // deprecated, use sensefarm
+type alias struct {
+	name       string
+	deprecated bool
+}
 
-		"sensative":        sensative.Decoder,
-		"strips_lora_ms_h": sensative.Decoder, // deprecated, use sensative
-		"presence":         sensative.Decoder, // deprecated, use sensative
+type registrations struct {
+	mu      sync.Mutex
+	entries map[string]map[int]registration
+	aliases map[string]alias
+}
 
-		"talkpool/oy1210": talkpool.DecoderOy1210,
+func newRegistrations() *registrations {
+	return &registrations{
+		entries: map[string]map[int]registration{},
+		aliases: map[string]alias{},
+	}
+}
 
-		"x2climate": x2climate.DecoderX2Climate,
+var builtin = newRegistrations()
+
+// Register makes a decoder and its converter available to registries created by NewRegistry.
+// It is intended to be called from the init function of the package implementing the decoder
+// and panics if the registration is incomplete or any of its names are already taken.
+func Register(name string, decoder DecoderFunc, converter ConverterFunc, options ...RegistrationOption) {
+	if err := builtin.register(name, decoder, converter, options...); err != nil {
+		panic(err)
 	}
+}
 
-	converters := map[string]ConverterFunc{
-		"airquality": airquality.Converter,
-		"axsensor":   axsensor.Converter,
-		"enviot":     enviot.Converter,
-		"niab-fls":   niab.Converter,
+func (r *registrations) register(name string, decoder DecoderFunc, converter ConverterFunc, options ...RegistrationOption) error {
+	reg := registration{
+		name:      strings.ToLower(name),
+		version:   1,
+		decoder:   decoder,
+		converter: converter,
+	}
 
-		"qalcosonic":     qalcosonic.Converter,
-		"qalcosonic/w1t": qalcosonic.Converter,
-		"qalcosonic/w1h": qalcosonic.Converter,
-		"qalcosonic/w1e": qalcosonic.Converter,
+	for _, apply := range options {
+		apply(&reg)
+	}
 
-		"vegapuls_air_41": vegapuls.Converter,
+	if reg.name == "" || strings.Contains(reg.name, versionSeparator) {
+		return fmt.Errorf("decoders: invalid sensor type name %q", name)
+	}
 
-		"elt_2_hp":        elsys.Converter,
-		"elsys":           elsys.Converter,
-		"elsys/elt/sht3x": elsys.ConverterEltSht3x,
-		"elsys_codec":     elsys.Converter, // deprecated, use elsys
+	if reg.decoder == nil || reg.converter == nil {
+		return fmt.Errorf("decoders: %s must be registered with both a decoder and a converter", reg.name)
+	}
 
-		"milesight":       milesight.Converter,
-		"milesight_am100": milesight.Converter, // deprecated, use milesight
+	if reg.version < 1 {
+		return fmt.Errorf("decoders: invalid version %d for %s", reg.version, reg.name)
+	}
 
-		"senlabt":      senlabt.Converter,
-		"tem_lab_14ns": senlabt.Converter, // deprecated, use senlabt
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-		"sensefarm": sensefarm.Converter,
-		"cube02":    sensefarm.Converter, // deprecated, use sensefarm
+	if _, ok := r.aliases[reg.name]; ok {
+		return fmt.Errorf("decoders: %s is already registered as an alias", reg.name)
+	}
 
-		"sensative":        sensative.Converter,
-		"strips_lora_ms_h": sensative.Converter, // deprecated, use sensative
-		"presence":         sensative.Converter, // deprecated, use sensative
+	if _, ok := r.entries[reg.name][reg.version]; ok {
+		return fmt.Errorf("decoders: %s%s%d is already registered", reg.name, versionSeparator, reg.version)
+	}
 
-		"talkpool/oy1210": talkpool.ConverterOy1210,
+	names := map[string]alias{}
+	for _, a := range reg.aliases {
+		names[strings.ToLower(a)] = alias{name: reg.name}
+	}
+	for _, d := range reg.deprecated {
+		names[strings.ToLower(d)] = alias{name: reg.name, deprecated: true}
+	}
 
-		"x2climate": x2climate.ConverterX2Climate,
+	for n, a := range names {
+		if _, ok := r.entries[n]; ok || n == reg.name {
+			return fmt.Errorf("decoders: alias %s of %s is already registered as a sensor type", n, reg.name)
+		}
+		if existing, ok := r.aliases[n]; ok && existing != a {
+			return fmt.Errorf("decoders: alias %s of %s is already registered for %s", n, reg.name, existing.name)
+		}
 	}
 
-	return &registryImpl{
-		decoders:   decoders,
-		converters: converters,
+	if _, ok := r.entries[reg.name]; !ok {
+		r.entries[reg.name] = map[int]registration{}
 	}
+
+	r.entries[reg.name][reg.version] = reg
+	maps.Copy(r.aliases, names)
+
+	return nil
 }
 
-func (c *registryImpl) Get(ctx context.Context, sensorType string) (DecoderFunc, ConverterFunc, bool) {
+type registryImpl struct {
+	entries map[string]map[int]registration
+	current map[string]int
+	aliases map[string]alias
+
+	instruments instruments
+}
+
+// instruments are created once per registry and shared by all decoders. The sensor type is
+// added as an attribute rather than being part of the metric name.
+type instruments struct {
+	decodeCounter     metric.Int64Counter
+	errCounter        metric.Int64Counter
+	deprecatedCounter metric.Int64Counter
+	decodeDuration    metric.Float64Histogram
+	convertDuration   metric.Float64Histogram
+}
 
-	log := logging.GetFromContext(ctx)
+func newInstruments() instruments {
+	meter := otel.Meter("iot-agent/decoding")
+	logErr := func(name string, err error) {
+		if err != nil {
+			slog.Default().Error("failed to create otel instrument", "name", name, "err", err.Error())
+		}
+	}
+
+	var i instruments
+	var err error
+
+	i.decodeCounter, err = meter.Int64Counter(
+		"diwise.decoding.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of decoded payloads"),
+	)
+	logErr("diwise.decoding.total", err)
 
-	errCounter, err := otel.Meter("iot-agent/decoding").Int64Counter(
+	i.errCounter, err = meter.Int64Counter(
 		"diwise.decoding.errors.total",
 		metric.WithUnit("1"),
 		metric.WithDescription("Total number of errors"),
 	)
+	logErr("diwise.decoding.errors.total", err)
 
-	if err != nil {
-		log.Error("failed to create otel message counter", "err", err.Error())
+	i.deprecatedCounter, err = meter.Int64Counter(
+		"diwise.decoding.deprecated.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of lookups using a deprecated sensor type name"),
+	)
+	logErr("diwise.decoding.deprecated.total", err)
+
+	i.decodeDuration, err = meter.Float64Histogram(
+		"diwise.decoding.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time spent decoding payloads"),
+	)
+	logErr("diwise.decoding.duration", err)
+
+	i.convertDuration, err = meter.Float64Histogram(
+		"diwise.converting.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time spent converting decoded payloads to lwm2m objects"),
+	)
+	logErr("diwise.converting.duration", err)
+
+	return i
+}
+
+// NewRegistry returns a registry with all decoders that have been registered using Register.
+func NewRegistry() Registry {
+	return newRegistry(builtin)
+}
+
+func newRegistry(r *registrations) *registryImpl {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := &registryImpl{
+		entries:     make(map[string]map[int]registration, len(r.entries)),
+		current:     make(map[string]int, len(r.entries)),
+		aliases:     maps.Clone(r.aliases),
+		instruments: newInstruments(),
 	}
 
-	decoder := func(fn DecoderFunc) DecoderFunc {
-		messageCounter, err := otel.Meter("iot-agent/decoding").Int64Counter(
-			"diwise.decoding."+sensorType+".total",
-			metric.WithUnit("1"),
-			metric.WithDescription(fmt.Sprintf("Total number of decoded %s payloads", sensorType)),
-		)
+	for name, versions := range r.entries {
+		c.entries[name] = maps.Clone(versions)
+		c.current[name] = slices.Max(slices.Collect(maps.Keys(versions)))
+	}
 
-		if err != nil {
-			log.Error("failed to create otel message counter", "err", err.Error())
+	return c
+}
+
+func (c *registryImpl) List() []Info {
+	info := make([]Info, 0, len(c.entries))
+
+	aliases := map[string][]string{}
+	deprecated := map[string][]string{}
+
+	for n, a := range c.aliases {
+		if a.deprecated {
+			deprecated[a.name] = append(deprecated[a.name], n)
+		} else {
+			aliases[a.name] = append(aliases[a.name], n)
 		}
+	}
 
-		return func(ctx context.Context, e types.Event) (types.SensorPayload, error) {
-			p, err := fn(ctx, e)
-			if err != nil {
-				errCounter.Add(ctx, 1)
-				return nil, err
-			}
+	for name, versions := range c.entries {
+		current := c.current[name]
 
-			messageCounter.Add(ctx, 1)
-			return p, nil
+		i := Info{
+			SensorType: name,
+			Version:    current,
+			Aliases:    aliases[name],
+			Deprecated: deprecated[name],
+			URNs:       versions[current].urns,
 		}
+
+		for v := range versions {
+			if v != current {
+				i.Versions = append(i.Versions, v)
+			}
+		}
+
+		slices.Sort(i.Versions)
+		slices.Sort(i.Aliases)
+		slices.Sort(i.Deprecated)
+
+		info = append(info, i)
+	}
+
+	slices.SortFunc(info, func(a, b Info) int { return strings.Compare(a.SensorType, b.SensorType) })
+
+	return info
+}
+
+// Resolve returns the name and version, formatted as name@version, of the decoder that Get
+// would use for sensorType.
+func (c *registryImpl) Resolve(sensorType string) (string, bool) {
+	reg, _, ok := c.lookup(sensorType)
+	if !ok {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s%s%d", reg.name, versionSeparator, reg.version), true
+}
+
+// Pin returns sensorType pinned to version, replacing any version that the sensor type is
+// already pinned to, and reports whether the version is registered. The sensor type is returned
+// unchanged if it is not.
+func (c *registryImpl) Pin(sensorType, version string) (string, bool) {
+	name, _, _ := strings.Cut(sensorType, versionSeparator)
+	pinned := name + versionSeparator + strings.TrimSpace(version)
+
+	if _, _, ok := c.lookup(pinned); !ok {
+		return sensorType, false
+	}
+
+	return pinned, true
+}
+
+// lookup finds the registration for a sensor type, alias or deprecated name with an optional
+// version suffix. The returned string is the name that was used if it is deprecated.
+func (c *registryImpl) lookup(sensorType string) (registration, string, bool) {
+	name, version, err := splitVersion(strings.ToLower(sensorType))
+	if err != nil {
+		return registration{}, "", false
 	}
 
-	converter := func(fn ConverterFunc) ConverterFunc {
-		return func(ctx context.Context, deviceID string, payload types.SensorPayload, ts time.Time) ([]lwm2m.Lwm2mObject, error) {
-			return fn(ctx, deviceID, payload, ts)
+	deprecatedName := ""
+
+	if a, ok := c.aliases[name]; ok {
+		if a.deprecated {
+			deprecatedName = name
 		}
+		name = a.name
 	}
 
-	if d, ok := c.decoders[strings.ToLower(sensorType)]; ok {
-		if c, ok := c.converters[strings.ToLower(sensorType)]; ok {
-			return decoder(d), converter(c), true
-		} else {
-			return decoder(d), converter(defaultdecoder.Converter), false
+	versions, ok := c.entries[name]
+	if !ok {
+		return registration{}, "", false
+	}
+
+	if version == 0 {
+		version = c.current[name]
+	}
+
+	reg, ok := versions[version]
+
+	return reg, deprecatedName, ok
+}
+
+func splitVersion(sensorType string) (string, int, error) {
+	name, v, found := strings.Cut(sensorType, versionSeparator)
+	if !found {
+		return sensorType, 0, nil
+	}
+
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return name, 0, fmt.Errorf("invalid decoder version %q", v)
+	}
+
+	return name, version, nil
+}
+
+func (c *registryImpl) Get(ctx context.Context, sensorType string) (DecoderFunc, ConverterFunc, bool) {
+	reg, deprecatedName, found := c.lookup(sensorType)
+	if !found {
+		return defaultdecoder.Decoder, defaultdecoder.Converter, false
+	}
+
+	attrs := metric.WithAttributes(attribute.String("sensor_type", reg.name))
+
+	if deprecatedName != "" {
+		logging.GetFromContext(ctx).Warn("deprecated sensor type used", "sensor_type", deprecatedName, "replaced_by", reg.name)
+		c.instruments.deprecatedCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("sensor_type", deprecatedName)))
+	}
+
+	decoder := func(ctx context.Context, e types.Event) (types.SensorPayload, error) {
+		start := time.Now()
+		p, err := reg.decoder(ctx, e)
+		c.instruments.decodeDuration.Record(ctx, time.Since(start).Seconds(), attrs)
+
+		if err != nil {
+			c.instruments.errCounter.Add(ctx, 1, attrs)
+			return nil, err
 		}
+
+		c.instruments.decodeCounter.Add(ctx, 1, attrs)
+		return p, nil
+	}
+
+	converter := func(ctx context.Context, deviceID string, payload types.SensorPayload, ts time.Time) ([]lwm2m.Lwm2mObject, error) {
+		start := time.Now()
+		defer func() {
+			c.instruments.convertDuration.Record(ctx, time.Since(start).Seconds(), attrs)
+		}()
+
+		return reg.converter(ctx, deviceID, payload, ts)
 	}
 
-	return defaultdecoder.Decoder, defaultdecoder.Converter, false
+	return decoder, converter, true
 }
@@ -8,6 +8,7 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
@@ -26,6 +27,13 @@ func (a SenlabPayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("senlabt", Decoder, Converter,
+		decoders.WithDeprecated("tem_lab_14ns"),
+		decoders.WithURNs(lwm2m.Device{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN()),
+	)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	var d SenlabPayload
 
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
@@ -29,6 +30,13 @@ func (a SensativePayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("sensative", Decoder, Converter,
+		decoders.WithDeprecated("strips_lora_ms_h", "presence"),
+		decoders.WithURNs(lwm2m.Device{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN(), lwm2m.Humidity{}.ObjectURN(), lwm2m.DigitalInput{}.ObjectURN(), lwm2m.Presence{}.ObjectURN()),
+	)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	if e.Payload == nil {
 		return nil, types.ErrPayloadContainsNoData
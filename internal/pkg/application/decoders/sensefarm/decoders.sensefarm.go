@@ -8,6 +8,7 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
@@ -30,6 +31,13 @@ func (a SensefarmPayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("sensefarm", Decoder, Converter,
+		decoders.WithDeprecated("cube02"),
+		decoders.WithURNs(lwm2m.Device{}.ObjectURN(), lwm2m.Conductivity{}.ObjectURN(), lwm2m.Pressure{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN()),
+	)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	// At minimum we must receive 2 bytes, one for header type and one for value
 	if len(e.Payload.Data) < 2 {
@@ -5,6 +5,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 )
@@ -22,6 +23,12 @@ func (a Oy1210Data) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("talkpool/oy1210", DecoderOy1210, ConverterOy1210,
+		decoders.WithURNs(lwm2m.Temperature{}.ObjectURN(), lwm2m.Humidity{}.ObjectURN(), lwm2m.AirQuality{}.ObjectURN()),
+	)
+}
+
 func DecoderOy1210(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	p, err := decodeOy1210Payload(e.Payload.Data, e.Payload.FPort)
 	if err != nil {
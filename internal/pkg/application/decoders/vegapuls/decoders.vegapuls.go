@@ -8,6 +8,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
@@ -58,6 +59,12 @@ func (a VegapulsPayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("vegapuls_air_41", Decoder, Converter,
+		decoders.WithURNs(lwm2m.Device{}.ObjectURN(), lwm2m.Distance{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN()),
+	)
+}
+
 func Decoder(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	return decode(e.Payload.Data)
 }
@@ -6,6 +6,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 )
@@ -29,6 +30,12 @@ func (p X2ClimatePayload) Error() (string, []string) {
 	return "", []string{}
 }
 
+func init() {
+	decoders.Register("x2climate", DecoderX2Climate, ConverterX2Climate,
+		decoders.WithURNs(lwm2m.Device{}.ObjectURN(), lwm2m.Temperature{}.ObjectURN(), lwm2m.Humidity{}.ObjectURN()),
+	)
+}
+
 func DecoderX2Climate(ctx context.Context, e types.Event) (types.SensorPayload, error) {
 	if e.Payload.FPort != 2 {
 		return nil, types.ErrInvalidFPort
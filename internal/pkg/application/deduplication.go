@@ -0,0 +1,176 @@
+package application
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// deduplicator keeps track of recently handled uplinks so that the same uplink, received through
+// mqtt redeliveries, http retries or several network server integrations, is only handled once.
+type deduplicator struct {
+	window time.Duration
+
+	seen      map[string]time.Time
+	inFlight  map[string]*inFlightUplink
+	seenMu    sync.Mutex
+	lastPrune time.Time
+
+	suppressedCounter metric.Int64Counter
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	suppressedCounter, err := otel.Meter("iot-agent/deduplication").Int64Counter(
+		"diwise.deduplication.suppressed.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of suppressed duplicate uplinks"),
+	)
+
+	if err != nil {
+		slog.Default().Error("failed to create otel suppressed counter", "err", err.Error())
+	}
+
+	return &deduplicator{
+		window:            window,
+		seen:              make(map[string]time.Time),
+		inFlight:          make(map[string]*inFlightUplink),
+		lastPrune:         time.Now(),
+		suppressedCounter: suppressedCounter,
+	}
+}
+
+// inFlightUplink is an uplink that is being handled. done is closed when the handling has
+// finished.
+type inFlightUplink struct {
+	done chan struct{}
+}
+
+// seenBefore reports whether the event has already been handled within the deduplication window.
+// If the same uplink is being handled, it waits for the outcome: the event is a duplicate if the
+// uplink was handled, and is handled instead if handling the uplink failed. An error is returned
+// if the context is done while waiting. If the event is not a duplicate, the returned function
+// must be called with the outcome of handling it, so that the event is remembered if it was
+// handled, or accepted again when it is retried if it failed.
+func (d *deduplicator) seenBefore(ctx context.Context, se types.Event) (bool, func(error), error) {
+	keys := deduplicationKeys(se)
+	if len(keys) == 0 {
+		return false, func(error) {}, nil
+	}
+
+	for {
+		now := time.Now()
+
+		d.seenMu.Lock()
+		d.prune(now)
+
+		for _, key := range keys {
+			if expires, ok := d.seen[key]; ok && now.Before(expires) {
+				d.seenMu.Unlock()
+				d.suppressedCounter.Add(ctx, 1)
+				return true, func(error) {}, nil
+			}
+		}
+
+		var pending *inFlightUplink
+		for _, key := range keys {
+			if u, ok := d.inFlight[key]; ok {
+				pending = u
+				break
+			}
+		}
+
+		if pending == nil {
+			u := &inFlightUplink{done: make(chan struct{})}
+			for _, key := range keys {
+				d.inFlight[key] = u
+			}
+			d.seenMu.Unlock()
+
+			return false, func(err error) { d.finish(keys, u, err) }, nil
+		}
+
+		d.seenMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false, func(error) {}, ctx.Err()
+		case <-pending.done:
+		}
+	}
+}
+
+// finish remembers the keys of an uplink that was handled, and wakes up the duplicates that are
+// waiting for it.
+func (d *deduplicator) finish(keys []string, u *inFlightUplink, err error) {
+	d.seenMu.Lock()
+	defer d.seenMu.Unlock()
+
+	expires := time.Now().Add(d.window)
+
+	for _, key := range keys {
+		if d.inFlight[key] == u {
+			delete(d.inFlight, key)
+		}
+		if err == nil {
+			d.seen[key] = expires
+		}
+	}
+
+	close(u.done)
+}
+
+func (d *deduplicator) prune(now time.Time) {
+	if now.Sub(d.lastPrune) < d.window {
+		return
+	}
+
+	for key, expires := range d.seen {
+		if now.After(expires) {
+			delete(d.seen, key)
+		}
+	}
+
+	d.lastPrune = now
+}
+
+// deduplicationKeys returns the keys that identify an uplink. The ChirpStack v4 deduplicationId is
+// used when present, along with a key based on DevEUI, frame counter and a hash of the payload so that
+// the same uplink received through another integration is detected as well. Sources that do not
+// report a frame counter have their timestamp used instead.
+func deduplicationKeys(se types.Event) []string {
+	if se.Payload == nil || se.DevEUI == "" {
+		return nil
+	}
+
+	keys := make([]string, 0, 2)
+
+	if se.DeduplicationID != "" {
+		keys = append(keys, "id:"+se.DeduplicationID)
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%d:", se.Payload.FPort)
+	if len(se.Payload.Data) > 0 {
+		h.Write(se.Payload.Data)
+	} else {
+		h.Write(se.Payload.Object)
+	}
+
+	counter := fmt.Sprintf("%d", se.FCnt)
+	if se.FCnt == 0 {
+		counter = se.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	keys = append(keys, fmt.Sprintf("uplink:%s:%s:%s", strings.ToLower(se.DevEUI), counter, hex.EncodeToString(h.Sum(nil))))
+
+	return keys
+}
@@ -0,0 +1,140 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/storage"
+	"github.com/diwise/iot-device-mgmt/pkg/client"
+	"github.com/matryer/is"
+)
+
+func TestDuplicateUplinkIsSuppressed(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	agent := New(dmc, e, s, true, "default", map[string]DeviceProfileConfig{}, WithDeduplication(time.Minute))
+	ue, _ := facades.New("servanet")(ctx, "up", []byte(elsys))
+
+	is.NoErr(agent.HandleSensorEvent(ctx, ue))
+	sent := len(e.SendCommandToCalls())
+	is.True(sent > 0)
+
+	is.NoErr(agent.HandleSensorEvent(ctx, ue))
+	is.Equal(len(e.SendCommandToCalls()), sent) // the duplicate should not be sent again
+	is.Equal(len(s.(*storage.StorageMock).SaveCalls()), 1)
+}
+
+func TestUplinkIsHandledAgainAfterFailure(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	dmc.FindDeviceFromDevEUIFunc = func(ctx context.Context, devEUI string) (client.Device, error) {
+		return nil, errors.New("device management unavailable")
+	}
+
+	agent := New(dmc, e, s, false, "default", map[string]DeviceProfileConfig{}, WithDeduplication(time.Minute))
+	ue, _ := facades.New("servanet")(ctx, "up", []byte(elsys))
+
+	is.True(agent.HandleSensorEvent(ctx, ue) != nil)
+	is.True(agent.HandleSensorEvent(ctx, ue) != nil) // a retry should not be suppressed if the first attempt failed
+	is.Equal(len(dmc.FindDeviceFromDevEUICalls()), 2)
+}
+
+func TestDeduplicationKeys(t *testing.T) {
+	is := is.New(t)
+
+	ts := time.Date(2024, 8, 5, 11, 23, 45, 0, time.UTC)
+	evt := func(devEUI string, fcnt int, data string) types.Event {
+		return types.Event{DevEUI: devEUI, FCnt: fcnt, Payload: &types.Payload{FPort: 5, Data: []byte(data)}, Timestamp: ts}
+	}
+
+	is.Equal(deduplicationKeys(evt("a81758fffe05e6fb", 1, "abc")), deduplicationKeys(evt("A81758FFFE05E6FB", 1, "abc")))
+	is.True(deduplicationKeys(evt("a81758fffe05e6fb", 1, "abc"))[0] != deduplicationKeys(evt("a81758fffe05e6fb", 2, "abc"))[0])
+	is.True(deduplicationKeys(evt("a81758fffe05e6fb", 1, "abc"))[0] != deduplicationKeys(evt("a81758fffe05e6fb", 1, "abd"))[0])
+	is.Equal(len(deduplicationKeys(types.Event{DevEUI: "a81758fffe05e6fb"})), 0) // nothing to deduplicate without a payload
+
+	withID := evt("a81758fffe05e6fb", 1, "abc")
+	withID.DeduplicationID = "3c0c9f3e-8f0c-4c2a-9c8e-1a1b2c3d4e5f"
+	is.Equal(deduplicationKeys(withID)[0], "id:3c0c9f3e-8f0c-4c2a-9c8e-1a1b2c3d4e5f")
+	is.Equal(len(deduplicationKeys(withID)), 2)
+}
+
+func TestDeduplicationWindowExpires(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	d := newDeduplicator(10 * time.Millisecond)
+	se := types.Event{DevEUI: "a81758fffe05e6fb", FCnt: 1, Payload: &types.Payload{FPort: 5, Data: []byte{1, 2, 3}}}
+
+	duplicate, done, _ := d.seenBefore(ctx, se)
+	is.True(!duplicate)
+	done(nil)
+
+	duplicate, _, _ = d.seenBefore(ctx, se)
+	is.True(duplicate)
+
+	time.Sleep(20 * time.Millisecond)
+
+	duplicate, _, _ = d.seenBefore(ctx, se)
+	is.True(!duplicate)
+}
+
+func TestDuplicateWaitsForUplinkInFlight(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	d := newDeduplicator(time.Minute)
+	se := types.Event{DevEUI: "a81758fffe05e6fb", FCnt: 1, Payload: &types.Payload{FPort: 5, Data: []byte{1, 2, 3}}}
+
+	wait := func() chan bool {
+		result := make(chan bool, 1)
+		go func() {
+			duplicate, done, _ := d.seenBefore(ctx, se)
+			done(nil)
+			result <- duplicate
+		}()
+		return result
+	}
+
+	_, done, _ := d.seenBefore(ctx, se)
+	result := wait()
+
+	select {
+	case <-result:
+		t.Fatal("expected the duplicate to wait while the first copy is being handled")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	done(errors.New("iot-core is unavailable"))
+	is.True(!<-result) // the duplicate should be handled when the first copy failed
+
+	duplicate, _, _ := d.seenBefore(ctx, se)
+	is.True(duplicate)
+}
+
+func TestDuplicateIsSuppressedWhenUplinkInFlightIsHandled(t *testing.T) {
+	is := is.New(t)
+
+	d := newDeduplicator(time.Minute)
+	se := types.Event{DevEUI: "a81758fffe05e6fb", FCnt: 1, Payload: &types.Payload{FPort: 5, Data: []byte{1, 2, 3}}}
+
+	_, done, _ := d.seenBefore(context.Background(), se)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, _, err := d.seenBefore(ctx, se)
+	is.True(errors.Is(err, context.DeadlineExceeded)) // a duplicate that can not wait should be retried
+
+	result := make(chan bool, 1)
+	go func() {
+		duplicate, _, _ := d.seenBefore(context.Background(), se)
+		result <- duplicate
+	}()
+
+	done(nil)
+	is.True(<-result)
+}
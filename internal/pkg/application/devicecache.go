@@ -0,0 +1,242 @@
+package application
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	dmc "github.com/diwise/iot-device-mgmt/pkg/client"
+	dmtypes "github.com/diwise/iot-device-mgmt/pkg/types"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	deviceCacheRefreshTimeout = 10 * time.Second
+)
+
+// DeviceCacheConfig configures the device cache in front of device management.
+type DeviceCacheConfig struct {
+	// TTL is how long a cached device is used before it is looked up again.
+	TTL time.Duration
+	// MaxStale is how long an expired device may still be used while device management
+	// can not be reached.
+	MaxStale time.Duration
+	// Size is the maximum number of cached lookups. The least recently used are evicted first.
+	Size int
+}
+
+type cachedDevice struct {
+	key     string
+	device  dmc.Device
+	fetched time.Time
+}
+
+// DeviceCache wraps a device management client and caches devices found by DevEUI or internal id.
+// Expired devices are returned while they are refreshed in the background, and are kept if the
+// refresh fails so that measurements are not lost while device management is unavailable.
+type DeviceCache struct {
+	dmc.DeviceManagementClient
+
+	cfg DeviceCacheConfig
+
+	entries    map[string]*list.Element
+	lru        *list.List
+	refreshing map[string]bool
+	mu         sync.Mutex
+
+	lookupCounter metric.Int64Counter
+}
+
+func NewDeviceCache(client dmc.DeviceManagementClient, cfg DeviceCacheConfig) *DeviceCache {
+	lookupCounter, err := otel.Meter("iot-agent/devicecache").Int64Counter(
+		"diwise.devicecache.lookups.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of device lookups by result (hit, stale or miss)"),
+	)
+
+	if err != nil {
+		slog.Default().Error("failed to create otel lookup counter", "err", err.Error())
+	}
+
+	if cfg.Size < 1 {
+		cfg.Size = 1
+	}
+
+	return &DeviceCache{
+		DeviceManagementClient: client,
+		cfg:                    cfg,
+		entries:                make(map[string]*list.Element),
+		lru:                    list.New(),
+		refreshing:             make(map[string]bool),
+		lookupCounter:          lookupCounter,
+	}
+}
+
+func (c *DeviceCache) FindDeviceFromDevEUI(ctx context.Context, devEUI string) (dmc.Device, error) {
+	return c.find(ctx, "deveui:"+strings.ToLower(devEUI), devEUI, c.DeviceManagementClient.FindDeviceFromDevEUI)
+}
+
+func (c *DeviceCache) FindDeviceFromInternalID(ctx context.Context, deviceID string) (dmc.Device, error) {
+	return c.find(ctx, "id:"+deviceID, deviceID, c.DeviceManagementClient.FindDeviceFromInternalID)
+}
+
+type deviceFinder func(ctx context.Context, id string) (dmc.Device, error)
+
+func (c *DeviceCache) find(ctx context.Context, key, id string, finder deviceFinder) (dmc.Device, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.get(key)
+	c.mu.Unlock()
+
+	if ok {
+		age := now.Sub(entry.fetched)
+
+		if age < c.cfg.TTL {
+			c.count(ctx, "hit")
+			return entry.device, nil
+		}
+
+		if age < c.cfg.TTL+c.cfg.MaxStale {
+			c.count(ctx, "stale")
+			c.refresh(ctx, key, id, finder)
+			return entry.device, nil
+		}
+	}
+
+	c.count(ctx, "miss")
+
+	device, err := finder(ctx, id)
+	if err != nil {
+		if errors.Is(err, dmc.ErrNotFound) {
+			c.remove(key)
+		}
+		return nil, err
+	}
+
+	c.put(key, device, now)
+
+	return device, nil
+}
+
+// refresh looks up an expired device in the background, unless it is already being refreshed.
+func (c *DeviceCache) refresh(ctx context.Context, key, id string, finder deviceFinder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refreshing[key] {
+		return
+	}
+	c.refreshing[key] = true
+
+	log := logging.GetFromContext(ctx)
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(ctx, deviceCacheRefreshTimeout)
+		defer cancel()
+
+		device, err := finder(ctx, id)
+		if err != nil {
+			if errors.Is(err, dmc.ErrNotFound) {
+				c.remove(key)
+				return
+			}
+
+			log.Warn("failed to refresh cached device, using stale device", "key", key, "err", err.Error())
+			return
+		}
+
+		c.put(key, device, time.Now())
+	}()
+}
+
+// Invalidate removes all cached lookups of a device.
+func (c *DeviceCache) Invalidate(deviceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if e.Value.(*cachedDevice).device.ID() == deviceID {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// get returns the cached entry for key and marks it as recently used. Must be called with mu held.
+func (c *DeviceCache) get(key string) (cachedDevice, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return cachedDevice{}, false
+	}
+
+	c.lru.MoveToFront(e)
+
+	return *e.Value.(*cachedDevice), true
+}
+
+func (c *DeviceCache) put(key string, device dmc.Device, fetched time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value = &cachedDevice{key: key, device: device, fetched: fetched}
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cachedDevice{key: key, device: device, fetched: fetched})
+
+	for c.lru.Len() > c.cfg.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedDevice).key)
+	}
+}
+
+func (c *DeviceCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+func (c *DeviceCache) count(ctx context.Context, result string) {
+	c.lookupCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+// NewDeviceUpdatedHandler returns a handler for device.updated events from device management that
+// removes the updated device from the cache.
+func NewDeviceUpdatedHandler(cache *DeviceCache) messaging.TopicMessageHandler {
+	return func(ctx context.Context, msg messaging.IncomingTopicMessage, log *slog.Logger) {
+		var evt dmtypes.DeviceUpdated
+
+		err := json.Unmarshal(msg.Body(), &evt)
+		if err != nil {
+			log.Error("failed to unmarshal device.updated event", "err", err.Error())
+			return
+		}
+
+		cache.Invalidate(evt.DeviceID)
+		log.Debug("invalidated cached device", "device_id", evt.DeviceID)
+	}
+}
@@ -0,0 +1,140 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-device-mgmt/pkg/client"
+	dmctest "github.com/diwise/iot-device-mgmt/pkg/test"
+	dmtypes "github.com/diwise/iot-device-mgmt/pkg/types"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestCachedDeviceIsNotLookedUpAgain(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	cache := NewDeviceCache(dmc, DeviceCacheConfig{TTL: time.Minute, Size: 10})
+	agent := New(dmc, e, s, false, "default", map[string]DeviceProfileConfig{}, WithDeviceCache(cache))
+	ue, _ := facades.New("servanet")(ctx, "up", []byte(elsys))
+
+	is.NoErr(agent.HandleSensorEvent(ctx, ue))
+	is.NoErr(agent.HandleSensorEvent(ctx, ue))
+	is.Equal(len(dmc.FindDeviceFromDevEUICalls()), 1)
+}
+
+func TestStaleDeviceIsUsedWhileDeviceManagementIsUnavailable(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	available := true
+	refreshed := make(chan struct{}, 1)
+
+	dmc := &dmctest.DeviceManagementClientMock{
+		FindDeviceFromDevEUIFunc: func(ctx context.Context, devEUI string) (client.Device, error) {
+			defer func() { refreshed <- struct{}{} }()
+			if !available {
+				return nil, errors.New("device management unavailable")
+			}
+			return testDevice("intern-a81758fffe05e6fb"), nil
+		},
+	}
+
+	cache := NewDeviceCache(dmc, DeviceCacheConfig{TTL: time.Millisecond, MaxStale: time.Hour, Size: 10})
+
+	_, err := cache.FindDeviceFromDevEUI(ctx, "a81758fffe05e6fb")
+	is.NoErr(err)
+	<-refreshed
+
+	available = false
+	time.Sleep(5 * time.Millisecond)
+
+	device, err := cache.FindDeviceFromDevEUI(ctx, "a81758fffe05e6fb")
+	is.NoErr(err) // an expired device should be used while it can not be refreshed
+	is.Equal(device.ID(), "intern-a81758fffe05e6fb")
+	<-refreshed
+
+	device, err = cache.FindDeviceFromDevEUI(ctx, "A81758FFFE05E6FB")
+	is.NoErr(err) // the failed refresh should not remove the stale device
+	is.Equal(device.ID(), "intern-a81758fffe05e6fb")
+}
+
+func TestExpiredDeviceIsLookedUpAfterMaxStale(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dmc := &dmctest.DeviceManagementClientMock{
+		FindDeviceFromInternalIDFunc: func(ctx context.Context, deviceID string) (client.Device, error) {
+			return testDevice(deviceID), nil
+		},
+	}
+
+	cache := NewDeviceCache(dmc, DeviceCacheConfig{TTL: time.Millisecond, MaxStale: time.Millisecond, Size: 10})
+
+	_, err := cache.FindDeviceFromInternalID(ctx, "device-1")
+	is.NoErr(err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = cache.FindDeviceFromInternalID(ctx, "device-1")
+	is.NoErr(err)
+	is.Equal(len(dmc.FindDeviceFromInternalIDCalls()), 2)
+}
+
+func TestLeastRecentlyUsedDeviceIsEvicted(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dmc := &dmctest.DeviceManagementClientMock{
+		FindDeviceFromInternalIDFunc: func(ctx context.Context, deviceID string) (client.Device, error) {
+			return testDevice(deviceID), nil
+		},
+	}
+
+	cache := NewDeviceCache(dmc, DeviceCacheConfig{TTL: time.Minute, Size: 2})
+
+	for _, id := range []string{"device-1", "device-2", "device-1", "device-3", "device-1"} {
+		_, err := cache.FindDeviceFromInternalID(ctx, id)
+		is.NoErr(err)
+	}
+
+	is.Equal(len(dmc.FindDeviceFromInternalIDCalls()), 3) // device-1 should still be cached
+
+	_, err := cache.FindDeviceFromInternalID(ctx, "device-2")
+	is.NoErr(err)
+	is.Equal(len(dmc.FindDeviceFromInternalIDCalls()), 4) // device-2 should have been evicted
+}
+
+func TestDeviceUpdatedInvalidatesCachedDevice(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dmc := &dmctest.DeviceManagementClientMock{
+		FindDeviceFromDevEUIFunc: func(ctx context.Context, devEUI string) (client.Device, error) {
+			return testDevice("intern-" + devEUI), nil
+		},
+	}
+
+	cache := NewDeviceCache(dmc, DeviceCacheConfig{TTL: time.Minute, Size: 10})
+
+	_, err := cache.FindDeviceFromDevEUI(ctx, "a81758fffe05e6fb")
+	is.NoErr(err)
+
+	evt := dmtypes.DeviceUpdated{DeviceID: "intern-a81758fffe05e6fb", Tenant: "default", Timestamp: time.Now()}
+	msg := &messaging.IncomingTopicMessageMock{BodyFunc: evt.Body}
+	NewDeviceUpdatedHandler(cache)(ctx, msg, slog.Default())
+
+	_, err = cache.FindDeviceFromDevEUI(ctx, "a81758fffe05e6fb")
+	is.NoErr(err)
+	is.Equal(len(dmc.FindDeviceFromDevEUICalls()), 2)
+}
+
+func testDevice(deviceID string) client.Device {
+	return &dmctest.DeviceMock{
+		IDFunc: func() string { return deviceID },
+	}
+}
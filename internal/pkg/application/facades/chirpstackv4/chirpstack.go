@@ -123,6 +123,8 @@ func handleUplinkEvent(b []byte) (types.Event, error) {
 		Tags:       mapToMapArr(uplinkEvent.DeviceInfo.Tags),
 		Timestamp:  uplinkEvent.Time.UTC(),
 
+		DeduplicationID: uplinkEvent.DeduplicationID,
+
 		Payload: &types.Payload{
 			FPort:  uplinkEvent.FPort,
 			Data:   data,
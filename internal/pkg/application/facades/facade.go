@@ -14,6 +14,11 @@ import (
 
 type EventFunc func(context.Context, string, []byte) (Event, error)
 
+// Names returns the names of the supported application server facades.
+func Names() []string {
+	return []string{"chirpstack", "chirpstackv4", "netmore", "servanet"}
+}
+
 func New(as string) EventFunc {
 	switch strings.ToLower(as) {
 	case "chirpstack":
@@ -28,3 +33,21 @@ func New(as string) EventFunc {
 		return chirpstack.HandleEvent
 	}
 }
+
+// Decode decodes an incoming message using the facade. The DevEUI hint of the message is used
+// when the decoded event has no DevEUI of its own, and the tenant hint is kept in the event.
+func Decode(ctx context.Context, facade EventFunc, im IncomingMessage) (Event, error) {
+	evt, err := facade(ctx, im.Type, im.Data)
+	if err != nil {
+		return evt, err
+	}
+
+	if evt.DevEUI == "" && (evt.Payload != nil || evt.Status != nil || evt.Error != nil) {
+		evt.DevEUI = im.DevEUI
+	}
+
+	evt.Source = im.Source
+	evt.Tenant = im.Tenant
+
+	return evt, nil
+}
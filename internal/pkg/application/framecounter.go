@@ -0,0 +1,214 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/storage"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type frameCounterStatus string
+
+const (
+	frameCounterOK         frameCounterStatus = ""
+	frameCounterReset      frameCounterStatus = "FCNT_RESET"
+	frameCounterOutOfOrder frameCounterStatus = "FCNT_OUT_OF_ORDER"
+	frameCounterReplay     frameCounterStatus = "FCNT_REPLAY"
+)
+
+const (
+	// frames this far behind the last seen frame counter are checked against the seen bitmap
+	frameCounterWindow int = 64
+	// a frame counter that drops below this limit is considered a reset of the device
+	frameCounterResetLimit int = 16
+	// a frame counter this far behind the last seen frame counter, such as after a wrap of a 32
+	// bit counter, is considered a reset of the device
+	frameCounterResetGap int = 16384
+	// this many consecutive increasing frames behind the window are considered a reset of a
+	// device whose first frames after the reset were lost
+	frameCounterResetAfter int = 3
+	// the number of locks that the checks of different sensors are spread over
+	frameCounterLocks int = 64
+)
+
+type frameCounterResult struct {
+	Status   frameCounterStatus
+	Previous int
+	Current  int
+}
+
+func (r frameCounterResult) Message() string {
+	switch r.Status {
+	case frameCounterReset:
+		return fmt.Sprintf("frame counter reset from %d to %d", r.Previous, r.Current)
+	case frameCounterOutOfOrder:
+		return fmt.Sprintf("frame %d received out of order after %d", r.Current, r.Previous)
+	case frameCounterReplay:
+		return fmt.Sprintf("frame %d has already been received", r.Current)
+	default:
+		return ""
+	}
+}
+
+// frameCounters tracks the last seen frame counter of each sensor. The state is kept in memory
+// and persisted in storage so that it survives restarts. Frames of the same sensor are checked
+// one at a time.
+type frameCounters struct {
+	store       storage.Storage
+	dropReplays bool
+
+	locks [frameCounterLocks]sync.Mutex
+
+	counters   map[string]types.FrameCounter
+	behind     map[string]behindFrames
+	countersMu sync.Mutex
+
+	anomalyCounter metric.Int64Counter
+}
+
+func newFrameCounters(store storage.Storage, dropReplays bool) *frameCounters {
+	anomalyCounter, err := otel.Meter("iot-agent/framecounters").Int64Counter(
+		"diwise.framecounter.anomalies.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of frame counter resets, out of order frames and replays"),
+	)
+
+	if err != nil {
+		slog.Default().Error("failed to create otel anomaly counter", "err", err.Error())
+	}
+
+	return &frameCounters{
+		store:          store,
+		dropReplays:    dropReplays,
+		counters:       make(map[string]types.FrameCounter),
+		behind:         make(map[string]behindFrames),
+		anomalyCounter: anomalyCounter,
+	}
+}
+
+// behindFrames counts the consecutive increasing frames of a sensor that were behind the window.
+type behindFrames struct {
+	fcnt  int
+	count int
+}
+
+func (f *frameCounters) lock(sensorID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(sensorID))
+	return &f.locks[h.Sum32()%uint32(frameCounterLocks)]
+}
+
+// check compares the frame counter of the event with the last seen frame counter of the sensor
+// and updates the state accordingly.
+func (f *frameCounters) check(ctx context.Context, se types.Event) frameCounterResult {
+	log := logging.GetFromContext(ctx)
+	sensorID := strings.ToLower(se.DevEUI)
+
+	mu := f.lock(sensorID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	f.countersMu.Lock()
+	last, ok := f.counters[sensorID]
+	behind := f.behind[sensorID]
+	f.countersMu.Unlock()
+
+	if !ok {
+		var err error
+		last, err = f.store.GetFrameCounter(ctx, sensorID)
+		ok = err == nil
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Warn("failed to load frame counter", "err", err.Error())
+		}
+	}
+
+	result := frameCounterResult{Status: frameCounterOK, Previous: last.FCnt, Current: se.FCnt}
+	next := last
+
+	switch {
+	case !ok:
+		next = types.FrameCounter{FCnt: se.FCnt}
+	case se.FCnt > last.FCnt:
+		next.FCnt = se.FCnt
+		next.Seen = shiftSeen(last.Seen, se.FCnt-last.FCnt)
+	case se.FCnt == last.FCnt:
+		// sources that do not report a frame counter always report 0
+		if se.FCnt != 0 {
+			result.Status = frameCounterReplay
+		}
+	case se.FCnt < frameCounterResetLimit || last.FCnt-se.FCnt > frameCounterResetGap:
+		result.Status = frameCounterReset
+		next = types.FrameCounter{FCnt: se.FCnt}
+	case last.FCnt-se.FCnt <= frameCounterWindow:
+		bit := uint64(1) << (last.FCnt - se.FCnt - 1)
+		if last.Seen&bit != 0 {
+			result.Status = frameCounterReplay
+		} else {
+			result.Status = frameCounterOutOfOrder
+			next.Seen |= bit
+		}
+	default:
+		if behind.count > 0 && se.FCnt > behind.fcnt {
+			behind.count++
+		} else {
+			behind.count = 1
+		}
+		behind.fcnt = se.FCnt
+
+		if behind.count >= frameCounterResetAfter {
+			result.Status = frameCounterReset
+			next = types.FrameCounter{FCnt: se.FCnt}
+		} else {
+			result.Status = frameCounterReplay
+		}
+	}
+
+	if result.Status != frameCounterReplay || last.FCnt-se.FCnt <= frameCounterWindow {
+		behind = behindFrames{}
+	}
+
+	if result.Status != frameCounterOK {
+		log.Info("frame counter anomaly detected", "status", result.Status, "fcnt", se.FCnt, "last_fcnt", last.FCnt)
+		f.anomalyCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("status", string(result.Status))))
+	}
+
+	f.countersMu.Lock()
+	if behind.count > 0 {
+		f.behind[sensorID] = behind
+	} else {
+		delete(f.behind, sensorID)
+	}
+	f.countersMu.Unlock()
+
+	// a replayed frame must not move the state of the sensor
+	if result.Status != frameCounterReplay {
+		next.Timestamp = se.Timestamp.UTC()
+
+		f.countersMu.Lock()
+		f.counters[sensorID] = next
+		f.countersMu.Unlock()
+
+		err := f.store.SaveFrameCounter(ctx, sensorID, next)
+		if err != nil {
+			log.Warn("failed to save frame counter", "err", err.Error())
+		}
+	}
+
+	return result
+}
+
+// shiftSeen moves the seen bitmap n frames forward and marks the previous frame counter as seen.
+// Frames that end up outside of the window are shifted out.
+func shiftSeen(seen uint64, n int) uint64 {
+	return seen<<n | 1<<(n-1)
+}
@@ -0,0 +1,165 @@
+package application
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/storage"
+	"github.com/matryer/is"
+)
+
+func TestFrameCounterStatus(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	fc := newFrameCounters(frameCounterStorage(map[string]types.FrameCounter{}), false)
+
+	check := func(fcnt int) frameCounterStatus {
+		return fc.check(ctx, types.Event{DevEUI: "a81758fffe05e6fb", FCnt: fcnt, Timestamp: time.Now()}).Status
+	}
+
+	is.Equal(check(100), frameCounterOK) // first frame seen
+	is.Equal(check(101), frameCounterOK)
+	is.Equal(check(104), frameCounterOK)
+	is.Equal(check(103), frameCounterOutOfOrder)
+	is.Equal(check(103), frameCounterReplay)
+	is.Equal(check(101), frameCounterReplay)
+	is.Equal(check(104), frameCounterReplay)
+	is.Equal(check(20), frameCounterReplay) // far behind but not low enough to be a reset
+	is.Equal(check(105), frameCounterOK)    // replays must not move the frame counter
+	is.Equal(check(1), frameCounterReset)
+	is.Equal(check(2), frameCounterOK)
+}
+
+func TestFrameCounterLargeBackwardJumpIsReset(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	fc := newFrameCounters(frameCounterStorage(map[string]types.FrameCounter{}), false)
+
+	check := func(fcnt int) frameCounterStatus {
+		return fc.check(ctx, types.Event{DevEUI: "a81758fffe05e6fb", FCnt: fcnt, Timestamp: time.Now()}).Status
+	}
+
+	// a 32 bit frame counter that wraps around
+	is.Equal(check(4294967290), frameCounterOK)
+	is.Equal(check(100), frameCounterReset)
+	is.Equal(check(101), frameCounterOK)
+}
+
+func TestFrameCounterIsResetAfterConsecutiveFramesBehindTheWindow(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	fc := newFrameCounters(frameCounterStorage(map[string]types.FrameCounter{}), false)
+
+	check := func(fcnt int) frameCounterStatus {
+		return fc.check(ctx, types.Event{DevEUI: "a81758fffe05e6fb", FCnt: fcnt, Timestamp: time.Now()}).Status
+	}
+
+	// a rejoined device whose first frames after the rejoin were lost
+	is.Equal(check(5000), frameCounterOK)
+	is.Equal(check(40), frameCounterReplay)
+	is.Equal(check(41), frameCounterReplay)
+	is.Equal(check(43), frameCounterReset)
+	is.Equal(check(44), frameCounterOK)
+	is.Equal(check(42), frameCounterOutOfOrder)
+
+	// frames behind the window that are not increasing are replays
+	is.Equal(check(5000), frameCounterOK)
+	is.Equal(check(40), frameCounterReplay)
+	is.Equal(check(40), frameCounterReplay)
+	is.Equal(check(39), frameCounterReplay)
+	is.Equal(check(5001), frameCounterOK)
+}
+
+func TestFrameCountersOfASensorAreCheckedOneAtATime(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	fc := newFrameCounters(frameCounterStorage(map[string]types.FrameCounter{"a81758fffe05e6fb": {FCnt: 100}}), false)
+
+	var ok atomic.Int32
+	var wg sync.WaitGroup
+
+	for range 20 {
+		wg.Go(func() {
+			if fc.check(ctx, types.Event{DevEUI: "a81758fffe05e6fb", FCnt: 101}).Status == frameCounterOK {
+				ok.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+
+	is.Equal(ok.Load(), int32(1)) // the other frames are replays of the first
+}
+
+func TestFrameCounterStateIsLoadedFromStorage(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	counters := map[string]types.FrameCounter{
+		"a81758fffe05e6fb": {FCnt: 100, Seen: shiftSeen(0, 1)},
+	}
+
+	fc := newFrameCounters(frameCounterStorage(counters), false)
+
+	result := fc.check(ctx, types.Event{DevEUI: "A81758FFFE05E6FB", FCnt: 99})
+	is.Equal(result.Status, frameCounterReplay)
+	is.Equal(result.Message(), "frame 99 has already been received")
+
+	result = fc.check(ctx, types.Event{DevEUI: "A81758FFFE05E6FB", FCnt: 102})
+	is.Equal(result.Status, frameCounterOK)
+	is.Equal(counters["a81758fffe05e6fb"].FCnt, 102)
+}
+
+func TestFrameCounterIgnoresSourcesWithoutFrameCounter(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	fc := newFrameCounters(frameCounterStorage(map[string]types.FrameCounter{}), false)
+
+	for range 3 {
+		is.Equal(fc.check(ctx, types.Event{DevEUI: "a81758fffe05e6fb"}).Status, frameCounterOK)
+	}
+}
+
+func TestReplayedFrameIsReportedAndDropped(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	s.(*storage.StorageMock).GetFrameCounterFunc = func(ctx context.Context, sensorID string) (types.FrameCounter, error) {
+		return types.FrameCounter{FCnt: 100}, nil
+	}
+
+	agent := New(dmc, e, s, false, "default", map[string]DeviceProfileConfig{}, WithFrameCounterTracking(true))
+	ue, _ := facades.New("servanet")(ctx, "up", []byte(elsys))
+	ue.FCnt = 100
+
+	is.NoErr(agent.HandleSensorEvent(ctx, ue))
+	is.Equal(len(e.SendCommandToCalls()), 0) // the replayed frame should not be sent
+
+	status := e.PublishOnTopicCalls()[0].Message.(*types.StatusMessage)
+	is.Equal(*status.Code, string(frameCounterReplay))
+	is.Equal(status.Messages[len(status.Messages)-1], "frame 100 has already been received")
+}
+
+func frameCounterStorage(counters map[string]types.FrameCounter) storage.Storage {
+	return &storage.StorageMock{
+		GetFrameCounterFunc: func(ctx context.Context, sensorID string) (types.FrameCounter, error) {
+			fc, ok := counters[sensorID]
+			if !ok {
+				return fc, storage.ErrNotFound
+			}
+			return fc, nil
+		},
+		SaveFrameCounterFunc: func(ctx context.Context, sensorID string, fc types.FrameCounter) error {
+			counters[sensorID] = fc
+			return nil
+		},
+	}
+}
@@ -0,0 +1,25 @@
+package application
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+)
+
+// HandleIncomingMessage decodes a message from an application server using the facade and handles
+// the resulting sensor event. Messages that the facade can not decode are returned as
+// types.ErrInvalidMessage, and messages without a DevEUI are ignored.
+func HandleIncomingMessage(ctx context.Context, app App, facade facades.EventFunc, im types.IncomingMessage) error {
+	evt, err := facades.Decode(ctx, facade, im)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrInvalidMessage, err)
+	}
+
+	if evt.DevEUI == "" {
+		return nil
+	}
+
+	return app.HandleSensorEvent(ctx, evt)
+}
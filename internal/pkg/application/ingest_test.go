@@ -0,0 +1,55 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+)
+
+func TestHandleIncomingMessage(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	agent := New(dmc, e, s, false, "default", map[string]DeviceProfileConfig{})
+
+	err := HandleIncomingMessage(ctx, agent, facades.New("servanet"), types.IncomingMessage{Type: "up", Source: "mqtt/up", Data: []byte(elsys)})
+	is.NoErr(err)
+	is.True(len(e.SendCommandToCalls()) > 0)
+
+	err = HandleIncomingMessage(ctx, agent, facades.New("servanet"), types.IncomingMessage{Type: "up", Data: []byte("{")})
+	is.True(errors.Is(err, types.ErrInvalidMessage))
+}
+
+func TestHandleIncomingMessageUsesHints(t *testing.T) {
+	is, _, _, _, ctx := testSetup(t)
+
+	var handled types.Event
+	app := &AppMock{
+		HandleSensorEventFunc: func(ctx context.Context, se types.Event) error {
+			handled = se
+			return nil
+		},
+	}
+
+	facade := func(ctx context.Context, messageType string, b []byte) (types.Event, error) {
+		if messageType != "up" {
+			return types.Event{}, nil
+		}
+		return types.Event{Payload: &types.Payload{FPort: 2, Data: b}}, nil
+	}
+
+	im := types.IncomingMessage{Type: "up", Source: "tenants/default/device/0101010101010101/up", DevEUI: "0101010101010101", Tenant: "default", Data: []byte{1}}
+
+	err := HandleIncomingMessage(ctx, app, facade, im)
+	is.NoErr(err)
+	is.Equal(handled.DevEUI, "0101010101010101")
+	is.Equal(handled.Tenant, "default")
+	is.Equal(handled.Source, im.Source)
+
+	im.Type = "join"
+	err = HandleIncomingMessage(ctx, app, facade, im)
+	is.NoErr(err)
+	is.Equal(len(app.HandleSensorEventCalls()), 1)
+}
@@ -13,16 +13,21 @@ import (
 	"time"
 
 	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
+	_ "github.com/diwise/iot-agent/internal/pkg/application/decoders/builtin"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/outbox"
 	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/storage"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
-	core "github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/iot-device-mgmt/pkg/client"
 	dmc "github.com/diwise/iot-device-mgmt/pkg/client"
 	dmtypes "github.com/diwise/iot-device-mgmt/pkg/types"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/senml"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:generate moq -rm -out iotagent_mock.go . App
@@ -33,6 +38,10 @@ type App interface {
 	HandleSensorEvent(ctx context.Context, se types.Event) error
 	HandleSensorMeasurementList(ctx context.Context, deviceID string, pack senml.Pack) error
 	GetDevice(ctx context.Context, deviceID string) (dmc.Device, error)
+	Decoders(ctx context.Context) []decoders.Info
+	Decode(ctx context.Context, sensorType string, se types.Event) (types.SensorPayload, []lwm2m.Lwm2mObject, error)
+	Replay(ctx context.Context, q types.EventQuery, dryRun bool) (ReplayReport, error)
+	QueryEvents(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error)
 }
 
 type app struct {
@@ -46,8 +55,54 @@ type app struct {
 
 	createUnknownDeviceEnabled bool
 	createUnknownDeviceTenant  string
+	tenantHints                bool
 	dpCfg                      map[string]profile
 	dpCfgMu                    sync.RWMutex
+
+	objectsEmitted  metric.Int64Counter
+	objectsFiltered metric.Int64Counter
+
+	dedup         *deduplicator
+	frameCounters *frameCounters
+	sinks         []Sink
+}
+
+type Option func(*app)
+
+// WithFrameCounterTracking reports frame counter resets, out of order frames and replays
+// in the device status messages, and optionally drops replayed frames.
+func WithFrameCounterTracking(dropReplays bool) Option {
+	return func(a *app) {
+		a.frameCounters = newFrameCounters(a.store, dropReplays)
+	}
+}
+
+// WithDeduplication suppresses uplinks that have already been handled within the given window.
+// A window of zero disables deduplication.
+func WithDeduplication(window time.Duration) Option {
+	return func(a *app) {
+		if window > 0 {
+			a.dedup = newDeduplicator(window)
+		}
+	}
+}
+
+// WithTenantHints gives devices that are created for unknown sensors the tenant from the topic
+// that the message was received on, when there is one, instead of the tenant of the profile.
+func WithTenantHints() Option {
+	return func(a *app) {
+		a.tenantHints = true
+	}
+}
+
+// WithDeviceCache looks up devices through the given cache instead of calling device management
+// for every uplink and measurement.
+func WithDeviceCache(cache *DeviceCache) Option {
+	return func(a *app) {
+		if cache != nil {
+			a.client = cache
+		}
+	}
 }
 
 type profile struct {
@@ -55,7 +110,7 @@ type profile struct {
 	Types []string
 }
 
-func New(dmc dmc.DeviceManagementClient, msgCtx messaging.MsgContext, storage storage.Storage, createUnknownDeviceEnabled bool, createUnknownDeviceTenant string, dpCfg map[string]DeviceProfileConfig) App {
+func New(dmc dmc.DeviceManagementClient, msgCtx messaging.MsgContext, storage storage.Storage, createUnknownDeviceEnabled bool, createUnknownDeviceTenant string, dpCfg map[string]DeviceProfileConfig, options ...Option) App {
 	d := decoders.NewRegistry()
 
 	a := &app{
@@ -69,6 +124,34 @@ func New(dmc dmc.DeviceManagementClient, msgCtx messaging.MsgContext, storage st
 		dpCfg:                      make(map[string]profile),
 	}
 
+	var err error
+
+	a.objectsEmitted, err = otel.Meter("iot-agent/decoding").Int64Counter(
+		"diwise.decoding.objects.emitted.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of converted objects sent for further processing"),
+	)
+	if err != nil {
+		slog.Default().Error("failed to create otel objects emitted counter", "err", err.Error())
+	}
+
+	a.objectsFiltered, err = otel.Meter("iot-agent/decoding").Int64Counter(
+		"diwise.decoding.objects.filtered.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of converted objects dropped since they are not in the types of the device"),
+	)
+	if err != nil {
+		slog.Default().Error("failed to create otel objects filtered counter", "err", err.Error())
+	}
+
+	for _, apply := range options {
+		apply(a)
+	}
+
+	if a.sinks == nil {
+		a.sinks = []Sink{NewIoTCoreSink(msgCtx)}
+	}
+
 	for sensorType, p := range dpCfg {
 		if p.Tenant == "" {
 			p.Tenant = createUnknownDeviceTenant
@@ -134,42 +217,149 @@ func (a *app) decodeAndConvert(ctx context.Context, se types.Event) (dmc.Device,
 	log = log.With("device_id", device.ID())
 	ctx = logging.NewContextWithLogger(ctx, log)
 
-	decoder, converter, ok := a.registry.Get(ctx, device.SensorType())
+	sensorType, err := a.sensorType(device)
+	if err != nil {
+		log.Warn("ignoring decoder version of device, using the sensor type of its profile", "sensor_type", sensorType, "err", err.Error())
+	}
+
+	if decoder, ok := a.registry.Resolve(sensorType); ok {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("decoder", decoder))
+	}
+
+	payload, objects, err := a.decode(ctx, sensorType, device.ID(), se)
+	if err != nil {
+		return device, nil, nil, err
+	}
+
+	return device, payload, objects, nil
+}
+
+// metadataDevice is implemented by devices that expose the metadata set in device management.
+type metadataDevice interface {
+	Metadata() []dmtypes.Metadata
+}
+
+// sensorType returns the sensor type of the profile of a device, pinned to the decoder version
+// in the decoders.VersionMetadataKey metadata of the device if it has one. The sensor type of the
+// profile is returned with an error if the version is not registered.
+func (a *app) sensorType(device dmc.Device) (string, error) {
+	sensorType := device.SensorType()
+
+	md, ok := device.(metadataDevice)
+	if !ok {
+		return sensorType, nil
+	}
+
+	i := slices.IndexFunc(md.Metadata(), func(m dmtypes.Metadata) bool { return m.Key == decoders.VersionMetadataKey })
+	if i == -1 {
+		return sensorType, nil
+	}
+
+	version := md.Metadata()[i].Value
+
+	pinned, ok := a.registry.Pin(sensorType, version)
 	if !ok {
-		return device, nil, nil, types.ErrDecoderOrConverterNotFound
+		return sensorType, fmt.Errorf("decoder version %q is not registered for %s", version, sensorType)
+	}
+
+	return pinned, nil
+}
+
+func (a *app) decode(ctx context.Context, sensorType, deviceID string, se types.Event) (types.SensorPayload, []lwm2m.Lwm2mObject, error) {
+	decoder, converter, ok := a.registry.Get(ctx, sensorType)
+	if !ok {
+		return nil, nil, types.ErrDecoderOrConverterNotFound
 	}
 
 	payload, err := decoder(ctx, se)
 	if err != nil {
-		return device, nil, nil, err
+		return nil, nil, err
 	}
 
-	objects, err := converter(ctx, device.ID(), payload, se.Timestamp)
+	objects, err := converter(ctx, deviceID, payload, se.Timestamp)
 	if err != nil {
-		return device, nil, nil, err
+		return nil, nil, err
 	}
 
-	return device, payload, objects, nil
+	return payload, objects, nil
+}
+
+func (a *app) Decoders(_ context.Context) []decoders.Info {
+	return a.registry.List()
+}
+
+// Decode runs the decoder and converter registered for sensorType on an event without
+// looking up the device, storing the event or publishing anything. The DevEUI of the
+// event is used as device id when converting.
+func (a *app) Decode(ctx context.Context, sensorType string, se types.Event) (types.SensorPayload, []lwm2m.Lwm2mObject, error) {
+	if se.Payload == nil {
+		return nil, nil, types.ErrPayloadContainsNoData
+	}
+
+	log := logging.GetFromContext(ctx).With(slog.String("sensor_type", sensorType), slog.Bool("dry_run", true))
+	ctx = logging.NewContextWithLogger(ctx, log)
+
+	return a.decode(ctx, sensorType, se.DevEUI, se)
+}
+
+func (a *app) QueryEvents(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+	return a.store.QueryEvents(ctx, q)
 }
 
 func (a *app) storeSensorEvent(ctx context.Context, se types.Event, device dmc.Device, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) {
-	a.store.Save(ctx, se, device, payload, objects, err)
+	var decoder string
+	if device != nil {
+		sensorType, _ := a.sensorType(device)
+		decoder, _ = a.registry.Resolve(sensorType)
+	}
+
+	a.store.Save(ctx, se, device, decoder, payload, objects, err)
 }
 
 func (a *app) HandleSensorEvent(ctx context.Context, se types.Event) error {
-	var errs []error
-
 	log := logging.GetFromContext(ctx).With(slog.String("sensor_id", se.DevEUI))
 	ctx = logging.NewContextWithLogger(ctx, log)
 
-	var device dmc.Device
-	var payload types.SensorPayload
-	var objects []lwm2m.Lwm2mObject
-	var err error
+	if a.dedup == nil {
+		return a.handleSensorEvent(ctx, se)
+	}
 
-	device, payload, objects, err = a.decodeAndConvert(ctx, se)
+	duplicate, done, err := a.dedup.seenBefore(ctx, se)
+	if err != nil {
+		return err
+	}
+
+	if duplicate {
+		log.Debug("suppressing duplicate uplink", "fcnt", se.FCnt)
+		return nil
+	}
+
+	err = a.handleSensorEvent(ctx, se)
+	// a failed uplink is handled again if it is retried, or by a duplicate that is waiting for it
+	done(err)
+
+	return err
+}
+
+// handleSensorEvent decodes and handles a sensor event. The messages that are sent while the
+// event is handled are collected, and stored together with the event when an outbox is used.
+func (a *app) handleSensorEvent(ctx context.Context, se types.Event) error {
+	ctx, batch := outbox.WithBatch(outbox.WithOrderKey(ctx, strings.ToLower(se.DevEUI)))
+
+	device, payload, objects, err := a.decodeAndConvert(ctx, se)
+	handleErr := a.handleDecodedSensorEvent(ctx, se, device, payload, objects, err)
 	a.storeSensorEvent(ctx, se, device, payload, objects, err)
 
+	return errors.Join(handleErr, batch.Flush(ctx))
+}
+
+// handleDecodedSensorEvent handles the outcome of decoding and converting a sensor event, and
+// sends the converted objects of an active device for further processing.
+func (a *app) handleDecodedSensorEvent(ctx context.Context, se types.Event, device dmc.Device, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
+	var errs []error
+
+	log := logging.GetFromContext(ctx)
+
 	if errors.Is(err, types.ErrDecoderOrConverterNotFound) {
 		log.Warn("decoder or converter not found for sensor type", "sensor_type", device.SensorType())
 		return nil
@@ -211,8 +401,20 @@ func (a *app) HandleSensorEvent(ctx context.Context, se types.Event) error {
 		return err
 	}
 
-	if err := a.sendStatusMessage(ctx, device, &se, payload); err != nil {
-		log.Warn("failed to send status message", "err", err.Error())
+	var fcnt frameCounterResult
+	if a.frameCounters != nil && !isReplay(ctx) {
+		fcnt = a.frameCounters.check(ctx, se)
+	}
+
+	if !isReplay(ctx) {
+		if err := a.sendStatusMessage(ctx, device, &se, payload, fcnt); err != nil {
+			log.Warn("failed to send status message", "err", err.Error())
+		}
+	}
+
+	if fcnt.Status == frameCounterReplay && a.frameCounters.dropReplays {
+		log.Warn("dropping replayed frame", "fcnt", se.FCnt)
+		return nil
 	}
 
 	if !device.IsActive() {
@@ -221,16 +423,20 @@ func (a *app) HandleSensorEvent(ctx context.Context, se types.Event) error {
 	}
 
 	types := device.Types()
+	attrs := metric.WithAttributes(attribute.String("sensor_type", strings.ToLower(device.SensorType())))
 
 	for _, obj := range objects {
 		if !slices.Contains(types, obj.ObjectURN()) {
 			log.Debug(fmt.Sprintf("%s is not in device types list %s", obj.ObjectURN(), strings.Join(types, ", ")))
+			a.objectsFiltered.Add(ctx, 1, attrs)
 			continue
 		}
 
+		a.objectsEmitted.Add(ctx, 1, attrs)
+
 		pack := lwm2m.ToPack(obj)
 
-		err := a.handleSensorMeasurementList(ctx, pack)
+		err := a.handleSensorMeasurementList(ctx, device, pack)
 		if err != nil {
 			b, _ := json.Marshal(pack)
 			log.Error("could not handle measurement", "pack", string(b), "err", err.Error())
@@ -248,7 +454,7 @@ func (a *app) HandleSensorMeasurementList(ctx context.Context, deviceID string,
 	deviceID = strings.ToLower(deviceID)
 
 	log := logging.GetFromContext(ctx).With(slog.String("device_id", deviceID))
-	ctx = logging.NewContextWithLogger(ctx, log)
+	ctx = logging.NewContextWithLogger(outbox.WithOrderKey(ctx, deviceID), log)
 
 	d, err := a.findDevice(ctx, deviceID, a.client.FindDeviceFromInternalID)
 	if err != nil {
@@ -266,11 +472,11 @@ func (a *app) HandleSensorMeasurementList(ctx context.Context, deviceID string,
 		return err
 	}
 
-	if err := a.sendStatusMessage(ctx, d, nil, nil); err != nil {
+	if err := a.sendStatusMessage(ctx, d, nil, nil, frameCounterResult{}); err != nil {
 		log.Warn("failed to send status message", "err", err.Error())
 	}
 
-	if err := a.handleSensorMeasurementList(ctx, pack); err != nil {
+	if err := a.handleSensorMeasurementList(ctx, d, pack); err != nil {
 		log.Error("could not handle measurement list", "err", err.Error())
 		return err
 	}
@@ -278,19 +484,23 @@ func (a *app) HandleSensorMeasurementList(ctx context.Context, deviceID string,
 	return nil
 }
 
-func (a *app) handleSensorMeasurementList(ctx context.Context, pack senml.Pack) error {
-	log := logging.GetFromContext(ctx)
-	m := core.NewMessageReceived(pack)
+func (a *app) handleSensorMeasurementList(ctx context.Context, device dmc.Device, pack senml.Pack) error {
+	mp := newMeasurementPack(device, pack)
+	replay := isReplay(ctx)
 
-	err := a.msgCtx.SendCommandTo(ctx, m, "iot-core")
-	if err != nil {
-		log.Error("failed to send message.received to iot-core", "err", err.Error())
-		return err
-	}
+	var errs []error
 
-	log.Debug("message.received => iot-core", "device_id", m.DeviceID(), "object_id", m.ObjectID(), "tenant", m.Tenant())
+	for _, s := range a.sinks {
+		if replay && !acceptsReplay(s) {
+			continue
+		}
 
-	return nil
+		if err := s.Send(ctx, mp); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func (a *app) findDevice(ctx context.Context, id string, finder func(ctx context.Context, id string) (dmc.Device, error)) (dmc.Device, error) {
@@ -432,6 +642,10 @@ func (a *app) createUnknownDevice(ctx context.Context, se types.Event) error {
 		Tenant: p.Cfg.Tenant,
 	}
 
+	if a.tenantHints && se.Tenant != "" {
+		d.Tenant = se.Tenant
+	}
+
 	if len(p.Types) > 0 {
 		d.Lwm2mTypes = make([]dmtypes.Lwm2mType, 0, len(p.Types))
 		for _, t := range p.Types {
@@ -506,7 +720,7 @@ func (a *app) createUnknownDevice(ctx context.Context, se types.Event) error {
 	return nil
 }
 
-func (a *app) sendStatusMessage(ctx context.Context, device dmc.Device, evt *types.Event, p types.SensorPayload) error {
+func (a *app) sendStatusMessage(ctx context.Context, device dmc.Device, evt *types.Event, p types.SensorPayload, fcnt frameCounterResult) error {
 	log := logging.GetFromContext(ctx)
 
 	ts := time.Now().UTC()
@@ -566,6 +780,15 @@ func (a *app) sendStatusMessage(ctx context.Context, device dmc.Device, evt *typ
 		}
 	}
 
+	if fcnt.Status != frameCounterOK {
+		// "0" is used by some decoders to report that there is no error
+		if msg.Code == nil || *msg.Code == "0" {
+			code := string(fcnt.Status)
+			msg.Code = &code
+		}
+		msg.Messages = append(msg.Messages, fcnt.Message())
+	}
+
 	log.Debug("publish device-status message", slog.String("device_id", msg.DeviceID), slog.Any("status", msg))
 
 	err := a.msgCtx.PublishOnTopic(ctx, &msg)
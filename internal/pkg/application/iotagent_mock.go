@@ -5,7 +5,9 @@ package application
 
 import (
 	"context"
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/pkg/lwm2m"
 	dmc "github.com/diwise/iot-device-mgmt/pkg/client"
 	"github.com/diwise/senml"
 	"sync"
@@ -21,6 +23,12 @@ var _ App = &AppMock{}
 //
 //		// make and configure a mocked App
 //		mockedApp := &AppMock{
+//			DecodeFunc: func(ctx context.Context, sensorType string, se types.Event) (types.SensorPayload, []lwm2m.Lwm2mObject, error) {
+//				panic("mock out the Decode method")
+//			},
+//			DecodersFunc: func(ctx context.Context) []decoders.Info {
+//				panic("mock out the Decoders method")
+//			},
 //			GetDeviceFunc: func(ctx context.Context, deviceID string) (dmc.Device, error) {
 //				panic("mock out the GetDevice method")
 //			},
@@ -30,6 +38,12 @@ var _ App = &AppMock{}
 //			HandleSensorMeasurementListFunc: func(ctx context.Context, deviceID string, pack senml.Pack) error {
 //				panic("mock out the HandleSensorMeasurementList method")
 //			},
+//			QueryEventsFunc: func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+//				panic("mock out the QueryEvents method")
+//			},
+//			ReplayFunc: func(ctx context.Context, q types.EventQuery, dryRun bool) (ReplayReport, error) {
+//				panic("mock out the Replay method")
+//			},
 //		}
 //
 //		// use mockedApp in code that requires App
@@ -37,6 +51,12 @@ var _ App = &AppMock{}
 //
 //	}
 type AppMock struct {
+	// DecodeFunc mocks the Decode method.
+	DecodeFunc func(ctx context.Context, sensorType string, se types.Event) (types.SensorPayload, []lwm2m.Lwm2mObject, error)
+
+	// DecodersFunc mocks the Decoders method.
+	DecodersFunc func(ctx context.Context) []decoders.Info
+
 	// GetDeviceFunc mocks the GetDevice method.
 	GetDeviceFunc func(ctx context.Context, deviceID string) (dmc.Device, error)
 
@@ -46,8 +66,28 @@ type AppMock struct {
 	// HandleSensorMeasurementListFunc mocks the HandleSensorMeasurementList method.
 	HandleSensorMeasurementListFunc func(ctx context.Context, deviceID string, pack senml.Pack) error
 
+	// QueryEventsFunc mocks the QueryEvents method.
+	QueryEventsFunc func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error)
+
+	// ReplayFunc mocks the Replay method.
+	ReplayFunc func(ctx context.Context, q types.EventQuery, dryRun bool) (ReplayReport, error)
+
 	// calls tracks calls to the methods.
 	calls struct {
+		// Decode holds details about calls to the Decode method.
+		Decode []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// SensorType is the sensorType argument value.
+			SensorType string
+			// Se is the se argument value.
+			Se types.Event
+		}
+		// Decoders holds details about calls to the Decoders method.
+		Decoders []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
 		// GetDevice holds details about calls to the GetDevice method.
 		GetDevice []struct {
 			// Ctx is the ctx argument value.
@@ -71,10 +111,102 @@ type AppMock struct {
 			// Pack is the pack argument value.
 			Pack senml.Pack
 		}
+		// QueryEvents holds details about calls to the QueryEvents method.
+		QueryEvents []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Q is the q argument value.
+			Q types.EventQuery
+		}
+		// Replay holds details about calls to the Replay method.
+		Replay []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Q is the q argument value.
+			Q types.EventQuery
+			// DryRun is the dryRun argument value.
+			DryRun bool
+		}
 	}
+	lockDecode                      sync.RWMutex
+	lockDecoders                    sync.RWMutex
 	lockGetDevice                   sync.RWMutex
 	lockHandleSensorEvent           sync.RWMutex
 	lockHandleSensorMeasurementList sync.RWMutex
+	lockQueryEvents                 sync.RWMutex
+	lockReplay                      sync.RWMutex
+}
+
+// Decode calls DecodeFunc.
+func (mock *AppMock) Decode(ctx context.Context, sensorType string, se types.Event) (types.SensorPayload, []lwm2m.Lwm2mObject, error) {
+	if mock.DecodeFunc == nil {
+		panic("AppMock.DecodeFunc: method is nil but App.Decode was just called")
+	}
+	callInfo := struct {
+		Ctx        context.Context
+		SensorType string
+		Se         types.Event
+	}{
+		Ctx:        ctx,
+		SensorType: sensorType,
+		Se:         se,
+	}
+	mock.lockDecode.Lock()
+	mock.calls.Decode = append(mock.calls.Decode, callInfo)
+	mock.lockDecode.Unlock()
+	return mock.DecodeFunc(ctx, sensorType, se)
+}
+
+// DecodeCalls gets all the calls that were made to Decode.
+// Check the length with:
+//
+//	len(mockedApp.DecodeCalls())
+func (mock *AppMock) DecodeCalls() []struct {
+	Ctx        context.Context
+	SensorType string
+	Se         types.Event
+} {
+	var calls []struct {
+		Ctx        context.Context
+		SensorType string
+		Se         types.Event
+	}
+	mock.lockDecode.RLock()
+	calls = mock.calls.Decode
+	mock.lockDecode.RUnlock()
+	return calls
+}
+
+// Decoders calls DecodersFunc.
+func (mock *AppMock) Decoders(ctx context.Context) []decoders.Info {
+	if mock.DecodersFunc == nil {
+		panic("AppMock.DecodersFunc: method is nil but App.Decoders was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockDecoders.Lock()
+	mock.calls.Decoders = append(mock.calls.Decoders, callInfo)
+	mock.lockDecoders.Unlock()
+	return mock.DecodersFunc(ctx)
+}
+
+// DecodersCalls gets all the calls that were made to Decoders.
+// Check the length with:
+//
+//	len(mockedApp.DecodersCalls())
+func (mock *AppMock) DecodersCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockDecoders.RLock()
+	calls = mock.calls.Decoders
+	mock.lockDecoders.RUnlock()
+	return calls
 }
 
 // GetDevice calls GetDeviceFunc.
@@ -188,3 +320,79 @@ func (mock *AppMock) HandleSensorMeasurementListCalls() []struct {
 	mock.lockHandleSensorMeasurementList.RUnlock()
 	return calls
 }
+
+// QueryEvents calls QueryEventsFunc.
+func (mock *AppMock) QueryEvents(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+	if mock.QueryEventsFunc == nil {
+		panic("AppMock.QueryEventsFunc: method is nil but App.QueryEvents was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Q   types.EventQuery
+	}{
+		Ctx: ctx,
+		Q:   q,
+	}
+	mock.lockQueryEvents.Lock()
+	mock.calls.QueryEvents = append(mock.calls.QueryEvents, callInfo)
+	mock.lockQueryEvents.Unlock()
+	return mock.QueryEventsFunc(ctx, q)
+}
+
+// QueryEventsCalls gets all the calls that were made to QueryEvents.
+// Check the length with:
+//
+//	len(mockedApp.QueryEventsCalls())
+func (mock *AppMock) QueryEventsCalls() []struct {
+	Ctx context.Context
+	Q   types.EventQuery
+} {
+	var calls []struct {
+		Ctx context.Context
+		Q   types.EventQuery
+	}
+	mock.lockQueryEvents.RLock()
+	calls = mock.calls.QueryEvents
+	mock.lockQueryEvents.RUnlock()
+	return calls
+}
+
+// Replay calls ReplayFunc.
+func (mock *AppMock) Replay(ctx context.Context, q types.EventQuery, dryRun bool) (ReplayReport, error) {
+	if mock.ReplayFunc == nil {
+		panic("AppMock.ReplayFunc: method is nil but App.Replay was just called")
+	}
+	callInfo := struct {
+		Ctx    context.Context
+		Q      types.EventQuery
+		DryRun bool
+	}{
+		Ctx:    ctx,
+		Q:      q,
+		DryRun: dryRun,
+	}
+	mock.lockReplay.Lock()
+	mock.calls.Replay = append(mock.calls.Replay, callInfo)
+	mock.lockReplay.Unlock()
+	return mock.ReplayFunc(ctx, q, dryRun)
+}
+
+// ReplayCalls gets all the calls that were made to Replay.
+// Check the length with:
+//
+//	len(mockedApp.ReplayCalls())
+func (mock *AppMock) ReplayCalls() []struct {
+	Ctx    context.Context
+	Q      types.EventQuery
+	DryRun bool
+} {
+	var calls []struct {
+		Ctx    context.Context
+		Q      types.EventQuery
+		DryRun bool
+	}
+	mock.lockReplay.RLock()
+	calls = mock.calls.Replay
+	mock.lockReplay.RUnlock()
+	return calls
+}
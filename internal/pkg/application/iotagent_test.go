@@ -4,17 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
 	"github.com/diwise/iot-agent/internal/pkg/application/facades"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/outbox"
 	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/storage"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	iotcore "github.com/diwise/iot-core/pkg/messaging/events"
 	"github.com/diwise/iot-device-mgmt/pkg/client"
 	dmctest "github.com/diwise/iot-device-mgmt/pkg/test"
+	dmtypes "github.com/diwise/iot-device-mgmt/pkg/types"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/senml"
 	"github.com/matryer/is"
@@ -74,6 +77,9 @@ func TestElsysPayload(t *testing.T) {
 
 	pack := getPackFromSendCalls(e, 0)
 	is.True(*pack[1].Value == 19.3)
+
+	saveCalls := s.(*storage.StorageMock).SaveCalls()
+	is.Equal(saveCalls[0].Decoder, "elsys@1")
 }
 
 func TestElsysDigital1Payload(t *testing.T) {
@@ -357,6 +363,27 @@ func TestUnknownDeviceIgnored(t *testing.T) {
 	is.True(timestamp.After(expectedTime.Add(-10*time.Second)) && timestamp.Before(expectedTime.Add(10*time.Second)))
 }
 
+func TestUnknownDeviceIsGivenTheTenantOfTheProfile(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	dmc.CreateSensorFunc = func(ctx context.Context, sensor dmtypes.SensorInputModel) error { return nil }
+	dmc.CreateDeviceFunc = func(ctx context.Context, device dmtypes.Device) error { return nil }
+	dmc.GetDeviceProfileFunc = func(ctx context.Context, id string) (*dmtypes.SensorProfile, error) {
+		return &dmtypes.SensorProfile{Name: id, Types: []string{"urn:oma:lwm2m:ext:3303"}}, nil
+	}
+
+	profiles := map[string]DeviceProfileConfig{"elsys": {ProfileName: "elsys", Tenant: "profile"}}
+	se := types.Event{DevEUI: "a81758fffe05e6fb", SensorType: "elsys", Tenant: "topic"}
+
+	agent := New(dmc, e, s, true, "default", profiles).(*app)
+	is.NoErr(agent.createUnknownDevice(ctx, se))
+	is.Equal(dmc.CreateDeviceCalls()[0].Device.Tenant, "profile") // the tenant hint should not be used by default
+
+	agent = New(dmc, e, s, true, "default", profiles, WithTenantHints()).(*app)
+	is.NoErr(agent.createUnknownDevice(ctx, se))
+	is.Equal(dmc.CreateDeviceCalls()[1].Device.Tenant, "topic")
+}
+
 func TestAutoCleanupWorks(t *testing.T) {
 	is := is.New(t)
 	_, _, e, s, _ := testSetup(t)
@@ -397,6 +424,27 @@ func TestAutoCleanupWorks(t *testing.T) {
 	is.Equal(len(agent.notFoundDevices), 0)
 }
 
+func TestDecodeDoesNotUseDeviceManagementOrMessaging(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	agent := New(dmc, e, s, true, "default", map[string]DeviceProfileConfig{})
+	ue, _ := facades.New("servanet")(ctx, "up", []byte(ers))
+
+	payload, objects, err := agent.Decode(ctx, "elsys", ue)
+	is.NoErr(err)
+	is.True(payload != nil)
+	is.Equal(len(objects), 5)
+	is.Equal(objects[0].ID(), ue.DevEUI)
+
+	is.Equal(len(dmc.FindDeviceFromDevEUICalls()), 0)
+	is.Equal(len(e.SendCommandToCalls()), 0)
+	is.Equal(len(e.PublishOnTopicCalls()), 0)
+	is.Equal(len(s.(*storage.StorageMock).SaveCalls()), 0)
+
+	_, _, err = agent.Decode(ctx, "no-such-decoder", ue)
+	is.True(errors.Is(err, types.ErrDecoderOrConverterNotFound))
+}
+
 func getPackFromSendCalls(e *messaging.MsgContextMock, i int) senml.Pack {
 	sendCalls := e.SendCommandToCalls()
 	cmd := sendCalls[i].Command
@@ -404,6 +452,81 @@ func getPackFromSendCalls(e *messaging.MsgContextMock, i int) senml.Pack {
 	return m.Pack()
 }
 
+func TestMessagesAreStoredWithTheSensorEvent(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	outboxStore := outbox.NewMemoryStore()
+	msgOutbox := outbox.New(ctx, e, outboxStore, outbox.DefaultConfig())
+
+	var saved []outbox.Message
+	s.(*storage.StorageMock).SaveFunc = func(ctx context.Context, se types.Event, device client.Device, decoder string, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
+		return outbox.BatchFromContext(ctx).StoreWith(outboxStore, func(messages []outbox.Message) error {
+			saved = messages
+			return nil
+		})
+	}
+
+	agent := New(dmc, msgOutbox, s, true, "default", map[string]DeviceProfileConfig{})
+	ue, _ := facades.New("netmore")(ctx, "payload", []byte(senlabT))
+
+	is.NoErr(agent.HandleSensorEvent(ctx, ue))
+	is.True(len(saved) > 1) // the status message and the measurements
+	is.Equal(saved[0].OrderKey, strings.ToLower(ue.DevEUI))
+
+	size, _, _ := outboxStore.OutboxBacklog(ctx)
+	is.Equal(size, 0) // the messages were stored with the event and should not be added again
+}
+
+func TestDecoderVersionIsPinnedByDeviceMetadata(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	version := "1"
+	findDevice := dmc.FindDeviceFromDevEUIFunc
+	dmc.FindDeviceFromDevEUIFunc = func(ctx context.Context, devEUI string) (client.Device, error) {
+		device, err := findDevice(ctx, devEUI)
+		return &metadataDeviceMock{
+			DeviceMock: device.(*dmctest.DeviceMock),
+			metadata:   []dmtypes.Metadata{{Key: decoders.VersionMetadataKey, Value: version}},
+		}, err
+	}
+
+	agent := New(dmc, e, s, true, "default", map[string]DeviceProfileConfig{}).(*app)
+	device, _ := dmc.FindDeviceFromDevEUI(ctx, "a81758fffe05e6fb")
+
+	sensorType, err := agent.sensorType(device)
+	is.NoErr(err)
+	is.Equal(sensorType, "Elsys_Codec@1")
+
+	// a version that is not registered falls back to the current version of the profile
+	version = "7"
+	device, _ = dmc.FindDeviceFromDevEUI(ctx, "a81758fffe05e6fb")
+
+	sensorType, err = agent.sensorType(device)
+	is.True(err != nil)
+	is.Equal(sensorType, "Elsys_Codec")
+
+	ue, _ := facades.New("servanet")(ctx, "up", []byte(ers))
+	is.NoErr(agent.HandleSensorEvent(ctx, ue))
+
+	saves := s.(*storage.StorageMock).SaveCalls()
+	is.Equal(len(saves), 1)
+	is.Equal(saves[0].Decoder, "elsys@1")
+
+	// devices without metadata use the sensor type of their profile
+	sensorType, err = agent.sensorType(&dmctest.DeviceMock{SensorTypeFunc: func() string { return "Elsys_Codec" }})
+	is.NoErr(err)
+	is.Equal(sensorType, "Elsys_Codec")
+}
+
+type metadataDeviceMock struct {
+	*dmctest.DeviceMock
+	metadata []dmtypes.Metadata
+}
+
+func (d *metadataDeviceMock) Metadata() []dmtypes.Metadata {
+	return d.metadata
+}
+
 func testSetup(t *testing.T) (*is.I, *dmctest.DeviceManagementClientMock, *messaging.MsgContextMock, storage.Storage, context.Context) {
 	is := is.New(t)
 	dmc := &dmctest.DeviceManagementClientMock{
@@ -471,7 +594,7 @@ func testSetup(t *testing.T) (*is.I, *dmctest.DeviceManagementClientMock, *messa
 		CloseFunc: func() error {
 			return nil
 		},
-		SaveFunc: func(ctx context.Context, se types.Event, device client.Device, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
+		SaveFunc: func(ctx context.Context, se types.Event, device client.Device, decoder string, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
 			return nil
 		},
 	}
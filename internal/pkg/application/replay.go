@@ -0,0 +1,217 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const (
+	defaultReplayLimit int = 1000
+	maxReplayLimit     int = 10000
+)
+
+// ReplayReport summarizes a replay of stored sensor events.
+type ReplayReport struct {
+	DryRun    bool           `json:"dryRun"`
+	Events    int            `json:"events"`
+	Changed   int            `json:"changed"`
+	Failed    int            `json:"failed"`
+	Published int            `json:"published"`
+	Results   []ReplayResult `json:"results"`
+}
+
+// ReplayResult is the outcome of decoding a stored sensor event again. Added and Removed
+// contain the objects that differ from the objects that were stored with the event.
+type ReplayResult struct {
+	ID           string            `json:"id"`
+	Time         time.Time         `json:"time"`
+	SensorID     string            `json:"sensorId"`
+	DeviceID     string            `json:"deviceId,omitempty"`
+	Decoder      string            `json:"decoder,omitempty"`
+	NewDecoder   string            `json:"newDecoder,omitempty"`
+	Changed      bool              `json:"changed"`
+	Added        []json.RawMessage `json:"added,omitempty"`
+	Removed      []json.RawMessage `json:"removed,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	NewError     string            `json:"newError,omitempty"`
+	Published    bool              `json:"published,omitempty"`
+	PublishError string            `json:"publishError,omitempty"`
+}
+
+type replayCtxKey struct{}
+
+func withReplay(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replayCtxKey{}, true)
+}
+
+// isReplay reports if a sensor event is being replayed. Replayed events are not checked for
+// duplicates or frame counter anomalies and do not update the status of the device.
+func isReplay(ctx context.Context) bool {
+	replay, _ := ctx.Value(replayCtxKey{}).(bool)
+	return replay
+}
+
+// Replay decodes the stored sensor events selected by the query using the current decoders and
+// reports how the converted objects differ from the stored ones. Unless dryRun is set, events
+// that can be decoded are also handled again and the measurements are sent to iot-core, and to
+// the other sinks that accept replayed measurements, without storing the events again.
+func (a *app) Replay(ctx context.Context, q types.EventQuery, dryRun bool) (ReplayReport, error) {
+	log := logging.GetFromContext(ctx)
+
+	if q.Limit <= 0 {
+		q.Limit = defaultReplayLimit
+	}
+	q.Limit = min(q.Limit, maxReplayLimit)
+
+	events, err := a.store.QueryEvents(ctx, q)
+	if err != nil {
+		return ReplayReport{}, err
+	}
+
+	report := ReplayReport{
+		DryRun:  dryRun,
+		Events:  len(events),
+		Results: make([]ReplayResult, 0, len(events)),
+	}
+
+	ctx = withReplay(ctx)
+
+	for _, e := range events {
+		result := a.replayEvent(ctx, e, dryRun)
+
+		if result.Changed {
+			report.Changed++
+		}
+		if result.NewError != "" || result.PublishError != "" {
+			report.Failed++
+		}
+		if result.Published {
+			report.Published++
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	log.Info("replayed stored sensor events", "dry_run", dryRun, "events", report.Events, "changed", report.Changed, "failed", report.Failed)
+
+	return report, nil
+}
+
+func (a *app) replayEvent(ctx context.Context, e types.StoredEvent, dryRun bool) ReplayResult {
+	log := logging.GetFromContext(ctx).With("event_id", e.ID, "sensor_id", e.SensorID)
+	ctx = logging.NewContextWithLogger(ctx, log)
+
+	result := ReplayResult{
+		ID:       e.ID,
+		Time:     e.Time,
+		SensorID: e.SensorID,
+		DeviceID: e.DeviceID,
+		Decoder:  e.Decoder,
+		Error:    e.Error,
+	}
+
+	device, payload, objects, err := a.decodeAndConvert(ctx, e.Event)
+	if device != nil {
+		sensorType, _ := a.sensorType(device)
+		result.NewDecoder, _ = a.registry.Resolve(sensorType)
+	}
+
+	if err != nil {
+		result.NewError = err.Error()
+		result.Changed = result.NewError != result.Error
+		return result
+	}
+
+	b, err := json.Marshal(objects)
+	if err != nil {
+		result.NewError = err.Error()
+		return result
+	}
+
+	result.Added, result.Removed, err = diffObjects(e.Objects, b)
+	if err != nil {
+		log.Warn("failed to compare stored objects", "err", err.Error())
+	}
+
+	result.Changed = result.Error != "" || len(result.Added) > 0 || len(result.Removed) > 0
+
+	if dryRun {
+		return result
+	}
+
+	// the event is already stored, so the decoded event is handled without storing it again
+	err = a.handleDecodedSensorEvent(ctx, e.Event, device, payload, objects, nil)
+	if err != nil {
+		log.Error("failed to republish stored sensor event", "err", err.Error())
+		result.PublishError = err.Error()
+		return result
+	}
+
+	result.Published = true
+
+	return result
+}
+
+// diffObjects compares two JSON arrays of objects regardless of the order of the objects and
+// of their keys, and returns the objects that only exist in the new or the old array.
+func diffObjects(old, new json.RawMessage) (added, removed []json.RawMessage, err error) {
+	oldObjects, err := canonicalObjects(old)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newObjects, err := canonicalObjects(new)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remaining := map[string]int{}
+	for _, o := range oldObjects {
+		remaining[string(o)]++
+	}
+
+	for _, o := range newObjects {
+		if remaining[string(o)] > 0 {
+			remaining[string(o)]--
+			continue
+		}
+		added = append(added, o)
+	}
+
+	for _, o := range oldObjects {
+		if remaining[string(o)] > 0 {
+			remaining[string(o)]--
+			removed = append(removed, o)
+		}
+	}
+
+	return added, removed, nil
+}
+
+func canonicalObjects(b json.RawMessage) ([]json.RawMessage, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return nil, nil
+	}
+
+	var objects []any
+	if err := json.Unmarshal(b, &objects); err != nil {
+		return nil, errors.Join(errors.New("objects is not a JSON array"), err)
+	}
+
+	result := make([]json.RawMessage, 0, len(objects))
+	for _, o := range objects {
+		// maps are marshalled with sorted keys
+		c, err := json.Marshal(o)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/storage"
+	"github.com/matryer/is"
+)
+
+func TestReplayDryRunReportsChangedObjects(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	ue, _ := facades.New("servanet")(ctx, "up", []byte(elsys))
+	stored := types.StoredEvent{ID: "1", SensorID: ue.DevEUI, Decoder: "elsys@1", Event: ue, Objects: json.RawMessage(`[]`)}
+
+	s.(*storage.StorageMock).QueryEventsFunc = func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+		return []types.StoredEvent{stored}, nil
+	}
+
+	agent := New(dmc, e, s, false, "default", map[string]DeviceProfileConfig{})
+
+	report, err := agent.Replay(ctx, types.EventQuery{SensorID: ue.DevEUI}, true)
+	is.NoErr(err)
+	is.Equal(report.Events, 1)
+	is.Equal(report.Changed, 1)
+	is.True(len(report.Results[0].Added) > 0)
+	is.Equal(report.Results[0].NewDecoder, "elsys@1")
+
+	is.Equal(s.(*storage.StorageMock).QueryEventsCalls()[0].Q.Limit, defaultReplayLimit)
+	is.Equal(len(e.SendCommandToCalls()), 0) // nothing should be sent in a dry run
+	is.Equal(len(s.(*storage.StorageMock).SaveCalls()), 0)
+}
+
+func TestReplayRepublishesStoredEvents(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	ue, _ := facades.New("servanet")(ctx, "up", []byte(elsys))
+
+	s.(*storage.StorageMock).QueryEventsFunc = func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+		return []types.StoredEvent{{ID: "1", SensorID: ue.DevEUI, Event: ue}}, nil
+	}
+
+	counters := frameCounterStorage(map[string]types.FrameCounter{}).(*storage.StorageMock)
+	s.(*storage.StorageMock).GetFrameCounterFunc = counters.GetFrameCounterFunc
+	s.(*storage.StorageMock).SaveFrameCounterFunc = counters.SaveFrameCounterFunc
+
+	agent := New(dmc, e, s, false, "default", map[string]DeviceProfileConfig{}, WithDeduplication(time.Minute), WithFrameCounterTracking(true))
+
+	// the uplink has already been handled, so it would be suppressed as a duplicate or replay
+	is.NoErr(agent.HandleSensorEvent(ctx, ue))
+	sent := len(e.SendCommandToCalls())
+	statuses := len(e.PublishOnTopicCalls())
+	saved := len(s.(*storage.StorageMock).SaveCalls())
+	lookups := len(dmc.FindDeviceFromDevEUICalls())
+
+	report, err := agent.Replay(ctx, types.EventQuery{SensorID: ue.DevEUI}, false)
+	is.NoErr(err)
+	is.Equal(report.Published, 1)
+	is.Equal(len(e.SendCommandToCalls()), 2*sent)
+	is.Equal(len(e.PublishOnTopicCalls()), statuses)           // replays should not update the device status
+	is.Equal(len(s.(*storage.StorageMock).SaveCalls()), saved) // the replayed event should not be stored again
+	is.Equal(len(dmc.FindDeviceFromDevEUICalls()), lookups+1)  // the event should only be decoded once
+}
+
+func TestDiffObjects(t *testing.T) {
+	is := is.New(t)
+
+	old := json.RawMessage(`[{"id":"a","v":1},{"v":2,"id":"b"}]`)
+	new := json.RawMessage(`[{"id":"b","v":2},{"id":"a","v":3}]`)
+
+	added, removed, err := diffObjects(old, new)
+	is.NoErr(err)
+	is.Equal(len(added), 1)
+	is.Equal(string(added[0]), `{"id":"a","v":3}`)
+	is.Equal(len(removed), 1)
+	is.Equal(string(removed[0]), `{"id":"a","v":1}`)
+
+	added, removed, err = diffObjects(old, json.RawMessage(`[{"v":1,"id":"a"},{"id":"b","v":2}]`))
+	is.NoErr(err)
+	is.Equal(len(added)+len(removed), 0)
+}
@@ -0,0 +1,86 @@
+package application
+
+import (
+	"context"
+	"strings"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	core "github.com/diwise/iot-core/pkg/messaging/events"
+	dmc "github.com/diwise/iot-device-mgmt/pkg/client"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/senml"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+// Sink receives the decoded measurements of devices, e.g. to send them to iot-core or to
+// deliver them to the systems of a tenant. An error returned by a sink fails the handling of
+// the measurements, so that they may be retried.
+type Sink interface {
+	Send(ctx context.Context, m types.MeasurementPack) error
+}
+
+// ReplaySink is implemented by sinks that may receive the historical measurements of replayed
+// events. Replayed measurements are only sent to sinks that accept them, so that e.g. retained
+// or upserted current values are not overwritten by older ones.
+type ReplaySink interface {
+	AcceptsReplay() bool
+}
+
+func acceptsReplay(s Sink) bool {
+	r, ok := s.(ReplaySink)
+	return ok && r.AcceptsReplay()
+}
+
+// WithSinks sends measurements to the sinks instead of to iot-core only. A sink created by
+// NewIoTCoreSink must be included for measurements to still be sent to iot-core.
+func WithSinks(sinks ...Sink) Option {
+	return func(a *app) {
+		a.sinks = append(a.sinks, sinks...)
+	}
+}
+
+type iotCoreSink struct {
+	msgCtx messaging.MsgContext
+}
+
+// NewIoTCoreSink returns the sink that sends measurements to iot-core as message.received
+// commands. It is the only sink unless others are configured.
+func NewIoTCoreSink(msgCtx messaging.MsgContext) Sink {
+	return &iotCoreSink{msgCtx: msgCtx}
+}
+
+func (s *iotCoreSink) AcceptsReplay() bool {
+	return true
+}
+
+func (s *iotCoreSink) Send(ctx context.Context, mp types.MeasurementPack) error {
+	log := logging.GetFromContext(ctx)
+	m := core.NewMessageReceived(mp.Pack)
+
+	err := s.msgCtx.SendCommandTo(ctx, m, "iot-core")
+	if err != nil {
+		log.Error("failed to send message.received to iot-core", "err", err.Error())
+		return err
+	}
+
+	log.Debug("message.received => iot-core", "device_id", m.DeviceID(), "object_id", m.ObjectID(), "tenant", m.Tenant())
+
+	return nil
+}
+
+func newMeasurementPack(device dmc.Device, pack senml.Pack) types.MeasurementPack {
+	m := types.MeasurementPack{
+		DeviceID: device.ID(),
+		Tenant:   device.Tenant(),
+		Pack:     pack,
+	}
+
+	// the base name of a pack is <device id>/<object id>/
+	if len(pack) > 0 {
+		if parts := strings.Split(pack[0].BaseName, "/"); len(parts) > 1 {
+			m.ObjectID = parts[1]
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,70 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/facades"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+)
+
+type sinkFunc func(ctx context.Context, m types.MeasurementPack) error
+
+func (f sinkFunc) Send(ctx context.Context, m types.MeasurementPack) error {
+	return f(ctx, m)
+}
+
+func TestMeasurementsAreSentToSinks(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	var sent []types.MeasurementPack
+	sink := sinkFunc(func(ctx context.Context, m types.MeasurementPack) error {
+		sent = append(sent, m)
+		return nil
+	})
+	agent := New(dmc, e, s, true, "default", map[string]DeviceProfileConfig{}, WithSinks(NewIoTCoreSink(e), sink))
+	ue, _ := facades.New("netmore")(ctx, "payload", []byte(senlabT))
+
+	err := agent.HandleSensorEvent(ctx, ue)
+	is.NoErr(err)
+	is.True(len(sent) > 0)
+	is.Equal(len(sent), len(e.SendCommandToCalls()))
+	is.Equal(sent[0].DeviceID, "internal-id-for-device")
+	is.Equal(sent[0].ObjectID, "3303")
+	is.Equal(sent[0].Tenant, "default")
+	is.Equal(len(sent[0].Pack), len(getPackFromSendCalls(e, 0)))
+}
+
+func TestReplayedMeasurementsAreOnlySentToSinksThatAcceptThem(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	var sent int
+	sink := sinkFunc(func(ctx context.Context, m types.MeasurementPack) error {
+		sent++
+		return nil
+	})
+
+	agent := New(dmc, e, s, true, "default", map[string]DeviceProfileConfig{}, WithSinks(NewIoTCoreSink(e), sink))
+	ue, _ := facades.New("netmore")(ctx, "payload", []byte(senlabT))
+
+	err := agent.HandleSensorEvent(withReplay(ctx), ue)
+	is.NoErr(err)
+	is.True(len(e.SendCommandToCalls()) > 0)
+	is.Equal(sent, 0) // the sink does not accept replayed measurements
+}
+
+func TestMeasurementsAreNotSentToIoTCoreUnlessItIsASink(t *testing.T) {
+	is, dmc, e, s, ctx := testSetup(t)
+
+	failing := sinkFunc(func(ctx context.Context, m types.MeasurementPack) error {
+		return errors.New("sink is unavailable")
+	})
+
+	agent := New(dmc, e, s, true, "default", map[string]DeviceProfileConfig{}, WithSinks(failing))
+	ue, _ := facades.New("netmore")(ctx, "payload", []byte(senlabT))
+
+	err := agent.HandleSensorEvent(ctx, ue)
+	is.True(err != nil)
+	is.Equal(len(e.SendCommandToCalls()), 0)
+}
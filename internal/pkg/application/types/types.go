@@ -12,6 +12,7 @@ import (
 
 var ErrSensorIDMissing = errors.New("sensor id is missing")
 var ErrUnknownMessageType = errors.New("unknown message type")
+var ErrInvalidMessage = errors.New("invalid message")
 
 var ErrNoDevice = errors.New("no device")
 var ErrDeviceIgnored = fmt.Errorf("%w: %s", ErrNoDevice, "device is ignored")
@@ -36,6 +37,7 @@ type Event struct {
 	Name       string   `json:"name,omitempty"`
 	SensorType string   `json:"sensorType,omitempty"`
 	Source     string   `json:"source,omitempty"`
+	Tenant     string   `json:"tenant,omitempty"`
 	Location   Location `json:"location"`
 
 	RX *RX `json:"rx,omitempty"`
@@ -43,6 +45,8 @@ type Event struct {
 
 	FCnt int `json:"fCnt"`
 
+	DeduplicationID string `json:"deduplicationId,omitempty"`
+
 	Payload *Payload `json:"payload,omitempty"`
 	Status  *Status  `json:"status,omitempty"`
 	Error   *Error   `json:"error,omitempty"`
@@ -103,6 +107,65 @@ type Measurement struct {
 	Pack      senml.Pack `json:"pack"`
 }
 
+// MeasurementPack is a pack of measurements of an object of a device, as it is sent to
+// iot-core and to any other sinks.
+type MeasurementPack struct {
+	DeviceID string     `json:"deviceID"`
+	ObjectID string     `json:"objectID"`
+	Tenant   string     `json:"tenant"`
+	Pack     senml.Pack `json:"pack"`
+}
+
+// FrameCounter is the last frame counter seen for a sensor. Seen is a bitmap of the preceding
+// frame counters that have been received, where bit n is set if FCnt-n-1 has been seen.
+type FrameCounter struct {
+	FCnt      int       `json:"fCnt"`
+	Seen      uint64    `json:"seen"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// EventQuery selects stored sensor events. Empty fields are not used as filters. SensorType
+// matches the decoder that was used, with or without version, and Error matches any part of
+// the error text. A nil Tenants does not restrict the tenants, and also matches the events of
+// unknown devices that have no tenant, while an empty Tenants matches no events at all.
+type EventQuery struct {
+	SensorID   string
+	DeviceID   string
+	SensorType string
+	Error      string
+	HasError   *bool
+	TraceID    string
+	Tenants    []string
+	From       time.Time
+	To         time.Time
+	Limit      int
+	// NewestFirst returns the latest events first instead of the oldest.
+	NewestFirst bool
+	// After continues a previous query after the last event it returned.
+	After *EventCursor
+}
+
+// EventCursor is the position of a stored event in the order of a query.
+type EventCursor struct {
+	Time time.Time
+	ID   string
+}
+
+// StoredEvent is a row in sensor_events_v2.
+type StoredEvent struct {
+	ID       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	SensorID string          `json:"sensorId"`
+	DeviceID string          `json:"deviceId,omitempty"`
+	Tenant   string          `json:"tenant,omitempty"`
+	Decoder  string          `json:"decoder,omitempty"`
+	Event    Event           `json:"event"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Objects  json.RawMessage `json:"objects,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	TraceID  string          `json:"traceId,omitempty"`
+}
+
 type DecoderErr struct {
 	Code      int
 	Messages  []string
@@ -144,9 +207,13 @@ func (m *StatusMessage) Body() []byte {
 	return b
 }
 
+// IncomingMessage is a message from an application server. DevEUI and Tenant are hints taken
+// from where the message was received, such as the topic of an mqtt message.
 type IncomingMessage struct {
 	ID     string `json:"id"`
 	Type   string `json:"type"`
 	Source string `json:"source,omitempty"`
+	DevEUI string `json:"devEUI,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
 	Data   []byte `json:"data"`
 }
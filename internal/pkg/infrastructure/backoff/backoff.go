@@ -0,0 +1,23 @@
+package backoff
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Exponential returns the delay after a failed attempt, starting at minDelay and doubled for
+// each attempt up to maxDelay.
+func Exponential(attempt int, minDelay, maxDelay time.Duration) time.Duration {
+	d := minDelay
+	for i := 1; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxDelay)
+}
+
+// Jittered returns the exponential delay after a failed attempt, reduced by a random jitter of
+// up to half the delay so that retries from several agents are spread out.
+func Jittered(attempt int, minDelay, maxDelay time.Duration) time.Duration {
+	d := Exponential(attempt, minDelay, maxDelay)
+	return d/2 + rand.N(d/2+1)
+}
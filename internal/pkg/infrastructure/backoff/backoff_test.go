@@ -0,0 +1,23 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponential(t *testing.T) {
+	for attempt, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 100: 10 * time.Second} {
+		if d := Exponential(attempt, time.Second, 10*time.Second); d != expected {
+			t.Fatalf("expected %s after attempt %d, got %s", expected, attempt, d)
+		}
+	}
+}
+
+func TestJittered(t *testing.T) {
+	for attempt := 1; attempt < 10; attempt++ {
+		expected := Exponential(attempt, time.Second, 10*time.Second)
+		if d := Jittered(attempt, time.Second, 10*time.Second); d < expected/2 || d > expected {
+			t.Fatalf("expected a delay between %s and %s after attempt %d, got %s", expected/2, expected, attempt, d)
+		}
+	}
+}
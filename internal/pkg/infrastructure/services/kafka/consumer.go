@@ -0,0 +1,385 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/backoff"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const commitTimeout = 5 * time.Second
+
+// MessageHandler handles a consumed message. The offset of the message is committed unless an
+// error, other than types.ErrNoDevice, types.ErrDecoderError or types.ErrInvalidMessage, is
+// returned, in which case the message is handled again until it has been attempted MaxAttempts
+// times and produced to the dead letter topic, or until it succeeds if there is none.
+type MessageHandler func(ctx context.Context, im types.IncomingMessage) error
+
+// ConsumerConfig configures the consumption of messages from kafka topics.
+type ConsumerConfig struct {
+	Brokers []string
+	Topics  []string
+	GroupID string
+	// Format is incoming if the messages are types.IncomingMessage as json, or raw if they are
+	// the events of a network server. The type of a raw event is taken from its type header, or
+	// is MessageType if it has none, and the key of the message is used as DevEUI hint.
+	Format      string
+	MessageType string
+	// MinBackoff and MaxBackoff bound the exponential backoff between attempts to handle a
+	// message that failed, and between attempts to fetch messages.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is the number of attempts to handle a message before it is produced to
+	// DeadLetterTopic, so that it does not stall its partition. Without a dead letter topic the
+	// message is never dropped, and is handled again until it succeeds.
+	MaxAttempts     int
+	DeadLetterTopic string
+}
+
+func (c ConsumerConfig) validate() error {
+	if len(c.Brokers) == 0 || len(c.Topics) == 0 {
+		return errors.New("at least one kafka broker and topic are required")
+	}
+
+	if c.GroupID == "" {
+		return errors.New("a kafka consumer group is required")
+	}
+
+	if c.Format != "incoming" && c.Format != "raw" {
+		return fmt.Errorf("expected kafka message format incoming or raw, got %q", c.Format)
+	}
+
+	return nil
+}
+
+// reader is the part of kafka.Reader that is used by the consumer.
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// writer is the part of kafka.Writer that is used to produce dead letters.
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Consumer handles the messages of a consumer group, one at a time. Offsets are committed once
+// a message has been handled, so messages that are not handled when the agent stops are consumed
+// again by the group.
+type Consumer struct {
+	cfg         ConsumerConfig
+	reader      reader
+	deadLetters writer
+	handler     MessageHandler
+	log         *slog.Logger
+
+	consumed     metric.Int64Counter
+	retries      metric.Int64Counter
+	deadLettered metric.Int64Counter
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewConsumer(ctx context.Context, cfg ConsumerConfig, handler MessageHandler) (*Consumer, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     cfg.Brokers,
+		GroupID:     cfg.GroupID,
+		GroupTopics: cfg.Topics,
+		StartOffset: kafka.FirstOffset,
+		MaxBytes:    10e6,
+		// offsets are committed when a message has been handled
+		CommitInterval: 0,
+	})
+
+	var w writer
+	if cfg.DeadLetterTopic != "" {
+		w = &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.DeadLetterTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			MaxAttempts:  1,
+			BatchSize:    1,
+		}
+	}
+
+	return newConsumer(ctx, cfg, r, w, handler), nil
+}
+
+func newConsumer(ctx context.Context, cfg ConsumerConfig, r reader, w writer, handler MessageHandler) *Consumer {
+	log := logging.GetFromContext(ctx).With(slog.String("kafka-group", cfg.GroupID))
+	cfg.MaxBackoff = max(cfg.MaxBackoff, cfg.MinBackoff)
+	cfg.MaxAttempts = max(cfg.MaxAttempts, 1)
+
+	c := &Consumer{
+		cfg:         cfg,
+		reader:      r,
+		deadLetters: w,
+		handler:     handler,
+		log:         log,
+	}
+
+	meter := otel.Meter("iot-agent/kafka")
+
+	var err error
+
+	c.consumed, err = meter.Int64Counter(
+		"diwise.kafka.consumed.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of kafka messages that have been handled and committed"),
+	)
+	if err != nil {
+		log.Error("failed to create otel consumed counter", "err", err.Error())
+	}
+
+	c.retries, err = meter.Int64Counter(
+		"diwise.kafka.retries.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of kafka messages that failed to be handled and are handled again"),
+	)
+	if err != nil {
+		log.Error("failed to create otel retries counter", "err", err.Error())
+	}
+
+	c.deadLettered, err = meter.Int64Counter(
+		"diwise.kafka.deadletters.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of kafka messages that failed to be handled too many times and were dead-lettered"),
+	)
+	if err != nil {
+		log.Error("failed to create otel dead letters counter", "err", err.Error())
+	}
+
+	return c
+}
+
+func (c *Consumer) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel != nil {
+		c.log.Warn("kafka consumer is already running")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+
+	c.log.Info("consuming kafka topics", "topics", c.cfg.Topics, "format", c.cfg.Format)
+
+	go func() {
+		defer close(c.done)
+		c.run(ctx)
+	}()
+}
+
+// Stop waits for the message that is being handled, and commits it if it was handled, before it
+// closes the reader.
+func (c *Consumer) Stop() {
+	c.mu.Lock()
+	cancel, done := c.cancel, c.done
+	c.cancel = nil
+	c.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	if err := c.reader.Close(); err != nil {
+		c.log.Error("failed to close kafka reader", "err", err.Error())
+	}
+
+	if c.deadLetters != nil {
+		if err := c.deadLetters.Close(); err != nil {
+			c.log.Error("failed to close kafka dead letter writer", "err", err.Error())
+		}
+	}
+}
+
+func (c *Consumer) run(ctx context.Context) {
+	failures := 0
+
+	for {
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return
+			}
+
+			failures++
+			delay := c.backoff(failures)
+			c.log.Error("failed to fetch kafka message", "attempt", failures, "delay", delay.String(), "err", err.Error())
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		failures = 0
+
+		if !c.handle(ctx, msg) {
+			return
+		}
+
+		// a message that is not committed is consumed again after a rebalance or a restart
+		commitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), commitTimeout)
+		err = c.reader.CommitMessages(commitCtx, msg)
+		cancel()
+		if err != nil {
+			c.log.Error("failed to commit kafka message", "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "err", err.Error())
+			continue
+		}
+
+		c.consumed.Add(ctx, 1, metric.WithAttributes(attribute.String("topic", msg.Topic)))
+	}
+}
+
+// handle handles the message until it succeeds, fails in a way that handling it again will not
+// change, or has been attempted MaxAttempts times, and reports whether it may be committed.
+func (c *Consumer) handle(ctx context.Context, msg kafka.Message) bool {
+	log := c.log.With("topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+
+	im, err := c.incomingMessage(msg)
+	if err != nil {
+		log.Warn("skipping kafka message that could not be read", "err", err.Error())
+		return true
+	}
+
+	// a message that is being handled is not abandoned when the consumer is stopped
+	msgCtx := otel.GetTextMapPropagator().Extract(context.WithoutCancel(ctx), HeaderCarrier{Headers: &msg.Headers})
+
+	for attempt := 1; ; attempt++ {
+		err := c.handler(msgCtx, im)
+
+		switch {
+		case err == nil, errors.Is(err, types.ErrNoDevice):
+			return true
+		case errors.Is(err, types.ErrDecoderError), errors.Is(err, types.ErrInvalidMessage):
+			log.Warn("error while processing message", "err", err.Error())
+			return true
+		}
+
+		if attempt >= c.cfg.MaxAttempts && c.deadLetters != nil {
+			return c.deadLetter(ctx, log, msg, attempt, err)
+		}
+
+		delay := c.backoff(attempt)
+
+		c.retries.Add(ctx, 1, metric.WithAttributes(attribute.String("topic", msg.Topic)))
+		log.Error("failed to handle kafka message", "attempt", attempt, "delay", delay.String(), "err", err.Error())
+
+		if attempt == c.cfg.MaxAttempts {
+			log.Warn("kafka message failed too many times and there is no dead letter topic, its partition is stalled until it is handled", "attempts", attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// deadLetter produces a message that failed too many times to the dead letter topic, with the
+// origin of the message and the last error in the headers, and reports whether it may be
+// committed. A message is not committed until it has been produced.
+func (c *Consumer) deadLetter(ctx context.Context, log *slog.Logger, msg kafka.Message, attempts int, cause error) bool {
+	attrs := metric.WithAttributes(attribute.String("topic", msg.Topic))
+
+	dl := kafka.Message{
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: append(slices.Clone(msg.Headers),
+			kafka.Header{Key: "dead-letter-topic", Value: []byte(msg.Topic)},
+			kafka.Header{Key: "dead-letter-partition", Value: []byte(strconv.Itoa(msg.Partition))},
+			kafka.Header{Key: "dead-letter-offset", Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+			kafka.Header{Key: "dead-letter-attempts", Value: []byte(strconv.Itoa(attempts))},
+			kafka.Header{Key: "dead-letter-error", Value: []byte(cause.Error())},
+		),
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.deadLetters.WriteMessages(context.WithoutCancel(ctx), dl)
+		if err == nil {
+			log.Error("moved kafka message that failed too many times to the dead letter topic", "attempts", attempts, "err", cause.Error())
+			c.deadLettered.Add(ctx, 1, attrs)
+			return true
+		}
+
+		delay := c.backoff(attempt)
+		log.Error("failed to produce kafka dead letter", "attempt", attempt, "delay", delay.String(), "err", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Consumer) incomingMessage(msg kafka.Message) (types.IncomingMessage, error) {
+	id := msg.Topic + "/" + strconv.Itoa(msg.Partition) + "/" + strconv.FormatInt(msg.Offset, 10)
+
+	if c.cfg.Format == "incoming" {
+		var im types.IncomingMessage
+		if err := json.Unmarshal(msg.Value, &im); err != nil {
+			return im, err
+		}
+
+		if im.ID == "" {
+			im.ID = id
+		}
+
+		// the tenant of a message is set by the producer, and is therefore not used
+		im.Tenant = ""
+
+		return im, nil
+	}
+
+	im := types.IncomingMessage{
+		ID:     id,
+		Type:   c.cfg.MessageType,
+		Source: msg.Topic,
+		DevEUI: string(msg.Key),
+		Data:   msg.Value,
+	}
+
+	for _, h := range msg.Headers {
+		if h.Key == "type" {
+			im.Type = string(h.Value)
+		}
+	}
+
+	return im, nil
+}
+
+func (c *Consumer) backoff(attempt int) time.Duration {
+	return backoff.Jittered(attempt, c.cfg.MinBackoff, c.cfg.MaxBackoff)
+}
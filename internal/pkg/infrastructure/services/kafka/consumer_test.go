@@ -0,0 +1,321 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestRawMessagesAreCommittedWhenHandled(t *testing.T) {
+	r := newFakeReader(kafka.Message{
+		Topic:   "uplinks",
+		Offset:  7,
+		Key:     []byte("a81758fffe0524f3"),
+		Value:   []byte(`{"data":"AQID"}`),
+		Headers: []kafka.Header{{Key: "tenant", Value: []byte("kommun")}},
+	})
+
+	handled := make(chan types.IncomingMessage, 1)
+	c := newTestConsumer(t, "raw", r, func(ctx context.Context, im types.IncomingMessage) error {
+		handled <- im
+		return nil
+	})
+
+	c.Start()
+	im := <-handled
+	r.waitForCommits(t, 1)
+	c.Stop()
+
+	// the tenant header is set by the producer and should not be used
+	if im.ID != "uplinks/0/7" || im.Type != "up" || im.Source != "uplinks" || im.DevEUI != "a81758fffe0524f3" || im.Tenant != "" || string(im.Data) != `{"data":"AQID"}` {
+		t.Fatalf("unexpected incoming message %+v", im)
+	}
+}
+
+func TestMessagesAreNotCommittedUntilHandled(t *testing.T) {
+	r := newFakeReader(
+		kafka.Message{Topic: "uplinks", Offset: 1, Value: []byte(`{"type":"up","data":"e30="}`)},
+		kafka.Message{Topic: "uplinks", Offset: 2, Value: []byte(`{"type":"up","data":"e30="}`)},
+	)
+
+	var mu sync.Mutex
+	attempts := map[int64]int{}
+
+	c := newTestConsumer(t, "incoming", r, func(ctx context.Context, im types.IncomingMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		offset := map[string]int64{"uplinks/0/1": 1, "uplinks/0/2": 2}[im.ID]
+		attempts[offset]++
+
+		if offset == 1 && attempts[offset] < 3 {
+			if committed := r.committed(); len(committed) > 0 {
+				t.Errorf("expected no commits before the first message is handled, got %v", committed)
+			}
+			return errors.New("iot-core is unavailable")
+		}
+
+		if offset == 2 {
+			return types.ErrInvalidMessage
+		}
+
+		return nil
+	})
+
+	c.Start()
+	r.waitForCommits(t, 2)
+	c.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if attempts[1] != 3 || attempts[2] != 1 {
+		t.Fatalf("expected three attempts for the failing message and one for the invalid message, got %v", attempts)
+	}
+}
+
+func TestMessagesThatFailAreNotCommittedWhenStopped(t *testing.T) {
+	r := newFakeReader(kafka.Message{Topic: "uplinks", Value: []byte(`{}`)})
+
+	failed := make(chan struct{}, 10)
+	c := newTestConsumer(t, "raw", r, func(ctx context.Context, im types.IncomingMessage) error {
+		failed <- struct{}{}
+		return errors.New("iot-core is unavailable")
+	})
+	c.cfg.MinBackoff, c.cfg.MaxBackoff = time.Minute, time.Minute
+
+	c.Start()
+	<-failed
+	c.Stop()
+
+	if committed := r.committed(); len(committed) != 0 || !r.closed {
+		t.Fatalf("expected the reader to be closed without commits, got %v", committed)
+	}
+}
+
+func TestMessagesThatFailTooManyTimesAreDeadLettered(t *testing.T) {
+	r := newFakeReader(
+		kafka.Message{Topic: "uplinks", Offset: 1, Key: []byte("a81758fffe0524f3"), Value: []byte(`{}`)},
+		kafka.Message{Topic: "uplinks", Offset: 2, Value: []byte(`{}`)},
+	)
+
+	var attempts atomic.Int32
+	c := newTestConsumer(t, "raw", r, func(ctx context.Context, im types.IncomingMessage) error {
+		if im.ID == "uplinks/0/2" {
+			return nil
+		}
+		attempts.Add(1)
+		return errors.New("poison")
+	})
+
+	w := &fakeWriter{}
+	c.deadLetters = w
+	c.cfg.MaxAttempts = 3
+
+	c.Start()
+	r.waitForCommits(t, 2)
+	c.Stop()
+
+	if attempts.Load() != 3 {
+		t.Fatalf("expected three attempts before the message is dead-lettered, got %d", attempts.Load())
+	}
+
+	dl := w.written()
+	if len(dl) != 1 || string(dl[0].Key) != "a81758fffe0524f3" || header(dl[0], "dead-letter-offset") != "1" || header(dl[0], "dead-letter-error") != "poison" {
+		t.Fatalf("unexpected dead letters %+v", dl)
+	}
+
+	if !w.closed {
+		t.Fatal("expected the dead letter writer to be closed")
+	}
+}
+
+func TestMessagesAreRetriedUntilHandledWithoutDeadLetterTopic(t *testing.T) {
+	r := newFakeReader(kafka.Message{Topic: "uplinks", Value: []byte(`{}`)})
+
+	var attempts atomic.Int32
+	c := newTestConsumer(t, "raw", r, func(ctx context.Context, im types.IncomingMessage) error {
+		if attempts.Add(1) < 5 {
+			if committed := r.committed(); len(committed) > 0 {
+				t.Errorf("expected no commits before the message is handled, got %v", committed)
+			}
+			return errors.New("iot-core is unavailable")
+		}
+		return nil
+	})
+	c.cfg.MaxAttempts = 2
+
+	c.Start()
+	r.waitForCommits(t, 1)
+	c.Stop()
+
+	if attempts.Load() != 5 {
+		t.Fatalf("expected the message to be handled until it succeeds, got %d attempts", attempts.Load())
+	}
+}
+
+func TestFetchIsBackedOffAfterErrors(t *testing.T) {
+	r := newFakeReader(kafka.Message{Topic: "uplinks", Value: []byte(`{}`)})
+	r.fetchErrors.Store(3)
+
+	c := newTestConsumer(t, "raw", r, func(ctx context.Context, im types.IncomingMessage) error {
+		return nil
+	})
+	c.cfg.MinBackoff, c.cfg.MaxBackoff = 20*time.Millisecond, 20*time.Millisecond
+
+	start := time.Now()
+	c.Start()
+	r.waitForCommits(t, 1)
+	c.Stop()
+
+	// each failed fetch is followed by a delay of at least half the backoff
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("expected failed fetches to be backed off, the message was committed after %s", elapsed)
+	}
+}
+
+func TestConsumerConfigIsValidated(t *testing.T) {
+	for _, cfg := range []ConsumerConfig{
+		{Topics: []string{"uplinks"}, GroupID: "iot-agent", Format: "raw"},
+		{Brokers: []string{"kafka:9092"}, GroupID: "iot-agent", Format: "raw"},
+		{Brokers: []string{"kafka:9092"}, Topics: []string{"uplinks"}, Format: "raw"},
+		{Brokers: []string{"kafka:9092"}, Topics: []string{"uplinks"}, GroupID: "iot-agent", Format: "avro"},
+	} {
+		if _, err := NewConsumer(t.Context(), cfg, nil); err == nil {
+			t.Fatalf("expected an error for %+v", cfg)
+		}
+	}
+}
+
+func newTestConsumer(t *testing.T, format string, r reader, handler MessageHandler) *Consumer {
+	t.Helper()
+
+	cfg := ConsumerConfig{
+		Brokers:     []string{"kafka:9092"},
+		Topics:      []string{"uplinks"},
+		GroupID:     "iot-agent",
+		Format:      format,
+		MessageType: "up",
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		MaxAttempts: 10,
+	}
+
+	return newConsumer(t.Context(), cfg, r, nil, handler)
+}
+
+type fakeReader struct {
+	messages    chan kafka.Message
+	fetchErrors atomic.Int32
+
+	mu      sync.Mutex
+	commits []int64
+	closed  bool
+}
+
+func newFakeReader(msgs ...kafka.Message) *fakeReader {
+	r := &fakeReader{messages: make(chan kafka.Message, len(msgs))}
+	for _, m := range msgs {
+		r.messages <- m
+	}
+	return r
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if r.fetchErrors.Add(-1) >= 0 {
+		return kafka.Message{}, errors.New("broker is unavailable")
+	}
+
+	select {
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	case m, ok := <-r.messages:
+		if !ok {
+			return kafka.Message{}, io.EOF
+		}
+		return m, nil
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range msgs {
+		r.commits = append(r.commits, m.Offset)
+	}
+
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	return nil
+}
+
+func (r *fakeReader) committed() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]int64(nil), r.commits...)
+}
+
+func (r *fakeReader) waitForCommits(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.committed()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d commits, got %v", n, r.committed())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type fakeWriter struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	closed   bool
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	return nil
+}
+
+func (w *fakeWriter) written() []kafka.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]kafka.Message(nil), w.messages...)
+}
+
+func header(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+)
+
+// ProducerConfig configures the production of decoded measurements to a kafka topic.
+type ProducerConfig struct {
+	Brokers []string
+	Topic   string
+}
+
+// Producer produces the decoded measurements as json to a kafka topic, with the trace context
+// in the headers. Messages are keyed by device so that the measurements of a device are kept in
+// order in a partition.
+type Producer struct {
+	writer *kafka.Writer
+}
+
+func NewProducer(cfg ProducerConfig) (*Producer, error) {
+	if len(cfg.Brokers) == 0 || cfg.Topic == "" {
+		return nil, errors.New("a topic and at least one kafka broker are required")
+	}
+
+	return &Producer{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// failed messages are retried by the caller
+			MaxAttempts: 1,
+			// measurements are sent one at a time, so a message is written as soon as it is sent
+			// instead of waiting for a batch to fill up
+			BatchSize:    1,
+			BatchTimeout: 5 * time.Millisecond,
+		},
+	}, nil
+}
+
+func (p *Producer) Send(ctx context.Context, m types.MeasurementPack) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	msg := kafka.Message{
+		Key:   []byte(m.DeviceID),
+		Value: b,
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier{Headers: &msg.Headers})
+
+	return p.writer.WriteMessages(ctx, msg)
+}
+
+func (p *Producer) Close() error {
+	return p.writer.Close()
+}
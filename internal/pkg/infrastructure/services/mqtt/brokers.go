@@ -0,0 +1,242 @@
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NewConfigsFromEnvironment returns the configuration of each broker connection. Connections
+// are read from the file in MQTT_BROKERS_FILE if it is set. Otherwise MQTT_BROKERS may list the
+// names of several connections, each configured by <NAME>_MQTT_* variables, and if it is not set
+// a single connection is configured by the MQTT_* variables.
+func NewConfigsFromEnvironment() ([]Config, error) {
+	if path := os.Getenv("MQTT_BROKERS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open mqtt brokers file: %w", err)
+		}
+		defer f.Close()
+
+		return NewConfigsFromFile(f)
+	}
+
+	brokers := os.Getenv("MQTT_BROKERS")
+	if brokers == "" {
+		cfg, err := NewConfigFromEnvironment("")
+		if err != nil {
+			return nil, err
+		}
+		return []Config{cfg}, nil
+	}
+
+	configs := []Config{}
+
+	for name := range strings.SplitSeq(brokers, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		cfg, err := NewConfigFromEnvironment(strings.ToUpper(name) + "_")
+		if err != nil {
+			return nil, err
+		}
+
+		configs = append(configs, cfg)
+	}
+
+	return configs, validateNames(configs)
+}
+
+type brokersFile struct {
+	Brokers []brokerConfig `yaml:"brokers"`
+}
+
+type brokerConfig struct {
+	Name      string   `yaml:"name"`
+	Disabled  bool     `yaml:"disabled"`
+	Scheme    string   `yaml:"scheme"`
+	Host      string   `yaml:"host"`
+	Port      int      `yaml:"port"`
+	Path      string   `yaml:"path"`
+	KeepAlive int64    `yaml:"keepAlive"`
+	User      string   `yaml:"user"`
+	Password  string   `yaml:"password"`
+	Topics    []string `yaml:"topics"`
+	QoS       *int     `yaml:"qos"`
+	Facade    string   `yaml:"facade"`
+	ClientID  string   `yaml:"clientId"`
+	Session   string   `yaml:"session"`
+	Protocol  string   `yaml:"protocolVersion"`
+	Group     string   `yaml:"shareGroup"`
+	TLS       struct {
+		CAFile             string `yaml:"caFile"`
+		CertFile           string `yaml:"certFile"`
+		KeyFile            string `yaml:"keyFile"`
+		ServerName         string `yaml:"serverName"`
+		MinVersion         string `yaml:"minVersion"`
+		InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	} `yaml:"tls"`
+}
+
+// NewConfigsFromFile reads the configuration of broker connections from yaml. A password may be
+// given as ${VARIABLE} to read it from the environment.
+func NewConfigsFromFile(r io.Reader) ([]Config, error) {
+	var f brokersFile
+
+	err := yaml.NewDecoder(r).Decode(&f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mqtt brokers file: %w", err)
+	}
+
+	configs := make([]Config, 0, len(f.Brokers))
+
+	for _, b := range f.Brokers {
+		if b.Name == "" {
+			return nil, fmt.Errorf("a name is required for each mqtt broker")
+		}
+
+		b.Password = os.ExpandEnv(b.Password)
+
+		cfg, err := b.config(func(setting string) string { return setting })
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration of mqtt broker %q: %w", b.Name, err)
+		}
+
+		configs = append(configs, cfg)
+	}
+
+	return configs, validateNames(configs)
+}
+
+// config validates the settings of a broker connection, whether they were read from the
+// environment or from a brokers file, and applies the defaults of the settings that are not
+// set. Errors refer to a setting by the name that field returns for its name in a brokers file.
+func (b brokerConfig) config(field func(setting string) string) (Config, error) {
+	var err error
+
+	cfg := Config{
+		name:      strings.ToLower(b.Name),
+		enabled:   !b.Disabled,
+		scheme:    strings.ToLower(b.Scheme),
+		host:      b.Host,
+		port:      b.Port,
+		path:      b.Path,
+		keepAlive: b.KeepAlive,
+		user:      b.User,
+		password:  b.Password,
+		topics:    b.Topics,
+		qos:       1,
+		facade:    strings.ToLower(b.Facade),
+		clientId:  b.ClientID,
+		group:     b.Group,
+		tls: tlsConfig{
+			caFile:             b.TLS.CAFile,
+			certFile:           b.TLS.CertFile,
+			keyFile:            b.TLS.KeyFile,
+			serverName:         b.TLS.ServerName,
+			insecureSkipVerify: b.TLS.InsecureSkipVerify,
+		},
+	}
+
+	if !cfg.enabled {
+		return cfg, nil
+	}
+
+	if cfg.host == "" {
+		return cfg, fmt.Errorf("the mqtt host must be specified using %s", field("host"))
+	}
+
+	if len(cfg.topics) == 0 {
+		return cfg, fmt.Errorf("at least one topic (%s) must be added to the configuration", field("topics"))
+	}
+
+	if _, err := parseTopicTemplates(cfg.topics); err != nil {
+		return cfg, err
+	}
+
+	switch cfg.scheme {
+	case "", "tls":
+		cfg.scheme = "ssl"
+	case "tcp", "ssl", "ws", "wss":
+	default:
+		return cfg, fmt.Errorf("invalid %s: expected tcp, ssl, ws or wss, got %q", field("scheme"), cfg.scheme)
+	}
+
+	if cfg.port == 0 {
+		cfg.port = defaultPorts[cfg.scheme]
+	}
+
+	if cfg.port < 1 || cfg.port > 65535 {
+		return cfg, fmt.Errorf("invalid %s: %d is outside valid range 1-65535", field("port"), cfg.port)
+	}
+
+	if cfg.path == "" && (cfg.scheme == "ws" || cfg.scheme == "wss") {
+		cfg.path = "/mqtt"
+	}
+
+	if cfg.keepAlive == 0 {
+		cfg.keepAlive = 30
+	}
+
+	if b.QoS != nil {
+		if *b.QoS < 0 || *b.QoS > 2 {
+			return cfg, fmt.Errorf("invalid %s: expected 0, 1 or 2, got %d", field("qos"), *b.QoS)
+		}
+		cfg.qos = byte(*b.QoS)
+	}
+
+	if cfg.session, err = parseSessionMode(b.Session); err != nil {
+		return cfg, fmt.Errorf("invalid %s: %w", field("session"), err)
+	}
+
+	if cfg.isDurable() && cfg.clientId == "" {
+		return cfg, fmt.Errorf("%s must be specified for durable sessions", field("clientId"))
+	}
+
+	if cfg.version, err = parseProtocolVersion(b.Protocol); err != nil {
+		return cfg, fmt.Errorf("invalid %s: %w", field("protocolVersion"), err)
+	}
+
+	if strings.ContainsAny(cfg.group, "/+#") {
+		return cfg, fmt.Errorf("invalid %s: %q may not contain /, + or #", field("shareGroup"), cfg.group)
+	}
+
+	if (cfg.tls.certFile == "") != (cfg.tls.keyFile == "") {
+		return cfg, fmt.Errorf("both %s and %s must be specified for client certificates", field("tls.certFile"), field("tls.keyFile"))
+	}
+
+	if cfg.tls.minVersion, err = parseTLSVersion(b.TLS.MinVersion); err != nil {
+		return cfg, fmt.Errorf("invalid %s: %w", field("tls.minVersion"), err)
+	}
+
+	return cfg, nil
+}
+
+func validateNames(configs []Config) error {
+	names := map[string]bool{}
+
+	for _, cfg := range configs {
+		if names[cfg.Name()] {
+			return fmt.Errorf("mqtt broker %q is configured more than once", cfg.Name())
+		}
+		names[cfg.Name()] = true
+	}
+
+	return nil
+}
+
+// Enabled returns false if the broker connection has been disabled.
+func (c Config) Enabled() bool {
+	return c.enabled
+}
+
+// Facade returns the name of the facade that messages from the broker should be decoded with,
+// or an empty string to use the default facade.
+func (c Config) Facade() string {
+	return c.facade
+}
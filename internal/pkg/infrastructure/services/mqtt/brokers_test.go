@@ -0,0 +1,141 @@
+package mqtt
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNewConfigsFromEnvironmentUsesNamedBrokers(t *testing.T) {
+	t.Setenv("MQTT_BROKERS", "netmore, mosquitto")
+
+	t.Setenv("NETMORE_MQTT_HOST", "netmore.example")
+	t.Setenv("NETMORE_MQTT_TOPIC_0", "netmore/#")
+	t.Setenv("NETMORE_MQTT_FACADE", "netmore")
+	t.Setenv("NETMORE_MQTT_QOS", "0")
+
+	t.Setenv("MOSQUITTO_MQTT_SCHEME", "tcp")
+	t.Setenv("MOSQUITTO_MQTT_HOST", "mosquitto.local")
+	t.Setenv("MOSQUITTO_MQTT_TOPIC_0", "application/#")
+	t.Setenv("MOSQUITTO_MQTT_TOPIC_1", "lwm2m/#")
+
+	configs, err := NewConfigsFromEnvironment()
+	if err != nil {
+		t.Fatalf("expected configs, got error: %v", err)
+	}
+
+	if len(configs) != 2 {
+		t.Fatalf("expected two brokers, got %d", len(configs))
+	}
+
+	netmore, mosquitto := configs[0], configs[1]
+
+	if netmore.Name() != "netmore" || netmore.Facade() != "netmore" || netmore.qos != 0 || netmore.brokerURL() != "ssl://netmore.example:8883" {
+		t.Fatalf("unexpected netmore config %+v", netmore)
+	}
+
+	if mosquitto.Name() != "mosquitto" || mosquitto.Facade() != "" || mosquitto.qos != 1 || len(mosquitto.topics) != 2 || mosquitto.brokerURL() != "tcp://mosquitto.local:1883" {
+		t.Fatalf("unexpected mosquitto config %+v", mosquitto)
+	}
+}
+
+func TestNewConfigsFromFile(t *testing.T) {
+	t.Setenv("NETMORE_PASSWORD", "s3cr3t")
+
+	configs, err := NewConfigsFromFile(strings.NewReader(brokersYaml))
+	if err != nil {
+		t.Fatalf("expected configs, got error: %v", err)
+	}
+
+	if len(configs) != 2 {
+		t.Fatalf("expected two brokers, got %d", len(configs))
+	}
+
+	netmore := configs[0]
+	if netmore.password != "s3cr3t" || !netmore.isDurable() || netmore.clientId != "iot-agent" || netmore.keepAlive != 30 {
+		t.Fatalf("unexpected netmore config %+v", netmore)
+	}
+
+	if configs[1].brokerURL() != "wss://mosquitto.local:443/mqtt" || configs[1].qos != 2 {
+		t.Fatalf("unexpected mosquitto config %+v", configs[1])
+	}
+
+	_, err = NewConfigsFromFile(strings.NewReader(brokersYaml + "\n  - name: netmore\n    disabled: true\n"))
+	if err == nil {
+		t.Fatal("expected an error for a broker that is configured more than once")
+	}
+}
+
+func TestEnvironmentAndFileAreValidatedAlike(t *testing.T) {
+	t.Setenv("MQTT_HOST", "broker.example")
+	t.Setenv("MQTT_TOPIC_0", "application/#")
+	t.Setenv("MQTT_PASSWORD", "${NOT_EXPANDED}")
+
+	cfg, err := NewConfigFromEnvironment("")
+	if err != nil || cfg.password != "${NOT_EXPANDED}" {
+		t.Fatalf("expected the password of the environment to be used as is, got %q (%v)", cfg.password, err)
+	}
+
+	for _, tc := range []struct {
+		env, value, yaml, setting string
+	}{
+		{"MQTT_SCHEME", "http", "scheme: http", "MQTT_SCHEME"},
+		{"MQTT_QOS", "3", "qos: 3", "MQTT_QOS"},
+		{"MQTT_PROTOCOL_VERSION", "6", "protocolVersion: 6", "MQTT_PROTOCOL_VERSION"},
+		{"MQTT_SHARE_GROUP", "a/b", "shareGroup: a/b", "MQTT_SHARE_GROUP"},
+		{"MQTT_CERT_FILE", "/certs/client.pem", "tls: {certFile: /certs/client.pem}", "MQTT_KEY_FILE"},
+		{"MQTT_TLS_MIN_VERSION", "1.4", "tls: {minVersion: \"1.4\"}", "MQTT_TLS_MIN_VERSION"},
+	} {
+		t.Run(tc.env, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+
+			_, err := NewConfigFromEnvironment("")
+			if err == nil || !strings.Contains(err.Error(), tc.setting) {
+				t.Fatalf("expected an error naming %s, got %v", tc.setting, err)
+			}
+
+			yaml := "brokers:\n  - name: broker\n    host: broker.example\n    topics: [application/#]\n    " + tc.yaml + "\n"
+			if _, err := NewConfigsFromFile(strings.NewReader(yaml)); err == nil {
+				t.Fatalf("expected %q to be rejected in a brokers file", tc.yaml)
+			}
+		})
+	}
+}
+
+func TestNewClientForwardsToTheRouteOfTheBrokerFacade(t *testing.T) {
+	client, err := NewClient(context.Background(), Config{
+		name:    "netmore",
+		enabled: true,
+		host:    "broker.example",
+		port:    8883,
+		topics:  []string{"foo/#"},
+		facade:  "netmore",
+		session: sessionModeEphemeral,
+	}, Forwarding{Endpoint: "http://example.invalid/api/v0/messages/"})
+	if err != nil {
+		t.Fatalf("expected client, got error: %v", err)
+	}
+
+	if endpoint := client.(*mqttClient).forwarder.forwardingEndpoint; endpoint != "http://example.invalid/api/v0/messages/netmore" {
+		t.Fatalf("unexpected forwarding endpoint %q", endpoint)
+	}
+}
+
+const brokersYaml string = `
+brokers:
+  - name: netmore
+    host: netmore.example
+    user: diwise
+    password: ${NETMORE_PASSWORD}
+    facade: netmore
+    session: durable
+    clientId: iot-agent
+    topics:
+      - netmore/#
+  - name: mosquitto
+    scheme: wss
+    host: mosquitto.local
+    qos: 2
+    topics:
+      - application/#
+`
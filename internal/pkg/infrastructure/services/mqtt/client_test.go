@@ -16,7 +16,7 @@ func TestNewClientUsesEphemeralSessionDefaults(t *testing.T) {
 		keepAlive: 30,
 		topics:    []string{"foo/#"},
 		session:   sessionModeEphemeral,
-	}, "http://example.invalid/api/v0/messages")
+	}, Forwarding{Endpoint: "http://example.invalid/api/v0/messages"})
 	if err != nil {
 		t.Fatalf("expected client, got error: %v", err)
 	}
@@ -48,7 +48,7 @@ func TestNewClientUsesDurableSessionOptions(t *testing.T) {
 		topics:    []string{"foo/#"},
 		clientId:  "iot-agent-durable",
 		session:   sessionModeDurable,
-	}, "http://example.invalid/api/v0/messages")
+	}, Forwarding{Endpoint: "http://example.invalid/api/v0/messages"})
 	if err != nil {
 		t.Fatalf("expected client, got error: %v", err)
 	}
@@ -121,7 +121,7 @@ func TestNewClientRejectsDurableSessionWithoutClientID(t *testing.T) {
 		keepAlive: 30,
 		topics:    []string{"foo/#"},
 		session:   sessionModeDurable,
-	}, "http://example.invalid/api/v0/messages")
+	}, Forwarding{Endpoint: "http://example.invalid/api/v0/messages"})
 	if err == nil {
 		t.Fatal("expected error when durable mqtt session lacks client id")
 	}
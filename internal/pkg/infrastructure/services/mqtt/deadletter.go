@@ -0,0 +1,45 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a message that could not be forwarded within the retry policy.
+type DeadLetter struct {
+	Broker    string
+	Topic     string
+	MessageID uint16
+	Payload   []byte
+	Attempts  int
+	LastError string
+	TraceID   string
+	Received  time.Time
+}
+
+// DeadLetterStore keeps messages that could not be forwarded so that they can be inspected
+// and replayed later.
+type DeadLetterStore interface {
+	AddMQTTDeadLetter(ctx context.Context, dl DeadLetter) error
+}
+
+// memoryDeadLetterStore keeps dead letters in memory. It is intended for devmode and tests,
+// dead letters are lost on restart.
+type memoryDeadLetterStore struct {
+	deadLetters []DeadLetter
+	mu          sync.Mutex
+}
+
+func NewMemoryDeadLetterStore() DeadLetterStore {
+	return &memoryDeadLetterStore{}
+}
+
+func (s *memoryDeadLetterStore) AddMQTTDeadLetter(ctx context.Context, dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deadLetters = append(s.deadLetters, dl)
+
+	return nil
+}
@@ -0,0 +1,474 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix    = ".seg"
+	commitFile       = "commit"
+	recordHeaderSize = 8
+	recordFixedSize  = 24
+)
+
+// diskQueue keeps received messages in append-only segment files, so that they are neither
+// lost when the forwarder falls behind nor when the agent is restarted. The sequence number of
+// the last handled message is stored in a commit file, and a segment file is removed when all
+// of its messages have been handled. Messages may be handled out of order by several workers,
+// and the commit file then records the last message before the first one that has not been
+// handled. A message may be forwarded again if the agent stops before it has been committed.
+type diskQueue struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	log          *slog.Logger
+
+	mu       sync.Mutex
+	segments []*segment
+	active   *os.File
+	pending  []record
+	cursor   int
+	handled  map[uint64]bool
+	bytes    int64
+	nextSeq  uint64
+	ready    chan struct{}
+}
+
+type segment struct {
+	path string
+	size int64
+	last uint64
+}
+
+type record struct {
+	seq      uint64
+	segment  *segment
+	offset   int64
+	size     int64
+	received time.Time
+}
+
+func openDiskQueue(log *slog.Logger, dir string, cfg QueueConfig) (*diskQueue, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	q := &diskQueue{
+		dir:          dir,
+		maxBytes:     cfg.MaxBytes,
+		segmentBytes: cfg.SegmentBytes,
+		log:          log,
+		handled:      map[uint64]bool{},
+		ready:        make(chan struct{}, 1),
+	}
+
+	committed, err := q.readCommit()
+	if err != nil {
+		return nil, err
+	}
+	q.nextSeq = committed + 1
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+
+	for _, path := range paths {
+		s, records, err := q.scan(path)
+		if err != nil {
+			return nil, err
+		}
+
+		q.segments = append(q.segments, s)
+
+		for _, r := range records {
+			q.nextSeq = max(q.nextSeq, r.seq+1)
+			if r.seq > committed {
+				q.pending = append(q.pending, r)
+				q.bytes += r.size
+			}
+		}
+	}
+
+	if !cfg.Replay && len(q.pending) > 0 {
+		log.Warn("discarding messages left in the mqtt queue", "dir", dir, "count", len(q.pending))
+		q.pending = nil
+		q.bytes = 0
+		committed = q.nextSeq - 1
+
+		err = q.writeCommit(committed)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(q.pending) > 0 {
+		log.Info("replaying messages left in the mqtt queue", "dir", dir, "count", len(q.pending))
+	}
+
+	q.removeSegments(committed)
+
+	err = q.rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// scan reads the records of a segment file. A record that was only partly written before the
+// agent stopped ends the segment, and the file is truncated after the last complete record.
+func (q *diskQueue) scan(path string) (*segment, []record, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open queue segment: %w", err)
+	}
+	defer f.Close()
+
+	s := &segment{path: path}
+	records := []record{}
+	header := make([]byte, recordHeaderSize)
+
+	for {
+		_, err := io.ReadFull(f, header)
+		if err != nil {
+			break
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		_, err = io.ReadFull(f, body)
+		if err != nil || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) || len(body) < recordFixedSize {
+			break
+		}
+
+		r := record{
+			seq:      binary.BigEndian.Uint64(body[0:8]),
+			segment:  s,
+			offset:   s.size,
+			size:     int64(recordHeaderSize + len(body)),
+			received: time.Unix(0, int64(binary.BigEndian.Uint64(body[8:16]))),
+		}
+
+		records = append(records, r)
+		s.size += r.size
+		s.last = r.seq
+	}
+
+	if fi, err := f.Stat(); err == nil && fi.Size() > s.size {
+		q.log.Warn("truncating incomplete record in mqtt queue segment", "path", path, "offset", s.size)
+		if err := f.Truncate(s.size); err != nil {
+			return nil, nil, fmt.Errorf("failed to truncate queue segment: %w", err)
+		}
+	}
+
+	return s, records, nil
+}
+
+func (q *diskQueue) push(job queuedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.active == nil {
+		return errors.New("queue is closed")
+	}
+
+	job.seq = q.nextSeq
+	b := encodeRecord(job)
+
+	if q.bytes+int64(len(b)) > q.maxBytes {
+		return errQueueFull
+	}
+
+	s := q.segments[len(q.segments)-1]
+	if s.size > 0 && s.size+int64(len(b)) > q.segmentBytes {
+		err := q.rotate()
+		if err != nil {
+			return err
+		}
+		s = q.segments[len(q.segments)-1]
+	}
+
+	_, err := q.active.Write(b)
+	if err == nil {
+		err = q.active.Sync()
+	}
+	if err != nil {
+		q.active.Truncate(s.size)
+		return fmt.Errorf("failed to write to queue segment: %w", err)
+	}
+
+	q.pending = append(q.pending, record{seq: job.seq, segment: s, offset: s.size, size: int64(len(b)), received: job.received})
+	q.bytes += int64(len(b))
+	q.nextSeq++
+	s.size += int64(len(b))
+	s.last = job.seq
+
+	signal(q.ready)
+
+	return nil
+}
+
+func (q *diskQueue) next(ctx context.Context) (queuedMessage, bool) {
+	for {
+		q.mu.Lock()
+		if q.cursor < len(q.pending) {
+			r := q.pending[q.cursor]
+			q.cursor++
+			q.mu.Unlock()
+
+			job, err := readRecord(r)
+			if err == nil {
+				return job, true
+			}
+
+			q.log.Error("dropping unreadable message from the mqtt queue", "path", r.segment.path, "seq", r.seq, "err", err.Error())
+			q.done(queuedMessage{seq: r.seq})
+			continue
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return queuedMessage{}, false
+		case <-q.ready:
+		}
+	}
+}
+
+// done marks a message as handled, and removes it from the queue together with the handled
+// messages after it once all messages before it have been handled.
+func (q *diskQueue) done(job queuedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.handled[job.seq] = true
+
+	var committed uint64
+	for len(q.pending) > 0 && q.handled[q.pending[0].seq] {
+		committed = q.pending[0].seq
+		delete(q.handled, committed)
+
+		q.bytes -= q.pending[0].size
+		q.pending = q.pending[1:]
+		q.cursor--
+	}
+
+	if committed == 0 {
+		return nil
+	}
+
+	err := q.writeCommit(committed)
+	if err != nil {
+		return err
+	}
+
+	q.removeSegments(committed)
+
+	return nil
+}
+
+func (q *diskQueue) stats() (int, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return 0, time.Time{}
+	}
+
+	return len(q.pending), q.pending[0].received
+}
+
+func (q *diskQueue) persistent() bool {
+	return true
+}
+
+func (q *diskQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.active == nil {
+		return nil
+	}
+
+	err := q.active.Close()
+	q.active = nil
+
+	return err
+}
+
+// rotate starts a new segment file, named by the sequence number of its first message.
+func (q *diskQueue) rotate() error {
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d%s", q.nextSeq, segmentSuffix))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create queue segment: %w", err)
+	}
+
+	if q.active != nil {
+		q.active.Close()
+	}
+
+	if n := len(q.segments); n > 0 && q.segments[n-1].path == path {
+		q.segments = q.segments[:n-1]
+	}
+
+	q.active = f
+	q.segments = append(q.segments, &segment{path: path})
+
+	return nil
+}
+
+// removeSegments removes the segment files, except the one that is written to, that only
+// contain messages up to and including the committed sequence number.
+func (q *diskQueue) removeSegments(committed uint64) {
+	kept := q.segments[:0]
+
+	for i, s := range q.segments {
+		active := i == len(q.segments)-1 && q.active != nil
+		if active || s.last > committed {
+			kept = append(kept, s)
+			continue
+		}
+
+		err := os.Remove(s.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			q.log.Error("failed to remove mqtt queue segment", "path", s.path, "err", err.Error())
+			kept = append(kept, s)
+		}
+	}
+
+	q.segments = kept
+}
+
+func (q *diskQueue) readCommit() (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(q.dir, commitFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read queue commit file: %w", err)
+	}
+
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid queue commit file: %w", err)
+	}
+
+	return seq, nil
+}
+
+func (q *diskQueue) writeCommit(seq uint64) error {
+	path := filepath.Join(q.dir, commitFile)
+
+	err := os.WriteFile(path+".tmp", []byte(strconv.FormatUint(seq, 10)), 0o640)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write queue commit file: %w", err)
+	}
+
+	return nil
+}
+
+// encodeRecord encodes a message as a length and checksum header followed by the sequence
+// number, the time it was received, its message id, qos, duplicate flag, topic, trace context
+// and payload.
+func encodeRecord(job queuedMessage) []byte {
+	trace := encodeTraceContext(job.trace)
+
+	bodyLen := recordFixedSize + len(job.topic) + len(trace) + len(job.payload)
+	b := make([]byte, recordHeaderSize+bodyLen)
+	body := b[recordHeaderSize:]
+
+	binary.BigEndian.PutUint64(body[0:8], job.seq)
+	binary.BigEndian.PutUint64(body[8:16], uint64(job.received.UnixNano()))
+	binary.BigEndian.PutUint16(body[16:18], job.messageID)
+	body[18] = job.qos
+	if job.duplicate {
+		body[19] = 1
+	}
+	binary.BigEndian.PutUint16(body[20:22], uint16(len(job.topic)))
+	binary.BigEndian.PutUint16(body[22:24], uint16(len(trace)))
+	copy(body[recordFixedSize:], job.topic)
+	copy(body[recordFixedSize+len(job.topic):], trace)
+	copy(body[recordFixedSize+len(job.topic)+len(trace):], job.payload)
+
+	binary.BigEndian.PutUint32(b[0:4], uint32(bodyLen))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(body))
+
+	return b
+}
+
+func readRecord(r record) (queuedMessage, error) {
+	f, err := os.Open(r.segment.path)
+	if err != nil {
+		return queuedMessage{}, err
+	}
+	defer f.Close()
+
+	b := make([]byte, r.size)
+	_, err = f.ReadAt(b, r.offset)
+	if err != nil {
+		return queuedMessage{}, err
+	}
+
+	body := b[recordHeaderSize:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[4:8]) {
+		return queuedMessage{}, errors.New("checksum mismatch")
+	}
+
+	topicEnd := recordFixedSize + int(binary.BigEndian.Uint16(body[20:22]))
+	traceEnd := topicEnd + int(binary.BigEndian.Uint16(body[22:24]))
+	if traceEnd > len(body) {
+		return queuedMessage{}, errors.New("invalid topic or trace context length")
+	}
+
+	return queuedMessage{
+		seq:       binary.BigEndian.Uint64(body[0:8]),
+		received:  time.Unix(0, int64(binary.BigEndian.Uint64(body[8:16]))),
+		messageID: binary.BigEndian.Uint16(body[16:18]),
+		qos:       body[18],
+		duplicate: body[19] == 1,
+		topic:     string(body[recordFixedSize:topicEnd]),
+		trace:     decodeTraceContext(body[topicEnd:traceEnd]),
+		payload:   body[traceEnd:],
+	}, nil
+}
+
+func encodeTraceContext(trace map[string]string) []byte {
+	var b []byte
+	for k, v := range trace {
+		b = fmt.Appendf(b, "%s=%s\n", k, v)
+	}
+	return b
+}
+
+func decodeTraceContext(b []byte) map[string]string {
+	if len(b) == 0 {
+		return nil
+	}
+
+	trace := map[string]string{}
+	for line := range strings.SplitSeq(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			trace[k] = v
+		}
+	}
+
+	return trace
+}
@@ -0,0 +1,164 @@
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueReplaysMessagesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := QueueConfig{MaxBytes: 1 << 20, SegmentBytes: 100, Replay: true}
+
+	q := openTestQueue(t, dir, cfg)
+	for i := range 5 {
+		if err := q.push(testJob(i)); err != nil {
+			t.Fatalf("expected message to be queued, got error: %v", err)
+		}
+	}
+
+	if segments := countSegments(t, dir); segments < 3 {
+		t.Fatalf("expected messages to be written to several segments, got %d", segments)
+	}
+
+	for i := range 2 {
+		job, _ := q.next(t.Context())
+		if job.topic != fmt.Sprintf("a/%d/up", i) || string(job.payload) != fmt.Sprintf(`{"n":%d}`, i) || job.messageID != uint16(i) || job.qos != 1 {
+			t.Fatalf("unexpected message %+v", job)
+		}
+		q.done(job)
+	}
+	q.close()
+
+	q = openTestQueue(t, dir, cfg)
+	if depth, _ := q.stats(); depth != 3 {
+		t.Fatalf("expected three messages to be replayed, got %d", depth)
+	}
+
+	for i := 2; i < 5; i++ {
+		job, _ := q.next(t.Context())
+		if job.topic != fmt.Sprintf("a/%d/up", i) {
+			t.Fatalf("expected message %d, got %s", i, job.topic)
+		}
+		q.done(job)
+	}
+
+	if segments := countSegments(t, dir); segments != 1 {
+		t.Fatalf("expected handled segments to be removed, got %d segments", segments)
+	}
+
+	if err := q.push(testJob(5)); err != nil {
+		t.Fatalf("expected message to be queued, got error: %v", err)
+	}
+	q.close()
+
+	q = openTestQueue(t, dir, QueueConfig{MaxBytes: 1 << 20, SegmentBytes: 100, Replay: false})
+	defer q.close()
+
+	if depth, _ := q.stats(); depth != 0 {
+		t.Fatalf("expected queued messages to be discarded, got %d", depth)
+	}
+}
+
+func TestDiskQueueIsLimitedInSizeAndDropsIncompleteRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	q := openTestQueue(t, dir, QueueConfig{MaxBytes: 100, SegmentBytes: 1 << 20, Replay: true})
+	q.push(testJob(0))
+	q.push(testJob(1))
+
+	if err := q.push(testJob(2)); err != errQueueFull {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+	q.close()
+
+	// a record that was only partly written when the agent stopped
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", 1, segmentSuffix))
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write(encodeRecord(queuedMessage{seq: 3, topic: "a/3/up"})[:20])
+	f.Close()
+
+	q = openTestQueue(t, dir, QueueConfig{MaxBytes: 100, SegmentBytes: 1 << 20, Replay: true})
+	defer q.close()
+
+	if depth, _ := q.stats(); depth != 2 {
+		t.Fatalf("expected the two complete messages to be replayed, got %d", depth)
+	}
+
+	if err := q.push(testJob(3)); err != errQueueFull {
+		t.Fatalf("expected replayed messages to count towards the size limit, got %v", err)
+	}
+}
+
+func TestMessageForwarderWithDiskQueueAcksWhenQueued(t *testing.T) {
+	release := make(chan struct{})
+	var requestCount atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		requestCount.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer s.Close()
+
+	dir := t.TempDir()
+	f, err := newMessageForwarder(t.Context(), Forwarding{
+		Endpoint: s.URL,
+		Queue:    QueueConfig{Dir: dir, MaxBytes: 1 << 20, SegmentBytes: 1 << 20, Replay: true},
+		broker:   "netmore",
+	}, defaultForwarderQueueDepth)
+	if err != nil {
+		t.Fatalf("expected forwarder, got error: %v", err)
+	}
+	defer f.Close()
+
+	msg := &fakeMessage{topic: "a/b/up", payload: []byte(`{"k":"v"}`), qos: 1}
+	f.Handle(nil, msg)
+
+	if msg.acked.Load() != 1 {
+		t.Fatal("expected the message to be acked when it has been queued")
+	}
+
+	close(release)
+	waitFor(t, func() bool { return requestCount.Load() == 1 })
+	waitFor(t, func() bool { depth, _ := f.queue.stats(); return depth == 0 })
+
+	if _, err := os.Stat(filepath.Join(dir, "netmore", commitFile)); err != nil {
+		t.Fatalf("expected the forwarded message to be committed: %v", err)
+	}
+}
+
+func openTestQueue(t *testing.T, dir string, cfg QueueConfig) *diskQueue {
+	t.Helper()
+
+	q, err := openDiskQueue(slog.New(slog.DiscardHandler), dir, cfg)
+	if err != nil {
+		t.Fatalf("expected queue, got error: %v", err)
+	}
+
+	return q
+}
+
+func testJob(i int) queuedMessage {
+	return queuedMessage{
+		topic:     fmt.Sprintf("a/%d/up", i),
+		payload:   fmt.Appendf(nil, `{"n":%d}`, i),
+		qos:       1,
+		messageID: uint16(i),
+		received:  time.Now(),
+	}
+}
+
+func countSegments(t *testing.T, dir string) int {
+	t.Helper()
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	return len(paths)
+}
@@ -2,24 +2,32 @@ package mqtt
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/backoff"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var tracer = otel.Tracer("iot-agent/mqtt/message-handler")
@@ -35,62 +43,280 @@ type queuedMessage struct {
 	qos       byte
 	messageID uint16
 	duplicate bool
+	received  time.Time
+	seq       uint64
+	trace     map[string]string
 	ack       func()
 }
 
+// MessageHandler handles a received message in-process. Messages are acknowledged unless an
+// error, other than types.ErrNoDevice, types.ErrDecoderError or types.ErrInvalidMessage, is
+// returned.
+type MessageHandler func(ctx context.Context, im types.IncomingMessage) error
+
+// Forwarding configures where received messages are sent. Messages are handled in-process by
+// Handler if it is set, and posted to Endpoint otherwise. Messages that can not be forwarded
+// within the Retry policy are moved to DeadLetters, or dropped if it is not set.
+type Forwarding struct {
+	Endpoint    string
+	Token       string
+	Handler     MessageHandler
+	Retry       RetryPolicy
+	DeadLetters DeadLetterStore
+	Queue       QueueConfig
+	// Workers is the number of messages that are forwarded at the same time. Messages are
+	// sharded by DevEUI so that the messages from a device are forwarded in order.
+	Workers int
+
+	broker string
+	topics []topicTemplate
+}
+
+// RetryPolicy bounds how a message that could not be forwarded is attempted again. A zero
+// policy is replaced by DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts before a message is dead-lettered.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the exponential backoff between attempts. A Retry-After
+	// header is honoured up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		MinBackoff:  500 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	return backoff.Jittered(attempt, p.MinBackoff, p.MaxBackoff)
+}
+
+// retryAfterError is returned when the receiver asks for the message to be sent again later.
+type retryAfterError struct {
+	statusCode int
+	after      time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("unexpected response code %d", e.statusCode)
+}
+
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+
+	return 0
+}
+
 type messageForwarder struct {
 	ctx                context.Context
 	cancel             context.CancelFunc
 	forwardingEndpoint string
+	forwardingToken    string
+	handler            MessageHandler
+	retry              RetryPolicy
+	deadLetters        DeadLetterStore
+	broker             string
+	topics             []topicTemplate
 	logger             *slog.Logger
 	messageCounter     metric.Int64Counter
+	retryCounter       metric.Int64Counter
+	deadLetterCounter  metric.Int64Counter
+	shardCounter       metric.Int64Counter
+	gauges             metric.Registration
 	httpClient         *http.Client
-	jobs               chan queuedMessage
+	queue              queue
+	shards             []chan queuedMessage
 	closeOnce          sync.Once
+	// unacked is set by clients that acknowledge messages in the order they were received, and
+	// must therefore not leave a message unacknowledged. Messages that can not be queued are
+	// dead-lettered by such clients, and unacked is called for messages that could not be
+	// acknowledged at all.
+	unacked func()
 }
 
 func NewMessageHandler(ctx context.Context, forwardingEndpoint string) func(mqtt.Client, mqtt.Message) {
-	forwarder := newMessageForwarder(ctx, forwardingEndpoint, defaultForwarderQueueDepth)
-	return forwarder.Handle
+	handler, _ := NewForwardingHandler(ctx, Forwarding{Endpoint: forwardingEndpoint})
+	return handler
 }
 
-func newMessageForwarder(ctx context.Context, forwardingEndpoint string, queueDepth int) *messageForwarder {
-	messageCounter, err := otel.Meter("iot-agent/mqtt").Int64Counter(
+// NewForwardingHandler returns a handler that forwards the messages it is passed as configured by
+// fwd, until the context is cancelled.
+func NewForwardingHandler(ctx context.Context, fwd Forwarding) (func(mqtt.Client, mqtt.Message), error) {
+	forwarder, err := newMessageForwarder(ctx, fwd, defaultForwarderQueueDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	return forwarder.Handle, nil
+}
+
+func newMessageForwarder(ctx context.Context, fwd Forwarding, queueDepth int) (*messageForwarder, error) {
+	meter := otel.Meter("iot-agent/mqtt")
+	logger := logging.GetFromContext(ctx)
+
+	messageCounter, err := meter.Int64Counter(
 		"diwise.mqtt.messages.total",
 		metric.WithUnit("1"),
 		metric.WithDescription("Total number of received mqtt messages"),
 	)
+	if err != nil {
+		logger.Error("failed to create otel message counter", "err", err.Error())
+	}
 
-	logger := logging.GetFromContext(ctx)
+	retryCounter, err := meter.Int64Counter(
+		"diwise.mqtt.forward.retries.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of failed attempts to forward an mqtt message that are retried"),
+	)
+	if err != nil {
+		logger.Error("failed to create otel retries counter", "err", err.Error())
+	}
 
+	deadLetterCounter, err := meter.Int64Counter(
+		"diwise.mqtt.forward.deadlettered.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of mqtt messages that could not be forwarded and were dead-lettered"),
+	)
 	if err != nil {
-		logger.Error("failed to create otel message counter", "err", err.Error())
+		logger.Error("failed to create otel dead-lettered counter", "err", err.Error())
 	}
 
-	if queueDepth < 1 {
-		queueDepth = 1
+	shardCounter, err := meter.Int64Counter(
+		"diwise.mqtt.shard.messages.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of mqtt messages handled by each forwarding worker"),
+	)
+	if err != nil {
+		logger.Error("failed to create otel shard counter", "err", err.Error())
+	}
+
+	if fwd.Retry.MaxAttempts < 1 {
+		fwd.Retry = DefaultRetryPolicy()
+	}
+
+	var q queue = newMemoryQueue(queueDepth)
+
+	if fwd.Queue.Dir != "" {
+		defaults := DefaultQueueConfig()
+		fwd.Queue.MaxBytes = cmp.Or(fwd.Queue.MaxBytes, defaults.MaxBytes)
+		fwd.Queue.SegmentBytes = cmp.Or(fwd.Queue.SegmentBytes, defaults.SegmentBytes)
+
+		dir := filepath.Join(fwd.Queue.Dir, cmp.Or(fwd.broker, "default"))
+
+		q, err = openDiskQueue(logger, dir, fwd.Queue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open mqtt queue: %w", err)
+		}
 	}
 
 	workerCtx, cancel := context.WithCancel(ctx)
 	f := &messageForwarder{
 		ctx:                workerCtx,
 		cancel:             cancel,
-		forwardingEndpoint: forwardingEndpoint,
+		forwardingEndpoint: fwd.Endpoint,
+		forwardingToken:    fwd.Token,
+		handler:            fwd.Handler,
+		retry:              fwd.Retry,
+		deadLetters:        fwd.DeadLetters,
+		broker:             fwd.broker,
+		topics:             fwd.topics,
 		logger:             logger,
 		messageCounter:     messageCounter,
+		retryCounter:       retryCounter,
+		deadLetterCounter:  deadLetterCounter,
+		shardCounter:       shardCounter,
 		httpClient: &http.Client{
 			Timeout:   forwardRequestTimeout,
 			Transport: otelhttp.NewTransport(http.DefaultTransport),
 		},
-		jobs: make(chan queuedMessage, queueDepth),
+		queue:  q,
+		shards: make([]chan queuedMessage, max(fwd.Workers, 1)),
 	}
 
+	for i := range f.shards {
+		f.shards[i] = make(chan queuedMessage, shardQueueDepth)
+	}
+
+	f.gauges = f.registerQueueGauges(meter)
+
 	go f.run()
 
-	return f
+	return f, nil
+}
+
+func (f *messageForwarder) registerQueueGauges(meter metric.Meter) metric.Registration {
+	depth, err := meter.Int64ObservableGauge(
+		"diwise.mqtt.queue.depth",
+		metric.WithUnit("1"),
+		metric.WithDescription("Number of received mqtt messages waiting to be forwarded"),
+	)
+	if err != nil {
+		f.logger.Error("failed to create otel queue depth gauge", "err", err.Error())
+		return nil
+	}
+
+	age, err := meter.Float64ObservableGauge(
+		"diwise.mqtt.queue.age",
+		metric.WithUnit("s"),
+		metric.WithDescription("Age of the oldest received mqtt message waiting to be forwarded"),
+	)
+	if err != nil {
+		f.logger.Error("failed to create otel queue age gauge", "err", err.Error())
+		return nil
+	}
+
+	shardDepth, err := meter.Int64ObservableGauge(
+		"diwise.mqtt.shard.depth",
+		metric.WithUnit("1"),
+		metric.WithDescription("Number of mqtt messages waiting for each forwarding worker"),
+	)
+	if err != nil {
+		f.logger.Error("failed to create otel shard depth gauge", "err", err.Error())
+		return nil
+	}
+
+	attrs := metric.WithAttributes(attribute.String("broker", f.broker))
+
+	registration, err := meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		n, oldest := f.queue.stats()
+
+		o.ObserveInt64(depth, int64(n), attrs)
+		if n > 0 {
+			o.ObserveFloat64(age, time.Since(oldest).Seconds(), attrs)
+		} else {
+			o.ObserveFloat64(age, 0, attrs)
+		}
+
+		for i, shard := range f.shards {
+			o.ObserveInt64(shardDepth, int64(len(shard)), metric.WithAttributes(attribute.String("broker", f.broker), attribute.Int("shard", i)))
+		}
+
+		return nil
+	}, depth, age, shardDepth)
+	if err != nil {
+		f.logger.Error("failed to register otel queue gauges", "err", err.Error())
+		return nil
+	}
+
+	return registration
 }
 
 func (f *messageForwarder) Handle(client mqtt.Client, msg mqtt.Message) {
+	f.enqueue(msg, nil)
+}
+
+// enqueue queues a received message together with the trace context it was published with.
+func (f *messageForwarder) enqueue(msg mqtt.Message, trace map[string]string) {
 	f.messageCounter.Add(f.ctx, 1)
 
 	job := queuedMessage{
@@ -99,68 +325,198 @@ func (f *messageForwarder) Handle(client mqtt.Client, msg mqtt.Message) {
 		qos:       msg.Qos(),
 		messageID: msg.MessageID(),
 		duplicate: msg.Duplicate(),
+		received:  time.Now(),
+		trace:     trace,
 	}
 	if msg.Qos() > 0 {
 		job.ack = msg.Ack
 	}
 
-	select {
-	case <-f.ctx.Done():
+	if f.ctx.Err() != nil {
 		f.logger.Warn("mqtt forwarder is shutting down; leaving message unacked", "topic", job.topic, "message_id", job.messageID)
-	case f.jobs <- job:
-	default:
+		return
+	}
+
+	err := f.queue.push(job)
+	if err != nil && f.unacked != nil {
+		f.logger.Warn("failed to queue message; dead-lettering it to not hold back later messages", "topic", job.topic, "message_id", job.messageID, "err", err.Error())
+		if !f.deadLetter(f.ctx, f.logger, job, 0, err) {
+			f.unacked()
+		}
+		return
+	}
+	if errors.Is(err, errQueueFull) {
 		f.logger.Warn("mqtt forwarder queue is full; leaving message unacked", "topic", job.topic, "message_id", job.messageID)
+		return
+	}
+	if err != nil {
+		f.logger.Error("failed to queue message; leaving message unacked", "topic", job.topic, "message_id", job.messageID, "err", err.Error())
+		return
+	}
+
+	// a message in a persistent queue is not lost if the agent is stopped before it is forwarded
+	if f.queue.persistent() {
+		ack(job)
 	}
 }
 
 func (f *messageForwarder) Close() {
 	f.closeOnce.Do(func() {
 		f.cancel()
+		if f.gauges != nil {
+			f.gauges.Unregister()
+		}
 	})
 }
 
+// run passes queued messages to the worker of their shard until the forwarder is closed.
 func (f *messageForwarder) run() {
+	var wg sync.WaitGroup
+
+	for i, shard := range f.shards {
+		wg.Go(func() { f.work(i, shard) })
+	}
+
+	defer func() {
+		wg.Wait()
+		f.queue.close()
+	}()
+
 	for {
+		job, ok := f.queue.next(f.ctx)
+		if !ok {
+			return
+		}
+
 		select {
 		case <-f.ctx.Done():
 			return
-		case job := <-f.jobs:
-			f.forward(job)
+		case f.shards[f.shardFor(job)] <- job:
 		}
 	}
 }
 
-func (f *messageForwarder) forward(job queuedMessage) {
+func (f *messageForwarder) work(shard int, jobs <-chan queuedMessage) {
+	attrs := metric.WithAttributes(attribute.String("broker", f.broker), attribute.Int("shard", shard))
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case job := <-jobs:
+			f.shardCounter.Add(f.ctx, 1, attrs)
+			f.settle(job)
+		}
+	}
+}
+
+// settle forwards a message and removes it from the queue. A message that is kept in a
+// persistent queue is attempted again after a while if it could neither be delivered nor
+// dead-lettered, and is otherwise left for the broker to redeliver.
+func (f *messageForwarder) settle(job queuedMessage) {
+	for !f.forward(job) {
+		if !f.queue.persistent() {
+			if f.unacked != nil && f.ctx.Err() == nil {
+				f.unacked()
+			}
+			return
+		}
+
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-time.After(f.retry.MaxBackoff):
+		}
+	}
+
+	err := f.queue.done(job)
+	if err != nil {
+		f.logger.Error("failed to remove forwarded message from queue", "topic", job.topic, "err", err.Error())
+	}
+}
+
+// forward delivers the message and retries failed attempts with a backoff. Messages that are
+// still not delivered after the last attempt are moved to the dead-letter store. The worker
+// is blocked while it waits, so that messages from a device are forwarded in order and new
+// messages are left unacknowledged for the broker to redeliver when the queue is full.
+// It reports whether the message has been settled, either delivered or dead-lettered.
+func (f *messageForwarder) forward(job queuedMessage) bool {
 	var err error
 
-	ctx, span := tracer.Start(f.ctx, "forward-message")
+	ctx := f.ctx
+	if len(job.trace) > 0 {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(job.trace))
+	}
+
+	ctx, span := tracer.Start(ctx, "forward-message")
 	defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
 	_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, f.logger, ctx)
 
-	parts := strings.Split(job.topic, "/")
+	hints := hintsFor(f.topics, job.topic)
 
 	im := types.IncomingMessage{
 		ID:     fmt.Sprintf("mqtt-%d", job.messageID),
-		Type:   parts[len(parts)-1],
+		Type:   hints.messageType,
 		Source: job.topic,
+		DevEUI: hints.devEUI,
+		Tenant: hints.tenant,
 		Data:   job.payload,
 	}
 
-	ctx = logging.NewContextWithLogger(ctx, log, "message_id", job.messageID, "duplicate", job.duplicate, "received_at", time.Now().Format(time.RFC3339Nano))
+	ctx = logging.NewContextWithLogger(ctx, log, "message_id", job.messageID, "duplicate", job.duplicate, "received_at", job.received.Format(time.RFC3339Nano))
+
+	for attempt := 1; ; attempt++ {
+		err = f.deliver(ctx, log, job, im)
+		if err == nil {
+			return true
+		}
+
+		if attempt >= f.retry.MaxAttempts {
+			return f.deadLetter(ctx, log, job, attempt, err)
+		}
+
+		delay := f.retry.backoff(attempt)
+
+		var retryAfter *retryAfterError
+		if errors.As(err, &retryAfter) {
+			delay = max(delay, min(retryAfter.after, f.retry.MaxBackoff))
+		}
+
+		f.retryCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("broker", f.broker)))
+		log.Warn("retrying message", "topic", job.topic, "attempt", attempt, "delay", delay.String(), "err", err.Error())
+
+		select {
+		case <-ctx.Done():
+			log.Warn("mqtt forwarder is shutting down; leaving message unacked", "topic", job.topic)
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// deliver forwards the message once. It returns nil if the message has been acknowledged, and
+// an error if it should be attempted again.
+func (f *messageForwarder) deliver(ctx context.Context, log *slog.Logger, job queuedMessage, im types.IncomingMessage) error {
+	if f.handler != nil {
+		return f.handle(ctx, log, job, im)
+	}
 
 	b, err := json.Marshal(im)
 	if err != nil {
 		log.Error("failed to marshal incoming message", "err", err.Error())
-		return
+		return err
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.forwardingEndpoint, bytes.NewReader(b))
 	if err != nil {
 		log.Error("failed to create http request", "err", err.Error())
-		return
+		return err
 	}
 
 	req.Header.Add("Content-Type", "application/json")
+	if f.forwardingToken != "" {
+		req.Header.Add("Authorization", "Bearer "+f.forwardingToken)
+	}
 
 	resp, err := f.httpClient.Do(req)
 	if err != nil {
@@ -172,7 +528,7 @@ func (f *messageForwarder) forward(job queuedMessage) {
 			"err", err,
 		)
 
-		return
+		return err
 	}
 	defer func() {
 		io.Copy(io.Discard, resp.Body)
@@ -181,30 +537,111 @@ func (f *messageForwarder) forward(job queuedMessage) {
 
 	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusNoContent {
 		ack(job)
-		return
+		return nil
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
 		ack(job)
-		return
+		return nil
 	}
 
 	if resp.StatusCode == http.StatusUnprocessableEntity {
 		log.Warn("error while processing message", "topic", im.Source, "duplicate", job.duplicate, "status_code", http.StatusUnprocessableEntity)
 		ack(job)
-		return
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &retryAfterError{
+			statusCode: resp.StatusCode,
+			after:      parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
-	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+	// the forwarding token is missing, invalid or not allowed to ingest, which is fixed by
+	// configuration rather than by the message, so the message is retried and dead-lettered
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		log.Error("forwarding request was not authorized", "status_code", resp.StatusCode)
+		return fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
 		log.Warn("dropping message after non-retryable response", "status_code", resp.StatusCode, "duplicate", job.duplicate)
 		ack(job)
-		return
+		return nil
 	}
 
 	log.Error(fmt.Sprintf("unexpected response code %d", resp.StatusCode),
 		"topic", job.topic,
 		"payload_snippet", string(job.payload[:min(100, len(job.payload))]),
 		"payload_bytes", len(job.payload))
+
+	return fmt.Errorf("unexpected response code %d", resp.StatusCode)
+}
+
+// deadLetter moves a message that could not be forwarded to the dead-letter store and
+// acknowledges it. The message is left unacknowledged if it could not be stored.
+func (f *messageForwarder) deadLetter(ctx context.Context, log *slog.Logger, job queuedMessage, attempts int, lastErr error) bool {
+	dl := DeadLetter{
+		Broker:    f.broker,
+		Topic:     job.topic,
+		MessageID: job.messageID,
+		Payload:   job.payload,
+		Attempts:  attempts,
+		LastError: lastErr.Error(),
+		Received:  job.received,
+	}
+
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.HasTraceID() {
+		dl.TraceID = spanCtx.TraceID().String()
+	}
+
+	if f.deadLetters != nil {
+		err := f.deadLetters.AddMQTTDeadLetter(ctx, dl)
+		if err != nil {
+			log.Error("failed to dead-letter message", "topic", job.topic, "err", err.Error())
+			return false
+		}
+		log.Error("message dead-lettered", "topic", job.topic, "attempts", attempts, "err", lastErr.Error())
+	} else {
+		log.Error("dropping message that could not be forwarded",
+			"topic", job.topic,
+			"attempts", attempts,
+			"payload_snippet", string(job.payload[:min(100, len(job.payload))]),
+			"payload_bytes", len(job.payload),
+			"err", lastErr.Error())
+	}
+
+	f.deadLetterCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("broker", f.broker)))
+	ack(job)
+
+	return true
+}
+
+// handle passes the message to the in-process handler and acknowledges it unless handling it
+// again could succeed, in which case the error is returned.
+func (f *messageForwarder) handle(ctx context.Context, log *slog.Logger, job queuedMessage, im types.IncomingMessage) error {
+	err := f.handler(ctx, im)
+
+	switch {
+	case err == nil:
+		ack(job)
+		return nil
+	case errors.Is(err, types.ErrNoDevice):
+		ack(job)
+		return nil
+	case errors.Is(err, types.ErrDecoderError), errors.Is(err, types.ErrInvalidMessage):
+		log.Warn("error while processing message", "topic", im.Source, "duplicate", job.duplicate, "err", err.Error())
+		ack(job)
+		return nil
+	default:
+		log.Error("failed to handle message",
+			"topic", job.topic,
+			"payload_snippet", string(job.payload[:min(100, len(job.payload))]),
+			"payload_bytes", len(job.payload),
+			"err", err.Error())
+		return err
+	}
 }
 
 func ack(job queuedMessage) {
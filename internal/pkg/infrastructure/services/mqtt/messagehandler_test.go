@@ -1,12 +1,17 @@
 package mqtt
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
 )
 
 type fakeMessage struct {
@@ -44,6 +49,258 @@ func TestMessageHandlerAcksOnCreated(t *testing.T) {
 	waitFor(t, func() bool { return msg.acked.Load() == 1 })
 }
 
+func TestMessageForwarderSendsBearerToken(t *testing.T) {
+	ctx := t.Context()
+
+	var authorization atomic.Value
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer s.Close()
+
+	f, _ := newMessageForwarder(ctx, Forwarding{Endpoint: s.URL, Token: "integration-token"}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	msg := &fakeMessage{topic: "a/b/up", payload: []byte(`{"k":"v"}`), qos: 1}
+
+	f.Handle(nil, msg)
+
+	waitFor(t, func() bool { return msg.acked.Load() == 1 })
+
+	if authorization.Load() != "Bearer integration-token" {
+		t.Fatalf("expected the forwarding token to be sent, got %q", authorization.Load())
+	}
+}
+
+func TestDirectForwardingAcksUnlessRetryable(t *testing.T) {
+	ctx := t.Context()
+
+	var handlerErr error
+	var calls int
+
+	deadLetters := NewMemoryDeadLetterStore()
+	f, _ := newMessageForwarder(ctx, Forwarding{
+		Handler: func(ctx context.Context, im types.IncomingMessage) error {
+			if im.Type != "up" || im.Source != "a/b/up" {
+				t.Errorf("unexpected incoming message %+v", im)
+			}
+			calls++
+			return handlerErr
+		},
+		Retry:       RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		DeadLetters: deadLetters,
+	}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	for _, tc := range []struct {
+		err   error
+		calls int
+	}{
+		{nil, 1},
+		{types.ErrDeviceNotFound, 1},
+		{fmt.Errorf("%w: bad json", types.ErrInvalidMessage), 1},
+		{types.ErrPayloadEmpty, 1},
+		{errors.New("rabbitmq is down"), 3},
+	} {
+		msg := &fakeMessage{topic: "a/b/up", payload: []byte(`{"k":"v"}`), qos: 1}
+
+		handlerErr, calls = tc.err, 0
+		f.forward(queuedMessage{topic: msg.topic, payload: msg.payload, qos: msg.qos, ack: msg.Ack})
+
+		if calls != tc.calls || msg.acked.Load() != 1 {
+			t.Fatalf("expected %d attempts and one ack for error %v, got %d and %d", tc.calls, tc.err, calls, msg.acked.Load())
+		}
+	}
+
+	dls := deadLetters.(*memoryDeadLetterStore).deadLetters
+	if len(dls) != 1 || dls[0].Attempts != 3 || dls[0].LastError != "rabbitmq is down" {
+		t.Fatalf("expected the failing message to be dead-lettered, got %+v", dls)
+	}
+}
+
+func TestMessageForwarderRetriesServerErrorsBeforeDeadLettering(t *testing.T) {
+	ctx := t.Context()
+
+	var requestCount atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer s.Close()
+
+	deadLetters := NewMemoryDeadLetterStore()
+	f, _ := newMessageForwarder(ctx, Forwarding{
+		Endpoint:    s.URL,
+		Retry:       RetryPolicy{MaxAttempts: 4, MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond},
+		DeadLetters: deadLetters,
+		broker:      "netmore",
+	}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	msg := &fakeMessage{topic: "a/b/up", payload: []byte(`{"k":"v"}`), qos: 1}
+	f.Handle(nil, msg)
+
+	waitFor(t, func() bool { return msg.acked.Load() == 1 })
+
+	if requestCount.Load() != 4 {
+		t.Fatalf("expected 4 attempts, got %d", requestCount.Load())
+	}
+
+	dl := deadLetters.(*memoryDeadLetterStore).deadLetters[0]
+	if dl.Broker != "netmore" || dl.Topic != "a/b/up" || string(dl.Payload) != `{"k":"v"}` || dl.LastError != "unexpected response code 502" {
+		t.Fatalf("unexpected dead letter %+v", dl)
+	}
+}
+
+func TestMessageForwarderDeadLettersUnauthorizedMessages(t *testing.T) {
+	ctx := t.Context()
+
+	var requestCount atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer s.Close()
+
+	deadLetters := NewMemoryDeadLetterStore()
+	f, _ := newMessageForwarder(ctx, Forwarding{
+		Endpoint:    s.URL,
+		Retry:       RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		DeadLetters: deadLetters,
+	}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	msg := &fakeMessage{topic: "a/b/up", payload: []byte(`{"k":"v"}`), qos: 1}
+	f.Handle(nil, msg)
+
+	waitFor(t, func() bool { return msg.acked.Load() == 1 })
+
+	if requestCount.Load() != 3 || len(deadLetters.(*memoryDeadLetterStore).deadLetters) != 1 {
+		t.Fatalf("expected 3 attempts and a dead letter, got %d attempts", requestCount.Load())
+	}
+}
+
+func TestMessageForwarderDeadLettersMessagesThatCanNotBeQueuedWhenAcksAreOrdered(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	deadLetters := NewMemoryDeadLetterStore()
+	f, _ := newMessageForwarder(t.Context(), Forwarding{
+		Handler: func(ctx context.Context, im types.IncomingMessage) error {
+			<-release
+			return nil
+		},
+		DeadLetters: deadLetters,
+	}, 1)
+	defer f.Close()
+
+	var reconnects atomic.Int32
+	f.unacked = func() { reconnects.Add(1) }
+
+	msgs := make([]*fakeMessage, 50)
+	for i := range msgs {
+		msgs[i] = &fakeMessage{topic: "a/b/up", payload: []byte(`{}`), qos: 1}
+		f.Handle(nil, msgs[i])
+	}
+
+	acked := 0
+	for _, msg := range msgs {
+		acked += int(msg.acked.Load())
+	}
+
+	// messages are only acknowledged once they have been handled, unless they are dead-lettered
+	if dls := len(deadLetters.(*memoryDeadLetterStore).deadLetters); acked == 0 || acked != dls || reconnects.Load() != 0 {
+		t.Fatalf("expected the messages that did not fit in the queue to be dead-lettered and acked, got %d acked, %d dead letters and %d reconnects", acked, dls, reconnects.Load())
+	}
+}
+
+func TestMessageForwarderReportsMessagesThatCanNotBeAckedWhenAcksAreOrdered(t *testing.T) {
+	f, _ := newMessageForwarder(t.Context(), Forwarding{
+		Handler: func(ctx context.Context, im types.IncomingMessage) error {
+			return errors.New("iot-core is unavailable")
+		},
+		Retry:       RetryPolicy{MaxAttempts: 1},
+		DeadLetters: failingDeadLetters{},
+	}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	unacked := make(chan struct{}, 1)
+	f.unacked = func() { unacked <- struct{}{} }
+
+	msg := &fakeMessage{topic: "a/b/up", payload: []byte(`{}`), qos: 1}
+	f.Handle(nil, msg)
+
+	select {
+	case <-unacked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a message that could neither be forwarded nor dead-lettered to be reported")
+	}
+
+	if msg.acked.Load() != 0 {
+		t.Fatal("expected the message to be left unacknowledged")
+	}
+}
+
+type failingDeadLetters struct{}
+
+func (failingDeadLetters) AddMQTTDeadLetter(ctx context.Context, dl DeadLetter) error {
+	return errors.New("database is unavailable")
+}
+
+func TestMessageForwarderHonoursRetryAfter(t *testing.T) {
+	ctx := t.Context()
+
+	var requestCount atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if requestCount.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer s.Close()
+
+	f, _ := newMessageForwarder(ctx, Forwarding{
+		Endpoint: s.URL,
+		Retry:    RetryPolicy{MaxAttempts: 2, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Second},
+	}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	msg := &fakeMessage{topic: "a/b/up", payload: []byte(`{"k":"v"}`), qos: 1}
+
+	start := time.Now()
+	f.forward(queuedMessage{topic: msg.topic, payload: msg.payload, qos: msg.qos, ack: msg.Ack})
+
+	if msg.acked.Load() != 1 || requestCount.Load() != 2 {
+		t.Fatalf("expected the message to be delivered on the second attempt, got %d attempts", requestCount.Load())
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expected the retry to wait for the Retry-After delay, waited %s", elapsed)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	for attempt, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 8: 10 * time.Second} {
+		if d := p.backoff(attempt); d < expected/2 || d > expected {
+			t.Fatalf("expected backoff after attempt %d to be between %s and %s, got %s", attempt, expected/2, expected, d)
+		}
+	}
+
+	now := time.Date(2024, 8, 5, 12, 0, 0, 0, time.UTC)
+	if d := parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now); d != 30*time.Second {
+		t.Fatalf("expected a Retry-After date to be parsed, got %s", d)
+	}
+}
+
 func TestMessageHandlerDoesNotAckOnServerError(t *testing.T) {
 	ctx := t.Context()
 
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -29,57 +30,87 @@ const (
 )
 
 type Config struct {
+	name      string
 	enabled   bool
+	scheme    string
 	host      string
 	port      int
+	path      string
 	keepAlive int64
 	user      string
 	password  string
 	topics    []string
+	qos       byte
+	facade    string
 	clientId  string
 	session   sessionMode
+	tls       tlsConfig
+	version   byte
+	group     string
 }
 
-func NewClient(ctx context.Context, cfg Config, forwardingEndpoint string) (Client, error) {
-	options := mqtt.NewClientOptions()
-
-	connectionString := fmt.Sprintf("ssl://%s:%d", cfg.host, cfg.port)
-	options.AddBroker(connectionString)
+const (
+	protocolVersion311 byte = 4
+	protocolVersion5   byte = 5
+)
 
-	options.SetUsername(cfg.user)
-	options.SetPassword(cfg.password)
+var defaultPorts = map[string]int{
+	"tcp": 1883,
+	"ssl": 8883,
+	"ws":  80,
+	"wss": 443,
+}
 
+func NewClient(ctx context.Context, cfg Config, fwd Forwarding) (Client, error) {
 	clientID, err := cfg.resolvedClientID()
 	if err != nil {
 		return nil, err
 	}
-	options.SetClientID(clientID)
 
-	forwarder := newMessageForwarder(ctx, forwardingEndpoint, defaultForwarderQueueDepth)
-	options.SetDefaultPublishHandler(forwarder.Handle)
+	// messages from a broker with its own facade are forwarded to the route of that facade
+	if cfg.facade != "" {
+		fwd.Endpoint = strings.TrimSuffix(fwd.Endpoint, "/") + "/" + cfg.facade
+	}
 
-	options.SetCleanSession(!cfg.isDurable())
-	options.SetKeepAlive(time.Duration(cfg.keepAlive) * time.Second)
-	options.SetAutoReconnect(true)
-	options.SetAutoAckDisabled(true)
-	options.SetConnectRetry(true)
-	options.SetConnectRetryInterval(10 * time.Second)
-	options.SetMaxReconnectInterval(10 * time.Second)
-	options.SetOrderMatters(false)
-	options.SetResumeSubs(cfg.isDurable())
+	fwd.broker = cfg.Name()
+	fwd.topics, err = parseTopicTemplates(cfg.topics)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarder, err := newMessageForwarder(ctx, fwd, defaultForwarderQueueDepth)
+	if err != nil {
+		return nil, err
+	}
 
 	log := logging.GetFromContext(ctx).With(
+		slog.String("mqtt-broker", cfg.Name()),
 		slog.String("mqtt-host", cfg.host),
 		slog.Int("mqtt-port", cfg.port),
 		slog.String("mqtt-session-mode", string(cfg.session)),
 	)
 
+	if cfg.version == protocolVersion5 {
+		return newV5Client(cfg, clientID, log, forwarder)
+	}
+
+	options, err := connectionOptions(cfg, clientID, log)
+	if err != nil {
+		return nil, err
+	}
+
+	options.SetDefaultPublishHandler(forwarder.Handle)
+	options.SetCleanSession(!cfg.isDurable())
+	options.SetAutoAckDisabled(true)
+	options.SetOrderMatters(false)
+	options.SetResumeSubs(cfg.isDurable())
+
 	options.OnConnect = func(mc mqtt.Client) {
 		log.Info("connected")
-		for _, topic := range cfg.topics {
+		for _, topic := range cfg.subscriptions() {
 			log.Info("subscribing to topic", "topic", topic)
 
-			token := mc.Subscribe(topic, 1, nil)
+			token := mc.Subscribe(topic, cfg.qos, nil)
 			token.Wait()
 			if token.Error() != nil {
 				log.Error("subscribe failed", "topic", topic, "err", token.Error())
@@ -87,6 +118,31 @@ func NewClient(ctx context.Context, cfg Config, forwardingEndpoint string) (Clie
 		}
 	}
 
+	return &mqttClient{
+		cfg:       cfg,
+		log:       log,
+		options:   options,
+		forwarder: forwarder,
+	}, nil
+}
+
+// connectionOptions returns the options used to connect to the broker, shared by the clients
+// that receive messages and the publisher.
+func connectionOptions(cfg Config, clientID string, log *slog.Logger) (*mqtt.ClientOptions, error) {
+	options := mqtt.NewClientOptions()
+
+	options.AddBroker(cfg.brokerURL())
+
+	options.SetUsername(cfg.user)
+	options.SetPassword(cfg.password)
+	options.SetClientID(clientID)
+
+	options.SetKeepAlive(time.Duration(cfg.keepAlive) * time.Second)
+	options.SetAutoReconnect(true)
+	options.SetConnectRetry(true)
+	options.SetConnectRetryInterval(10 * time.Second)
+	options.SetMaxReconnectInterval(10 * time.Second)
+
 	options.OnConnectionLost = func(mc mqtt.Client, err error) {
 		if err != nil {
 			log.Error("connection lost", "err", err)
@@ -100,16 +156,27 @@ func NewClient(ctx context.Context, cfg Config, forwardingEndpoint string) (Clie
 		log.Warn("attempting mqtt reconnect")
 	}
 
-	options.TLSConfig = &tls.Config{
-		InsecureSkipVerify: true,
+	if cfg.usesTLS() {
+		loader := newTLSLoader(cfg.tlsSettings())
+
+		tlsCfg, err := loader.load()
+		if err != nil {
+			return nil, fmt.Errorf("invalid mqtt tls configuration: %w", err)
+		}
+		options.SetTLSConfig(tlsCfg)
+
+		// certificates are loaded again before each connection attempt, in case they have been rotated
+		options.SetConnectionAttemptHandler(func(broker *url.URL, current *tls.Config) *tls.Config {
+			tlsCfg, err := loader.load()
+			if err != nil {
+				log.Error("failed to reload mqtt tls configuration, using the previous configuration", "err", err.Error())
+				return current
+			}
+			return tlsCfg
+		})
 	}
 
-	return &mqttClient{
-		cfg:       cfg,
-		log:       log,
-		options:   options,
-		forwarder: forwarder,
-	}, nil
+	return options, nil
 }
 
 func NewConfigFromEnvironment(prefix string) (Config, error) {
@@ -118,75 +185,122 @@ func NewConfigFromEnvironment(prefix string) (Config, error) {
 
 	//TODO: clientID should be <username>-<uuid>
 
-	cfg := Config{
-		enabled:   os.Getenv(fmt.Sprintf("%sMQTT_DISABLED", prefix)) != "true",
-		host:      os.Getenv(fmt.Sprintf("%sMQTT_HOST", prefix)),
-		port:      8883,
-		keepAlive: 30,
-		user:      os.Getenv(fmt.Sprintf("%sMQTT_USER", prefix)),
-		password:  os.Getenv(fmt.Sprintf("%sMQTT_PASSWORD", prefix)),
-		session:   sessionModeEphemeral,
-		topics: []string{
-			os.Getenv(fmt.Sprintf(topicEnvNamePattern, prefix, 0)),
-		},
-		clientId: os.Getenv(fmt.Sprintf("%sMQTT_CLIENT_ID", prefix)),
+	env := func(name string) string {
+		return os.Getenv(prefix + name)
 	}
 
-	if !cfg.enabled {
-		return cfg, nil
+	b := brokerConfig{
+		Name:     strings.TrimSuffix(prefix, "_"),
+		Disabled: env("MQTT_DISABLED") == "true",
+		Scheme:   env("MQTT_SCHEME"),
+		Host:     env("MQTT_HOST"),
+		Path:     env("MQTT_PATH"),
+		User:     env("MQTT_USER"),
+		Password: env("MQTT_PASSWORD"),
+		Facade:   env("MQTT_FACADE"),
+		ClientID: env("MQTT_CLIENT_ID"),
+		Session:  env("MQTT_SESSION_MODE"),
+		Protocol: env("MQTT_PROTOCOL_VERSION"),
+		Group:    env("MQTT_SHARE_GROUP"),
 	}
 
-	if cfg.host == "" {
-		return cfg, fmt.Errorf("the mqtt host must be specified using the %sMQTT_HOST environment variable", prefix)
-	}
+	b.TLS.CAFile = env("MQTT_CA_FILE")
+	b.TLS.CertFile = env("MQTT_CERT_FILE")
+	b.TLS.KeyFile = env("MQTT_KEY_FILE")
+	b.TLS.ServerName = env("MQTT_TLS_SERVER_NAME")
+	b.TLS.MinVersion = env("MQTT_TLS_MIN_VERSION")
+	b.TLS.InsecureSkipVerify = env("MQTT_TLS_INSECURE_SKIP_VERIFY") == "true"
 
-	parsedSessionMode, err := parseSessionMode(os.Getenv(fmt.Sprintf("%sMQTT_SESSION_MODE", prefix)))
-	if err != nil {
-		return cfg, fmt.Errorf("invalid %sMQTT_SESSION_MODE: %w", prefix, err)
+	if qos := env("MQTT_QOS"); qos != "" {
+		q, err := strconv.Atoi(strings.TrimSpace(qos))
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid %sMQTT_QOS: expected 0, 1 or 2, got %q", prefix, qos)
+		}
+		b.QoS = &q
 	}
-	cfg.session = parsedSessionMode
 
-	customPort := os.Getenv(fmt.Sprintf("%sMQTT_PORT", prefix))
+	customPort := env("MQTT_PORT")
 	if customPort != "" {
 		port, err := strconv.Atoi(customPort)
 		if err != nil {
-			return cfg, fmt.Errorf("custom port value %s is not parseable to an int (%s)", customPort, err.Error())
+			return Config{}, fmt.Errorf("custom port value %s is not parseable to an int (%s)", customPort, err.Error())
 		}
-		if port < 1 || port > 65535 {
-			return cfg, fmt.Errorf("custom port value %s is outside valid range 1-65535", customPort)
-		}
-		cfg.port = port
-	}
-
-	if cfg.topics[0] == "" {
-		return cfg, fmt.Errorf("at least one topic (%sMQTT_TOPIC_0) must be added to the configuration", prefix)
+		b.Port = port
 	}
 
-	if cfg.isDurable() && cfg.clientId == "" {
-		return cfg, fmt.Errorf("%sMQTT_CLIENT_ID must be specified when %sMQTT_SESSION_MODE=durable", prefix, prefix)
-	}
-
-	customKeepAlive := os.Getenv(fmt.Sprintf("%sMQTT_KEEPALIVE", prefix))
+	customKeepAlive := env("MQTT_KEEPALIVE")
 	if customKeepAlive != "" {
 		keepAlive, err := strconv.ParseInt(customKeepAlive, 10, 64)
 		if err != nil {
-			return cfg, fmt.Errorf("custom keepalive value %s is not parseable to an int (%s)", customKeepAlive, err.Error())
+			return Config{}, fmt.Errorf("custom keepalive value %s is not parseable to an int (%s)", customKeepAlive, err.Error())
 		}
-		cfg.keepAlive = keepAlive
+		b.KeepAlive = keepAlive
 	}
 
 	const maxTopicCount int = 25
 
-	for idx := 1; idx < maxTopicCount; idx++ {
-		varName := fmt.Sprintf(topicEnvNamePattern, prefix, idx)
-		value := os.Getenv(varName)
+	// topics are only read from MQTT_TOPIC_1 and onwards when MQTT_TOPIC_0 is set
+	if topic := os.Getenv(fmt.Sprintf(topicEnvNamePattern, prefix, 0)); topic != "" {
+		b.Topics = append(b.Topics, topic)
 
-		if value != "" {
-			cfg.topics = append(cfg.topics, value)
+		for idx := 1; idx < maxTopicCount; idx++ {
+			if value := os.Getenv(fmt.Sprintf(topicEnvNamePattern, prefix, idx)); value != "" {
+				b.Topics = append(b.Topics, value)
+			}
 		}
 	}
 
-	return cfg, nil
+	return b.config(func(setting string) string {
+		return prefix + envNames[setting]
+	})
+}
+
+// envNames are the environment variables of the settings of a brokers file.
+var envNames = map[string]string{
+	"scheme":          "MQTT_SCHEME",
+	"host":            "MQTT_HOST",
+	"port":            "MQTT_PORT",
+	"topics":          "MQTT_TOPIC_0",
+	"qos":             "MQTT_QOS",
+	"clientId":        "MQTT_CLIENT_ID",
+	"session":         "MQTT_SESSION_MODE",
+	"protocolVersion": "MQTT_PROTOCOL_VERSION",
+	"shareGroup":      "MQTT_SHARE_GROUP",
+	"tls.certFile":    "MQTT_CERT_FILE",
+	"tls.keyFile":     "MQTT_KEY_FILE",
+	"tls.minVersion":  "MQTT_TLS_MIN_VERSION",
+}
+
+// Name returns the name of the broker connection, or default for the unnamed connection.
+func (c Config) Name() string {
+	if c.name == "" {
+		return "default"
+	}
+	return c.name
+}
+
+func (c Config) usesTLS() bool {
+	return c.scheme == "" || c.scheme == "ssl" || c.scheme == "wss"
+}
+
+// tlsSettings returns the tls configuration of the broker connection, with the host of the
+// broker as the server name to verify the broker certificate against unless another server
+// name has been configured.
+func (c Config) tlsSettings() tlsConfig {
+	settings := c.tls
+	if settings.serverName == "" {
+		settings.serverName = c.host
+	}
+	return settings
+}
+
+func (c Config) brokerURL() string {
+	scheme := c.scheme
+	if scheme == "" {
+		scheme = "ssl"
+	}
+
+	return fmt.Sprintf("%s://%s:%d%s", scheme, c.host, c.port, c.path)
 }
 
 func (c Config) isDurable() bool {
@@ -205,6 +319,37 @@ func (c Config) resolvedClientID() (string, error) {
 	return "diwise/iot-agent/" + uuid.NewString(), nil
 }
 
+// subscriptions returns the topic filters to subscribe to, with the names of named wildcards
+// removed. Topics are subscribed to as shared subscriptions when a share group is configured,
+// so that each message is only delivered to one of the agents in the group.
+func (c Config) subscriptions() []string {
+	filters := make([]string, 0, len(c.topics))
+	for _, topic := range c.topics {
+		if t, err := parseTopicTemplate(topic); err == nil {
+			topic = t.filter
+		}
+
+		if c.group != "" {
+			topic = "$share/" + c.group + "/" + topic
+		}
+
+		filters = append(filters, topic)
+	}
+
+	return filters
+}
+
+func parseProtocolVersion(value string) (byte, error) {
+	switch strings.TrimSpace(value) {
+	case "", "3", "3.1.1", "4":
+		return protocolVersion311, nil
+	case "5", "5.0":
+		return protocolVersion5, nil
+	default:
+		return 0, fmt.Errorf("expected 3.1.1 or 5, got %q", value)
+	}
+}
+
 func parseSessionMode(value string) (sessionMode, error) {
 	switch strings.ToLower(strings.TrimSpace(value)) {
 	case "", string(sessionModeEphemeral):
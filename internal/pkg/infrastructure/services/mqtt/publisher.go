@@ -0,0 +1,195 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+)
+
+const publishTimeout = 5 * time.Second
+
+var errNotConnected = errors.New("mqtt publisher is not connected")
+
+var placeholderPattern = regexp.MustCompile(`\{[^}]*\}`)
+
+var topicLevelReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// PublishConfig configures the publishing of decoded measurements to a broker.
+type PublishConfig struct {
+	// Topic is the topic that a pack is published to, in which {tenant}, {deviceID} and
+	// {objectID} are replaced by the values of the pack, e.g. diwise/{tenant}/{deviceID}/{objectID}.
+	Topic    string
+	QoS      byte
+	Retained bool
+}
+
+// Publisher publishes the SenML packs of decoded measurements to a broker, using its own
+// connection with a clean session.
+type Publisher struct {
+	publish  PublishConfig
+	log      *slog.Logger
+	options  *mqtt.ClientOptions
+	running  atomic.Bool
+	client   mqtt.Client
+	clientMu sync.RWMutex
+}
+
+func NewPublisher(ctx context.Context, cfg Config, publish PublishConfig) (*Publisher, error) {
+	if !cfg.enabled {
+		return nil, fmt.Errorf("mqtt broker %s is disabled", cfg.Name())
+	}
+
+	if err := validatePublishTopic(publish.Topic); err != nil {
+		return nil, err
+	}
+
+	if publish.QoS > 2 {
+		return nil, fmt.Errorf("expected qos 0, 1 or 2, got %d", publish.QoS)
+	}
+
+	clientID := "diwise/iot-agent/publisher/" + uuid.NewString()
+	if cfg.clientId != "" {
+		clientID = cfg.clientId + "-publisher"
+	}
+
+	log := logging.GetFromContext(ctx).With(
+		slog.String("mqtt-broker", cfg.Name()),
+		slog.String("mqtt-host", cfg.host),
+		slog.Int("mqtt-port", cfg.port),
+		slog.String("mqtt-publish-topic", publish.Topic),
+	)
+
+	options, err := connectionOptions(cfg, clientID, log)
+	if err != nil {
+		return nil, err
+	}
+
+	options.SetCleanSession(true)
+	options.OnConnect = func(mqtt.Client) {
+		log.Info("connected")
+	}
+
+	return &Publisher{
+		publish: publish,
+		log:     log,
+		options: options,
+	}, nil
+}
+
+func (p *Publisher) Start() error {
+	if !p.running.CompareAndSwap(false, true) {
+		p.log.Warn("mqtt publisher is already running")
+		return nil
+	}
+
+	client := mqtt.NewClient(p.options)
+
+	p.clientMu.Lock()
+	p.client = client
+	p.clientMu.Unlock()
+
+	token := client.Connect()
+	go func() {
+		token.Wait()
+		if err := token.Error(); err != nil && p.running.Load() {
+			p.log.Error("mqtt connect failed", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+func (p *Publisher) Ready() bool {
+	p.clientMu.RLock()
+	defer p.clientMu.RUnlock()
+
+	return p.client != nil && p.client.IsConnectionOpen()
+}
+
+func (p *Publisher) Stop() {
+	p.running.Store(false)
+
+	p.clientMu.Lock()
+	client := p.client
+	p.client = nil
+	p.clientMu.Unlock()
+
+	if client != nil {
+		client.Disconnect(250)
+	}
+}
+
+// Send publishes the pack to its topic. Measurements are not queued while the publisher is
+// disconnected from the broker.
+func (p *Publisher) Send(ctx context.Context, m types.MeasurementPack) error {
+	p.clientMu.RLock()
+	client := p.client
+	p.clientMu.RUnlock()
+
+	if client == nil || !client.IsConnectionOpen() {
+		return errNotConnected
+	}
+
+	b, err := json.Marshal(m.Pack)
+	if err != nil {
+		return err
+	}
+
+	topic := publishTopic(p.publish.Topic, m)
+	token := client.Publish(topic, p.publish.QoS, p.publish.Retained, b)
+
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("failed to publish to %s: %w", topic, err)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(publishTimeout):
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+
+	return nil
+}
+
+func validatePublishTopic(topic string) error {
+	if topic == "" {
+		return errors.New("a topic to publish to is required")
+	}
+
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("topic %q to publish to may not contain wildcards", topic)
+	}
+
+	for _, placeholder := range placeholderPattern.FindAllString(topic, -1) {
+		switch placeholder {
+		case "{tenant}", "{deviceID}", "{objectID}":
+		default:
+			return fmt.Errorf("topic %q has an unknown placeholder %s", topic, placeholder)
+		}
+	}
+
+	return nil
+}
+
+// publishTopic replaces the placeholders in the topic. Characters that would add topic levels
+// or wildcards are replaced in the values.
+func publishTopic(topic string, m types.MeasurementPack) string {
+	return strings.NewReplacer(
+		"{tenant}", topicLevelReplacer.Replace(m.Tenant),
+		"{deviceID}", topicLevelReplacer.Replace(m.DeviceID),
+		"{objectID}", topicLevelReplacer.Replace(m.ObjectID),
+	).Replace(topic)
+}
@@ -0,0 +1,86 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/senml"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPublisherPublishesToTopicTemplate(t *testing.T) {
+	p, err := NewPublisher(t.Context(), Config{enabled: true, scheme: "tcp", host: "broker.example", port: 1883}, PublishConfig{
+		Topic:    "diwise/{tenant}/{deviceID}/{objectID}",
+		QoS:      1,
+		Retained: true,
+	})
+	if err != nil {
+		t.Fatalf("expected publisher, got error: %v", err)
+	}
+
+	client := &fakePublishClient{}
+	p.client = client
+
+	v := 21.5
+	err = p.Send(t.Context(), types.MeasurementPack{
+		DeviceID: "a/b",
+		ObjectID: "3303",
+		Tenant:   "default",
+		Pack:     senml.Pack{{BaseName: "a/b/3303/", Name: "5700", Value: &v}},
+	})
+	if err != nil {
+		t.Fatalf("expected pack to be published, got error: %v", err)
+	}
+
+	if client.topic != "diwise/default/a_b/3303" || client.qos != 1 || !client.retained || string(client.payload) != `[{"bn":"a/b/3303/","n":"5700","v":21.5}]` {
+		t.Fatalf("unexpected publish to %s (qos %d, retained %t): %s", client.topic, client.qos, client.retained, client.payload)
+	}
+
+	client.disconnected = true
+	if err := p.Send(t.Context(), types.MeasurementPack{}); err != errNotConnected {
+		t.Fatalf("expected an error while disconnected, got %v", err)
+	}
+}
+
+func TestPublishTopicIsValidated(t *testing.T) {
+	for _, topic := range []string{"", "diwise/+/{deviceID}", "diwise/#", "diwise/{sensorID}"} {
+		if err := validatePublishTopic(topic); err == nil {
+			t.Fatalf("expected an error for topic %q", topic)
+		}
+	}
+
+	if _, err := NewPublisher(t.Context(), Config{host: "broker.example"}, PublishConfig{Topic: "diwise/{deviceID}"}); err == nil {
+		t.Fatal("expected an error for a disabled broker")
+	}
+}
+
+type fakePublishClient struct {
+	mqtt.Client
+
+	disconnected bool
+	topic        string
+	qos          byte
+	retained     bool
+	payload      []byte
+}
+
+func (c *fakePublishClient) IsConnectionOpen() bool {
+	return !c.disconnected
+}
+
+func (c *fakePublishClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	c.topic, c.qos, c.retained, c.payload = topic, qos, retained, payload.([]byte)
+	return &doneToken{}
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
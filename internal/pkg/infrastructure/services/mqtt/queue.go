@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errQueueFull = errors.New("queue is full")
+
+// queue holds received messages until the forwarder has handled them. Messages are returned
+// by next in the order they were pushed, and a persistent queue keeps a message until done
+// has been called for it.
+type queue interface {
+	push(job queuedMessage) error
+	next(ctx context.Context) (queuedMessage, bool)
+	done(job queuedMessage) error
+	stats() (depth int, oldest time.Time)
+	persistent() bool
+	close() error
+}
+
+// QueueConfig configures the queue of received messages that are waiting to be forwarded.
+// Messages are queued in memory unless Dir is set, in which case they are stored in segment
+// files in a directory per broker and acknowledged as soon as they have been stored. Sizes
+// that are not set are taken from DefaultQueueConfig.
+type QueueConfig struct {
+	Dir string
+	// MaxBytes limits the size of the messages that are waiting in a persistent queue.
+	MaxBytes int64
+	// SegmentBytes is the size at which a new segment file is started.
+	SegmentBytes int64
+	// Replay forwards messages that were left in a persistent queue when the agent was stopped.
+	// They are discarded otherwise.
+	Replay bool
+}
+
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		MaxBytes:     256 << 20,
+		SegmentBytes: 16 << 20,
+		Replay:       true,
+	}
+}
+
+type memoryQueue struct {
+	mu    sync.Mutex
+	jobs  []queuedMessage
+	limit int
+	ready chan struct{}
+}
+
+func newMemoryQueue(limit int) *memoryQueue {
+	return &memoryQueue{
+		limit: max(limit, 1),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *memoryQueue) push(job queuedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.jobs) >= q.limit {
+		return errQueueFull
+	}
+
+	q.jobs = append(q.jobs, job)
+	signal(q.ready)
+
+	return nil
+}
+
+func (q *memoryQueue) next(ctx context.Context) (queuedMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.jobs) > 0 {
+			job := q.jobs[0]
+			q.jobs[0] = queuedMessage{}
+			q.jobs = q.jobs[1:]
+			q.mu.Unlock()
+			return job, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return queuedMessage{}, false
+		case <-q.ready:
+		}
+	}
+}
+
+func (q *memoryQueue) done(queuedMessage) error {
+	return nil
+}
+
+func (q *memoryQueue) stats() (int, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.jobs) == 0 {
+		return 0, time.Time{}
+	}
+
+	return len(q.jobs), q.jobs[0].received
+}
+
+func (q *memoryQueue) persistent() bool {
+	return false
+}
+
+func (q *memoryQueue) close() error {
+	return nil
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
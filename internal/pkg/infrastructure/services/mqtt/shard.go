@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+const shardQueueDepth = 16
+
+var devEUIPattern = regexp.MustCompile(`"(?i:dev_?eui)"\s*:\s*"([^"]{1,64})"`)
+
+// shardKey returns the key that decides which worker forwards a message, so that messages
+// from the same device are forwarded in order. The DevEUI is taken from a device topic, such
+// as application/1/device/<deveui>/event/up, or from a devEUI field in the payload. Messages
+// are sharded by topic if neither contains a DevEUI.
+func shardKey(topic string, payload []byte) string {
+	parts := strings.Split(topic, "/")
+
+	for i, p := range parts[:len(parts)-1] {
+		if p == "device" || p == "devices" {
+			return strings.ToLower(parts[i+1])
+		}
+	}
+
+	for _, p := range parts {
+		if isDevEUI(p) {
+			return strings.ToLower(p)
+		}
+	}
+
+	if m := devEUIPattern.FindSubmatch(payload); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+
+	return topic
+}
+
+func isDevEUI(s string) bool {
+	if len(s) != 16 {
+		return false
+	}
+
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func shardOf(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// shardFor returns the worker that forwards a message, using the DevEUI from the topic
+// template that matches the topic of the message if there is one.
+func (f *messageForwarder) shardFor(job queuedMessage) int {
+	key := hintsFor(f.topics, job.topic).devEUI
+	if key != "" {
+		key = strings.ToLower(key)
+	} else {
+		key = shardKey(job.topic, job.payload)
+	}
+
+	return shardOf(key, len(f.shards))
+}
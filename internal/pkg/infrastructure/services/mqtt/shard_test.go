@@ -0,0 +1,128 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+)
+
+func TestShardKey(t *testing.T) {
+	for _, tc := range []struct {
+		topic   string
+		payload string
+		key     string
+	}{
+		{"application/3/device/0101010101010101/event/up", `{}`, "0101010101010101"},
+		{"v3/app@ttn/devices/my-sensor/up", `{}`, "my-sensor"},
+		{"netmore/70B3D554600002E7/up", `{}`, "70b3d554600002e7"},
+		{"netmore/up", `[{"devEui":"70B3D554600002E7","fPort":"2"}]`, "70b3d554600002e7"},
+		{"ttn/up", `{"end_device_ids":{"dev_eui": "24E124329E090021"}}`, "24e124329e090021"},
+		{"servanet/up", `{"applicationID":"102"}`, "servanet/up"},
+	} {
+		if key := shardKey(tc.topic, []byte(tc.payload)); key != tc.key {
+			t.Fatalf("expected shard key %q for topic %s, got %q", tc.key, tc.topic, key)
+		}
+	}
+}
+
+func TestParallelForwardingKeepsMessagesFromADeviceInOrder(t *testing.T) {
+	var mu sync.Mutex
+	handled := map[string][]string{}
+
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+
+	f, _ := newMessageForwarder(t.Context(), Forwarding{
+		Workers: 4,
+		Handler: func(ctx context.Context, im types.IncomingMessage) error {
+			device, n := shardKey(im.Source, im.Data), string(im.Data)
+
+			if device == "slow" && n == "0" {
+				close(blocked)
+				<-release
+			}
+
+			mu.Lock()
+			handled[device] = append(handled[device], n)
+			mu.Unlock()
+
+			return nil
+		},
+	}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	slow := shardOf("slow", len(f.shards))
+	fast := "fast"
+	for i := 0; shardOf(fast, len(f.shards)) == slow; i++ {
+		fast = fmt.Sprintf("fast-%d", i)
+	}
+
+	for i := range 3 {
+		f.Handle(nil, &fakeMessage{topic: "devices/slow/up", payload: fmt.Append(nil, i), qos: 1})
+		f.Handle(nil, &fakeMessage{topic: "devices/" + fast + "/up", payload: fmt.Append(nil, i), qos: 1})
+	}
+
+	<-blocked
+
+	// messages from other devices are forwarded while a device is blocked
+	waitFor(t, func() bool { mu.Lock(); defer mu.Unlock(); return len(handled[fast]) == 3 })
+
+	close(release)
+	waitFor(t, func() bool { mu.Lock(); defer mu.Unlock(); return len(handled["slow"]) == 3 })
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !slices.Equal(handled["slow"], []string{"0", "1", "2"}) || !slices.Equal(handled[fast], []string{"0", "1", "2"}) {
+		t.Fatalf("expected messages from each device to be handled in order, got %v", handled)
+	}
+}
+
+func TestDiskQueueCommitsMessagesHandledOutOfOrder(t *testing.T) {
+	dir := t.TempDir()
+	cfg := QueueConfig{MaxBytes: 1 << 20, SegmentBytes: 1 << 20, Replay: true}
+
+	q := openTestQueue(t, dir, cfg)
+	for i := range 3 {
+		q.push(testJob(i))
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+
+	first, _ := q.next(ctx)
+	second, _ := q.next(ctx)
+	third, _ := q.next(ctx)
+
+	q.done(second)
+	q.done(third)
+
+	if depth, _ := q.stats(); depth != 3 {
+		t.Fatalf("expected messages after an unhandled message to be kept, got depth %d", depth)
+	}
+
+	q.close()
+
+	q = openTestQueue(t, dir, cfg)
+	if depth, _ := q.stats(); depth != 3 {
+		t.Fatalf("expected all messages to be replayed, got %d", depth)
+	}
+
+	first, _ = q.next(ctx)
+	second, _ = q.next(ctx)
+	q.done(second)
+	q.done(first)
+	q.close()
+
+	q = openTestQueue(t, dir, cfg)
+	defer q.close()
+
+	if job, _ := q.next(ctx); job.topic != third.topic {
+		t.Fatalf("expected only the unhandled message to be replayed, got %s", job.topic)
+	}
+}
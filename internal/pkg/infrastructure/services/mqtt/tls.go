@@ -0,0 +1,178 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(value string) (uint16, error) {
+	if value == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	version, ok := tlsVersions[strings.TrimSpace(value)]
+	if !ok {
+		return 0, fmt.Errorf("expected one of 1.0, 1.1, 1.2 or 1.3, got %q", value)
+	}
+
+	return version, nil
+}
+
+type tlsConfig struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	serverName         string
+	minVersion         uint16
+	insecureSkipVerify bool
+}
+
+// tlsLoader builds the tls configuration from the configured certificate files, and builds it
+// again when any of the files has been changed so that rotated certificates are used when the
+// client reconnects.
+type tlsLoader struct {
+	cfg tlsConfig
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+	current  *tls.Config
+}
+
+func newTLSLoader(cfg tlsConfig) *tlsLoader {
+	return &tlsLoader{cfg: cfg, modTimes: map[string]time.Time{}}
+}
+
+func (l *tlsLoader) load() (*tls.Config, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	modTimes := map[string]time.Time{}
+
+	for _, f := range []string{l.cfg.caFile, l.cfg.certFile, l.cfg.keyFile} {
+		if f == "" {
+			continue
+		}
+
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+
+		modTimes[f] = fi.ModTime()
+	}
+
+	if l.current != nil && !l.changed(modTimes) {
+		return l.current, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         l.cfg.serverName,
+		MinVersion:         l.cfg.minVersion,
+		InsecureSkipVerify: l.cfg.insecureSkipVerify,
+	}
+
+	if l.cfg.caFile != "" {
+		pem, err := os.ReadFile(l.cfg.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", l.cfg.caFile)
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	if l.cfg.certFile != "" || l.cfg.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(l.cfg.certFile, l.cfg.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	l.current = cfg
+	l.modTimes = modTimes
+
+	return cfg, nil
+}
+
+func (l *tlsLoader) changed(modTimes map[string]time.Time) bool {
+	for f, t := range modTimes {
+		if !t.Equal(l.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyingConfig returns a tls configuration that uses the current certificates for each new
+// connection, for clients that do not allow the configuration to be replaced before they
+// reconnect. The broker certificate is verified by VerifyConnection against the current ca
+// bundle, or the system roots if no ca file has been configured, and against the server name
+// of the connection, which must not be empty.
+func (l *tlsLoader) verifyingConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         l.cfg.serverName,
+		MinVersion:         l.cfg.minVersion,
+		InsecureSkipVerify: true, // the certificate chain is verified in VerifyConnection
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cfg, err := l.load()
+			if err != nil {
+				return nil, err
+			}
+
+			if len(cfg.Certificates) == 0 {
+				return &tls.Certificate{}, nil
+			}
+
+			return &cfg.Certificates[0], nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if l.cfg.insecureSkipVerify {
+				return nil
+			}
+
+			cfg, err := l.load()
+			if err != nil {
+				return err
+			}
+
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("the broker did not present a certificate")
+			}
+
+			if cs.ServerName == "" {
+				return fmt.Errorf("no server name to verify the broker certificate against")
+			}
+
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         cfg.RootCAs,
+				Intermediates: x509.NewCertPool(),
+			}
+
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+
+			_, err = cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
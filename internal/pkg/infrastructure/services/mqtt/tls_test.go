@@ -0,0 +1,180 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSLoaderReloadsRotatedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	writeCertificate(t, certFile, keyFile, "first")
+
+	loader := newTLSLoader(tlsConfig{caFile: certFile, certFile: certFile, keyFile: keyFile, minVersion: tls.VersionTLS12})
+
+	cfg, err := loader.load()
+	if err != nil {
+		t.Fatalf("expected tls config, got error: %v", err)
+	}
+
+	if cfg.InsecureSkipVerify {
+		t.Fatal("expected the broker certificate to be verified")
+	}
+
+	if cfg.RootCAs == nil || len(cfg.Certificates) != 1 {
+		t.Fatal("expected ca bundle and client certificate to be loaded")
+	}
+
+	if again, _ := loader.load(); again != cfg {
+		t.Fatal("expected unchanged certificates not to be loaded again")
+	}
+
+	writeCertificate(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	rotated, err := loader.load()
+	if err != nil {
+		t.Fatalf("expected tls config, got error: %v", err)
+	}
+
+	leaf, _ := x509.ParseCertificate(rotated.Certificates[0].Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Fatalf("expected rotated certificate, got %q", leaf.Subject.CommonName)
+	}
+}
+
+func TestNewConfigFromEnvironmentUsesTLSSettings(t *testing.T) {
+	t.Setenv("MQTT_DISABLED", "false")
+	t.Setenv("MQTT_HOST", "broker.example")
+	t.Setenv("MQTT_TOPIC_0", "foo/#")
+	t.Setenv("MQTT_SCHEME", "wss")
+	t.Setenv("MQTT_CA_FILE", "/etc/ssl/broker-ca.pem")
+	t.Setenv("MQTT_TLS_SERVER_NAME", "mqtt.example")
+	t.Setenv("MQTT_TLS_MIN_VERSION", "1.3")
+
+	cfg, err := NewConfigFromEnvironment("")
+	if err != nil {
+		t.Fatalf("expected config, got error: %v", err)
+	}
+
+	if cfg.brokerURL() != "wss://broker.example:443/mqtt" {
+		t.Fatalf("unexpected broker url %q", cfg.brokerURL())
+	}
+
+	if cfg.tls.minVersion != tls.VersionTLS13 || cfg.tls.serverName != "mqtt.example" || cfg.tls.insecureSkipVerify {
+		t.Fatalf("unexpected tls config %+v", cfg.tls)
+	}
+
+	t.Setenv("MQTT_CERT_FILE", "/etc/ssl/client.pem")
+	if _, err := NewConfigFromEnvironment(""); err == nil {
+		t.Fatal("expected an error when the client key is missing")
+	}
+}
+
+func TestVerifyingConfigRequiresServerName(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "broker.crt")
+	keyFile := filepath.Join(dir, "broker.key")
+
+	writeCertificate(t, certFile, keyFile, "broker")
+
+	loader := newTLSLoader(tlsConfig{caFile: certFile, minVersion: tls.VersionTLS12})
+
+	contents, _ := os.ReadFile(certFile)
+	block, _ := pem.Decode(contents)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := loader.verifyingConfig().VerifyConnection
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}); err == nil {
+		t.Fatal("expected verification to fail without a server name")
+	}
+
+	if err := verify(tls.ConnectionState{ServerName: "other.example", PeerCertificates: []*x509.Certificate{leaf}}); err == nil {
+		t.Fatal("expected verification to fail for another host")
+	}
+}
+
+func TestServerNameDefaultsToBrokerHost(t *testing.T) {
+	t.Setenv("MQTT_DISABLED", "false")
+	t.Setenv("MQTT_HOST", "broker.example")
+	t.Setenv("MQTT_TOPIC_0", "foo/#")
+
+	cfg, err := NewConfigFromEnvironment("")
+	if err != nil {
+		t.Fatalf("expected config, got error: %v", err)
+	}
+
+	if cfg.tlsSettings().serverName != "broker.example" {
+		t.Fatalf("expected the broker host as server name, got %q", cfg.tlsSettings().serverName)
+	}
+
+	t.Setenv("MQTT_TLS_SERVER_NAME", "mqtt.example")
+
+	cfg, _ = NewConfigFromEnvironment("")
+	if cfg.tlsSettings().serverName != "mqtt.example" {
+		t.Fatalf("expected the configured server name, got %q", cfg.tlsSettings().serverName)
+	}
+}
+
+func TestNewConfigFromEnvironmentAllowsPlainTCP(t *testing.T) {
+	t.Setenv("MQTT_DISABLED", "false")
+	t.Setenv("MQTT_HOST", "broker.example")
+	t.Setenv("MQTT_TOPIC_0", "foo/#")
+	t.Setenv("MQTT_SCHEME", "tcp")
+
+	cfg, err := NewConfigFromEnvironment("")
+	if err != nil {
+		t.Fatalf("expected config, got error: %v", err)
+	}
+
+	if cfg.usesTLS() || cfg.brokerURL() != "tcp://broker.example:1883" {
+		t.Fatalf("unexpected broker url %q", cfg.brokerURL())
+	}
+}
+
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var wildcardNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// topicTemplate is a topic filter in which single level wildcards may be named, such as
+// application/+app/device/+devEUI/event/+type. The levels named type, devEUI and tenant are
+// extracted from the topics of received messages, other names only document the topic.
+type topicTemplate struct {
+	filter string
+	names  []string
+}
+
+// topicHints holds what was extracted from the topic of a received message.
+type topicHints struct {
+	messageType string
+	devEUI      string
+	tenant      string
+}
+
+func parseTopicTemplate(template string) (topicTemplate, error) {
+	levels := strings.Split(template, "/")
+	t := topicTemplate{names: make([]string, len(levels))}
+
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return t, fmt.Errorf("topic %q has a multi level wildcard that is not the last level", template)
+			}
+		case strings.HasPrefix(level, "+"):
+			name := level[1:]
+			if name != "" && !wildcardNamePattern.MatchString(name) {
+				return t, fmt.Errorf("topic %q has an invalid wildcard name %q", template, name)
+			}
+			t.names[i] = name
+			levels[i] = "+"
+		case strings.ContainsAny(level, "+#"):
+			return t, fmt.Errorf("topic %q has a wildcard that is not a whole level", template)
+		}
+	}
+
+	t.filter = strings.Join(levels, "/")
+
+	return t, nil
+}
+
+func parseTopicTemplates(templates []string) ([]topicTemplate, error) {
+	parsed := make([]topicTemplate, 0, len(templates))
+
+	for _, template := range templates {
+		t, err := parseTopicTemplate(template)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, t)
+	}
+
+	return parsed, nil
+}
+
+// match reports whether the topic matches the filter of the template and returns the values of
+// the named levels.
+func (t topicTemplate) match(topic string) (topicHints, bool) {
+	var hints topicHints
+
+	filter := strings.Split(t.filter, "/")
+	levels := strings.Split(topic, "/")
+
+	for i, f := range filter {
+		if f == "#" {
+			return hints, true
+		}
+
+		if i >= len(levels) || (f != "+" && f != levels[i]) {
+			return topicHints{}, false
+		}
+
+		switch strings.ToLower(t.names[i]) {
+		case "type":
+			hints.messageType = levels[i]
+		case "deveui":
+			hints.devEUI = levels[i]
+		case "tenant":
+			hints.tenant = levels[i]
+		}
+	}
+
+	if len(levels) != len(filter) {
+		return topicHints{}, false
+	}
+
+	return hints, true
+}
+
+// hintsFor returns the hints from the first template that matches the topic. The message type
+// is the last level of the topic unless it is named in the template.
+func hintsFor(templates []topicTemplate, topic string) topicHints {
+	var hints topicHints
+
+	for _, t := range templates {
+		if h, ok := t.match(topic); ok {
+			hints = h
+			break
+		}
+	}
+
+	if hints.messageType == "" {
+		hints.messageType = topic[strings.LastIndex(topic, "/")+1:]
+	}
+
+	return hints
+}
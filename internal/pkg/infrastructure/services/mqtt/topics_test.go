@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+)
+
+func TestTopicTemplates(t *testing.T) {
+	templates, err := parseTopicTemplates([]string{
+		"application/+app/device/+devEUI/event/+type",
+		"tenants/+tenant/netmore/#",
+		"v3/+/devices/+devEUI/up",
+	})
+	if err != nil {
+		t.Fatalf("expected templates, got error: %v", err)
+	}
+
+	if templates[0].filter != "application/+/device/+/event/+" || templates[1].filter != "tenants/+/netmore/#" {
+		t.Fatalf("unexpected topic filters %q and %q", templates[0].filter, templates[1].filter)
+	}
+
+	for _, tc := range []struct {
+		topic string
+		hints topicHints
+	}{
+		{"application/3/device/0101010101010101/event/up", topicHints{messageType: "up", devEUI: "0101010101010101"}},
+		{"application/3/device/0101010101010101/event/join", topicHints{messageType: "join", devEUI: "0101010101010101"}},
+		{"tenants/sundsvall/netmore/payload", topicHints{messageType: "payload", tenant: "sundsvall"}},
+		{"tenants/sundsvall/netmore", topicHints{messageType: "netmore", tenant: "sundsvall"}},
+		{"v3/app@ttn/devices/my-sensor/up", topicHints{messageType: "up", devEUI: "my-sensor"}},
+		{"application/3/device/0101010101010101/event/up/extra", topicHints{messageType: "extra"}},
+		{"servanet/up", topicHints{messageType: "up"}},
+	} {
+		if hints := hintsFor(templates, tc.topic); hints != tc.hints {
+			t.Fatalf("expected hints %+v for topic %s, got %+v", tc.hints, tc.topic, hints)
+		}
+	}
+
+	for _, template := range []string{"a/#/b", "a/b+/c", "a/+1st/c", "a/#name"} {
+		if _, err := parseTopicTemplate(template); err == nil {
+			t.Fatalf("expected an error for topic %q", template)
+		}
+	}
+}
+
+func TestNewConfigFromEnvironmentSubscribesToTopicFilters(t *testing.T) {
+	t.Setenv("MQTT_HOST", "broker.example")
+	t.Setenv("MQTT_TOPIC_0", "application/+app/device/+devEUI/event/+type")
+
+	cfg, err := NewConfigFromEnvironment("")
+	if err != nil {
+		t.Fatalf("expected config, got error: %v", err)
+	}
+
+	if subscriptions := cfg.subscriptions(); len(subscriptions) != 1 || subscriptions[0] != "application/+/device/+/event/+" {
+		t.Fatalf("unexpected subscriptions %v", subscriptions)
+	}
+
+	t.Setenv("MQTT_TOPIC_0", "application/+app/#type")
+	if _, err := NewConfigFromEnvironment(""); err == nil {
+		t.Fatal("expected an error for an invalid topic template")
+	}
+}
+
+func TestMessageForwarderPassesTopicHints(t *testing.T) {
+	messages := make(chan types.IncomingMessage, 1)
+
+	templates, _ := parseTopicTemplates([]string{"tenants/+tenant/application/+/device/+devEUI/event/+type"})
+
+	f, _ := newMessageForwarder(t.Context(), Forwarding{
+		Handler: func(ctx context.Context, im types.IncomingMessage) error {
+			messages <- im
+			return nil
+		},
+		topics: templates,
+	}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	msg := &fakeMessage{topic: "tenants/default/application/3/device/0101010101010101/event/up", payload: []byte(`{}`), qos: 1}
+	f.Handle(nil, msg)
+
+	im := <-messages
+	if im.Type != "up" || im.DevEUI != "0101010101010101" || im.Tenant != "default" || im.Source != msg.topic {
+		t.Fatalf("unexpected incoming message %+v", im)
+	}
+}
@@ -0,0 +1,335 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"go.opentelemetry.io/otel"
+)
+
+// reasons holds the names of the reason codes that a broker may refuse a connection or a
+// subscription with.
+var reasons = map[byte]string{
+	0x80: "unspecified error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8A: "banned",
+	0x8F: "topic filter invalid",
+	0x91: "packet identifier in use",
+	0x97: "quota exceeded",
+	0x9E: "shared subscriptions not supported",
+	0xA1: "subscription identifiers not supported",
+	0xA2: "wildcard subscriptions not supported",
+}
+
+func reason(code byte) string {
+	if r, ok := reasons[code]; ok {
+		return r
+	}
+	return fmt.Sprintf("reason code 0x%02X", code)
+}
+
+// v5Client connects to the broker using MQTT v5. Messages are acknowledged in the order they
+// were received, as the protocol requires, so a message that is left unacknowledged holds back
+// the acknowledgements of later messages until the client reconnects and the broker redelivers
+// them. The broker is told not to send more unacknowledged messages than fit in the queue.
+// Messages that can not be queued are therefore dead-lettered and acknowledged, and the client
+// reconnects if a message could not be acknowledged at all.
+type v5Client struct {
+	cfg       Config
+	log       *slog.Logger
+	clientCfg autopaho.ClientConfig
+	forwarder *messageForwarder
+
+	running      atomic.Bool
+	connected    atomic.Bool
+	reconnecting atomic.Bool
+
+	mu     sync.Mutex
+	conn   *autopaho.ConnectionManager
+	cancel context.CancelFunc
+}
+
+func newV5Client(cfg Config, clientID string, log *slog.Logger, forwarder *messageForwarder) (Client, error) {
+	brokerURL, err := url.Parse(cfg.brokerURL())
+	if err != nil {
+		return nil, fmt.Errorf("invalid mqtt broker url: %w", err)
+	}
+
+	c := &v5Client{
+		cfg:       cfg,
+		log:       log.With(slog.String("mqtt-protocol", "5")),
+		forwarder: forwarder,
+	}
+
+	forwarder.unacked = c.reconnect
+
+	receiveMaximum := uint16(defaultForwarderQueueDepth)
+
+	c.clientCfg = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{brokerURL},
+		KeepAlive:                     uint16(min(cfg.keepAlive, math.MaxUint16)),
+		CleanStartOnInitialConnection: !cfg.isDurable(),
+		ConnectRetryDelay:             10 * time.Second,
+		ConnectUsername:               cfg.user,
+		ConnectPassword:               []byte(cfg.password),
+		OnConnectionUp:                c.onConnectionUp,
+		OnConnectionDown:              c.onConnectionDown,
+		OnConnectError:                c.onConnectError,
+		ConnectPacketBuilder: func(cp *paho.Connect, u *url.URL) (*paho.Connect, error) {
+			if cp.Properties == nil {
+				cp.Properties = &paho.ConnectProperties{}
+			}
+			cp.Properties.ReceiveMaximum = &receiveMaximum
+			return cp, nil
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:                   clientID,
+			EnableManualAcknowledgment: true,
+			OnPublishReceived:          []func(paho.PublishReceived) (bool, error){c.onPublishReceived},
+			OnServerDisconnect:         c.onServerDisconnect,
+			OnClientError: func(err error) {
+				c.log.Error("mqtt client error", "err", err.Error())
+			},
+		},
+	}
+
+	// a durable session is kept by the broker until the client reconnects
+	if cfg.isDurable() {
+		c.clientCfg.SessionExpiryInterval = math.MaxUint32
+	}
+
+	if cfg.usesTLS() {
+		loader := newTLSLoader(cfg.tlsSettings())
+
+		_, err := loader.load()
+		if err != nil {
+			return nil, fmt.Errorf("invalid mqtt tls configuration: %w", err)
+		}
+
+		// certificates are loaded again for each connection, in case they have been rotated
+		c.clientCfg.TlsCfg = loader.verifyingConfig()
+	}
+
+	return c, nil
+}
+
+func (c *v5Client) Start() error {
+	if !c.cfg.enabled {
+		c.log.Warn("mqtt has been explicitly disabled with MQTT_DISABLED=true and will therefore not start")
+		return nil
+	}
+
+	if !c.running.CompareAndSwap(false, true) {
+		c.log.Warn("mqtt client is already running")
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn, err := autopaho.NewConnection(ctx, c.clientCfg)
+	if err != nil {
+		cancel()
+		c.running.Store(false)
+		return fmt.Errorf("failed to create mqtt v5 connection: %w", err)
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *v5Client) Ready() bool {
+	return c.connected.Load()
+}
+
+func (c *v5Client) Stop() {
+	c.running.Store(false)
+
+	c.mu.Lock()
+	conn, cancel := c.conn, c.cancel
+	c.conn, c.cancel = nil, nil
+	c.mu.Unlock()
+
+	if conn != nil {
+		ctx, done := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		conn.Disconnect(ctx)
+		done()
+	}
+
+	if cancel != nil {
+		cancel()
+	}
+
+	c.forwarder.Close()
+}
+
+// reconnect replaces the connection to the broker, so that the acknowledgements of later
+// messages are no longer held back by a message that could not be acknowledged. The broker
+// redelivers the unacknowledged messages of a durable session.
+func (c *v5Client) reconnect() {
+	if !c.running.Load() || !c.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer c.reconnecting.Store(false)
+
+		c.mu.Lock()
+		conn, cancel := c.conn, c.cancel
+		c.mu.Unlock()
+
+		if conn == nil {
+			return
+		}
+
+		c.log.Warn("reconnecting to release the acknowledgements held back by an unacknowledged message")
+
+		ctx, done := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		conn.Disconnect(ctx)
+		done()
+		cancel()
+
+		ctx, cancel = context.WithCancel(context.Background())
+
+		conn, err := autopaho.NewConnection(ctx, c.clientCfg)
+		if err != nil {
+			cancel()
+			c.log.Error("failed to reconnect", "err", err.Error())
+			return
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// the client may have been stopped while it reconnected
+		if !c.running.Load() {
+			ctx, done := context.WithTimeout(context.Background(), 250*time.Millisecond)
+			conn.Disconnect(ctx)
+			done()
+			cancel()
+			return
+		}
+
+		c.conn, c.cancel = conn, cancel
+	}()
+}
+
+func (c *v5Client) onConnectionUp(conn *autopaho.ConnectionManager, connack *paho.Connack) {
+	c.connected.Store(true)
+	c.log.Info("connected", "session_present", connack.SessionPresent)
+
+	subscribe := &paho.Subscribe{}
+	for _, topic := range c.cfg.subscriptions() {
+		c.log.Info("subscribing to topic", "topic", topic)
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: c.cfg.qos})
+	}
+
+	// the callback must not block
+	go func() {
+		suback, err := conn.Subscribe(context.Background(), subscribe)
+		if err != nil && suback == nil {
+			c.log.Error("subscribe failed", "err", err.Error())
+			return
+		}
+
+		for i, code := range suback.Reasons {
+			if code >= 0x80 && i < len(subscribe.Subscriptions) {
+				c.log.Error("subscribe failed", "topic", subscribe.Subscriptions[i].Topic, "reason_code", code, "reason", reason(code))
+			}
+		}
+	}()
+}
+
+func (c *v5Client) onConnectionDown() bool {
+	c.connected.Store(false)
+	c.log.Warn("connection lost")
+
+	return c.running.Load()
+}
+
+func (c *v5Client) onConnectError(err error) {
+	var connackErr *autopaho.ConnackError
+	if errors.As(err, &connackErr) {
+		c.log.Error("mqtt connect refused", "reason_code", connackErr.ReasonCode, "reason", reason(connackErr.ReasonCode))
+		return
+	}
+
+	c.log.Error("mqtt connect failed", "err", err.Error())
+}
+
+func (c *v5Client) onServerDisconnect(d *paho.Disconnect) {
+	args := []any{"reason_code", d.ReasonCode}
+	if d.Properties != nil && d.Properties.ReasonString != "" {
+		args = append(args, "reason", d.Properties.ReasonString)
+	}
+
+	c.log.Warn("disconnected by broker", args...)
+}
+
+// onPublishReceived queues a received message, together with the trace context from its user
+// properties, and acknowledges it once it has been forwarded.
+func (c *v5Client) onPublishReceived(pr paho.PublishReceived) (bool, error) {
+	msg := &v5Message{publish: pr.Packet, ack: func() {
+		err := pr.Client.Ack(pr.Packet)
+		if err != nil {
+			c.log.Error("failed to acknowledge mqtt message", "topic", pr.Packet.Topic, "err", err.Error())
+		}
+	}}
+
+	c.forwarder.enqueue(msg, traceContext(pr.Packet.Properties))
+
+	return true, nil
+}
+
+// traceContext returns the user properties of a message that carry a trace context.
+func traceContext(props *paho.PublishProperties) map[string]string {
+	if props == nil {
+		return nil
+	}
+
+	var trace map[string]string
+
+	for _, field := range otel.GetTextMapPropagator().Fields() {
+		if v := props.User.Get(field); v != "" {
+			if trace == nil {
+				trace = map[string]string{}
+			}
+			trace[field] = v
+		}
+	}
+
+	return trace
+}
+
+// v5Message adapts a received MQTT v5 message to the message interface of the forwarder.
+type v5Message struct {
+	publish *paho.Publish
+	ack     func()
+	once    sync.Once
+}
+
+func (m *v5Message) Duplicate() bool   { return m.publish.Duplicate() }
+func (m *v5Message) Qos() byte         { return m.publish.QoS }
+func (m *v5Message) Retained() bool    { return m.publish.Retain }
+func (m *v5Message) Topic() string     { return m.publish.Topic }
+func (m *v5Message) MessageID() uint16 { return m.publish.PacketID }
+func (m *v5Message) Payload() []byte   { return m.publish.Payload }
+func (m *v5Message) Ack()              { m.once.Do(m.ack) }
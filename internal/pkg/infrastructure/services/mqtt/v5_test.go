@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/eclipse/paho.golang/paho"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const traceParent string = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestNewConfigFromEnvironmentUsesSharedSubscriptions(t *testing.T) {
+	t.Setenv("MQTT_HOST", "broker.example")
+	t.Setenv("MQTT_TOPIC_0", "application/#")
+	t.Setenv("MQTT_TOPIC_1", "netmore/+/up")
+	t.Setenv("MQTT_PROTOCOL_VERSION", "5")
+	t.Setenv("MQTT_SHARE_GROUP", "iot-agent")
+
+	cfg, err := NewConfigFromEnvironment("")
+	if err != nil {
+		t.Fatalf("expected config, got error: %v", err)
+	}
+
+	subscriptions := cfg.subscriptions()
+	if cfg.version != protocolVersion5 || len(subscriptions) != 2 || subscriptions[0] != "$share/iot-agent/application/#" || subscriptions[1] != "$share/iot-agent/netmore/+/up" {
+		t.Fatalf("unexpected subscriptions %v", subscriptions)
+	}
+
+	client, err := NewClient(t.Context(), cfg, Forwarding{Endpoint: "http://example.invalid/api/v0/messages"})
+	if err != nil {
+		t.Fatalf("expected client, got error: %v", err)
+	}
+	defer client.Stop()
+
+	if _, ok := client.(*v5Client); !ok {
+		t.Fatalf("expected an mqtt v5 client, got %T", client)
+	}
+
+	t.Setenv("MQTT_SHARE_GROUP", "iot/agent")
+	if _, err := NewConfigFromEnvironment(""); err == nil {
+		t.Fatal("expected an error for a share group with a topic separator")
+	}
+}
+
+func TestV5MessagesAreForwardedWithTheirTraceContext(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	traceIDs := make(chan trace.TraceID, 1)
+
+	f, _ := newMessageForwarder(t.Context(), Forwarding{
+		Handler: func(ctx context.Context, im types.IncomingMessage) error {
+			traceIDs <- trace.SpanContextFromContext(ctx).TraceID()
+			return nil
+		},
+	}, defaultForwarderQueueDepth)
+	defer f.Close()
+
+	c := &v5Client{forwarder: f}
+
+	props := &paho.PublishProperties{}
+	props.User.Add("traceparent", traceParent)
+
+	c.onPublishReceived(paho.PublishReceived{Packet: &paho.Publish{
+		Topic:      "application/1/device/0101010101010101/event/up",
+		Payload:    []byte(`{}`),
+		Properties: props,
+	}})
+
+	if traceID := <-traceIDs; traceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("expected the message to be forwarded in the published trace, got %s", traceID)
+	}
+}
+
+func TestDiskQueueKeepsTraceContext(t *testing.T) {
+	q := openTestQueue(t, t.TempDir(), QueueConfig{MaxBytes: 1 << 20, SegmentBytes: 1 << 20, Replay: true})
+	defer q.close()
+
+	job := testJob(0)
+	job.trace = map[string]string{"traceparent": traceParent, "tracestate": "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7"}
+	q.push(job)
+
+	queued, _ := q.next(t.Context())
+	if queued.trace["traceparent"] != traceParent || queued.trace["tracestate"] != job.trace["tracestate"] || string(queued.payload) != `{"n":0}` {
+		t.Fatalf("unexpected queued message %+v", queued)
+	}
+}
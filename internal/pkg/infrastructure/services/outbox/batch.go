@@ -0,0 +1,111 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type batchCtxKey struct{}
+type orderKeyCtxKey struct{}
+
+// WithOrderKey returns a context in which the messages added to an outbox are sent in order with
+// the other messages of the same key, such as the messages of a device. Messages of different
+// keys do not wait for each other.
+func WithOrderKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, orderKeyCtxKey{}, key)
+}
+
+func orderKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(orderKeyCtxKey{}).(string)
+	return key
+}
+
+// Batch collects the messages that are added to an outbox while a sensor event is handled, so
+// that a store can save them in the same transaction as the event. Messages that have not been
+// saved by a store are added to their outbox when the batch is flushed.
+type Batch struct {
+	mu      sync.Mutex
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	outbox *Outbox
+	m      Message
+	stored bool
+}
+
+// WithBatch returns a context in which the messages added to an outbox are collected in the
+// returned batch instead of being stored.
+func WithBatch(ctx context.Context) (context.Context, *Batch) {
+	b := &Batch{}
+	return context.WithValue(ctx, batchCtxKey{}, b), b
+}
+
+// BatchFromContext returns the batch of the context, or nil if messages are not collected.
+func BatchFromContext(ctx context.Context) *Batch {
+	b, _ := ctx.Value(batchCtxKey{}).(*Batch)
+	return b
+}
+
+func (b *Batch) add(o *Outbox, m Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries = append(b.entries, batchEntry{outbox: o, m: m})
+}
+
+// StoreWith calls save with the messages of the batch that are kept in the store, and marks them
+// as stored if save succeeds. Save is called without messages if the batch is nil.
+func (b *Batch) StoreWith(store Store, save func(messages []Message) error) error {
+	if b == nil {
+		return save(nil)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var indexes []int
+	var messages []Message
+
+	for i, e := range b.entries {
+		if !e.stored && e.outbox.store == store {
+			indexes = append(indexes, i)
+			messages = append(messages, e.m)
+		}
+	}
+
+	if err := save(messages); err != nil {
+		return err
+	}
+
+	for _, i := range indexes {
+		b.entries[i].stored = true
+	}
+
+	return nil
+}
+
+// Flush adds the messages that have not been stored together with the sensor event to their
+// outbox, and wakes the relays of the messages.
+func (b *Batch) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	entries := b.entries
+	b.entries = nil
+	b.mu.Unlock()
+
+	var errs []error
+
+	for _, e := range entries {
+		if !e.stored {
+			if err := e.outbox.store.AddOutboxMessage(ctx, e.m); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		e.outbox.notify()
+	}
+
+	return errors.Join(errs...)
+}
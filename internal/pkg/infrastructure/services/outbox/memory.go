@@ -0,0 +1,114 @@
+package outbox
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the outbox in memory. It is intended for devmode and tests, messages
+// that have not been sent are lost on restart.
+type memoryStore struct {
+	messages    map[string]Message
+	claimed     map[string]time.Time
+	deadLetters []Message
+	nextID      int
+	mu          sync.Mutex
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		messages: make(map[string]Message),
+		claimed:  make(map[string]time.Time),
+	}
+}
+
+func (s *memoryStore) AddOutboxMessage(ctx context.Context, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	m.ID = strconv.Itoa(s.nextID)
+	s.messages[m.ID] = m
+
+	return nil
+}
+
+func (s *memoryStore) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	pending := slices.SortedFunc(maps.Values(s.messages), func(a, b Message) int { return a.Created.Compare(b.Created) })
+	messages := []Message{}
+	blocked := map[string]bool{}
+
+	for _, m := range pending {
+		if len(messages) == limit {
+			break
+		}
+
+		// messages created after a message of the same key that is claimed or waits to be
+		// retried are kept in order behind it
+		if blocked[m.OrderKey] || m.NextAttempt.After(now) || s.claimed[m.ID].After(now) {
+			blocked[m.OrderKey] = true
+			continue
+		}
+
+		s.claimed[m.ID] = now.Add(lease)
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+func (s *memoryStore) DeleteOutboxMessage(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.messages, id)
+	delete(s.claimed, id)
+
+	return nil
+}
+
+func (s *memoryStore) RetryOutboxMessage(ctx context.Context, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.messages[m.ID]; ok {
+		s.messages[m.ID] = m
+		delete(s.claimed, m.ID)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) DeadLetterOutboxMessage(ctx context.Context, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.messages, m.ID)
+	delete(s.claimed, m.ID)
+	s.deadLetters = append(s.deadLetters, m)
+
+	return nil
+}
+
+func (s *memoryStore) OutboxBacklog(ctx context.Context) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldest time.Time
+	for _, m := range s.messages {
+		if oldest.IsZero() || m.Created.Before(oldest) {
+			oldest = m.Created
+		}
+	}
+
+	return len(s.messages), oldest, nil
+}
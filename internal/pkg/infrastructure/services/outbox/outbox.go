@@ -0,0 +1,422 @@
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/backoff"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Kind string
+
+const (
+	KindCommand Kind = "command"
+	KindTopic   Kind = "topic"
+)
+
+// Message is a message waiting to be sent. Key is the routing key of a command or
+// the name of the topic a topic message is published on, and OrderKey groups the messages that
+// are sent in order, such as the messages of a device.
+type Message struct {
+	ID          string
+	Kind        Kind
+	Key         string
+	OrderKey    string
+	ContentType string
+	Body        []byte
+	TraceID     string
+	SpanID      string
+	Attempts    int
+	LastError   string
+	Created     time.Time
+	NextAttempt time.Time
+}
+
+// Store keeps messages until they have been sent. Claimed messages are not returned
+// by another claim until the lease has expired, so that several relays can share a store.
+// Messages are claimed in the order they were created, and no message is claimed while an
+// earlier message of the same order key is claimed or waits to be retried, so that the
+// messages of a key are sent in order.
+type Store interface {
+	AddOutboxMessage(ctx context.Context, m Message) error
+	ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]Message, error)
+	DeleteOutboxMessage(ctx context.Context, id string) error
+	RetryOutboxMessage(ctx context.Context, m Message) error
+	DeadLetterOutboxMessage(ctx context.Context, m Message) error
+	OutboxBacklog(ctx context.Context) (int, time.Time, error)
+}
+
+type Config struct {
+	// Interval is how often the store is polled for messages that are due for a retry.
+	Interval time.Duration
+	// BatchSize is the maximum number of messages claimed at a time.
+	BatchSize int
+	// Lease is how long a claimed message is reserved for the relay that claimed it.
+	Lease time.Duration
+	// MaxAttempts is the number of failed attempts before a message is dead-lettered.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the exponential backoff between attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:    5 * time.Second,
+		BatchSize:   100,
+		Lease:       time.Minute,
+		MaxAttempts: 10,
+		MinBackoff:  time.Second,
+		MaxBackoff:  2 * time.Minute,
+	}
+}
+
+// Outbox is a messaging.MsgContext that stores commands and topic messages before
+// they are sent, and relays them in the background with retries and backoff.
+// Everything else is passed through to the wrapped context. Messages that are added with a
+// context from WithBatch are stored when the batch is stored or flushed, e.g. in the same
+// transaction as the sensor event they were decoded from.
+type Outbox struct {
+	messaging.MsgContext
+
+	store Store
+	cfg   Config
+	log   *slog.Logger
+
+	wake    chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+	running atomic.Bool
+
+	sentCounter         metric.Int64Counter
+	retriedCounter      metric.Int64Counter
+	deadLetteredCounter metric.Int64Counter
+	backlogSize         metric.Int64Gauge
+	backlogAge          metric.Float64Gauge
+}
+
+func New(ctx context.Context, msgCtx messaging.MsgContext, store Store, cfg Config) *Outbox {
+	o := &Outbox{
+		MsgContext: msgCtx,
+		store:      store,
+		cfg:        cfg,
+		log:        logging.GetFromContext(ctx),
+		wake:       make(chan struct{}, 1),
+	}
+
+	var err error
+	meter := otel.Meter("iot-agent/outbox")
+
+	o.sentCounter, err = meter.Int64Counter(
+		"diwise.outbox.sent.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of messages relayed from the outbox"),
+	)
+	if err != nil {
+		o.log.Error("failed to create otel sent counter", "err", err.Error())
+	}
+
+	o.retriedCounter, err = meter.Int64Counter(
+		"diwise.outbox.retries.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of failed attempts to relay a message from the outbox"),
+	)
+	if err != nil {
+		o.log.Error("failed to create otel retries counter", "err", err.Error())
+	}
+
+	o.deadLetteredCounter, err = meter.Int64Counter(
+		"diwise.outbox.deadlettered.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of messages moved to the dead-letter table"),
+	)
+	if err != nil {
+		o.log.Error("failed to create otel dead-lettered counter", "err", err.Error())
+	}
+
+	o.backlogSize, err = meter.Int64Gauge(
+		"diwise.outbox.backlog.size",
+		metric.WithUnit("1"),
+		metric.WithDescription("Number of messages waiting in the outbox"),
+	)
+	if err != nil {
+		o.log.Error("failed to create otel backlog size gauge", "err", err.Error())
+	}
+
+	o.backlogAge, err = meter.Float64Gauge(
+		"diwise.outbox.backlog.age",
+		metric.WithUnit("s"),
+		metric.WithDescription("Age of the oldest message waiting in the outbox"),
+	)
+	if err != nil {
+		o.log.Error("failed to create otel backlog age gauge", "err", err.Error())
+	}
+
+	return o
+}
+
+func (o *Outbox) SendCommandTo(ctx context.Context, command messaging.Command, key string) error {
+	return o.add(ctx, Message{Kind: KindCommand, Key: key, ContentType: command.ContentType(), Body: command.Body()})
+}
+
+func (o *Outbox) PublishOnTopic(ctx context.Context, message messaging.TopicMessage) error {
+	return o.add(ctx, Message{Kind: KindTopic, Key: message.TopicName(), ContentType: message.ContentType(), Body: message.Body()})
+}
+
+func (o *Outbox) add(ctx context.Context, m Message) error {
+	m.Created = time.Now().UTC()
+	m.NextAttempt = m.Created
+	m.OrderKey = orderKeyFromContext(ctx)
+
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.IsValid() {
+		m.TraceID = spanCtx.TraceID().String()
+		m.SpanID = spanCtx.SpanID().String()
+	}
+
+	if b := BatchFromContext(ctx); b != nil {
+		b.add(o, m)
+		return nil
+	}
+
+	err := o.store.AddOutboxMessage(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	o.notify()
+
+	return nil
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts relaying messages in the background until Stop is called.
+func (o *Outbox) Start() {
+	if !o.running.CompareAndSwap(false, true) {
+		o.log.Warn("outbox relay is already running")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(logging.NewContextWithLogger(context.Background(), o.log))
+	o.cancel = cancel
+	o.done = make(chan struct{})
+
+	go func() {
+		defer close(o.done)
+		o.run(ctx)
+	}()
+}
+
+// Stop stops the relay and waits for the current batch to complete.
+func (o *Outbox) Stop() {
+	if !o.running.CompareAndSwap(true, false) {
+		return
+	}
+
+	o.cancel()
+	<-o.done
+}
+
+func (o *Outbox) run(ctx context.Context) {
+	ticker := time.NewTicker(o.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		for o.relay(ctx) && ctx.Err() == nil {
+			// keep going while there are more messages ready to be sent
+		}
+
+		o.recordBacklog(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// relay sends a batch of claimed messages and reports if there may be more messages to send.
+// The messages of the same order key as a message that failed are released to be retried after
+// it, in order, while the messages of other keys are still sent. If a message of another key
+// fails as well the broker is most likely unavailable, so the rest of the batch is released
+// without counting it as an attempt.
+func (o *Outbox) relay(ctx context.Context) bool {
+	messages, err := o.store.ClaimOutboxMessages(ctx, o.cfg.BatchSize, o.cfg.Lease)
+	if err != nil {
+		o.log.Error("failed to claim outbox messages", "err", err.Error())
+		return false
+	}
+
+	slices.SortFunc(messages, func(a, b Message) int { return a.Created.Compare(b.Created) })
+
+	blocked := map[string]time.Time{}
+
+	for i, m := range messages {
+		if next, ok := blocked[m.OrderKey]; ok {
+			o.release(ctx, m, next)
+			continue
+		}
+
+		err := o.send(ctx, m)
+		if err == nil {
+			o.sentCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", string(m.Kind))))
+
+			err = o.store.DeleteOutboxMessage(ctx, m.ID)
+			if err != nil {
+				o.log.Error("failed to delete relayed outbox message", "id", m.ID, "err", err.Error())
+			}
+			continue
+		}
+
+		if len(blocked) > 0 {
+			for _, rest := range messages[i:] {
+				o.release(ctx, rest, o.retryAt(blocked))
+			}
+			return false
+		}
+
+		blocked[m.OrderKey] = o.failed(ctx, m, err)
+	}
+
+	return len(blocked) == 0 && len(messages) == o.cfg.BatchSize
+}
+
+// retryAt returns when the first of the failed messages is retried.
+func (o *Outbox) retryAt(blocked map[string]time.Time) time.Time {
+	var first time.Time
+	for _, next := range blocked {
+		if first.IsZero() || next.Before(first) {
+			first = next
+		}
+	}
+	return first
+}
+
+func (o *Outbox) send(ctx context.Context, m Message) error {
+	msg := message{contentType: m.ContentType, body: m.Body, topic: m.Key}
+
+	// the message is sent as part of the trace of the sensor event it was decoded from
+	if spanCtx, ok := m.spanContext(); ok {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, spanCtx)
+	}
+
+	if m.Kind == KindTopic {
+		return o.MsgContext.PublishOnTopic(ctx, msg)
+	}
+
+	return o.MsgContext.SendCommandTo(ctx, msg, m.Key)
+}
+
+// failed schedules a retry of a message that failed to be sent, or dead-letters it after too
+// many attempts, and returns when the following messages may be sent.
+func (o *Outbox) failed(ctx context.Context, m Message, err error) time.Time {
+	m.Attempts++
+	m.LastError = err.Error()
+
+	log := o.log.With("id", m.ID, "kind", m.Kind, "key", m.Key, "attempts", m.Attempts, "trace_id", m.TraceID)
+
+	if m.Attempts >= o.cfg.MaxAttempts {
+		log.Error("failed to relay outbox message, moving it to the dead-letter table", "err", err.Error())
+		o.deadLetteredCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", string(m.Kind))))
+
+		if err := o.store.DeadLetterOutboxMessage(ctx, m); err != nil {
+			log.Error("failed to dead-letter outbox message", "err", err.Error())
+		}
+		return time.Now().UTC().Add(o.backoff(1))
+	}
+
+	m.NextAttempt = time.Now().UTC().Add(o.backoff(m.Attempts))
+
+	log.Warn("failed to relay outbox message, will retry", "next_attempt", m.NextAttempt, "err", err.Error())
+	o.retriedCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", string(m.Kind))))
+
+	if err := o.store.RetryOutboxMessage(ctx, m); err != nil {
+		log.Error("failed to schedule retry of outbox message", "err", err.Error())
+	}
+
+	return m.NextAttempt
+}
+
+// release makes a claimed message that was not attempted available again, at the same time
+// as the message that failed before it, so that it is not sent before that message.
+func (o *Outbox) release(ctx context.Context, m Message, next time.Time) {
+	m.NextAttempt = next
+
+	if err := o.store.RetryOutboxMessage(ctx, m); err != nil {
+		o.log.Error("failed to release outbox message", "id", m.ID, "err", err.Error())
+	}
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	return backoff.Exponential(attempts, o.cfg.MinBackoff, o.cfg.MaxBackoff)
+}
+
+func (o *Outbox) recordBacklog(ctx context.Context) {
+	size, oldest, err := o.store.OutboxBacklog(ctx)
+	if err != nil {
+		o.log.Error("failed to get outbox backlog", "err", err.Error())
+		return
+	}
+
+	age := 0.0
+	if size > 0 {
+		age = time.Since(oldest).Seconds()
+	}
+
+	o.backlogSize.Record(ctx, int64(size))
+	o.backlogAge.Record(ctx, age)
+}
+
+func (m Message) spanContext() (trace.SpanContext, bool) {
+	traceID, err := trace.TraceIDFromHex(m.TraceID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+
+	spanID, err := trace.SpanIDFromHex(m.SpanID)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}), true
+}
+
+// message is a stored message that is sent as either a command or a topic message.
+type message struct {
+	contentType string
+	body        []byte
+	topic       string
+}
+
+func (m message) ContentType() string {
+	return m.contentType
+}
+
+func (m message) Body() []byte {
+	return m.body
+}
+
+func (m message) TopicName() string {
+	return m.topic
+}
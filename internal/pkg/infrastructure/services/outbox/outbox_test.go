@@ -0,0 +1,285 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMessagesAreStoredAndRelayed(t *testing.T) {
+	is, ctx, msgCtx, store := testSetup(t)
+
+	o := New(ctx, msgCtx, store, DefaultConfig())
+
+	is.NoErr(o.SendCommandTo(ctx, message{contentType: "application/vnd.diwise.messagereceived+json", body: []byte(`{}`)}, "iot-core"))
+	is.NoErr(o.PublishOnTopic(ctx, message{contentType: "application/json", body: []byte(`{}`), topic: "device-status"}))
+
+	is.Equal(len(msgCtx.SendCommandToCalls()), 0) // nothing should be sent before the relay runs
+
+	size, _, _ := store.OutboxBacklog(ctx)
+	is.Equal(size, 2)
+
+	is.True(!o.relay(ctx))
+
+	is.Equal(len(msgCtx.SendCommandToCalls()), 1)
+	is.Equal(msgCtx.SendCommandToCalls()[0].Key, "iot-core")
+	is.Equal(msgCtx.SendCommandToCalls()[0].Command.ContentType(), "application/vnd.diwise.messagereceived+json")
+	is.Equal(len(msgCtx.PublishOnTopicCalls()), 1)
+	is.Equal(msgCtx.PublishOnTopicCalls()[0].Message.TopicName(), "device-status")
+
+	size, _, _ = store.OutboxBacklog(ctx)
+	is.Equal(size, 0)
+}
+
+func TestFailedMessageIsRetriedWithBackoff(t *testing.T) {
+	is, ctx, msgCtx, store := testSetup(t)
+
+	msgCtx.SendCommandToFunc = func(ctx context.Context, command messaging.Command, key string) error {
+		return errors.New("rabbitmq unavailable")
+	}
+
+	o := New(ctx, msgCtx, store, DefaultConfig())
+
+	is.NoErr(o.SendCommandTo(ctx, message{body: []byte(`1`)}, "iot-core"))
+	is.NoErr(o.SendCommandTo(ctx, message{body: []byte(`2`)}, "iot-core"))
+
+	is.True(!o.relay(ctx))
+	is.Equal(len(msgCtx.SendCommandToCalls()), 1) // the rest of the batch should not be attempted after a failure
+
+	is.True(!o.relay(ctx))
+	is.Equal(len(msgCtx.SendCommandToCalls()), 1) // nothing should be due before the backoff has passed
+
+	ms := store.(*memoryStore)
+	for _, m := range ms.messages {
+		is.True(m.NextAttempt.After(time.Now()))
+		if m.Attempts == 1 {
+			is.Equal(m.LastError, "rabbitmq unavailable")
+		}
+	}
+}
+
+func TestMessagesAreSentInOrderAfterFailure(t *testing.T) {
+	is, ctx, msgCtx, store := testSetup(t)
+
+	failures := 1
+	msgCtx.SendCommandToFunc = func(ctx context.Context, command messaging.Command, key string) error {
+		if failures > 0 {
+			failures--
+			return errors.New("rabbitmq unavailable")
+		}
+		return nil
+	}
+
+	cfg := DefaultConfig()
+	cfg.MinBackoff, cfg.MaxBackoff = 50*time.Millisecond, 50*time.Millisecond
+
+	o := New(ctx, msgCtx, store, cfg)
+
+	is.NoErr(o.SendCommandTo(ctx, message{body: []byte(`1`)}, "iot-core"))
+	is.NoErr(o.SendCommandTo(ctx, message{body: []byte(`2`)}, "iot-core"))
+	is.True(!o.relay(ctx))
+
+	is.NoErr(o.SendCommandTo(ctx, message{body: []byte(`3`)}, "iot-core"))
+	is.True(!o.relay(ctx))
+	is.Equal(len(msgCtx.SendCommandToCalls()), 1) // a new message should not be sent before the failed one
+
+	time.Sleep(60 * time.Millisecond)
+	is.True(!o.relay(ctx))
+
+	calls := msgCtx.SendCommandToCalls()
+	is.Equal(len(calls), 4)
+	for i, body := range []string{"1", "1", "2", "3"} {
+		is.Equal(string(calls[i].Command.Body()), body)
+	}
+}
+
+func TestFailedMessageDoesNotBlockOtherKeys(t *testing.T) {
+	is, ctx, msgCtx, store := testSetup(t)
+
+	msgCtx.SendCommandToFunc = func(ctx context.Context, command messaging.Command, key string) error {
+		if string(command.Body()) == "a1" {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+
+	o := New(ctx, msgCtx, store, DefaultConfig())
+
+	a, b := WithOrderKey(ctx, "a"), WithOrderKey(ctx, "b")
+	is.NoErr(o.SendCommandTo(a, message{body: []byte(`a1`)}, "iot-core"))
+	is.NoErr(o.SendCommandTo(b, message{body: []byte(`b1`)}, "iot-core"))
+	is.NoErr(o.SendCommandTo(a, message{body: []byte(`a2`)}, "iot-core"))
+	is.NoErr(o.SendCommandTo(b, message{body: []byte(`b2`)}, "iot-core"))
+
+	is.True(!o.relay(ctx))
+
+	calls := msgCtx.SendCommandToCalls()
+	is.Equal(len(calls), 3) // a2 should wait for a1, while the messages of b are sent
+	for i, body := range []string{"a1", "b1", "b2"} {
+		is.Equal(string(calls[i].Command.Body()), body)
+	}
+
+	is.NoErr(o.SendCommandTo(b, message{body: []byte(`b3`)}, "iot-core"))
+	is.True(!o.relay(ctx))
+	is.Equal(len(msgCtx.SendCommandToCalls()), 4)
+	is.Equal(len(store.(*memoryStore).messages), 2)
+}
+
+func TestOnlyOneAttemptIsCountedWhenTheBrokerIsUnavailable(t *testing.T) {
+	is, ctx, msgCtx, store := testSetup(t)
+
+	msgCtx.SendCommandToFunc = func(ctx context.Context, command messaging.Command, key string) error {
+		return errors.New("rabbitmq unavailable")
+	}
+
+	o := New(ctx, msgCtx, store, DefaultConfig())
+
+	for _, key := range []string{"a", "b", "c"} {
+		is.NoErr(o.SendCommandTo(WithOrderKey(ctx, key), message{body: []byte(key)}, "iot-core"))
+	}
+
+	is.True(!o.relay(ctx))
+	is.Equal(len(msgCtx.SendCommandToCalls()), 2) // the second failure stops the batch
+
+	attempts := 0
+	for _, m := range store.(*memoryStore).messages {
+		attempts += m.Attempts
+		is.True(m.NextAttempt.After(time.Now()))
+	}
+	is.Equal(attempts, 1)
+}
+
+func TestReleasedMessagesAreNotOvertaken(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	store := NewMemoryStore()
+	now := time.Now().UTC()
+
+	is.NoErr(store.AddOutboxMessage(ctx, Message{Body: []byte(`1`), Created: now, NextAttempt: now}))
+	is.NoErr(store.AddOutboxMessage(ctx, Message{Body: []byte(`2`), Created: now.Add(time.Millisecond), NextAttempt: now}))
+
+	claimed, err := store.ClaimOutboxMessages(ctx, 1, time.Minute)
+	is.NoErr(err)
+	is.Equal(len(claimed), 1)
+
+	// the first message is released without being attempted, to be sent later
+	released := claimed[0]
+	released.NextAttempt = now.Add(time.Minute)
+	is.NoErr(store.RetryOutboxMessage(ctx, released))
+
+	claimed, err = store.ClaimOutboxMessages(ctx, 10, time.Minute)
+	is.NoErr(err)
+	is.Equal(len(claimed), 0)
+}
+
+func TestTraceIsPropagatedWhenRelaying(t *testing.T) {
+	is, ctx, msgCtx, store := testSetup(t)
+
+	var sent trace.SpanContext
+	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
+		sent = trace.SpanContextFromContext(ctx)
+		return nil
+	}
+
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3, 4},
+		SpanID:     trace.SpanID{5, 6, 7, 8},
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	o := New(ctx, msgCtx, store, DefaultConfig())
+	is.NoErr(o.PublishOnTopic(trace.ContextWithSpanContext(ctx, spanCtx), message{topic: "device-status"}))
+
+	o.relay(ctx)
+
+	is.Equal(sent.TraceID(), spanCtx.TraceID())
+	is.Equal(sent.SpanID(), spanCtx.SpanID())
+}
+
+func TestBatchedMessagesAreStoredWithTheEvent(t *testing.T) {
+	is, ctx, msgCtx, store := testSetup(t)
+
+	o := New(ctx, msgCtx, store, DefaultConfig())
+	other := New(ctx, msgCtx, NewMemoryStore(), DefaultConfig())
+
+	bctx, batch := WithBatch(WithOrderKey(ctx, "a"))
+	is.NoErr(o.SendCommandTo(bctx, message{body: []byte(`1`)}, "iot-core"))
+	is.NoErr(other.SendCommandTo(bctx, message{body: []byte(`2`)}, "iot-core"))
+
+	size, _, _ := store.OutboxBacklog(ctx)
+	is.Equal(size, 0) // nothing should be stored before the batch is
+
+	var saved []Message
+	is.NoErr(batch.StoreWith(store, func(messages []Message) error {
+		saved = messages
+		return nil
+	}))
+	is.Equal(len(saved), 1)
+	is.Equal(saved[0].OrderKey, "a")
+
+	is.NoErr(batch.Flush(ctx))
+
+	size, _, _ = store.OutboxBacklog(ctx)
+	is.Equal(size, 0) // the message was stored with the event, and is not added again
+
+	size, _, _ = other.store.OutboxBacklog(ctx)
+	is.Equal(size, 1)
+}
+
+func TestMessageIsDeadLetteredAfterMaxAttempts(t *testing.T) {
+	is, ctx, msgCtx, store := testSetup(t)
+
+	msgCtx.PublishOnTopicFunc = func(ctx context.Context, message messaging.TopicMessage) error {
+		return errors.New("rabbitmq unavailable")
+	}
+
+	cfg := DefaultConfig()
+	cfg.MaxAttempts = 3
+	cfg.MinBackoff = 0
+
+	o := New(ctx, msgCtx, store, cfg)
+	is.NoErr(o.PublishOnTopic(ctx, message{topic: "device-status"}))
+
+	for range 3 {
+		o.relay(ctx)
+	}
+
+	ms := store.(*memoryStore)
+	is.Equal(len(ms.messages), 0)
+	is.Equal(len(ms.deadLetters), 1)
+	is.Equal(ms.deadLetters[0].Attempts, 3)
+	is.Equal(len(msgCtx.PublishOnTopicCalls()), 3)
+}
+
+func TestBackoff(t *testing.T) {
+	is := is.New(t)
+
+	o := &Outbox{cfg: Config{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+
+	is.Equal(o.backoff(1), time.Second)
+	is.Equal(o.backoff(2), 2*time.Second)
+	is.Equal(o.backoff(4), 8*time.Second)
+	is.Equal(o.backoff(5), 10*time.Second)
+	is.Equal(o.backoff(100), 10*time.Second)
+}
+
+func testSetup(t *testing.T) (*is.I, context.Context, *messaging.MsgContextMock, Store) {
+	is := is.New(t)
+
+	msgCtx := &messaging.MsgContextMock{
+		SendCommandToFunc: func(ctx context.Context, command messaging.Command, key string) error {
+			return nil
+		},
+		PublishOnTopicFunc: func(ctx context.Context, message messaging.TopicMessage) error {
+			return nil
+		},
+	}
+
+	return is, context.Background(), msgCtx, NewMemoryStore()
+}
@@ -0,0 +1,45 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+)
+
+// fileTarget appends measurements to a file with one json object per line.
+type fileTarget struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newFileTarget(path string) (*fileTarget, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileTarget{f: f}, nil
+}
+
+func (t *fileTarget) Send(_ context.Context, m types.MeasurementPack) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, err = t.f.Write(append(b, '\n'))
+	return err
+}
+
+func (t *fileTarget) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.f.Close()
+}
@@ -0,0 +1,76 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// httpTarget posts measurements as json to a webhook.
+type httpTarget struct {
+	url        string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+func newHTTPTarget(cfg Config) *httpTarget {
+	return &httpTarget{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		},
+	}
+}
+
+func (t *httpTarget) Send(ctx context.Context, m types.MeasurementPack) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	return responseError(resp.StatusCode)
+}
+
+// responseError returns an error for a response code that is not a success, which is permanent
+// for client errors that will not succeed if they are attempted again.
+func responseError(statusCode int) error {
+	if statusCode >= 200 && statusCode < 300 {
+		return nil
+	}
+
+	err := fmt.Errorf("unexpected response code %d", statusCode)
+
+	if statusCode >= 400 && statusCode < 500 && statusCode != http.StatusTooManyRequests && statusCode != http.StatusRequestTimeout {
+		return &permanentError{err}
+	}
+
+	return err
+}
@@ -0,0 +1,184 @@
+package sinks
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/senml"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const defaultNGSILDContext = "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+
+// property maps a resource of an LwM2M object to a property of an entity. The value of the
+// resource is multiplied by scale, to convert it into the unit of the data model.
+type property struct {
+	name     string
+	resource string
+	scale    float64
+	unitCode string
+}
+
+// dataModel is the Smart Data Models entity type that an LwM2M object is converted into.
+type dataModel struct {
+	entityType string
+	properties []property
+}
+
+// dataModels holds the data models by LwM2M object id. Units are UN/CEFACT codes.
+var dataModels = map[string]dataModel{
+	"3":    {"Device", []property{{"batteryLevel", "9", 0.01, "C62"}}},
+	"3411": {"Device", []property{{"batteryLevel", "1", 0.01, "C62"}}},
+	"3301": {"WeatherObserved", []property{{"illuminance", "5700", 1, "LUX"}}},
+	"3303": {"WeatherObserved", []property{{"temperature", "5700", 1, "CEL"}}},
+	"3304": {"WeatherObserved", []property{{"relativeHumidity", "5700", 0.01, "C62"}}},
+	"3323": {"WeatherObserved", []property{{"atmosphericPressure", "5700", 0.01, "A97"}}},
+	"3424": {"WaterConsumptionObserved", []property{{"waterConsumption", "1", 1000, "LTR"}}},
+	"3428": {"AirQualityObserved", []property{
+		{"pm10", "1", 1, "GQ"},
+		{"pm25", "3", 1, "GQ"},
+		{"no2", "15", 1, "59"},
+		{"co2", "17", 1, "59"},
+	}},
+}
+
+type entity map[string]any
+
+// newEntity converts the measurements into an entity, named after the entity type and the
+// device. Observed entities refer to the Device entity of the device. Objects that have no data
+// model, or none of the resources of one, are not converted.
+func newEntity(m types.MeasurementPack) (entity, bool) {
+	model, ok := dataModels[m.ObjectID]
+	if !ok {
+		return nil, false
+	}
+
+	pack := m.Pack.Clone()
+	pack.Normalize()
+
+	records := map[string]senml.Record{}
+	for _, r := range pack {
+		records[r.Name[strings.LastIndex(r.Name, "/")+1:]] = r
+	}
+
+	e := entity{
+		"id":   fmt.Sprintf("urn:ngsi-ld:%s:%s", model.entityType, m.DeviceID),
+		"type": model.entityType,
+	}
+
+	var observedAt time.Time
+
+	for _, p := range model.properties {
+		r, ok := records[p.resource]
+		if !ok || r.Value == nil {
+			continue
+		}
+
+		ts := time.UnixMilli(int64(r.Time * 1000)).UTC()
+		if ts.After(observedAt) {
+			observedAt = ts
+		}
+
+		e[p.name] = map[string]any{
+			"type":       "Property",
+			"value":      *r.Value * p.scale,
+			"observedAt": ts.Format(time.RFC3339),
+			"unitCode":   p.unitCode,
+		}
+	}
+
+	if observedAt.IsZero() {
+		return nil, false
+	}
+
+	dateProperty := "dateObserved"
+	if model.entityType == "Device" {
+		dateProperty = "dateLastValueReported"
+	} else {
+		e["refDevice"] = map[string]any{
+			"type":   "Relationship",
+			"object": "urn:ngsi-ld:Device:" + m.DeviceID,
+		}
+	}
+
+	e[dateProperty] = map[string]any{
+		"type": "Property",
+		"value": map[string]any{
+			"@type":  "DateTime",
+			"@value": observedAt.Format(time.RFC3339),
+		},
+	}
+
+	return e, true
+}
+
+// ngsildTarget upserts measurements as Smart Data Models entities to an NGSI-LD context broker.
+// Attributes that are not in the measurements are kept, so that the objects of a device may
+// update the same entity.
+type ngsildTarget struct {
+	url        string
+	context    string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+func newNGSILDTarget(cfg Config) *ngsildTarget {
+	return &ngsildTarget{
+		url:     strings.TrimSuffix(cfg.URL, "/") + "/ngsi-ld/v1/entityOperations/upsert?options=update",
+		context: cmp.Or(cfg.Context, defaultNGSILDContext),
+		headers: cfg.Headers,
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		},
+	}
+}
+
+func (t *ngsildTarget) Send(ctx context.Context, m types.MeasurementPack) error {
+	e, ok := newEntity(m)
+	if !ok {
+		return nil
+	}
+
+	e["@context"] = t.context
+
+	b, err := json.Marshal([]entity{e})
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	req.Header.Set("Content-Type", "application/ld+json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	// the broker reports the entities that it failed to upsert in a multi status response
+	if resp.StatusCode == http.StatusMultiStatus {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &permanentError{fmt.Errorf("failed to upsert %s: %s", e["id"], body)}
+	}
+
+	return responseError(resp.StatusCode)
+}
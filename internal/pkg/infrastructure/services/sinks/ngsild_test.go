@@ -0,0 +1,100 @@
+package sinks
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/pkg/lwm2m"
+)
+
+func TestNGSILDSinkUpsertsEntities(t *testing.T) {
+	received := make(chan []map[string]any, 10)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ngsi-ld/v1/entityOperations/upsert" || r.URL.Query().Get("options") != "update" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/ld+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var entities []map[string]any
+		json.NewDecoder(r.Body).Decode(&entities)
+		received <- entities
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	ts := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	co2, pm25 := 412.0, 8.5
+
+	target := newNGSILDTarget(Config{URL: s.URL + "/"})
+
+	for _, m := range []types.MeasurementPack{
+		{DeviceID: "device", ObjectID: "3304", Pack: lwm2m.ToPack(lwm2m.NewHumidity("device", 45, ts))},
+		{DeviceID: "device", ObjectID: "3428", Pack: lwm2m.ToPack(lwm2m.NewAirQuality("device", &co2, nil, &pm25, nil, ts))},
+	} {
+		if err := target.Send(t.Context(), m); err != nil {
+			t.Fatalf("expected %s to be upserted, got error: %v", m.ObjectID, err)
+		}
+	}
+
+	weather := <-received
+	if len(weather) != 1 || weather[0]["id"] != "urn:ngsi-ld:WeatherObserved:device" || weather[0]["type"] != "WeatherObserved" || weather[0]["@context"] != defaultNGSILDContext {
+		t.Fatalf("unexpected entities %v", weather)
+	}
+
+	humidity := weather[0]["relativeHumidity"].(map[string]any)
+	if humidity["value"] != 0.45 || humidity["observedAt"] != "2026-10-18T12:00:00Z" || humidity["unitCode"] != "C62" {
+		t.Fatalf("unexpected relative humidity %v", humidity)
+	}
+
+	if ref := weather[0]["refDevice"].(map[string]any); ref["object"] != "urn:ngsi-ld:Device:device" {
+		t.Fatalf("unexpected device reference %v", ref)
+	}
+
+	air := <-received
+	if air[0]["type"] != "AirQualityObserved" || air[0]["co2"].(map[string]any)["value"] != 412.0 || air[0]["pm25"].(map[string]any)["value"] != 8.5 || air[0]["pm10"] != nil {
+		t.Fatalf("unexpected entities %v", air)
+	}
+}
+
+func TestNGSILDSinkSkipsObjectsWithoutDataModel(t *testing.T) {
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	m := types.MeasurementPack{DeviceID: "device", ObjectID: "3350", Pack: lwm2m.ToPack(lwm2m.NewStopwatch("device", 10, time.Now()))}
+
+	if err := newNGSILDTarget(Config{URL: s.URL}).Send(t.Context(), m); err != nil || requests.Load() != 0 {
+		t.Fatalf("expected the stopwatch to be skipped, got %v after %d requests", err, requests.Load())
+	}
+}
+
+func TestNGSILDSinkDoesNotRetryFailedUpserts(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(`{"success":[],"errors":[{"entityId":"urn:ngsi-ld:WeatherObserved:device","error":{"type":"https://uri.etsi.org/ngsi-ld/errors/BadRequestData"}}]}`))
+	}))
+	defer s.Close()
+
+	err := newNGSILDTarget(Config{URL: s.URL}).Send(t.Context(), testPack("default"))
+
+	var permanent *permanentError
+	if !errors.As(err, &permanent) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+}
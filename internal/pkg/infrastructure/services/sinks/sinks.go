@@ -0,0 +1,519 @@
+package sinks
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/backoff"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/kafka"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/mqtt"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultQueueSize = 1000
+
+// Target delivers measurements to a destination.
+type Target interface {
+	Send(ctx context.Context, m types.MeasurementPack) error
+}
+
+// permanentError is returned by a target for measurements that will never be accepted, so that
+// they are not attempted again.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Config configures a sink. Type is one of iotcore, http, ngsild, mqtt, kafka or file, and decides
+// which of the other settings are used.
+type Config struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Tenants limits the sink to the measurements of these tenants, and ExcludeTenants leaves
+	// out the measurements of those tenants.
+	Tenants        []string    `yaml:"tenants"`
+	ExcludeTenants []string    `yaml:"excludeTenants"`
+	Retry          RetryPolicy `yaml:"retry"`
+	// QueueSize is the number of measurements of each tenant that may wait to be delivered.
+	// Each tenant has its own queue and worker, so that a tenant whose measurements are slow to
+	// deliver does not hold up the others. Measurements are dropped when the queue of their
+	// tenant is full. The iotcore sink is not queued.
+	QueueSize int `yaml:"queueSize"`
+	// Replay sends the measurements of replayed events to the sink. The iotcore sink always
+	// receives them, while ngsild and retained mqtt sinks, which keep the current value, never do.
+	Replay bool `yaml:"replay"`
+
+	// http and ngsild
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+
+	// ngsild
+	Context string `yaml:"context"`
+
+	// mqtt and kafka
+	Topic string `yaml:"topic"`
+
+	// mqtt
+	Broker   string `yaml:"broker"`
+	QoS      byte   `yaml:"qos"`
+	Retained bool   `yaml:"retained"`
+
+	// kafka
+	Brokers []string `yaml:"brokers"`
+
+	// file
+	Path string `yaml:"path"`
+}
+
+// RetryPolicy bounds how a delivery that failed is attempted again. Attempts that are not set
+// are taken from the defaults of the sink type.
+type RetryPolicy struct {
+	MaxAttempts int           `yaml:"maxAttempts"`
+	MinBackoff  time.Duration `yaml:"minBackoff"`
+	MaxBackoff  time.Duration `yaml:"maxBackoff"`
+}
+
+func defaultRetryPolicy(sinkType string) RetryPolicy {
+	// messages to iot-core are already retried by the outbox
+	if sinkType == "iotcore" {
+		return RetryPolicy{MaxAttempts: 1}
+	}
+
+	return RetryPolicy{
+		MaxAttempts: 5,
+		MinBackoff:  time.Second,
+		MaxBackoff:  time.Minute,
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	return backoff.Jittered(attempt, p.MinBackoff, p.MaxBackoff)
+}
+
+type sinksFile struct {
+	Sinks []Config `yaml:"sinks"`
+}
+
+// NewConfigsFromFile reads the configuration of the sinks from a yaml file. Header values may
+// refer to environment variables.
+func NewConfigsFromFile(r io.Reader) ([]Config, error) {
+	var f sinksFile
+
+	err := yaml.NewDecoder(r).Decode(&f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sinks file: %w", err)
+	}
+
+	names := map[string]bool{}
+
+	for i, cfg := range f.Sinks {
+		cfg.Type = strings.ToLower(cfg.Type)
+
+		for k, v := range cfg.Headers {
+			cfg.Headers[k] = os.ExpandEnv(v)
+		}
+
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("invalid sink %q: %w", cfg.Name, err)
+		}
+
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("sink name %q is not unique", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		f.Sinks[i] = cfg
+	}
+
+	return f.Sinks, nil
+}
+
+func (c Config) validate() error {
+	if c.Name == "" {
+		return errors.New("a name is required")
+	}
+
+	if c.QueueSize < 0 {
+		return errors.New("queueSize can not be negative")
+	}
+
+	if len(c.Tenants) > 0 && len(c.ExcludeTenants) > 0 {
+		return errors.New("tenants and excludeTenants can not both be set")
+	}
+
+	if c.Replay && (c.Type == "ngsild" || (c.Type == "mqtt" && c.Retained)) {
+		return errors.New("replay can not be set for sinks that keep the current value")
+	}
+
+	switch c.Type {
+	case "iotcore":
+	case "http", "ngsild":
+		if c.URL == "" {
+			return errors.New("a url is required")
+		}
+	case "mqtt":
+		if c.Topic == "" {
+			return errors.New("a topic is required")
+		}
+	case "kafka":
+		if c.Topic == "" || len(c.Brokers) == 0 {
+			return errors.New("a topic and at least one broker are required")
+		}
+	case "file":
+		if c.Path == "" {
+			return errors.New("a path is required")
+		}
+	default:
+		return fmt.Errorf("expected type iotcore, http, ngsild, mqtt, kafka or file, got %q", c.Type)
+	}
+
+	return nil
+}
+
+// Dependencies holds what the sinks need from the rest of the agent.
+type Dependencies struct {
+	// IoTCore sends measurements to iot-core.
+	IoTCore Target
+	// Brokers are the mqtt broker connections that an mqtt sink may publish to.
+	Brokers []mqtt.Config
+}
+
+// Sinks delivers measurements to the configured destinations.
+type Sinks struct {
+	sinks  []*Sink
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type instruments struct {
+	sent    metric.Int64Counter
+	failed  metric.Int64Counter
+	dropped metric.Int64Counter
+	retries metric.Int64Counter
+}
+
+func newInstruments(logger *slog.Logger) instruments {
+	meter := otel.Meter("iot-agent/sinks")
+
+	var inst instruments
+	var err error
+
+	inst.sent, err = meter.Int64Counter(
+		"diwise.sinks.sent.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of measurement packs delivered by each sink"),
+	)
+	if err != nil {
+		logger.Error("failed to create otel sent counter", "err", err.Error())
+	}
+
+	inst.failed, err = meter.Int64Counter(
+		"diwise.sinks.failed.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of measurement packs that a sink failed to deliver after the last attempt"),
+	)
+	if err != nil {
+		logger.Error("failed to create otel failed counter", "err", err.Error())
+	}
+
+	inst.dropped, err = meter.Int64Counter(
+		"diwise.sinks.dropped.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of measurement packs dropped since the queue of a tenant in a sink was full"),
+	)
+	if err != nil {
+		logger.Error("failed to create otel dropped counter", "err", err.Error())
+	}
+
+	inst.retries, err = meter.Int64Counter(
+		"diwise.sinks.retries.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of failed deliveries that are attempted again"),
+	)
+	if err != nil {
+		logger.Error("failed to create otel retries counter", "err", err.Error())
+	}
+
+	return inst
+}
+
+func New(ctx context.Context, cfgs []Config, deps Dependencies) (*Sinks, error) {
+	logger := logging.GetFromContext(ctx)
+	inst := newInstruments(logger)
+
+	sinksCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	s := &Sinks{ctx: sinksCtx, cancel: cancel}
+
+	for _, cfg := range cfgs {
+		target, err := newTarget(ctx, cfg, deps)
+		if err != nil {
+			cancel()
+			s.close()
+			return nil, fmt.Errorf("failed to create sink %s: %w", cfg.Name, err)
+		}
+
+		s.sinks = append(s.sinks, newSink(cfg, target, inst, logger))
+	}
+
+	return s, nil
+}
+
+func newTarget(ctx context.Context, cfg Config, deps Dependencies) (Target, error) {
+	switch cfg.Type {
+	case "iotcore":
+		if deps.IoTCore == nil {
+			return nil, errors.New("iot-core is not available")
+		}
+		return deps.IoTCore, nil
+	case "http":
+		return newHTTPTarget(cfg), nil
+	case "ngsild":
+		return newNGSILDTarget(cfg), nil
+	case "mqtt":
+		for _, b := range deps.Brokers {
+			if cfg.Broker == "" || strings.EqualFold(b.Name(), cfg.Broker) {
+				return mqtt.NewPublisher(ctx, b, mqtt.PublishConfig{Topic: cfg.Topic, QoS: cfg.QoS, Retained: cfg.Retained})
+			}
+		}
+		return nil, fmt.Errorf("unknown mqtt broker %q", cfg.Broker)
+	case "kafka":
+		return kafka.NewProducer(kafka.ProducerConfig{Brokers: cfg.Brokers, Topic: cfg.Topic})
+	case "file":
+		return newFileTarget(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
+
+// All returns the sinks in the order they were configured.
+func (s *Sinks) All() []*Sink {
+	return s.sinks
+}
+
+// Start connects the sinks that need a connection and starts delivering queued measurements.
+func (s *Sinks) Start() error {
+	for _, sink := range s.sinks {
+		if starter, ok := sink.target.(interface{ Start() error }); ok {
+			if err := starter.Start(); err != nil {
+				return fmt.Errorf("failed to start sink %s: %w", sink.name, err)
+			}
+		}
+
+		sink.startWorkers(func(queue chan queuedPack) {
+			s.wg.Go(func() { sink.run(s.ctx, queue) })
+		})
+	}
+
+	return nil
+}
+
+// Stop stops delivering measurements. Measurements that are still queued are dropped.
+func (s *Sinks) Stop() {
+	s.cancel()
+
+	// no workers may be started for new tenants while waiting for the running ones
+	for _, sink := range s.sinks {
+		sink.startWorkers(nil)
+	}
+
+	s.wg.Wait()
+	s.close()
+}
+
+func (s *Sinks) close() {
+	for _, sink := range s.sinks {
+		switch t := sink.target.(type) {
+		case interface{ Stop() }:
+			t.Stop()
+		case io.Closer:
+			t.Close()
+		}
+	}
+}
+
+type queuedPack struct {
+	ctx context.Context
+	m   types.MeasurementPack
+}
+
+// Sink delivers the measurements of the tenants it accepts to a target. Measurements are
+// delivered in the background, from a queue per tenant, except to iot-core where a failure fails
+// the handling of the measurements.
+type Sink struct {
+	name      string
+	tenants   []string
+	exclude   []string
+	replay    bool
+	retry     RetryPolicy
+	target    Target
+	queueSize int
+	attrs     metric.MeasurementOption
+	inst      instruments
+	log       *slog.Logger
+
+	mu     sync.Mutex
+	queues map[string]chan queuedPack
+	start  func(queue chan queuedPack)
+}
+
+func newSink(cfg Config, target Target, inst instruments, logger *slog.Logger) *Sink {
+	retry := defaultRetryPolicy(cfg.Type)
+	if cfg.Retry.MaxAttempts > 0 {
+		retry.MaxAttempts = cfg.Retry.MaxAttempts
+	}
+	if cfg.Retry.MinBackoff > 0 {
+		retry.MinBackoff = cfg.Retry.MinBackoff
+	}
+	if cfg.Retry.MaxBackoff > 0 {
+		retry.MaxBackoff = cfg.Retry.MaxBackoff
+	}
+	retry.MaxBackoff = max(retry.MaxBackoff, retry.MinBackoff)
+
+	s := &Sink{
+		name:    cfg.Name,
+		tenants: cfg.Tenants,
+		exclude: cfg.ExcludeTenants,
+		replay:  cfg.Replay || cfg.Type == "iotcore",
+		retry:   retry,
+		target:  target,
+		attrs:   metric.WithAttributes(attribute.String("sink", cfg.Name)),
+		inst:    inst,
+		log:     logger.With(slog.String("sink", cfg.Name)),
+	}
+
+	if cfg.Type != "iotcore" {
+		s.queueSize = cmp.Or(cfg.QueueSize, defaultQueueSize)
+		s.queues = map[string]chan queuedPack{}
+	}
+
+	return s
+}
+
+// startWorkers starts a worker for the queue of each tenant using start, and for the queues of
+// tenants that are added later. Workers are no longer started once start is nil.
+func (s *Sink) startWorkers(start func(queue chan queuedPack)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.start = start
+
+	if start != nil {
+		for _, queue := range s.queues {
+			start(queue)
+		}
+	}
+}
+
+// queue returns the queue of a tenant, and starts a worker for it if it is new.
+func (s *Sink) queue(tenant string) chan queuedPack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue, ok := s.queues[tenant]
+	if !ok {
+		queue = make(chan queuedPack, s.queueSize)
+		s.queues[tenant] = queue
+
+		if s.start != nil {
+			s.start(queue)
+		}
+	}
+
+	return queue
+}
+
+// Send delivers the measurements if the sink accepts their tenant.
+func (s *Sink) Send(ctx context.Context, m types.MeasurementPack) error {
+	if !s.accepts(m.Tenant) {
+		return nil
+	}
+
+	if s.queues == nil {
+		return s.deliver(ctx, m)
+	}
+
+	select {
+	case s.queue(m.Tenant) <- queuedPack{ctx: context.WithoutCancel(ctx), m: m}:
+	default:
+		s.inst.dropped.Add(ctx, 1, metric.WithAttributes(attribute.String("sink", s.name), attribute.String("tenant", m.Tenant)))
+		s.log.Warn("dropping measurements since the queue of the tenant is full", "tenant", m.Tenant, "device_id", m.DeviceID, "object_id", m.ObjectID)
+	}
+
+	return nil
+}
+
+// AcceptsReplay reports if the measurements of replayed events are sent to the sink.
+func (s *Sink) AcceptsReplay() bool {
+	return s.replay
+}
+
+func (s *Sink) accepts(tenant string) bool {
+	if len(s.tenants) > 0 {
+		return slices.Contains(s.tenants, tenant)
+	}
+
+	return !slices.Contains(s.exclude, tenant)
+}
+
+func (s *Sink) run(ctx context.Context, queue chan queuedPack) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-queue:
+			// deliveries are abandoned when the sinks are stopped
+			qctx, cancel := context.WithCancel(q.ctx)
+			stop := context.AfterFunc(ctx, cancel)
+			s.deliver(qctx, q.m)
+			stop()
+			cancel()
+		}
+	}
+}
+
+// deliver sends the measurements to the target and retries failed attempts with a backoff.
+func (s *Sink) deliver(ctx context.Context, m types.MeasurementPack) error {
+	for attempt := 1; ; attempt++ {
+		err := s.target.Send(ctx, m)
+		if err == nil {
+			s.inst.sent.Add(ctx, 1, s.attrs)
+			return nil
+		}
+
+		var permanent *permanentError
+		if attempt >= s.retry.MaxAttempts || errors.As(err, &permanent) || ctx.Err() != nil {
+			s.inst.failed.Add(ctx, 1, s.attrs)
+			s.log.Error("failed to deliver measurements", "device_id", m.DeviceID, "object_id", m.ObjectID, "attempts", attempt, "err", err.Error())
+			return err
+		}
+
+		delay := s.retry.backoff(attempt)
+
+		s.inst.retries.Add(ctx, 1, s.attrs)
+		s.log.Warn("retrying delivery of measurements", "device_id", m.DeviceID, "attempt", attempt, "delay", delay.String(), "err", err.Error())
+
+		select {
+		case <-ctx.Done():
+			s.inst.failed.Add(ctx, 1, s.attrs)
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/senml"
+)
+
+func TestNewConfigsFromFile(t *testing.T) {
+	t.Setenv("WEBHOOK_TOKEN", "secret")
+
+	cfgs, err := NewConfigsFromFile(strings.NewReader(`
+sinks:
+  - name: iot-core
+    type: iotcore
+    excludeTenants: [kommun]
+  - name: kommun
+    type: HTTP
+    url: https://kommun.example/measurements
+    headers:
+      Authorization: Bearer ${WEBHOOK_TOKEN}
+    tenants: [kommun]
+    retry:
+      maxAttempts: 10
+      minBackoff: 2s
+      maxBackoff: 5m
+  - name: archive
+    type: file
+    path: /var/lib/iot-agent/measurements.jsonl
+`))
+	if err != nil {
+		t.Fatalf("expected configs, got error: %v", err)
+	}
+
+	if len(cfgs) != 3 || cfgs[1].Type != "http" || cfgs[1].Headers["Authorization"] != "Bearer secret" || cfgs[1].Retry.MaxAttempts != 10 || cfgs[1].Retry.MaxBackoff != 5*time.Minute {
+		t.Fatalf("unexpected configs %+v", cfgs)
+	}
+
+	for _, file := range []string{
+		"sinks:\n  - name: a\n    type: http\n",
+		"sinks:\n  - name: a\n    type: ngsild\n",
+		"sinks:\n  - name: a\n    type: kafka\n    topic: measurements\n",
+		"sinks:\n  - name: a\n    type: ftp\n",
+		"sinks:\n  - name: a\n    type: iotcore\n  - name: a\n    type: iotcore\n",
+		"sinks:\n  - name: a\n    type: iotcore\n    tenants: [a]\n    excludeTenants: [b]\n",
+		"sinks:\n  - name: a\n    type: ngsild\n    url: http://broker\n    replay: true\n",
+		"sinks:\n  - name: a\n    type: mqtt\n    topic: a\n    retained: true\n    replay: true\n",
+	} {
+		if _, err := NewConfigsFromFile(strings.NewReader(file)); err == nil {
+			t.Fatalf("expected an error for %q", file)
+		}
+	}
+}
+
+func TestHTTPSinkRetriesAndFiltersTenants(t *testing.T) {
+	var requests atomic.Int32
+	received := make(chan types.MeasurementPack, 10)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var m types.MeasurementPack
+		json.NewDecoder(r.Body).Decode(&m)
+		received <- m
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	sinks := newTestSinks(t, Config{
+		Name:    "kommun",
+		Type:    "http",
+		URL:     s.URL,
+		Tenants: []string{"kommun"},
+		Retry:   RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	})
+
+	sink := sinks.All()[0]
+	sink.Send(t.Context(), testPack("default"))
+	sink.Send(t.Context(), testPack("kommun"))
+
+	select {
+	case m := <-received:
+		if m.Tenant != "kommun" || m.DeviceID != "device" || len(m.Pack) != 1 {
+			t.Fatalf("unexpected measurements %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected measurements to be delivered")
+	}
+
+	if requests.Load() != 2 {
+		t.Fatalf("expected one failed and one successful request, got %d requests", requests.Load())
+	}
+}
+
+func TestHTTPSinkDoesNotRetryClientErrors(t *testing.T) {
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer s.Close()
+
+	sink := newSink(Config{Name: "kommun", Type: "http"}, newHTTPTarget(Config{URL: s.URL}), newInstruments(slog.New(slog.DiscardHandler)), slog.New(slog.DiscardHandler))
+	sink.retry.MinBackoff, sink.retry.MaxBackoff = time.Millisecond, time.Millisecond
+
+	if err := sink.deliver(t.Context(), testPack("default")); err == nil {
+		t.Fatal("expected delivery to fail")
+	}
+
+	if requests.Load() != 1 {
+		t.Fatalf("expected a single request, got %d", requests.Load())
+	}
+}
+
+func TestIoTCoreSinkIsSynchronous(t *testing.T) {
+	var calls int
+	iotCore := targetFunc(func(ctx context.Context, m types.MeasurementPack) error {
+		calls++
+		return context.DeadlineExceeded
+	})
+
+	sinks, err := New(t.Context(), []Config{{Name: "iot-core", Type: "iotcore"}}, Dependencies{IoTCore: iotCore})
+	if err != nil {
+		t.Fatalf("expected sinks, got error: %v", err)
+	}
+
+	if err := sinks.All()[0].Send(t.Context(), testPack("default")); err == nil || calls != 1 {
+		t.Fatalf("expected the error from iot-core after a single attempt, got %v after %d attempts", err, calls)
+	}
+
+	if !sinks.All()[0].AcceptsReplay() {
+		t.Fatal("expected iot-core to accept replayed measurements")
+	}
+}
+
+func TestSlowTenantDoesNotHoldUpOtherTenants(t *testing.T) {
+	blocked := make(chan struct{}, 10)
+	release := make(chan struct{})
+	delivered := make(chan string, 10)
+
+	target := targetFunc(func(ctx context.Context, m types.MeasurementPack) error {
+		if m.Tenant == "slow" {
+			blocked <- struct{}{}
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		delivered <- m.Tenant
+		return nil
+	})
+
+	logger := slog.New(slog.DiscardHandler)
+	sinks := &Sinks{}
+	sinks.ctx, sinks.cancel = context.WithCancel(t.Context())
+	sinks.sinks = []*Sink{newSink(Config{Name: "kommun", Type: "http", QueueSize: 1}, target, newInstruments(logger), logger)}
+	sinks.Start()
+	t.Cleanup(sinks.Stop)
+
+	sink := sinks.All()[0]
+
+	sink.Send(t.Context(), testPack("slow"))
+	<-blocked
+
+	// the first pack is being delivered, so the second is queued and the rest are dropped
+	for range 3 {
+		sink.Send(t.Context(), testPack("slow"))
+	}
+	sink.Send(t.Context(), testPack("default"))
+
+	select {
+	case tenant := <-delivered:
+		if tenant != "default" {
+			t.Fatalf("expected the measurements of the default tenant first, got %s", tenant)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the default tenant to be delivered while the slow tenant is blocked")
+	}
+
+	close(release)
+
+	for range 2 {
+		select {
+		case tenant := <-delivered:
+			if tenant != "slow" {
+				t.Fatalf("unexpected delivery to %s", tenant)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the queued measurements of the slow tenant to be delivered")
+		}
+	}
+
+	select {
+	case tenant := <-delivered:
+		t.Fatalf("expected the measurements that did not fit in the queue to be dropped, got one for %s", tenant)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFileSinkWritesJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "measurements.jsonl")
+
+	sinks := newTestSinks(t, Config{Name: "archive", Type: "file", Path: path})
+
+	sink := sinks.All()[0]
+	sink.Send(t.Context(), testPack("default"))
+	sink.Send(t.Context(), testPack("kommun"))
+
+	var lines []string
+	deadline := time.Now().Add(5 * time.Second)
+	for len(lines) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+
+		f, _ := os.Open(path)
+		lines = lines[:0]
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		f.Close()
+	}
+
+	// the tenants are delivered by their own workers, in no particular order
+	if len(lines) != 2 || !strings.Contains(strings.Join(lines, "\n"), `"tenant":"kommun"`) {
+		t.Fatalf("unexpected lines %v", lines)
+	}
+}
+
+func newTestSinks(t *testing.T, cfgs ...Config) *Sinks {
+	t.Helper()
+
+	sinks, err := New(t.Context(), cfgs, Dependencies{})
+	if err != nil {
+		t.Fatalf("expected sinks, got error: %v", err)
+	}
+
+	sinks.Start()
+	t.Cleanup(sinks.Stop)
+
+	return sinks
+}
+
+func testPack(tenant string) types.MeasurementPack {
+	v := 21.5
+	return types.MeasurementPack{
+		DeviceID: "device",
+		ObjectID: "3303",
+		Tenant:   tenant,
+		Pack:     senml.Pack{{BaseName: "device/3303/", Name: "5700", Value: &v}},
+	}
+}
+
+type targetFunc func(ctx context.Context, m types.MeasurementPack) error
+
+func (f targetFunc) Send(ctx context.Context, m types.MeasurementPack) error {
+	return f(ctx, m)
+}
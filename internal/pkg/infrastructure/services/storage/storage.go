@@ -5,15 +5,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/mqtt"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/outbox"
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	dmc "github.com/diwise/iot-device-mgmt/pkg/client"
 	"github.com/diwise/service-chassis/pkg/infrastructure/env"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"go.opentelemetry.io/otel/trace"
@@ -43,9 +47,14 @@ func (c Config) ConnStr() string {
 	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s", c.user, c.password, c.host, c.port, c.dbname, c.sslmode)
 }
 
+var ErrNotFound = errors.New("not found")
+
 //go:generate moq -rm -out storage_mock.go . Storage
 type Storage interface {
-	Save(ctx context.Context, se types.Event, device dmc.Device, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error
+	Save(ctx context.Context, se types.Event, device dmc.Device, decoder string, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error
+	QueryEvents(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error)
+	GetFrameCounter(ctx context.Context, sensorID string) (types.FrameCounter, error)
+	SaveFrameCounter(ctx context.Context, sensorID string, fc types.FrameCounter) error
 	Close() error
 }
 
@@ -86,7 +95,7 @@ func (s *postgres) Ping(ctx context.Context) error {
 	return s.conn.Ping(ctx)
 }
 
-func (s *postgres) Save(ctx context.Context, se types.Event, device dmc.Device, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, e error) error {
+func (s *postgres) Save(ctx context.Context, se types.Event, device dmc.Device, decoder string, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, e error) error {
 	log := logging.GetFromContext(ctx)
 
 	evt, err := json.Marshal(se)
@@ -98,6 +107,8 @@ func (s *postgres) Save(ctx context.Context, se types.Event, device dmc.Device,
 	args := pgx.NamedArgs{
 		"sensor_id": se.DevEUI,
 		"device_id": nil,
+		"tenant":    nil,
+		"decoder":   nil,
 		"event":     evt,
 		"payload":   nil,
 		"objects":   nil,
@@ -107,6 +118,11 @@ func (s *postgres) Save(ctx context.Context, se types.Event, device dmc.Device,
 
 	if device != nil {
 		args["device_id"] = device.ID()
+		args["tenant"] = device.Tenant()
+	}
+
+	if decoder != "" {
+		args["decoder"] = decoder
 	}
 
 	if payload != nil {
@@ -129,9 +145,29 @@ func (s *postgres) Save(ctx context.Context, se types.Event, device dmc.Device,
 		args["trace_id"] = traceID.String()
 	}
 
-	sql := `INSERT INTO sensor_events_v2 (sensor_id, device_id, event, payload, objects, error, trace_id) VALUES (@sensor_id, @device_id, @event, @payload, @objects, @error, @trace_id);`
+	sql := `INSERT INTO sensor_events_v2 (sensor_id, device_id, tenant, decoder, event, payload, objects, error, trace_id) VALUES (@sensor_id, @device_id, @tenant, @decoder, @event, @payload, @objects, @error, @trace_id);`
+
+	// the outbox messages of the event are stored in the same transaction as the event
+	err = outbox.BatchFromContext(ctx).StoreWith(s, func(messages []outbox.Message) error {
+		if len(messages) == 0 {
+			_, err := s.conn.Exec(ctx, sql, args)
+			return err
+		}
+
+		return pgx.BeginFunc(ctx, s.conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, sql, args); err != nil {
+				return err
+			}
+
+			for _, m := range messages {
+				if err := addOutboxMessage(ctx, tx, m); err != nil {
+					return err
+				}
+			}
 
-	_, err = s.conn.Exec(ctx, sql, args)
+			return nil
+		})
+	})
 	if err != nil {
 		log.Error("could not save sensor event", "sql", sql, "args", args, "err", err.Error())
 		return err
@@ -140,6 +176,334 @@ func (s *postgres) Save(ctx context.Context, se types.Event, device dmc.Device,
 	return nil
 }
 
+func (s *postgres) QueryEvents(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+	conditions := []string{}
+	args := pgx.NamedArgs{"limit": q.Limit}
+
+	if q.SensorID != "" {
+		conditions = append(conditions, "sensor_id = @sensor_id")
+		args["sensor_id"] = q.SensorID
+	}
+
+	if q.DeviceID != "" {
+		conditions = append(conditions, "device_id = @device_id")
+		args["device_id"] = q.DeviceID
+	}
+
+	if q.SensorType != "" {
+		conditions = append(conditions, "(decoder = @sensor_type OR decoder LIKE @sensor_type || '@%')")
+		args["sensor_type"] = q.SensorType
+	}
+
+	if q.Error != "" {
+		conditions = append(conditions, "error ILIKE '%' || @error || '%'")
+		args["error"] = q.Error
+	}
+
+	if q.HasError != nil {
+		if *q.HasError {
+			conditions = append(conditions, "error IS NOT NULL")
+		} else {
+			conditions = append(conditions, "error IS NULL")
+		}
+	}
+
+	if q.TraceID != "" {
+		conditions = append(conditions, "trace_id = @trace_id")
+		args["trace_id"] = q.TraceID
+	}
+
+	if q.Tenants != nil {
+		conditions = append(conditions, "tenant = ANY(@tenants)")
+		args["tenants"] = q.Tenants
+	}
+
+	if !q.From.IsZero() {
+		conditions = append(conditions, "time >= @from")
+		args["from"] = q.From
+	}
+
+	if !q.To.IsZero() {
+		conditions = append(conditions, "time < @to")
+		args["to"] = q.To
+	}
+
+	order := "ASC"
+	if q.NewestFirst {
+		order = "DESC"
+	}
+
+	if q.After != nil {
+		if q.NewestFirst {
+			conditions = append(conditions, "(time, id) < (@after_time, @after_id)")
+		} else {
+			conditions = append(conditions, "(time, id) > (@after_time, @after_id)")
+		}
+		args["after_time"] = q.After.Time
+		args["after_id"] = q.After.ID
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	sql := fmt.Sprintf(`SELECT id, time, sensor_id, COALESCE(device_id, ''), COALESCE(tenant, ''), COALESCE(decoder, ''), event, payload, objects, COALESCE(error, ''), COALESCE(trace_id, '')
+			FROM sensor_events_v2 %s
+			ORDER BY time %s, id %s
+			LIMIT @limit;`, where, order, order)
+
+	rows, err := s.conn.Query(ctx, sql, args)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("could not query sensor events", "sql", sql, "args", args, "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []types.StoredEvent{}
+
+	for rows.Next() {
+		var e types.StoredEvent
+		var evt, payload, objects []byte
+
+		err = rows.Scan(&e.ID, &e.Time, &e.SensorID, &e.DeviceID, &e.Tenant, &e.Decoder, &evt, &payload, &objects, &e.Error, &e.TraceID)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Payload = payload
+		e.Objects = objects
+
+		if len(evt) > 0 {
+			err = json.Unmarshal(evt, &e.Event)
+			if err != nil {
+				return nil, fmt.Errorf("could not unmarshal stored event %s: %w", e.ID, err)
+			}
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *postgres) GetFrameCounter(ctx context.Context, sensorID string) (types.FrameCounter, error) {
+	var fc types.FrameCounter
+	var seen int64
+
+	sql := `SELECT fcnt, seen, updated FROM sensor_frame_counters WHERE sensor_id = @sensor_id;`
+
+	err := s.conn.QueryRow(ctx, sql, pgx.NamedArgs{"sensor_id": sensorID}).Scan(&fc.FCnt, &seen, &fc.Timestamp)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fc, ErrNotFound
+		}
+		return fc, err
+	}
+
+	// the bitmap is stored as a signed BIGINT
+	fc.Seen = uint64(seen)
+
+	return fc, nil
+}
+
+func (s *postgres) SaveFrameCounter(ctx context.Context, sensorID string, fc types.FrameCounter) error {
+	args := pgx.NamedArgs{
+		"sensor_id": sensorID,
+		"fcnt":      fc.FCnt,
+		"seen":      int64(fc.Seen),
+		"updated":   fc.Timestamp,
+	}
+
+	sql := `INSERT INTO sensor_frame_counters (sensor_id, fcnt, seen, updated) VALUES (@sensor_id, @fcnt, @seen, @updated)
+			ON CONFLICT (sensor_id) DO UPDATE SET fcnt = EXCLUDED.fcnt, seen = EXCLUDED.seen, updated = EXCLUDED.updated;`
+
+	_, err := s.conn.Exec(ctx, sql, args)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("could not save frame counter", "sensor_id", sensorID, "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (s *postgres) AddOutboxMessage(ctx context.Context, m outbox.Message) error {
+	return addOutboxMessage(ctx, s.conn, m)
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+func addOutboxMessage(ctx context.Context, conn execer, m outbox.Message) error {
+	args := pgx.NamedArgs{
+		"created":      m.Created,
+		"kind":         string(m.Kind),
+		"key":          m.Key,
+		"order_key":    m.OrderKey,
+		"content_type": m.ContentType,
+		"body":         m.Body,
+		"trace_id":     nil,
+		"span_id":      nil,
+		"next_attempt": m.NextAttempt,
+	}
+
+	if m.TraceID != "" {
+		args["trace_id"] = m.TraceID
+	}
+
+	if m.SpanID != "" {
+		args["span_id"] = m.SpanID
+	}
+
+	sql := `INSERT INTO message_outbox (created, kind, key, order_key, content_type, body, trace_id, span_id, next_attempt) VALUES (@created, @kind, @key, @order_key, @content_type, @body, @trace_id, @span_id, @next_attempt);`
+
+	_, err := conn.Exec(ctx, sql, args)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("could not add message to outbox", "kind", m.Kind, "key", m.Key, "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (s *postgres) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]outbox.Message, error) {
+	args := pgx.NamedArgs{
+		"limit": limit,
+		"lease": time.Now().UTC().Add(lease),
+	}
+
+	sql := `UPDATE message_outbox SET next_attempt = @lease
+			WHERE id IN (
+				SELECT id FROM message_outbox m
+				WHERE next_attempt <= CURRENT_TIMESTAMP
+				-- messages created after a message of the same key that is claimed or waits to be
+				-- retried are kept in order behind it
+				AND NOT EXISTS (
+					SELECT 1 FROM message_outbox b
+					WHERE b.order_key = m.order_key AND b.created < m.created AND b.next_attempt > CURRENT_TIMESTAMP
+				)
+				ORDER BY created
+				LIMIT @limit
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, created, kind, key, order_key, content_type, body, COALESCE(trace_id, ''), COALESCE(span_id, ''), attempts, COALESCE(last_error, ''), next_attempt;`
+
+	rows, err := s.conn.Query(ctx, sql, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []outbox.Message{}
+
+	for rows.Next() {
+		var m outbox.Message
+		var kind string
+
+		err = rows.Scan(&m.ID, &m.Created, &kind, &m.Key, &m.OrderKey, &m.ContentType, &m.Body, &m.TraceID, &m.SpanID, &m.Attempts, &m.LastError, &m.NextAttempt)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Kind = outbox.Kind(kind)
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+func (s *postgres) DeleteOutboxMessage(ctx context.Context, id string) error {
+	_, err := s.conn.Exec(ctx, `DELETE FROM message_outbox WHERE id = @id;`, pgx.NamedArgs{"id": id})
+	return err
+}
+
+func (s *postgres) RetryOutboxMessage(ctx context.Context, m outbox.Message) error {
+	args := pgx.NamedArgs{
+		"id":           m.ID,
+		"attempts":     m.Attempts,
+		"last_error":   nil,
+		"next_attempt": m.NextAttempt,
+	}
+
+	if m.LastError != "" {
+		args["last_error"] = m.LastError
+	}
+
+	sql := `UPDATE message_outbox SET attempts = @attempts, last_error = @last_error, next_attempt = @next_attempt WHERE id = @id;`
+
+	_, err := s.conn.Exec(ctx, sql, args)
+	return err
+}
+
+func (s *postgres) DeadLetterOutboxMessage(ctx context.Context, m outbox.Message) error {
+	args := pgx.NamedArgs{
+		"id":         m.ID,
+		"attempts":   m.Attempts,
+		"last_error": m.LastError,
+	}
+
+	sql := `WITH moved AS (DELETE FROM message_outbox WHERE id = @id RETURNING *)
+			INSERT INTO message_outbox_dead_letters (id, created, kind, key, content_type, body, trace_id, attempts, last_error)
+			SELECT id, created, kind, key, content_type, body, trace_id, @attempts, @last_error FROM moved;`
+
+	_, err := s.conn.Exec(ctx, sql, args)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("could not dead-letter outbox message", "id", m.ID, "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (s *postgres) OutboxBacklog(ctx context.Context) (int, time.Time, error) {
+	var size int
+	var oldest *time.Time
+
+	err := s.conn.QueryRow(ctx, `SELECT COUNT(*), MIN(created) FROM message_outbox;`).Scan(&size, &oldest)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if oldest == nil {
+		return size, time.Time{}, nil
+	}
+
+	return size, *oldest, nil
+}
+
+func (s *postgres) AddMQTTDeadLetter(ctx context.Context, dl mqtt.DeadLetter) error {
+	args := pgx.NamedArgs{
+		"received":   dl.Received,
+		"broker":     dl.Broker,
+		"topic":      dl.Topic,
+		"message_id": int(dl.MessageID),
+		"payload":    dl.Payload,
+		"attempts":   dl.Attempts,
+		"last_error": dl.LastError,
+		"trace_id":   nil,
+	}
+
+	if dl.TraceID != "" {
+		args["trace_id"] = dl.TraceID
+	}
+
+	if dl.Payload == nil {
+		args["payload"] = []byte{}
+	}
+
+	sql := `INSERT INTO mqtt_dead_letters (received, broker, topic, message_id, payload, attempts, last_error, trace_id)
+			VALUES (@received, @broker, @topic, @message_id, @payload, @attempts, @last_error, @trace_id);`
+
+	_, err := s.conn.Exec(ctx, sql, args)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("could not add mqtt dead letter", "broker", dl.Broker, "topic", dl.Topic, "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
 func connect(ctx context.Context, config Config) (*pgxpool.Pool, error) {
 	poolConfig, err := pgxpool.ParseConfig(config.ConnStr())
 	if err != nil {
@@ -185,6 +549,64 @@ func initialize(ctx context.Context, conn *pgxpool.Pool) error {
 			PRIMARY KEY (time, id)
 		);
 
+		ALTER TABLE sensor_events_v2 ADD COLUMN IF NOT EXISTS decoder TEXT NULL;
+		ALTER TABLE sensor_events_v2 ADD COLUMN IF NOT EXISTS tenant TEXT NULL;
+
+		CREATE INDEX IF NOT EXISTS sensor_events_v2_sensor_id_idx ON sensor_events_v2 (sensor_id, time DESC);
+		CREATE INDEX IF NOT EXISTS sensor_events_v2_device_id_idx ON sensor_events_v2 (device_id, time DESC);
+
+		CREATE TABLE IF NOT EXISTS sensor_frame_counters (
+			sensor_id 	TEXT PRIMARY KEY,
+			fcnt 		BIGINT NOT NULL,
+			seen 		BIGINT NOT NULL DEFAULT 0,
+			updated 	TIMESTAMPTZ NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS message_outbox (
+			id 				UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			created 		TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			kind 			TEXT NOT NULL,
+			key 			TEXT NOT NULL,
+			content_type 	TEXT NOT NULL,
+			body 			BYTEA NOT NULL,
+			trace_id 		TEXT NULL,
+			attempts 		INTEGER NOT NULL DEFAULT 0,
+			last_error 		TEXT NULL,
+			next_attempt 	TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		ALTER TABLE message_outbox ADD COLUMN IF NOT EXISTS order_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE message_outbox ADD COLUMN IF NOT EXISTS span_id TEXT NULL;
+
+		CREATE INDEX IF NOT EXISTS message_outbox_next_attempt_idx ON message_outbox (next_attempt);
+		CREATE INDEX IF NOT EXISTS message_outbox_order_key_idx ON message_outbox (order_key, created);
+
+		CREATE TABLE IF NOT EXISTS message_outbox_dead_letters (
+			id 				UUID PRIMARY KEY,
+			created 		TIMESTAMPTZ NOT NULL,
+			dead_lettered 	TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			kind 			TEXT NOT NULL,
+			key 			TEXT NOT NULL,
+			content_type 	TEXT NOT NULL,
+			body 			BYTEA NOT NULL,
+			trace_id 		TEXT NULL,
+			attempts 		INTEGER NOT NULL,
+			last_error 		TEXT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS mqtt_dead_letters (
+			id 				UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			received 		TIMESTAMPTZ NOT NULL,
+			dead_lettered 	TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			broker 			TEXT NOT NULL,
+			topic 			TEXT NOT NULL,
+			message_id 		INTEGER NOT NULL,
+			payload 		BYTEA NOT NULL,
+			attempts 		INTEGER NOT NULL,
+			last_error 		TEXT NULL,
+			trace_id 		TEXT NULL
+		);
+
 		DO $$
 		DECLARE
 			n INTEGER;
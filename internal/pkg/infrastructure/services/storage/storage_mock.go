@@ -24,9 +24,18 @@ var _ Storage = &StorageMock{}
 //			CloseFunc: func() error {
 //				panic("mock out the Close method")
 //			},
-//			SaveFunc: func(ctx context.Context, se types.Event, device dmc.Device, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
+//			GetFrameCounterFunc: func(ctx context.Context, sensorID string) (types.FrameCounter, error) {
+//				panic("mock out the GetFrameCounter method")
+//			},
+//			QueryEventsFunc: func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+//				panic("mock out the QueryEvents method")
+//			},
+//			SaveFunc: func(ctx context.Context, se types.Event, device dmc.Device, decoder string, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
 //				panic("mock out the Save method")
 //			},
+//			SaveFrameCounterFunc: func(ctx context.Context, sensorID string, fc types.FrameCounter) error {
+//				panic("mock out the SaveFrameCounter method")
+//			},
 //		}
 //
 //		// use mockedStorage in code that requires Storage
@@ -37,14 +46,37 @@ type StorageMock struct {
 	// CloseFunc mocks the Close method.
 	CloseFunc func() error
 
+	// GetFrameCounterFunc mocks the GetFrameCounter method.
+	GetFrameCounterFunc func(ctx context.Context, sensorID string) (types.FrameCounter, error)
+
+	// QueryEventsFunc mocks the QueryEvents method.
+	QueryEventsFunc func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error)
+
 	// SaveFunc mocks the Save method.
-	SaveFunc func(ctx context.Context, se types.Event, device dmc.Device, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error
+	SaveFunc func(ctx context.Context, se types.Event, device dmc.Device, decoder string, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error
+
+	// SaveFrameCounterFunc mocks the SaveFrameCounter method.
+	SaveFrameCounterFunc func(ctx context.Context, sensorID string, fc types.FrameCounter) error
 
 	// calls tracks calls to the methods.
 	calls struct {
 		// Close holds details about calls to the Close method.
 		Close []struct {
 		}
+		// GetFrameCounter holds details about calls to the GetFrameCounter method.
+		GetFrameCounter []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// SensorID is the sensorID argument value.
+			SensorID string
+		}
+		// QueryEvents holds details about calls to the QueryEvents method.
+		QueryEvents []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Q is the q argument value.
+			Q types.EventQuery
+		}
 		// Save holds details about calls to the Save method.
 		Save []struct {
 			// Ctx is the ctx argument value.
@@ -53,6 +85,8 @@ type StorageMock struct {
 			Se types.Event
 			// Device is the device argument value.
 			Device dmc.Device
+			// Decoder is the decoder argument value.
+			Decoder string
 			// Payload is the payload argument value.
 			Payload types.SensorPayload
 			// Objects is the objects argument value.
@@ -60,9 +94,21 @@ type StorageMock struct {
 			// Err is the err argument value.
 			Err error
 		}
+		// SaveFrameCounter holds details about calls to the SaveFrameCounter method.
+		SaveFrameCounter []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// SensorID is the sensorID argument value.
+			SensorID string
+			// Fc is the fc argument value.
+			Fc types.FrameCounter
+		}
 	}
-	lockClose sync.RWMutex
-	lockSave  sync.RWMutex
+	lockClose            sync.RWMutex
+	lockGetFrameCounter  sync.RWMutex
+	lockQueryEvents      sync.RWMutex
+	lockSave             sync.RWMutex
+	lockSaveFrameCounter sync.RWMutex
 }
 
 // Close calls CloseFunc.
@@ -92,8 +138,80 @@ func (mock *StorageMock) CloseCalls() []struct {
 	return calls
 }
 
+// GetFrameCounter calls GetFrameCounterFunc.
+func (mock *StorageMock) GetFrameCounter(ctx context.Context, sensorID string) (types.FrameCounter, error) {
+	if mock.GetFrameCounterFunc == nil {
+		panic("StorageMock.GetFrameCounterFunc: method is nil but Storage.GetFrameCounter was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		SensorID string
+	}{
+		Ctx:      ctx,
+		SensorID: sensorID,
+	}
+	mock.lockGetFrameCounter.Lock()
+	mock.calls.GetFrameCounter = append(mock.calls.GetFrameCounter, callInfo)
+	mock.lockGetFrameCounter.Unlock()
+	return mock.GetFrameCounterFunc(ctx, sensorID)
+}
+
+// GetFrameCounterCalls gets all the calls that were made to GetFrameCounter.
+// Check the length with:
+//
+//	len(mockedStorage.GetFrameCounterCalls())
+func (mock *StorageMock) GetFrameCounterCalls() []struct {
+	Ctx      context.Context
+	SensorID string
+} {
+	var calls []struct {
+		Ctx      context.Context
+		SensorID string
+	}
+	mock.lockGetFrameCounter.RLock()
+	calls = mock.calls.GetFrameCounter
+	mock.lockGetFrameCounter.RUnlock()
+	return calls
+}
+
+// QueryEvents calls QueryEventsFunc.
+func (mock *StorageMock) QueryEvents(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+	if mock.QueryEventsFunc == nil {
+		panic("StorageMock.QueryEventsFunc: method is nil but Storage.QueryEvents was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Q   types.EventQuery
+	}{
+		Ctx: ctx,
+		Q:   q,
+	}
+	mock.lockQueryEvents.Lock()
+	mock.calls.QueryEvents = append(mock.calls.QueryEvents, callInfo)
+	mock.lockQueryEvents.Unlock()
+	return mock.QueryEventsFunc(ctx, q)
+}
+
+// QueryEventsCalls gets all the calls that were made to QueryEvents.
+// Check the length with:
+//
+//	len(mockedStorage.QueryEventsCalls())
+func (mock *StorageMock) QueryEventsCalls() []struct {
+	Ctx context.Context
+	Q   types.EventQuery
+} {
+	var calls []struct {
+		Ctx context.Context
+		Q   types.EventQuery
+	}
+	mock.lockQueryEvents.RLock()
+	calls = mock.calls.QueryEvents
+	mock.lockQueryEvents.RUnlock()
+	return calls
+}
+
 // Save calls SaveFunc.
-func (mock *StorageMock) Save(ctx context.Context, se types.Event, device dmc.Device, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
+func (mock *StorageMock) Save(ctx context.Context, se types.Event, device dmc.Device, decoder string, payload types.SensorPayload, objects []lwm2m.Lwm2mObject, err error) error {
 	if mock.SaveFunc == nil {
 		panic("StorageMock.SaveFunc: method is nil but Storage.Save was just called")
 	}
@@ -101,6 +219,7 @@ func (mock *StorageMock) Save(ctx context.Context, se types.Event, device dmc.De
 		Ctx     context.Context
 		Se      types.Event
 		Device  dmc.Device
+		Decoder string
 		Payload types.SensorPayload
 		Objects []lwm2m.Lwm2mObject
 		Err     error
@@ -108,6 +227,7 @@ func (mock *StorageMock) Save(ctx context.Context, se types.Event, device dmc.De
 		Ctx:     ctx,
 		Se:      se,
 		Device:  device,
+		Decoder: decoder,
 		Payload: payload,
 		Objects: objects,
 		Err:     err,
@@ -115,7 +235,7 @@ func (mock *StorageMock) Save(ctx context.Context, se types.Event, device dmc.De
 	mock.lockSave.Lock()
 	mock.calls.Save = append(mock.calls.Save, callInfo)
 	mock.lockSave.Unlock()
-	return mock.SaveFunc(ctx, se, device, payload, objects, err)
+	return mock.SaveFunc(ctx, se, device, decoder, payload, objects, err)
 }
 
 // SaveCalls gets all the calls that were made to Save.
@@ -126,6 +246,7 @@ func (mock *StorageMock) SaveCalls() []struct {
 	Ctx     context.Context
 	Se      types.Event
 	Device  dmc.Device
+	Decoder string
 	Payload types.SensorPayload
 	Objects []lwm2m.Lwm2mObject
 	Err     error
@@ -134,6 +255,7 @@ func (mock *StorageMock) SaveCalls() []struct {
 		Ctx     context.Context
 		Se      types.Event
 		Device  dmc.Device
+		Decoder string
 		Payload types.SensorPayload
 		Objects []lwm2m.Lwm2mObject
 		Err     error
@@ -143,3 +265,43 @@ func (mock *StorageMock) SaveCalls() []struct {
 	mock.lockSave.RUnlock()
 	return calls
 }
+
+// SaveFrameCounter calls SaveFrameCounterFunc.
+func (mock *StorageMock) SaveFrameCounter(ctx context.Context, sensorID string, fc types.FrameCounter) error {
+	if mock.SaveFrameCounterFunc == nil {
+		panic("StorageMock.SaveFrameCounterFunc: method is nil but Storage.SaveFrameCounter was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		SensorID string
+		Fc       types.FrameCounter
+	}{
+		Ctx:      ctx,
+		SensorID: sensorID,
+		Fc:       fc,
+	}
+	mock.lockSaveFrameCounter.Lock()
+	mock.calls.SaveFrameCounter = append(mock.calls.SaveFrameCounter, callInfo)
+	mock.lockSaveFrameCounter.Unlock()
+	return mock.SaveFrameCounterFunc(ctx, sensorID, fc)
+}
+
+// SaveFrameCounterCalls gets all the calls that were made to SaveFrameCounter.
+// Check the length with:
+//
+//	len(mockedStorage.SaveFrameCounterCalls())
+func (mock *StorageMock) SaveFrameCounterCalls() []struct {
+	Ctx      context.Context
+	SensorID string
+	Fc       types.FrameCounter
+} {
+	var calls []struct {
+		Ctx      context.Context
+		SensorID string
+		Fc       types.FrameCounter
+	}
+	mock.lockSaveFrameCounter.RLock()
+	calls = mock.calls.SaveFrameCounter
+	mock.lockSaveFrameCounter.RUnlock()
+	return calls
+}
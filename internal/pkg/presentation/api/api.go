@@ -14,6 +14,8 @@ import (
 	"github.com/diwise/iot-agent/internal/pkg/application"
 	"github.com/diwise/iot-agent/internal/pkg/application/facades"
 	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api/auth"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api/webhook"
 
 	"github.com/diwise/iot-agent/pkg/lwm2m"
 	"github.com/diwise/senml"
@@ -28,22 +30,86 @@ import (
 
 var tracer = otel.Tracer("iot-agent/api")
 
-func RegisterHandlers(ctx context.Context, rootMux *http.ServeMux, app application.App, facade facades.EventFunc) error {
+func RegisterHandlers(ctx context.Context, rootMux *http.ServeMux, policies *auth.Policies, webhooks webhook.Verifiers, app application.App, facade facades.EventFunc) error {
 	const apiPrefix string = "/api/v0"
 
 	docs.RegisterHandlers(ctx, rootMux)
 
 	r := router.New(rootMux, router.WithPrefix(apiPrefix), router.WithTaggedRoutes(true))
 
-	r.Post("/messages", NewIncomingMessageHandler(ctx, app, facade))
-	r.Post("/messages/lwm2m", NewIncomingLWM2MMessageHandler(ctx, app))
+	// ingestion endpoints are called by integrations, such as application servers
+	r.Route("/messages", func(r router.ServeMux) {
+		r.Use(policies.Authenticator(auth.IngestRule))
+		r.Post("", NewIncomingMessageHandler(ctx, app, facade, webhooks.For(webhook.DefaultIntegration)))
+		r.Post("/lwm2m", NewIncomingLWM2MMessageHandler(ctx, app))
+
+		// each application server integration may post to its own route, using its own secret
+		for _, name := range facades.Names() {
+			r.Post("/"+name, NewIncomingMessageHandler(ctx, app, facades.New(name), webhooks.For(name)))
+		}
+	})
+
+	// messages forwarded from mqtt are only authorized by the bearer token of the forwarder,
+	// since the forwarder does not hold the secrets of the integrations, and the forward rule
+	// keeps integrations from posting here to pass their own tenant and device hints
+	r.Route("/messages/mqtt", func(r router.ServeMux) {
+		r.Use(policies.Authenticator(auth.ForwardRule))
+		r.Post("", NewForwardedMessageHandler(ctx, app, facade))
+		for _, name := range facades.Names() {
+			r.Post("/"+name, NewForwardedMessageHandler(ctx, app, facades.New(name)))
+		}
+	})
+
+	r.Route("/decoders", func(r router.ServeMux) {
+		r.Use(policies.Authenticator(auth.ReadRule))
+		r.Get("", NewListDecodersHandler(ctx, app))
+		r.Post("/{sensorType}/decode", NewDecodeHandler(ctx, app))
+	})
+
+	r.Route("/events", func(r router.ServeMux) {
+		r.Use(policies.Authenticator(auth.ReadRule))
+		r.Get("", NewQueryEventsHandler(ctx, app))
+	})
+
+	r.Route("/devices", func(r router.ServeMux) {
+		r.Use(policies.Authenticator(auth.ReadRule))
+		r.Get("/{id}/events/latest", NewLatestDeviceEventHandler(ctx, app))
+	})
+
+	r.Route("/admin", func(r router.ServeMux) {
+		r.Use(policies.Authenticator(auth.AdminRule))
+		r.Post("/replay", NewReplayHandler(ctx, app))
+	})
 
 	return nil
 }
 
-func NewIncomingMessageHandler(ctx context.Context, app application.App, facade facades.EventFunc) http.HandlerFunc {
+// NewIncomingMessageHandler returns a handler for messages posted by integrations. The tenant
+// and device hints of a message are set by the integration, and are therefore not used.
+func NewIncomingMessageHandler(ctx context.Context, app application.App, facade facades.EventFunc, verifier webhook.Verifier) http.HandlerFunc {
+	return newIncomingMessageHandler(ctx, app, facade, verifier, false)
+}
+
+// NewForwardedMessageHandler returns a handler for messages forwarded from mqtt, in which the
+// tenant and device hints are taken from the topic templates of the agent. A tenant hint is
+// only used if the forwarder is allowed to access the tenant.
+func NewForwardedMessageHandler(ctx context.Context, app application.App, facade facades.EventFunc) http.HandlerFunc {
+	return newIncomingMessageHandler(ctx, app, facade, webhook.None(), true)
+}
+
+func newIncomingMessageHandler(ctx context.Context, app application.App, facade facades.EventFunc, verifier webhook.Verifier, tenantHints bool) http.HandlerFunc {
+	rejectedCounter, err := otel.Meter("iot-agent/api").Int64Counter(
+		"diwise.webhook.rejected.total",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of incoming messages rejected by webhook verification"),
+	)
+
 	logger := logging.GetFromContext(ctx)
 
+	if err != nil {
+		logger.Error("failed to create otel rejected webhook counter", "err", err.Error())
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
 
@@ -59,6 +125,14 @@ func NewIncomingMessageHandler(ctx context.Context, app application.App, facade
 			return
 		}
 
+		err = verifier.Verify(r, b)
+		if err != nil {
+			log.Warn("rejected incoming message", "path", r.URL.Path, "err", err.Error())
+			rejectedCounter.Add(ctx, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
 		var im types.IncomingMessage
 		err = json.Unmarshal(b, &im)
 		if err != nil {
@@ -67,7 +141,14 @@ func NewIncomingMessageHandler(ctx context.Context, app application.App, facade
 			return
 		}
 
-		evt, err := facade(ctx, im.Type, im.Data)
+		if !tenantHints {
+			im.Tenant, im.DevEUI = "", ""
+		} else if im.Tenant != "" && len(allowedTenants(ctx, im.Tenant)) == 0 {
+			log.Warn("ignoring tenant hint that the forwarder is not allowed to access", "tenant", im.Tenant)
+			im.Tenant = ""
+		}
+
+		evt, err := facades.Decode(ctx, facade, im)
 		if err != nil {
 			log.Error("failed to decode sensor event using facade", "err", err.Error())
 			w.WriteHeader(statusCodeForFacadeError(err))
@@ -81,9 +162,6 @@ func NewIncomingMessageHandler(ctx context.Context, app application.App, facade
 			return
 		}
 
-		// add source to event to use for auto create devices (TODO)
-		evt.Source = im.Source
-
 		err = app.HandleSensorEvent(ctx, evt)
 		if err != nil {
 			if !errors.Is(err, types.ErrNoDevice) {
@@ -9,9 +9,17 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/diwise/iot-agent/internal/pkg/application"
+	"github.com/diwise/iot-agent/internal/pkg/application/decoders"
+	"github.com/diwise/iot-agent/internal/pkg/infrastructure/services/mqtt"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api/auth"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api/webhook"
+	"github.com/diwise/iot-agent/pkg/lwm2m"
 
 	"github.com/matryer/is"
 
@@ -52,6 +60,51 @@ func TestThatApiCallsMessageReceivedProperlyOnValidMessageFromMQTT(t *testing.T)
 	is.Equal(len(app.HandleSensorEventCalls()), 1)
 }
 
+func TestTenantHintIsOnlyUsedInForwardedMessages(t *testing.T) {
+	is, app, mux := testSetup(t)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	im := types.IncomingMessage{Type: "up", Source: "application/1/device/24e124329e090021/event/up", Tenant: "default", Data: []byte(msgfromMQTT)}
+	b, _ := json.Marshal(im)
+
+	resp, _ := testRequest(is, http.MethodPost, server.URL+"/api/v0/messages", bytes.NewBuffer(b))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+	is.Equal(app.HandleSensorEventCalls()[0].Se.Tenant, "") // integrations should not choose the tenant
+
+	resp, _ = testRequestWithToken(is, http.MethodPost, server.URL+"/api/v0/messages/mqtt", "forwarder", bytes.NewBuffer(b))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+	is.Equal(app.HandleSensorEventCalls()[1].Se.Tenant, "default")
+
+	// the forwarder is not allowed to access the tenant, so the hint should not be used
+	im.Tenant = "other"
+	b, _ = json.Marshal(im)
+
+	resp, _ = testRequestWithToken(is, http.MethodPost, server.URL+"/api/v0/messages/mqtt", "forwarder", bytes.NewBuffer(b))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+	is.Equal(app.HandleSensorEventCalls()[2].Se.Tenant, "")
+}
+
+func TestForwardedMessagesRequireTheForwardRule(t *testing.T) {
+	is, app, mux := testSetup(t)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	im := types.IncomingMessage{Type: "up", Tenant: "default", Data: []byte(msgfromMQTT)}
+	b, _ := json.Marshal(im)
+
+	// an ingest token should not be accepted by the routes of the forwarder
+	resp, _ := testRequest(is, http.MethodPost, server.URL+"/api/v0/messages/mqtt", bytes.NewBuffer(b))
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+
+	resp, _ = testRequest(is, http.MethodPost, server.URL+"/api/v0/messages/mqtt/chirpstack", bytes.NewBuffer(b))
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+
+	is.Equal(len(app.HandleSensorEventCalls()), 0)
+}
+
 func TestIncomingMessageStatusCodeMatchesHandleSensorEventErrors(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -85,7 +138,7 @@ func TestIncomingMessageStatusCodeMatchesHandleSensorEventErrors(t *testing.T) {
 			}
 
 			mux := http.NewServeMux()
-			RegisterHandlers(context.Background(), mux, app, facades.New("servanet"))
+			RegisterHandlers(context.Background(), mux, testPolicies(is), webhook.Verifiers{}, app, facades.New("servanet"))
 
 			server := httptest.NewServer(mux)
 			defer server.Close()
@@ -153,7 +206,7 @@ func TestIncomingMessageStatusCodeMatchesFacadeErrors(t *testing.T) {
 			}
 
 			mux := http.NewServeMux()
-			RegisterHandlers(context.Background(), mux, app, func(ctx context.Context, messageType string, b []byte) (types.Event, error) {
+			RegisterHandlers(context.Background(), mux, testPolicies(is), webhook.Verifiers{}, app, func(ctx context.Context, messageType string, b []byte) (types.Event, error) {
 				return types.Event{}, tc.facadeErr
 			})
 
@@ -175,6 +228,96 @@ func TestIncomingMessageStatusCodeMatchesFacadeErrors(t *testing.T) {
 	}
 }
 
+func TestIncomingMessageIsVerifiedPerIntegration(t *testing.T) {
+	is := is.New(t)
+
+	app := &application.AppMock{
+		HandleSensorEventFunc: func(ctx context.Context, se types.Event) error { return nil },
+	}
+
+	verifier, err := webhook.New(webhook.Config{Scheme: webhook.SchemeSecret, Secret: "s3cr3t"})
+	is.NoErr(err)
+
+	mux := http.NewServeMux()
+	RegisterHandlers(context.Background(), mux, testPolicies(is), webhook.Verifiers{"servanet": verifier}, app, facades.New("servanet"))
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	im, _ := json.Marshal(types.IncomingMessage{ID: "123", Type: "up", Data: []byte(msgfromMQTT)})
+
+	resp, _ := testRequest(is, http.MethodPost, server.URL+"/api/v0/messages/servanet", bytes.NewReader(im))
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	is.Equal(len(app.HandleSensorEventCalls()), 0)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v0/messages/servanet", bytes.NewReader(im))
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Webhook-Secret", "s3cr3t")
+	resp, err = http.DefaultClient.Do(req)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusCreated)
+
+	// integrations without a secret are not verified
+	resp, _ = testRequest(is, http.MethodPost, server.URL+"/api/v0/messages", bytes.NewReader(im))
+	is.Equal(resp.StatusCode, http.StatusCreated)
+}
+
+func TestForwardedMessagesAreNotVerifiedByTheIntegrationSecrets(t *testing.T) {
+	is := is.New(t)
+
+	app := &application.AppMock{
+		HandleSensorEventFunc: func(ctx context.Context, se types.Event) error { return nil },
+	}
+
+	verifier, err := webhook.New(webhook.Config{Scheme: webhook.SchemeSecret, Secret: "s3cr3t"})
+	is.NoErr(err)
+
+	mux := http.NewServeMux()
+	RegisterHandlers(context.Background(), mux, testPolicies(is), webhook.Verifiers{webhook.DefaultIntegration: verifier, "servanet": verifier}, app, facades.New("servanet"))
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	deadLetters := &countingDeadLetters{}
+
+	forward := func(endpoint string) *forwardedMessage {
+		handler, err := mqtt.NewForwardingHandler(t.Context(), mqtt.Forwarding{
+			Endpoint:    endpoint,
+			Token:       "forwarder",
+			Retry:       mqtt.RetryPolicy{MaxAttempts: 1},
+			DeadLetters: deadLetters,
+		})
+		is.NoErr(err)
+
+		msg := &forwardedMessage{topic: "application/1/device/24e124329e090021/event/up", payload: []byte(msgfromMQTT)}
+		handler(nil, msg)
+
+		return msg
+	}
+
+	waitForAck := func(msg *forwardedMessage) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !msg.acked.Load() {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the forwarded message to be acknowledged")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// the verified route rejects the forwarded message, which is dead-lettered
+	waitForAck(forward(server.URL + "/api/v0/messages"))
+	is.Equal(len(app.HandleSensorEventCalls()), 0)
+	is.Equal(deadLetters.count.Load(), int32(1))
+
+	for _, route := range []string{"/api/v0/messages/mqtt", "/api/v0/messages/mqtt/servanet"} {
+		waitForAck(forward(server.URL + route))
+	}
+	is.Equal(len(app.HandleSensorEventCalls()), 2)
+	is.Equal(deadLetters.count.Load(), int32(1))
+}
+
 func TestSenMLPayload(t *testing.T) {
 	is, app, mux := testSetup(t)
 
@@ -186,6 +329,244 @@ func TestSenMLPayload(t *testing.T) {
 	is.Equal(len(app.HandleSensorMeasurementListCalls()), 1)
 }
 
+func TestListDecoders(t *testing.T) {
+	is, app, mux := testSetup(t)
+
+	app.DecodersFunc = func(ctx context.Context) []decoders.Info {
+		return []decoders.Info{{SensorType: "elsys", Deprecated: []string{"elsys_codec"}, URNs: []string{"urn:oma:lwm2m:ext:3303"}}}
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, body := testRequest(is, http.MethodGet, server.URL+"/api/v0/decoders", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	var info []decoders.Info
+	is.NoErr(json.Unmarshal([]byte(body), &info))
+	is.Equal(len(info), 1)
+	is.Equal(info[0].Deprecated[0], "elsys_codec")
+}
+
+func TestDryRunDecode(t *testing.T) {
+	is, app, mux := testSetup(t)
+
+	ts := time.Date(2024, 8, 5, 11, 23, 45, 0, time.UTC)
+
+	app.DecodeFunc = func(ctx context.Context, sensorType string, se types.Event) (types.SensorPayload, []lwm2m.Lwm2mObject, error) {
+		return nil, []lwm2m.Lwm2mObject{lwm2m.NewTemperature(se.DevEUI, 21.5, se.Timestamp)}, nil
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	body := `{"data":"0100e6","fPort":5,"timestamp":"2024-08-05T11:23:45Z"}`
+	resp, respBody := testRequest(is, http.MethodPost, server.URL+"/api/v0/decoders/elsys%2Felt%2Fsht3x/decode", bytes.NewBufferString(body))
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	call := app.DecodeCalls()[0]
+	is.Equal(call.SensorType, "elsys/elt/sht3x")
+	is.Equal(call.Se.Payload.Data, []byte{0x01, 0x00, 0xe6})
+	is.Equal(call.Se.Payload.FPort, 5)
+	is.Equal(call.Se.Timestamp, ts)
+
+	var response struct {
+		Packs []senml.Pack `json:"packs"`
+	}
+	is.NoErr(json.Unmarshal([]byte(respBody), &response))
+	is.Equal(len(response.Packs), 1)
+	is.Equal(response.Packs[0][0].StringValue, "urn:oma:lwm2m:ext:3303")
+
+	is.Equal(len(app.HandleSensorEventCalls()), 0)
+}
+
+func TestDryRunDecodeStatusCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		decodeErr  error
+		statusCode int
+	}{
+		{
+			name:       "base64 payload is accepted",
+			body:       `{"data":"AQDuAhYEALIFAgYBxAcONA==","encoding":"base64","fPort":5}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "invalid payload encoding maps to 400",
+			body:       `{"data":"not hex","encoding":"hex","fPort":5}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown sensor type maps to 404",
+			body:       `{"data":"0100e6","fPort":5}`,
+			decodeErr:  types.ErrDecoderOrConverterNotFound,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "decoder error maps to 422",
+			body:       `{"data":"0100e6","fPort":5}`,
+			decodeErr:  types.ErrInvalidFPort,
+			statusCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			is, app, mux := testSetup(t)
+
+			app.DecodeFunc = func(ctx context.Context, sensorType string, se types.Event) (types.SensorPayload, []lwm2m.Lwm2mObject, error) {
+				return nil, nil, tc.decodeErr
+			}
+
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			resp, _ := testRequest(is, http.MethodPost, server.URL+"/api/v0/decoders/elsys/decode", bytes.NewBufferString(tc.body))
+			is.Equal(resp.StatusCode, tc.statusCode)
+		})
+	}
+}
+
+func TestReplayIsDryRunByDefault(t *testing.T) {
+	is, app, mux := testSetup(t)
+
+	app.ReplayFunc = func(ctx context.Context, q types.EventQuery, dryRun bool) (application.ReplayReport, error) {
+		return application.ReplayReport{DryRun: dryRun, Events: 1}, nil
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	body := `{"sensorId":"a81758fffe05e6fb","from":"2024-08-05T00:00:00Z","to":"2024-08-06T00:00:00Z"}`
+	resp, respBody := testRequest(is, http.MethodPost, server.URL+"/api/v0/admin/replay", bytes.NewBufferString(body))
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	call := app.ReplayCalls()[0]
+	is.True(call.DryRun)
+	is.Equal(call.Q.SensorID, "a81758fffe05e6fb")
+	is.Equal(call.Q.From, time.Date(2024, 8, 5, 0, 0, 0, 0, time.UTC))
+	is.Equal(call.Q.Tenants, []string{"default"})
+
+	var report application.ReplayReport
+	is.NoErr(json.Unmarshal([]byte(respBody), &report))
+	is.True(report.DryRun)
+
+	resp, _ = testRequest(is, http.MethodPost, server.URL+"/api/v0/admin/replay", bytes.NewBufferString(`{"sensorId":"a81758fffe05e6fb","dryRun":false}`))
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(!app.ReplayCalls()[1].DryRun)
+
+	resp, _ = testRequest(is, http.MethodPost, server.URL+"/api/v0/admin/replay", bytes.NewBufferString(`{"limit":10}`))
+	is.Equal(resp.StatusCode, http.StatusBadRequest) // replaying every stored event requires a filter
+}
+
+func TestQueryEventsIsRestrictedToAllowedTenants(t *testing.T) {
+	is, app, mux := testSetup(t)
+
+	t0 := time.Date(2024, 8, 5, 12, 0, 0, 0, time.UTC)
+
+	app.QueryEventsFunc = func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+		return []types.StoredEvent{
+			{ID: "3", Time: t0, SensorID: "a81758fffe05e6fb", Tenant: "default"},
+			{ID: "2", Time: t0.Add(-time.Minute), SensorID: "a81758fffe05e6fb", Tenant: "default"},
+			{ID: "1", Time: t0.Add(-2 * time.Minute), SensorID: "a81758fffe05e6fb", Tenant: "default"},
+		}, nil
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, respBody := testRequest(is, http.MethodGet, server.URL+"/api/v0/events?sensorId=a81758fffe05e6fb&hasError=false&limit=2", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	q := app.QueryEventsCalls()[0].Q
+	is.Equal(q.SensorID, "a81758fffe05e6fb")
+	is.Equal(q.Tenants, []string{"default"})
+	is.True(q.HasError != nil && !*q.HasError)
+	is.Equal(q.Limit, 3) // one more than requested to find out if there is a next page
+	is.True(q.NewestFirst)
+
+	var response eventsResponse
+	is.NoErr(json.Unmarshal([]byte(respBody), &response))
+	is.Equal(len(response.Events), 2)
+	is.True(response.NextCursor != "")
+
+	resp, _ = testRequest(is, http.MethodGet, server.URL+"/api/v0/events?sensorId=a81758fffe05e6fb&cursor="+response.NextCursor, nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(*app.QueryEventsCalls()[1].Q.After, types.EventCursor{Time: t0.Add(-time.Minute), ID: "2"})
+
+	resp, respBody = testRequest(is, http.MethodGet, server.URL+"/api/v0/events?tenant=other", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(len(app.QueryEventsCalls()), 2) // events of other tenants should not be queried at all
+	is.Equal(respBody, `{"events":[]}`)
+
+	resp, _ = testRequest(is, http.MethodGet, server.URL+"/api/v0/events?cursor=garbage", nil)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestQueryEventsIsNotRestrictedWhenAllTenantsAreAllowed(t *testing.T) {
+	is, app, _ := testSetup(t)
+
+	app.QueryEventsFunc = func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+		return []types.StoredEvent{}, nil
+	}
+
+	server := httptest.NewServer(allTenantsMux(is, app))
+	defer server.Close()
+
+	resp, _ := testRequest(is, http.MethodGet, server.URL+"/api/v0/events", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(app.QueryEventsCalls()[0].Q.Tenants, nil) // events without a tenant should be included
+
+	resp, _ = testRequest(is, http.MethodGet, server.URL+"/api/v0/events?tenant=other", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(app.QueryEventsCalls()[1].Q.Tenants, []string{"other"})
+}
+
+func TestReplayIsNotRestrictedWhenAllTenantsAreAllowed(t *testing.T) {
+	is, app, _ := testSetup(t)
+
+	app.ReplayFunc = func(ctx context.Context, q types.EventQuery, dryRun bool) (application.ReplayReport, error) {
+		return application.ReplayReport{DryRun: dryRun}, nil
+	}
+
+	server := httptest.NewServer(allTenantsMux(is, app))
+	defer server.Close()
+
+	resp, _ := testRequest(is, http.MethodPost, server.URL+"/api/v0/admin/replay", bytes.NewBufferString(`{"sensorType":"elsys"}`))
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(app.ReplayCalls()[0].Q.Tenants, nil) // events without a tenant should be replayed
+}
+
+func TestLatestDeviceEvent(t *testing.T) {
+	is, app, mux := testSetup(t)
+
+	app.QueryEventsFunc = func(ctx context.Context, q types.EventQuery) ([]types.StoredEvent, error) {
+		if q.DeviceID != "device-1" {
+			return []types.StoredEvent{}, nil
+		}
+		return []types.StoredEvent{{ID: "1", DeviceID: q.DeviceID, Objects: json.RawMessage(`[]`)}}, nil
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, respBody := testRequest(is, http.MethodGet, server.URL+"/api/v0/devices/device-1/events/latest", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	var event types.StoredEvent
+	is.NoErr(json.Unmarshal([]byte(respBody), &event))
+	is.Equal(event.DeviceID, "device-1")
+
+	q := app.QueryEventsCalls()[0].Q
+	is.Equal(q.Limit, 1)
+	is.True(q.NewestFirst)
+	is.Equal(q.Tenants, []string{"default"})
+
+	resp, _ = testRequest(is, http.MethodGet, server.URL+"/api/v0/devices/device-2/events/latest", nil)
+	is.Equal(resp.StatusCode, http.StatusNotFound)
+}
+
 func testSetup(t *testing.T) (*is.I, *application.AppMock, *http.ServeMux) {
 	is := is.New(t)
 
@@ -195,14 +576,35 @@ func testSetup(t *testing.T) (*is.I, *application.AppMock, *http.ServeMux) {
 	}
 
 	mux := http.NewServeMux()
-	RegisterHandlers(context.Background(), mux, app, facades.New("servanet"))
+	RegisterHandlers(context.Background(), mux, testPolicies(is), webhook.Verifiers{}, app, facades.New("servanet"))
 
 	return is, app, mux
 }
 
-func testRequest(_ *is.I, method, url string, body io.Reader) (*http.Response, string) {
+// allTenantsMux returns handlers that are authorized by a policy that grants all tenants.
+func allTenantsMux(is *is.I, app application.App) *http.ServeMux {
+	policies, err := auth.NewPolicies(context.Background(), strings.NewReader(strings.Replace(policy, `["default"]`, `["*"]`, 1)))
+	is.NoErr(err)
+
+	mux := http.NewServeMux()
+	RegisterHandlers(context.Background(), mux, policies, webhook.Verifiers{}, app, facades.New("servanet"))
+
+	return mux
+}
+
+func testPolicies(is *is.I) *auth.Policies {
+	policies, err := auth.NewPolicies(context.Background(), strings.NewReader(policy))
+	is.NoErr(err)
+	return policies
+}
+
+func testRequest(is *is.I, method, url string, body io.Reader) (*http.Response, string) {
+	return testRequestWithToken(is, method, url, "token", body)
+}
+
+func testRequestWithToken(_ *is.I, method, url, token string, body io.Reader) (*http.Response, string) {
 	req, _ := http.NewRequest(method, url, body)
-	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Authorization", "Bearer "+token)
 	resp, _ := http.DefaultClient.Do(req)
 	respBody, _ := io.ReadAll(resp.Body)
 	defer resp.Body.Close()
@@ -218,9 +620,44 @@ package example.authz
 # See https://www.openpolicyagent.org/docs/latest/policy-reference/ to learn more about rego
 
 default allow := false
+default forward := false
 
 allow = response {
 	response := {
 		"tenants": ["default"]
 	}
+}
+
+read = allow
+
+admin = allow
+
+forward = response {
+	input.token == "forwarder"
+	response := {
+		"tenants": ["default"]
+	}
 }`
+
+type forwardedMessage struct {
+	topic   string
+	payload []byte
+	acked   atomic.Bool
+}
+
+func (m *forwardedMessage) Duplicate() bool   { return false }
+func (m *forwardedMessage) Qos() byte         { return 1 }
+func (m *forwardedMessage) Retained() bool    { return false }
+func (m *forwardedMessage) Topic() string     { return m.topic }
+func (m *forwardedMessage) MessageID() uint16 { return 1 }
+func (m *forwardedMessage) Payload() []byte   { return m.payload }
+func (m *forwardedMessage) Ack()              { m.acked.Store(true) }
+
+type countingDeadLetters struct {
+	count atomic.Int32
+}
+
+func (d *countingDeadLetters) AddMQTTDeadLetter(ctx context.Context, dl mqtt.DeadLetter) error {
+	d.count.Add(1)
+	return nil
+}
@@ -1,15 +1,21 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"go.opentelemetry.io/otel"
 )
@@ -22,23 +28,147 @@ var allowedTenantsCtxKey = &tenantsContextKey{"allowed-tenants"}
 
 var tracer = otel.Tracer("iot-agent/authz")
 
-func NewAuthenticator(ctx context.Context, policies io.Reader) (func(http.Handler) http.Handler, error) {
+// Policy rules, in the example.authz package, that are used to authorize requests to the
+// different kinds of routes. ForwardRule authorizes the mqtt forwarder, whose messages are
+// trusted to carry the tenant and device of their topic. An ingest rule that is not defined
+// falls back to AllowRule, while requests to routes with any other rule that is not defined are
+// denied.
+const (
+	AllowRule   string = "allow"
+	IngestRule  string = "ingest"
+	ReadRule    string = "read"
+	AdminRule   string = "admin"
+	ForwardRule string = "forward"
+)
+
+// Policies holds the prepared authorization policies. The policies can be replaced while the
+// service is running, and requests are always evaluated against the latest loaded policies.
+type Policies struct {
+	queries   atomic.Pointer[map[string]rego.PreparedEvalQuery]
+	anonymous map[string]bool
+	logger    *slog.Logger
+}
 
-	module, err := io.ReadAll(policies)
+func NewPolicies(ctx context.Context, policies io.Reader) (*Policies, error) {
+	p := &Policies{
+		logger: logging.GetFromContext(ctx),
+	}
+
+	err := p.Load(ctx, policies)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read authz policies: %s", err.Error())
+		return nil, err
 	}
 
-	query, err := rego.New(
-		rego.Query("x = data.example.authz.allow"),
-		rego.Module("example.rego", string(module)),
-	).PrepareForEval(ctx)
+	return p, nil
+}
+
+// Load prepares the rules of the provided policy module and replaces the current policies. The
+// current policies are kept if the module can not be read or prepared.
+func (p *Policies) Load(ctx context.Context, policies io.Reader) error {
+	b, err := io.ReadAll(policies)
+	if err != nil {
+		return fmt.Errorf("unable to read authz policies: %s", err.Error())
+	}
 
+	module, err := ast.ParseModule("example.rego", string(b))
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	defined := map[string]bool{}
+	for _, rule := range module.Rules {
+		defined[rule.Head.Name.String()] = true
+	}
+
+	queries := map[string]rego.PreparedEvalQuery{}
+
+	for _, rule := range []string{AllowRule, IngestRule, ReadRule, AdminRule, ForwardRule} {
+		if rule != AllowRule && !defined[rule] {
+			if rule != IngestRule {
+				p.logger.Warn("authz rule is not defined, requests to its routes will be denied", "rule", rule)
+			}
+			continue
+		}
+
+		query, err := rego.New(
+			rego.Query("x = data.example.authz."+rule),
+			rego.Module("example.rego", string(b)),
+		).PrepareForEval(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		queries[rule] = query
+	}
+
+	p.queries.Store(&queries)
+
+	return nil
+}
+
+// AllowAnonymous lets requests without an authorization header through to the routes of the
+// given rules, without any allowed tenants, as before the routes were authorized. Requests that
+// carry a token are still authorized by the rule. It must be called before the middlewares of
+// the rules are created.
+func (p *Policies) AllowAnonymous(rules ...string) {
+	if p.anonymous == nil {
+		p.anonymous = map[string]bool{}
+	}
+
+	for _, rule := range rules {
+		p.anonymous[rule] = true
+	}
+}
+
+// Watch reloads the policies from path whenever the file is changed, checking for changes at
+// the given interval until the context is cancelled.
+func (p *Policies) Watch(ctx context.Context, path string, interval time.Duration) {
+	modified := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, 0
+		}
+		return fi.ModTime(), fi.Size()
 	}
 
-	logger := logging.GetFromContext(ctx)
+	lastModTime, lastSize := modified()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime, size := modified()
+			if modTime.IsZero() || (modTime.Equal(lastModTime) && size == lastSize) {
+				continue
+			}
+
+			lastModTime, lastSize = modTime, size
+
+			b, err := os.ReadFile(path)
+			if err == nil {
+				err = p.Load(ctx, bytes.NewReader(b))
+			}
+
+			if err != nil {
+				p.logger.Error("failed to reload authz policies, keeping the current policies", "path", path, "err", err.Error())
+				continue
+			}
+
+			p.logger.Info("reloaded authz policies", "path", path)
+		}
+	}
+}
+
+// Authenticator returns a middleware that authorizes requests using the given policy rule, and
+// stores the tenants that the caller is allowed to access in the request context.
+func (p *Policies) Authenticator(rule string) func(http.Handler) http.Handler {
+	logger := p.logger
+	anonymous := p.anonymous[rule]
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -49,6 +179,12 @@ func NewAuthenticator(ctx context.Context, policies io.Reader) (func(http.Handle
 
 			token := r.Header.Get("Authorization")
 
+			if token == "" && anonymous {
+				logger.Warn("accepting request without authorization header", "rule", rule, "path", r.URL.Path)
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			if token == "" || !strings.HasPrefix(token, "Bearer ") {
 				err = errors.New("authorization header missing")
 				logger.Info(err.Error())
@@ -64,6 +200,19 @@ func NewAuthenticator(ctx context.Context, policies io.Reader) (func(http.Handle
 				"token":  token[7:],
 			}
 
+			queries := *p.queries.Load()
+			query, ok := queries[rule]
+			if !ok && rule == IngestRule {
+				query, ok = queries[AllowRule]
+			}
+
+			if !ok {
+				err = fmt.Errorf("authz rule %s is not defined", rule)
+				logger.Warn("authorization failed", "err", err.Error())
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
 			results, err := query.Eval(r.Context(), rego.EvalInput(input))
 			if err != nil {
 				logger.Error("opa eval failed", "err", err.Error())
@@ -84,7 +233,7 @@ func NewAuthenticator(ctx context.Context, policies io.Reader) (func(http.Handle
 				allowed, ok := binding.(bool)
 				if ok && !allowed {
 					err = errors.New("authorization failed")
-					logger.Warn(err.Error())
+					logger.Warn(err.Error(), "rule", rule)
 					http.Error(w, "Unauthorized", http.StatusUnauthorized)
 					return
 				}
@@ -121,9 +270,24 @@ func NewAuthenticator(ctx context.Context, policies io.Reader) (func(http.Handle
 			// Token is authenticated, pass it through
 			next.ServeHTTP(w, r)
 		})
-	}, nil
+	}
 }
 
+// NewAuthenticator returns a middleware that authorizes requests using the allow rule of the
+// provided policies.
+func NewAuthenticator(ctx context.Context, policies io.Reader) (func(http.Handler) http.Handler, error) {
+	p, err := NewPolicies(ctx, policies)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Authenticator(AllowRule), nil
+}
+
+// AllTenants is the tenant that a policy grants to callers that may access all tenants,
+// including data that does not belong to any tenant.
+const AllTenants = "*"
+
 // GetAllowedTenantsFromContext extracts the names of allowed tenants, if any, from the provided context
 func GetAllowedTenantsFromContext(ctx context.Context) []string {
 	tenants, ok := ctx.Value(allowedTenantsCtxKey).([]string)
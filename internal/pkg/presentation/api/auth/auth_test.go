@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestOnlyIngestFallsBackToAllow(t *testing.T) {
+	is := is.New(t)
+
+	policies, err := NewPolicies(context.Background(), strings.NewReader(integrationPolicy))
+	is.NoErr(err)
+
+	var tenants []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenants = GetAllowedTenantsFromContext(r.Context())
+	})
+
+	is.Equal(serve(policies.Authenticator(IngestRule)(handler), "integration"), http.StatusOK)
+	is.Equal(tenants, []string{"default", "other"})
+
+	is.Equal(serve(policies.Authenticator(IngestRule)(handler), "user"), http.StatusUnauthorized)
+
+	// read and admin are not defined in the policy and should deny every request
+	is.Equal(serve(policies.Authenticator(ReadRule)(handler), "user"), http.StatusUnauthorized)
+	is.Equal(serve(policies.Authenticator(AdminRule)(handler), "user"), http.StatusUnauthorized)
+
+	p, err := NewPolicies(context.Background(), strings.NewReader(userPolicy))
+	is.NoErr(err)
+
+	// ingest is not defined in this policy and should use allow instead
+	is.Equal(serve(p.Authenticator(IngestRule)(handler), "user"), http.StatusOK)
+	is.Equal(tenants, []string{"default"})
+}
+
+func TestAnonymousRequestsAreOnlyAllowedForGivenRules(t *testing.T) {
+	is := is.New(t)
+
+	policies, err := NewPolicies(context.Background(), strings.NewReader(integrationPolicy))
+	is.NoErr(err)
+	policies.AllowAnonymous(IngestRule)
+
+	tenants := []string{"unset"}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenants = GetAllowedTenantsFromContext(r.Context())
+	})
+
+	is.Equal(serve(policies.Authenticator(IngestRule)(handler), ""), http.StatusOK)
+	is.Equal(tenants, []string{})
+
+	// requests with a token are still authorized by the rule
+	is.Equal(serve(policies.Authenticator(IngestRule)(handler), "user"), http.StatusUnauthorized)
+	is.Equal(serve(policies.Authenticator(ReadRule)(handler), ""), http.StatusUnauthorized)
+}
+
+func TestExamplePolicyDefinesEveryRule(t *testing.T) {
+	is := is.New(t)
+
+	f, err := os.Open("../../../../../assets/config/all-authz.rego")
+	is.NoErr(err)
+	defer f.Close()
+
+	policies, err := NewPolicies(context.Background(), f)
+	is.NoErr(err)
+
+	queries := *policies.queries.Load()
+	for _, rule := range []string{AllowRule, IngestRule, ReadRule, AdminRule, ForwardRule} {
+		_, ok := queries[rule]
+		is.True(ok) // the example policy should define every rule
+	}
+}
+
+func TestPoliciesAreReloadedWhenTheFileChanges(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "authz.rego")
+	is.NoErr(os.WriteFile(path, []byte(integrationPolicy), 0644))
+
+	f, err := os.Open(path)
+	is.NoErr(err)
+	defer f.Close()
+
+	policies, err := NewPolicies(context.Background(), f)
+	is.NoErr(err)
+
+	go policies.Watch(t.Context(), path, 10*time.Millisecond)
+
+	handler := policies.Authenticator(IngestRule)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	is.Equal(serve(handler, "integration"), http.StatusOK)
+
+	// an invalid policy should be ignored
+	is.NoErr(os.WriteFile(path, []byte("package example.authz\n\nallow = {"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	is.Equal(serve(handler, "integration"), http.StatusOK)
+
+	is.NoErr(os.WriteFile(path, []byte(strings.ReplaceAll(integrationPolicy, `"integration"`, `"someone else"`)), 0644))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for serve(handler, "integration") != http.StatusUnauthorized {
+		if time.Now().After(deadline) {
+			t.Fatal("policies were not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func serve(handler http.Handler, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/api/v0/events", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w.Code
+}
+
+const integrationPolicy string = `
+package example.authz
+
+default allow := false
+default ingest := false
+
+allow = response {
+	input.token == "user"
+	response := {
+		"tenants": ["default"]
+	}
+}
+
+ingest = response {
+	input.token == "integration"
+	response := {
+		"tenants": ["default", "other"]
+	}
+}`
+
+const userPolicy string = `
+package example.authz
+
+default allow := false
+
+allow = response {
+	input.token == "user"
+	response := {
+		"tenants": ["default"]
+	}
+}`
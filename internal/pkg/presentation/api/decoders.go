@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/pkg/lwm2m"
+	"github.com/diwise/senml"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+const dryRunDevEUI string = "dry-run"
+
+type decodeRequest struct {
+	DevEUI    string          `json:"devEUI,omitempty"`
+	Data      string          `json:"data"`
+	Encoding  string          `json:"encoding,omitempty"`
+	FPort     int             `json:"fPort"`
+	Object    json.RawMessage `json:"object,omitempty"`
+	Timestamp *time.Time      `json:"timestamp,omitempty"`
+}
+
+type decodeResponse struct {
+	SensorType string              `json:"sensorType"`
+	Payload    types.SensorPayload `json:"payload"`
+	Packs      []senml.Pack        `json:"packs"`
+}
+
+func NewListDecodersHandler(ctx context.Context, app application.App) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "list-decoders")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		b, err := json.Marshal(app.Decoders(ctx))
+		if err != nil {
+			log.Error("failed to marshal decoder list", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// NewDecodeHandler returns a handler that decodes and converts a payload using the decoder
+// registered for the sensor type in the request path. Nothing is stored or published.
+func NewDecodeHandler(ctx context.Context, app application.App) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "dry-run-decode")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		sensorType := r.PathValue("sensorType")
+
+		b, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			log.Error("failed to read decode request body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var req decodeRequest
+		err = json.Unmarshal(b, &req)
+		if err != nil {
+			log.Debug("failed to unmarshal decode request", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data, err := decodePayloadData(req.Data, req.Encoding)
+		if err != nil {
+			log.Debug("failed to decode payload data", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		evt := types.Event{
+			DevEUI:     req.DevEUI,
+			SensorType: sensorType,
+			Payload: &types.Payload{
+				FPort:  req.FPort,
+				Data:   data,
+				Object: req.Object,
+			},
+			Timestamp: time.Now().UTC(),
+		}
+
+		if evt.DevEUI == "" {
+			evt.DevEUI = dryRunDevEUI
+		}
+
+		if req.Timestamp != nil {
+			evt.Timestamp = req.Timestamp.UTC()
+		}
+
+		payload, objects, err := app.Decode(ctx, sensorType, evt)
+		if err != nil {
+			log.Debug("dry run decode failed", "sensor_type", sensorType, "err", err.Error())
+			http.Error(w, err.Error(), statusCodeForDecodeError(err))
+			return
+		}
+
+		response := decodeResponse{
+			SensorType: sensorType,
+			Payload:    payload,
+			Packs:      lwm2m.ToPacks(objects),
+		}
+
+		b, err = json.Marshal(response)
+		if err != nil {
+			log.Error("failed to marshal decode response", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func statusCodeForDecodeError(err error) int {
+	if errors.Is(err, types.ErrDecoderOrConverterNotFound) {
+		return http.StatusNotFound
+	}
+	// any other error is caused by the payload not being decodable by this decoder
+	return http.StatusUnprocessableEntity
+}
+
+// decodePayloadData decodes a hex or base64 encoded payload. If no encoding is given, hex
+// is tried before base64 since a valid hex string is almost never intended as base64.
+func decodePayloadData(data, encoding string) ([]byte, error) {
+	data = strings.TrimSpace(data)
+
+	switch strings.ToLower(encoding) {
+	case "hex":
+		return hex.DecodeString(data)
+	case "base64":
+		return base64.StdEncoding.DecodeString(data)
+	case "":
+		if b, err := hex.DecodeString(data); err == nil {
+			return b, nil
+		}
+		return base64.StdEncoding.DecodeString(data)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q, expected hex or base64", encoding)
+	}
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/iot-agent/internal/pkg/presentation/api/auth"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+const (
+	defaultEventsLimit int = 100
+	maxEventsLimit     int = 1000
+)
+
+type eventsResponse struct {
+	Events     []types.StoredEvent `json:"events"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+// NewQueryEventsHandler returns a handler that lists stored sensor events, newest first, for the
+// tenants that the caller is allowed to access.
+func NewQueryEventsHandler(ctx context.Context, app application.App) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "query-events")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		q, err := newEventQuery(r.URL.Query())
+		if err != nil {
+			log.Debug("invalid event query", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q.Tenants = allowedTenants(ctx, r.URL.Query().Get("tenant"))
+
+		response := eventsResponse{Events: []types.StoredEvent{}}
+
+		if q.Tenants == nil || len(q.Tenants) > 0 {
+			limit := q.Limit
+			// ask for one more event to know if there is a next page
+			q.Limit++
+
+			response.Events, err = app.QueryEvents(ctx, q)
+			if err != nil {
+				log.Error("failed to query stored sensor events", "err", err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if len(response.Events) > limit {
+				response.Events = response.Events[:limit]
+				last := response.Events[limit-1]
+				response.NextCursor = encodeCursor(types.EventCursor{Time: last.Time, ID: last.ID})
+			}
+		}
+
+		writeJSON(w, log, http.StatusOK, response)
+	}
+}
+
+// NewLatestDeviceEventHandler returns a handler that responds with the last stored event of a
+// device, including the raw event as well as the decoded payload and objects.
+func NewLatestDeviceEventHandler(ctx context.Context, app application.App) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "latest-device-event")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		q := types.EventQuery{
+			DeviceID:    r.PathValue("id"),
+			Tenants:     allowedTenants(ctx, ""),
+			Limit:       1,
+			NewestFirst: true,
+		}
+
+		var events []types.StoredEvent
+
+		if q.Tenants == nil || len(q.Tenants) > 0 {
+			events, err = app.QueryEvents(ctx, q)
+			if err != nil {
+				log.Error("failed to query latest device event", "err", err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if len(events) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, log, http.StatusOK, events[0])
+	}
+}
+
+func newEventQuery(params url.Values) (types.EventQuery, error) {
+	var err error
+
+	q := types.EventQuery{
+		SensorID:    params.Get("sensorId"),
+		DeviceID:    params.Get("deviceId"),
+		TraceID:     params.Get("traceId"),
+		Limit:       defaultEventsLimit,
+		NewestFirst: true,
+	}
+
+	if v := params.Get("from"); v != "" {
+		if q.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+
+	if v := params.Get("to"); v != "" {
+		if q.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	if v := params.Get("hasError"); v != "" {
+		hasError, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid hasError: %w", err)
+		}
+		q.HasError = &hasError
+	}
+
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 {
+			return q, errors.New("invalid limit, expected a positive number")
+		}
+		q.Limit = min(q.Limit, maxEventsLimit)
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			return q, err
+		}
+		q.After = &cursor
+	}
+
+	return q, nil
+}
+
+// allowedTenants returns the tenants the caller is allowed to access, or only the requested
+// tenant if the caller is allowed to access it. A caller that is granted all tenants gets nil,
+// so that the events of unknown devices, that have no tenant, are not filtered out.
+func allowedTenants(ctx context.Context, tenant string) []string {
+	allowed := auth.GetAllowedTenantsFromContext(ctx)
+	unrestricted := slices.Contains(allowed, auth.AllTenants)
+
+	if tenant == "" {
+		if unrestricted {
+			return nil
+		}
+		return allowed
+	}
+
+	if unrestricted || slices.Contains(allowed, tenant) {
+		return []string{tenant}
+	}
+
+	return []string{}
+}
+
+func encodeCursor(c types.EventCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Time.UTC().Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+func decodeCursor(s string) (types.EventCursor, error) {
+	errInvalid := errors.New("invalid cursor")
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return types.EventCursor{}, errInvalid
+	}
+
+	ts, id, ok := strings.Cut(string(b), "|")
+	if !ok || id == "" {
+		return types.EventCursor{}, errInvalid
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return types.EventCursor{}, errInvalid
+	}
+
+	return types.EventCursor{Time: t, ID: id}, nil
+}
+
+func writeJSON(w http.ResponseWriter, log *slog.Logger, statusCode int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error("failed to marshal response", "err", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(b)
+}
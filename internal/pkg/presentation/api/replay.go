@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/diwise/iot-agent/internal/pkg/application"
+	"github.com/diwise/iot-agent/internal/pkg/application/types"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+// ReplayRequest selects the stored sensor events to replay. DryRun defaults to true so that
+// nothing is published unless explicitly asked for.
+type ReplayRequest struct {
+	SensorID   string     `json:"sensorId,omitempty"`
+	DeviceID   string     `json:"deviceId,omitempty"`
+	SensorType string     `json:"sensorType,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	From       *time.Time `json:"from,omitempty"`
+	To         *time.Time `json:"to,omitempty"`
+	Limit      int        `json:"limit,omitempty"`
+	DryRun     *bool      `json:"dryRun,omitempty"`
+}
+
+func (r ReplayRequest) query() types.EventQuery {
+	q := types.EventQuery{
+		SensorID:   r.SensorID,
+		DeviceID:   r.DeviceID,
+		SensorType: r.SensorType,
+		Error:      r.Error,
+		Limit:      r.Limit,
+	}
+
+	if r.From != nil {
+		q.From = r.From.UTC()
+	}
+
+	if r.To != nil {
+		q.To = r.To.UTC()
+	}
+
+	return q
+}
+
+// NewReplayHandler returns a handler that decodes stored sensor events again using the current
+// decoders, and reports the difference between the stored and the new objects.
+func NewReplayHandler(ctx context.Context, app application.App) http.HandlerFunc {
+	logger := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "replay-events")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, log := o11y.AddTraceIDToLoggerAndStoreInContext(span, logger, ctx)
+
+		b, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			log.Error("failed to read replay request body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var req ReplayRequest
+		err = json.Unmarshal(b, &req)
+		if err != nil {
+			log.Debug("failed to unmarshal replay request", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q := req.query()
+		if q.SensorID == "" && q.DeviceID == "" && q.SensorType == "" && q.Error == "" && q.From.IsZero() {
+			http.Error(w, "at least one of sensorId, deviceId, sensorType, error or from is required", http.StatusBadRequest)
+			return
+		}
+
+		// a caller that is granted all tenants also replays the events that have no tenant
+		q.Tenants = allowedTenants(ctx, "")
+
+		dryRun := req.DryRun == nil || *req.DryRun
+
+		report, err := app.Replay(ctx, q, dryRun)
+		if err != nil {
+			log.Error("failed to replay stored sensor events", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err = json.Marshal(report)
+		if err != nil {
+			log.Error("failed to marshal replay report", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
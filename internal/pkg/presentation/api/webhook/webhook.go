@@ -0,0 +1,284 @@
+package webhook
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrMissingSignature = errors.New("missing signature")
+var ErrInvalidSignature = errors.New("invalid signature")
+var ErrClockSkew = errors.New("timestamp outside of allowed clock skew")
+var ErrReplayed = errors.New("signature has already been used")
+
+// Scheme is the way that an integration proves that a request comes from it.
+type Scheme string
+
+const (
+	// SchemeNone accepts all requests.
+	SchemeNone Scheme = "none"
+	// SchemeSecret expects a shared secret in a request header.
+	SchemeSecret Scheme = "secret"
+	// SchemeTTN expects the webhook secret of The Things Network in the X-Downlink-Apikey header.
+	SchemeTTN Scheme = "ttn"
+	// SchemeHMAC expects a HMAC-SHA256 signature of the timestamp and the body in the X-Signature header.
+	SchemeHMAC Scheme = "hmac"
+)
+
+const (
+	SignatureHeader string = "X-Signature"
+	TimestampHeader string = "X-Timestamp"
+
+	DefaultMaxClockSkew time.Duration = 5 * time.Minute
+)
+
+// DefaultIntegration is the name of the integration that posts to the messages endpoint
+// without naming a facade.
+const DefaultIntegration string = ""
+
+var defaultHeaders = map[Scheme]string{
+	SchemeSecret: "X-Webhook-Secret",
+	SchemeTTN:    "X-Downlink-Apikey",
+	SchemeHMAC:   SignatureHeader,
+}
+
+// Verifier checks that an incoming request was sent by the integration it claims to come from.
+type Verifier interface {
+	Verify(r *http.Request, body []byte) error
+}
+
+type Config struct {
+	Scheme Scheme
+	Secret string
+	// Header overrides the default header of the scheme.
+	Header string
+	// MaxClockSkew is how far the timestamp of a signed request may differ from the current time.
+	MaxClockSkew time.Duration
+}
+
+func New(cfg Config) (Verifier, error) {
+	if cfg.Scheme == "" || cfg.Scheme == SchemeNone {
+		return none{}, nil
+	}
+
+	header, ok := defaultHeaders[cfg.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported webhook scheme %q", cfg.Scheme)
+	}
+
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("a secret is required for webhook scheme %q", cfg.Scheme)
+	}
+
+	if cfg.Header != "" {
+		header = cfg.Header
+	}
+
+	if cfg.Scheme != SchemeHMAC {
+		return &sharedSecret{header: header, secret: []byte(cfg.Secret)}, nil
+	}
+
+	maxSkew := cfg.MaxClockSkew
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxClockSkew
+	}
+
+	return &signature{
+		header:  header,
+		secret:  []byte(cfg.Secret),
+		maxSkew: maxSkew,
+		seen:    map[string]time.Time{},
+		now:     time.Now,
+	}, nil
+}
+
+// Sign returns the X-Signature header value of a body sent at the given unix timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	return "sha256=" + hex.EncodeToString(mac([]byte(secret), strconv.FormatInt(timestamp, 10), body))
+}
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// None returns a verifier that accepts all requests, for routes that are only authorized by the
+// bearer token of the caller.
+func None() Verifier {
+	return none{}
+}
+
+type none struct{}
+
+func (none) Verify(*http.Request, []byte) error {
+	return nil
+}
+
+type sharedSecret struct {
+	header string
+	secret []byte
+}
+
+func (s *sharedSecret) Verify(r *http.Request, _ []byte) error {
+	value := r.Header.Get(s.header)
+	if value == "" {
+		return ErrMissingSignature
+	}
+
+	if subtle.ConstantTimeCompare([]byte(value), s.secret) != 1 {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+type signature struct {
+	header  string
+	secret  []byte
+	maxSkew time.Duration
+
+	mu       sync.Mutex
+	seen     map[string]time.Time
+	expiries expiries
+	now      func() time.Time
+}
+
+func (s *signature) Verify(r *http.Request, body []byte) error {
+	value := r.Header.Get(s.header)
+	ts := r.Header.Get(TimestampHeader)
+
+	if value == "" || ts == "" {
+		return ErrMissingSignature
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(value, "sha256="))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	now := s.now()
+	sent := time.Unix(unix, 0)
+
+	if sent.Before(now.Add(-s.maxSkew)) || sent.After(now.Add(s.maxSkew)) {
+		return ErrClockSkew
+	}
+
+	if !hmac.Equal(sig, mac(s.secret, ts, body)) {
+		return ErrInvalidSignature
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// signatures only need to be remembered until their timestamp is outside of the allowed skew
+	for len(s.expiries) > 0 && now.After(s.expiries[0].at) {
+		delete(s.seen, heap.Pop(&s.expiries).(expiry).key)
+	}
+
+	key := hex.EncodeToString(sig)
+	if _, ok := s.seen[key]; ok {
+		return ErrReplayed
+	}
+
+	s.seen[key] = sent.Add(s.maxSkew)
+	heap.Push(&s.expiries, expiry{key: key, at: sent.Add(s.maxSkew)})
+
+	return nil
+}
+
+type expiry struct {
+	key string
+	at  time.Time
+}
+
+// expiries is a heap of the seen signatures ordered by when they expire, so that expired
+// signatures are found without going through all of them.
+type expiries []expiry
+
+func (e expiries) Len() int           { return len(e) }
+func (e expiries) Less(i, j int) bool { return e[i].at.Before(e[j].at) }
+func (e expiries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func (e *expiries) Push(x any) {
+	*e = append(*e, x.(expiry))
+}
+
+func (e *expiries) Pop() any {
+	old := *e
+	x := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return x
+}
+
+// Verifiers holds the verifier of each integration, by name.
+type Verifiers map[string]Verifier
+
+// For returns the verifier of an integration, accepting all requests for integrations that
+// have not been configured.
+func (v Verifiers) For(integration string) Verifier {
+	if verifier, ok := v[integration]; ok {
+		return verifier
+	}
+	return none{}
+}
+
+// NewVerifiersFromEnvironment configures the default integration from WEBHOOK_SCHEME,
+// WEBHOOK_SECRET and WEBHOOK_HEADER, and each named integration from the same variables with
+// the upper case name after WEBHOOK_, e.g. WEBHOOK_CHIRPSTACKV4_SECRET.
+func NewVerifiersFromEnvironment(integrations ...string) (Verifiers, error) {
+	maxSkew := DefaultMaxClockSkew
+
+	if value := os.Getenv("WEBHOOK_MAX_CLOCK_SKEW"); value != "" {
+		var err error
+		maxSkew, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_MAX_CLOCK_SKEW: %w", err)
+		}
+	}
+
+	verifiers := Verifiers{}
+
+	for _, name := range append([]string{DefaultIntegration}, integrations...) {
+		prefix := "WEBHOOK_"
+		if name != DefaultIntegration {
+			prefix = fmt.Sprintf("WEBHOOK_%s_", strings.ToUpper(name))
+		}
+
+		cfg := Config{
+			Scheme:       Scheme(strings.ToLower(os.Getenv(prefix + "SCHEME"))),
+			Secret:       os.Getenv(prefix + "SECRET"),
+			Header:       os.Getenv(prefix + "HEADER"),
+			MaxClockSkew: maxSkew,
+		}
+
+		if cfg.Scheme == "" && cfg.Secret != "" {
+			cfg.Scheme = SchemeSecret
+		}
+
+		verifier, err := New(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook configuration %s*: %w", prefix, err)
+		}
+
+		verifiers[name] = verifier
+	}
+
+	return verifiers, nil
+}
@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestSharedSecret(t *testing.T) {
+	is := is.New(t)
+
+	verifier, err := New(Config{Scheme: SchemeTTN, Secret: "s3cr3t"})
+	is.NoErr(err)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v0/messages/chirpstack", nil)
+	is.Equal(verifier.Verify(r, nil), ErrMissingSignature)
+
+	r.Header.Set("X-Downlink-Apikey", "wrong")
+	is.Equal(verifier.Verify(r, nil), ErrInvalidSignature)
+
+	r.Header.Set("X-Downlink-Apikey", "s3cr3t")
+	is.NoErr(verifier.Verify(r, nil))
+
+	_, err = New(Config{Scheme: SchemeSecret})
+	is.True(err != nil) // a secret is required
+
+	_, err = New(Config{Scheme: "chirpstack", Secret: "s3cr3t"})
+	is.True(err != nil) // chirpstack has no scheme of its own and uses secret
+}
+
+func TestSignature(t *testing.T) {
+	is := is.New(t)
+
+	v, err := New(Config{Scheme: SchemeHMAC, Secret: "s3cr3t", MaxClockSkew: time.Minute})
+	is.NoErr(err)
+
+	now := time.Date(2024, 8, 5, 12, 0, 0, 0, time.UTC)
+	v.(*signature).now = func() time.Time { return now }
+
+	body := []byte(`{"id":"1"}`)
+
+	request := func(ts time.Time, sig string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/v0/messages", nil)
+		r.Header.Set(TimestampHeader, strconv.FormatInt(ts.Unix(), 10))
+		r.Header.Set(SignatureHeader, sig)
+		return r
+	}
+
+	is.NoErr(v.Verify(request(now, Sign("s3cr3t", now.Unix(), body)), body))
+	is.Equal(v.Verify(request(now, Sign("s3cr3t", now.Unix(), body)), body), ErrReplayed)
+
+	sent := now.Add(-10 * time.Second)
+	is.Equal(v.Verify(request(sent, Sign("wrong", sent.Unix(), body)), body), ErrInvalidSignature)
+	is.Equal(v.Verify(request(sent, Sign("s3cr3t", sent.Unix(), []byte(`{"id":"2"}`))), body), ErrInvalidSignature)
+
+	sent = now.Add(-2 * time.Minute)
+	is.Equal(v.Verify(request(sent, Sign("s3cr3t", sent.Unix(), body)), body), ErrClockSkew)
+
+	// signatures are forgotten once they are outside of the allowed skew
+	now = now.Add(2 * time.Minute)
+	is.Equal(len(v.(*signature).seen), 1)
+	sent = now.Add(-30 * time.Second)
+	is.NoErr(v.Verify(request(sent, Sign("s3cr3t", sent.Unix(), body)), body))
+	is.Equal(len(v.(*signature).seen), 1)
+}
+
+func TestSignaturesArePrunedInTheOrderTheyExpire(t *testing.T) {
+	is := is.New(t)
+
+	v, err := New(Config{Scheme: SchemeHMAC, Secret: "s3cr3t", MaxClockSkew: time.Minute})
+	is.NoErr(err)
+
+	s := v.(*signature)
+	now := time.Date(2024, 8, 5, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	verify := func(id string, sent time.Time) error {
+		body := []byte(`{"id":"` + id + `"}`)
+		r := httptest.NewRequest(http.MethodPost, "/api/v0/messages", nil)
+		r.Header.Set(TimestampHeader, strconv.FormatInt(sent.Unix(), 10))
+		r.Header.Set(SignatureHeader, Sign("s3cr3t", sent.Unix(), body))
+		return v.Verify(r, body)
+	}
+
+	// signatures are not received in the order they were sent
+	is.NoErr(verify("1", now.Add(30*time.Second)))
+	is.NoErr(verify("2", now.Add(-50*time.Second)))
+	is.NoErr(verify("3", now))
+
+	now = now.Add(20 * time.Second)
+	is.NoErr(verify("4", now))
+	is.Equal(len(s.seen), 3) // 2 has expired
+
+	now = now.Add(50 * time.Second)
+	is.NoErr(verify("5", now))
+	is.Equal(len(s.seen), 3) // 3 has expired, while 1 and 4 have not
+	is.Equal(len(s.expiries), 3)
+
+	is.Equal(verify("1", time.Date(2024, 8, 5, 12, 0, 30, 0, time.UTC)), ErrReplayed)
+}
+
+func TestVerifiersFromEnvironment(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("WEBHOOK_CHIRPSTACKV4_SECRET", "s3cr3t")
+	t.Setenv("WEBHOOK_NETMORE_SCHEME", "hmac")
+	t.Setenv("WEBHOOK_NETMORE_SECRET", "other")
+
+	verifiers, err := NewVerifiersFromEnvironment("chirpstackv4", "netmore", "servanet")
+	is.NoErr(err)
+
+	is.Equal(verifiers.For(DefaultIntegration), none{})
+	is.Equal(verifiers.For("servanet"), none{})
+	is.Equal(verifiers.For("chirpstackv4").(*sharedSecret).header, "X-Webhook-Secret")
+	is.Equal(verifiers.For("netmore").(*signature).maxSkew, DefaultMaxClockSkew)
+
+	t.Setenv("WEBHOOK_SCHEME", "unknown")
+	_, err = NewVerifiersFromEnvironment()
+	is.True(err != nil)
+}